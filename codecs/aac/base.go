@@ -37,7 +37,7 @@ func (b Base) Extension() string {
 }
 
 func (b Base) RTPParser(cb func(codec codecs.Codec)) (codecs.RTPParser, error) {
-	return nil, errors.New("aac codec not support rtp parser")
+	return NewRTPParser(cb), nil
 }
 
 func (b Base) RTPIngressCapability() {
@@ -0,0 +1,117 @@
+package aac
+
+import (
+	"github.com/pion/rtp"
+	"go.uber.org/zap"
+
+	"mediaserver-go/codecs"
+	"mediaserver-go/utils/log"
+	"mediaserver-go/utils/units"
+)
+
+/*
+	https://datatracker.ietf.org/doc/html/rfc3640#section-3.2
+
+RTP payload 는 AU-headers-length(16 bit, 단위는 bit) 다음에 AU-header 들이 오고, 그 뒤에 AU 들이 순서대로 붙어있다.
+AU-header 는 AU-size(sizeLength bit)와 AU-Index(첫 번째는 indexLength, 다음부터는 indexDeltaLength bit)이다.
+AU 하나가 MTU 보다 크면 여러 패킷으로 나뉘어 오고 마지막 패킷에 marker 가 켜진다.
+*/
+type RTPParser struct {
+	cb func(codec codecs.Codec)
+
+	sizeLength       int
+	indexLength      int
+	indexDeltaLength int
+
+	fragments []byte
+	// 나뉘어 오는 AU 의 전체 크기
+	fragmentSize int
+}
+
+// NewRTPParser 는 AAC-hbr 모드(sizeLength=13, indexLength=3)의 파서를 만든다.
+// AAC 의 코덱 정보는 RTP 가 아닌 SDP 의 fmtp config 에 있으므로 cb 는 호출하지 않는다.
+func NewRTPParser(cb func(codec codecs.Codec)) *RTPParser {
+	return &RTPParser{
+		cb:               cb,
+		sizeLength:       13,
+		indexLength:      3,
+		indexDeltaLength: 3,
+	}
+}
+
+// SetAUHeaderLengths 는 SDP fmtp 의 sizelength, indexlength, indexdeltalength 를 설정한다.
+func (r *RTPParser) SetAUHeaderLengths(sizeLength, indexLength, indexDeltaLength int) {
+	r.sizeLength = sizeLength
+	r.indexLength = indexLength
+	r.indexDeltaLength = indexDeltaLength
+}
+
+func (r *RTPParser) Parse(rtpPacket *rtp.Packet) ([][]byte, units.FrameInfo) {
+	payload := rtpPacket.Payload
+	if len(payload) < 2 {
+		return nil, units.FrameInfo{}
+	}
+	headersLength := int(payload[0])<<8 | int(payload[1])
+	headersBytes := (headersLength + 7) / 8
+	if len(payload) < 2+headersBytes {
+		log.Logger.Warn("aac rtp au headers too short")
+		return nil, units.FrameInfo{}
+	}
+	headers := payload[2 : 2+headersBytes]
+	data := payload[2+headersBytes:]
+
+	var sizes []int
+	pos := 0
+	for i := 0; pos < headersLength; i++ {
+		indexLength := r.indexDeltaLength
+		if i == 0 {
+			indexLength = r.indexLength
+		}
+		if pos+r.sizeLength+indexLength > headersLength {
+			break
+		}
+		sizes = append(sizes, readBits(headers, pos, r.sizeLength))
+		pos += r.sizeLength + indexLength
+	}
+	if len(sizes) == 0 {
+		return nil, units.FrameInfo{}
+	}
+
+	// 나뉘어 오는 AU
+	if len(sizes) == 1 && sizes[0] > len(data) || len(r.fragments) > 0 {
+		if len(r.fragments) == 0 {
+			r.fragmentSize = sizes[0]
+		}
+		r.fragments = append(r.fragments, data...)
+		if !rtpPacket.Marker {
+			return nil, units.FrameInfo{}
+		}
+		au := r.fragments
+		r.fragments = nil
+		if len(au) != r.fragmentSize {
+			log.Logger.Warn("aac rtp fragmented au size mismatch", zap.Int("expected", r.fragmentSize), zap.Int("actual", len(au)))
+			return nil, units.FrameInfo{}
+		}
+		return [][]byte{au}, units.FrameInfo{}
+	}
+
+	aus := make([][]byte, 0, len(sizes))
+	for _, size := range sizes {
+		if size > len(data) {
+			log.Logger.Warn("aac rtp au truncated")
+			break
+		}
+		aus = append(aus, data[:size])
+		data = data[size:]
+	}
+	return aus, units.FrameInfo{}
+}
+
+func readBits(b []byte, pos, n int) int {
+	v := 0
+	for i := 0; i < n; i++ {
+		bit := (b[(pos+i)/8] >> (7 - uint((pos+i)%8))) & 0x01
+		v = v<<1 | int(bit)
+	}
+	return v
+}
@@ -59,18 +59,18 @@ func GetExtension(videoCodec VideoCodec, audioCodec AudioCodec) (string, error)
 	extension := ""
 	if videoCodec != nil && audioCodec != nil {
 		switch videoCodec.CodecType() {
-		case types.CodecTypeVP8:
+		case types.CodecTypeVP8, types.CodecTypeVP9:
 			extension = "webm"
-		case types.CodecTypeH264, types.CodecTypeAV1:
+		case types.CodecTypeH264, types.CodecTypeH265, types.CodecTypeAV1:
 			extension = "mp4"
 		default:
 			return "", fmt.Errorf("video codec:%v. %w", videoCodec.CodecType(), errUnsupportedCodec)
 		}
 	} else if videoCodec != nil {
 		switch videoCodec.CodecType() {
-		case types.CodecTypeVP8:
+		case types.CodecTypeVP8, types.CodecTypeVP9:
 			extension = "mkv"
-		case types.CodecTypeH264, types.CodecTypeAV1:
+		case types.CodecTypeH264, types.CodecTypeH265, types.CodecTypeAV1:
 			extension = "m4v"
 		default:
 			return "", fmt.Errorf("video codec:%v. %w", videoCodec.CodecType(), errUnsupportedCodec)
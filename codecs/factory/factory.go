@@ -7,8 +7,10 @@ import (
 	"mediaserver-go/codecs/aac"
 	"mediaserver-go/codecs/av1"
 	"mediaserver-go/codecs/h264"
+	"mediaserver-go/codecs/h265"
 	"mediaserver-go/codecs/opus"
 	"mediaserver-go/codecs/vp8"
+	"mediaserver-go/codecs/vp9"
 	"strings"
 )
 
@@ -20,6 +22,10 @@ func NewBase(mime string) (codecs.Base, error) {
 		return &vp8.Base{}, nil
 	case strings.ToLower(pion.MimeTypeH264):
 		return &h264.Base{}, nil
+	case strings.ToLower(pion.MimeTypeH265):
+		return &h265.Base{}, nil
+	case strings.ToLower(pion.MimeTypeVP9):
+		return &vp9.Base{}, nil
 	case strings.ToLower(pion.MimeTypeOpus):
 		return &opus.Base{}, nil
 	case strings.ToLower("audio/aac"):
@@ -27,6 +27,12 @@ func NewH264Parser(cb func(codec codecs.Codec)) *RTPParser {
 	}
 }
 
+// SetParameterSets 는 SDP 의 sprop-parameter-sets 로 받은 SPS, PPS 를 넣는다. 첫 IDR 앞에 SPS, PPS 가 없어도 바로 파싱한다.
+func (h *RTPParser) SetParameterSets(sps, pps []byte) {
+	h.spsTemp = sps
+	h.ppsTemp = pps
+}
+
 func (h *RTPParser) Parse(rtpPacket *rtp.Packet) ([][]byte, units.FrameInfo) {
 	var payloads [][]byte
 	flag := 0
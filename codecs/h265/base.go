@@ -0,0 +1,63 @@
+package h265
+
+import (
+	"errors"
+	"fmt"
+	"github.com/pion/rtp"
+	pion "github.com/pion/webrtc/v3"
+	"mediaserver-go/codecs"
+	"mediaserver-go/thirdparty/ffmpeg/avcodec"
+	"mediaserver-go/thirdparty/ffmpeg/avutil"
+	"mediaserver-go/utils/types"
+)
+
+type Base struct {
+}
+
+func (b Base) MimeType() string {
+	return pion.MimeTypeH265
+}
+
+func (b Base) MediaType() types.MediaType {
+	return types.MediaTypeVideo
+}
+
+func (b Base) AVMediaType() avutil.MediaType {
+	return avutil.AVMEDIA_TYPE_VIDEO
+}
+
+func (b Base) CodecType() types.CodecType {
+	return types.CodecTypeH265
+}
+
+func (b Base) AVCodecID() avcodec.CodecID {
+	return avcodec.AV_CODEC_ID_HEVC
+}
+
+func (b Base) Extension() string {
+	return "mp4"
+}
+
+func (b Base) RTPParser(cb func(codecs.Codec)) (codecs.RTPParser, error) {
+	return nil, errors.New("h265 codec not support rtp parser")
+}
+
+func (b Base) RTPPacketizer(pt uint8, ssrc uint32, clockRate uint32) (rtp.Packetizer, error) {
+	return nil, errors.New("h265 codec not support rtp packetizer")
+}
+
+func (b Base) CodecFromAVCodecParameters(param *avcodec.AvCodecParameters) (codecs.Codec, error) {
+	config := &Config{}
+	if err := config.UnmarshalFromExtraData(param.ExtraData()); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal hvcc: %v", err)
+	}
+	return NewH265(config), nil
+}
+
+func (b Base) Decoder() codecs.Decoder {
+	return &Decoder{}
+}
+
+func (b Base) GetBitStreamFilter(fromTranscoding bool) codecs.BitStreamFilter {
+	return &BitStreamHVCC{}
+}
@@ -0,0 +1,41 @@
+package h265
+
+import (
+	"encoding/binary"
+	"github.com/bluenviron/mediacommon/pkg/codecs/h265"
+)
+
+// BitStreamHVCC 는 HVCC(4 byte 길이 + NAL unit) 형식이다.
+type BitStreamHVCC struct {
+}
+
+func (h *BitStreamHVCC) AddFilter(payload []byte) []byte {
+	hvcc := make([]byte, 4+len(payload))
+	binary.BigEndian.PutUint32(hvcc, uint32(len(payload)))
+	copy(hvcc[4:], payload)
+	return hvcc
+}
+
+func (h *BitStreamHVCC) Filter(payload []byte) [][]byte {
+	const (
+		hvccSizeLength = 4
+	)
+
+	var aus [][]byte
+	offset := 0
+	for offset+hvccSizeLength <= len(payload) {
+		auLength := int(binary.BigEndian.Uint32(payload[offset:]))
+		offset += hvccSizeLength
+		if auLength == 0 || offset+auLength > len(payload) {
+			break
+		}
+		au := payload[offset : offset+auLength]
+		offset += auLength
+		switch NALUType(au) {
+		case h265.NALUType_PREFIX_SEI_NUT, h265.NALUType_SUFFIX_SEI_NUT, h265.NALUType_AUD_NUT, h265.NALUType_FD_NUT:
+			continue
+		}
+		aus = append(aus, au)
+	}
+	return aus
+}
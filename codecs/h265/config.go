@@ -0,0 +1,152 @@
+package h265
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/bluenviron/mediacommon/pkg/codecs/h265"
+	"mediaserver-go/thirdparty/ffmpeg/avutil"
+)
+
+var (
+	errExtraDataInvalid = errors.New("invalid extra data")
+	errExtraDataShort   = errors.New("extra data too short")
+	errExtraDataNALU    = errors.New("invalid NALU length")
+	errNeedVPSSPSPPS    = errors.New("need VPS, SPS and PPS")
+)
+
+const (
+	// HEVCDecoderConfigurationRecord 에서 NAL unit 배열 앞까지의 크기
+	hvccHeaderSize = 23
+)
+
+type Config struct {
+	vps, sps, pps []byte
+	// HEVCDecoderConfigurationRecord 원본. mp4 등에 그대로 extradata 로 쓴다.
+	record []byte
+
+	spsInfo  h265.SPS
+	width    int
+	height   int
+	pixelFmt int
+}
+
+func (c *Config) String() string {
+	return fmt.Sprintf("H265 width:%d height:%d profile:%d level:%d pixelFmt:%d",
+		c.width, c.height, c.spsInfo.ProfileTierLevel.GeneralProfileIdc, c.level(), c.pixelFmt)
+}
+
+/*
+UnmarshalFromExtraData 는 HEVCDecoderConfigurationRecord(ISO/IEC 14496-15 8.3.3.1) 에서 VPS, SPS, PPS 를 읽는다.
+
+	8    configurationVersion ( always 0x01 )
+	2,1,5 general_profile_space, general_tier_flag, general_profile_idc
+	32   general_profile_compatibility_flags
+	48   general_constraint_indicator_flags
+	8    general_level_idc
+	...  (min_spatial_segmentation_idc, parallelismType, chroma, bit depth, frame rate 등)
+	8    numOfArrays
+	repeated once per array:
+		1,1,6 array_completeness, reserved, NAL_unit_type
+		16    numNalus
+		repeated once per NALU:
+			16       nalUnitLength
+			variable NALU data
+*/
+func (c *Config) UnmarshalFromExtraData(extradata []byte) error {
+	if len(extradata) < hvccHeaderSize {
+		return errExtraDataShort
+	}
+	if extradata[0] != 0x01 {
+		return errExtraDataInvalid
+	}
+
+	var vps, sps, pps []byte
+	numOfArrays := int(extradata[hvccHeaderSize-1])
+	offset := hvccHeaderSize
+	for i := 0; i < numOfArrays; i++ {
+		if len(extradata) < offset+3 {
+			return fmt.Errorf("array %d. %w", i, errExtraDataNALU)
+		}
+		naluType := h265.NALUType(extradata[offset] & 0x3f)
+		numNalus := int(binary.BigEndian.Uint16(extradata[offset+1:]))
+		offset += 3
+		for j := 0; j < numNalus; j++ {
+			if len(extradata) < offset+2 {
+				return fmt.Errorf("array %d nalu %d. %w", i, j, errExtraDataNALU)
+			}
+			naluLength := int(binary.BigEndian.Uint16(extradata[offset:]))
+			offset += 2
+			if len(extradata) < offset+naluLength {
+				return fmt.Errorf("array %d nalu %d length %d. %w", i, j, naluLength, errExtraDataNALU)
+			}
+			nalu := extradata[offset : offset+naluLength]
+			offset += naluLength
+			// 같은 타입이 여러 개면 첫 번째만 쓴다.
+			switch naluType {
+			case h265.NALUType_VPS_NUT:
+				if vps == nil {
+					vps = nalu
+				}
+			case h265.NALUType_SPS_NUT:
+				if sps == nil {
+					sps = nalu
+				}
+			case h265.NALUType_PPS_NUT:
+				if pps == nil {
+					pps = nalu
+				}
+			}
+		}
+	}
+	if len(vps) == 0 || len(sps) == 0 || len(pps) == 0 {
+		return errNeedVPSSPSPPS
+	}
+
+	var spsInfo h265.SPS
+	if err := spsInfo.Unmarshal(sps); err != nil {
+		return fmt.Errorf("failed to unmarshal. %w", err)
+	}
+	c.spsInfo = spsInfo
+	c.vps = bytes.Clone(vps)
+	c.sps = bytes.Clone(sps)
+	c.pps = bytes.Clone(pps)
+	c.record = bytes.Clone(extradata)
+	c.width = spsInfo.Width()
+	c.height = spsInfo.Height()
+	c.pixelFmt = makePixelFmt(&spsInfo)
+	return nil
+}
+
+func (c *Config) MarshalToExtraData() ([]byte, error) {
+	if len(c.record) == 0 {
+		return nil, errNeedVPSSPSPPS
+	}
+	return c.record, nil
+}
+
+func (c *Config) level() int {
+	if len(c.record) < hvccHeaderSize {
+		return 0
+	}
+	return int(c.record[12])
+}
+
+func makePixelFmt(spsInfo *h265.SPS) int {
+	switch spsInfo.ChromaFormatIdc {
+	case 0:
+		return avutil.AV_PIX_FMT_GRAY8
+	case 1:
+		if spsInfo.BitDepthLumaMinus8 == 2 {
+			return avutil.AV_PIX_FMT_YUV420P10
+		}
+		return avutil.AV_PIX_FMT_YUV420P
+	case 2:
+		return avutil.AV_PIX_FMT_YUV422P
+	case 3:
+		return avutil.AV_PIX_FMT_YUV444P
+	default:
+		return avutil.AV_PIX_FMT_NONE
+	}
+}
@@ -0,0 +1,19 @@
+package h265
+
+import "github.com/bluenviron/mediacommon/pkg/codecs/h265"
+
+type Decoder struct {
+}
+
+// KeyFrame 은 IRAP(BLA, IDR, CRA) 이면 true 이다.
+func (d *Decoder) KeyFrame(payload []byte) bool {
+	if len(payload) == 0 {
+		return false
+	}
+	naluType := NALUType(payload)
+	return naluType >= h265.NALUType_BLA_W_LP && naluType <= h265.NALUType_RSV_IRAP_VCL23
+}
+
+func NALUType(nalu []byte) h265.NALUType {
+	return h265.NALUType((nalu[0] >> 1) & 0x3f)
+}
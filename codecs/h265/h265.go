@@ -0,0 +1,166 @@
+package h265
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/pion/sdp/v3"
+	pion "github.com/pion/webrtc/v3"
+	"math/bits"
+	"mediaserver-go/codecs"
+	"mediaserver-go/hubs/engines"
+	"mediaserver-go/thirdparty/ffmpeg/avcodec"
+	"mediaserver-go/thirdparty/ffmpeg/avutil"
+	"strings"
+)
+
+type H265 struct {
+	Base
+	config *Config
+}
+
+func NewH265(config *Config) *H265 {
+	return &H265{
+		Base:   Base{},
+		config: config,
+	}
+}
+
+func (h *H265) String() string {
+	return fmt.Sprintf("%s. width:%d,height:%d", h.MimeType(), h.Width(), h.Height())
+}
+
+// HLSMIME 는 RFC 6381 의 hvc1 codecs 문자열이다. (ISO/IEC 14496-15 E.3)
+func (h *H265) HLSMIME() string {
+	record := h.config.record
+	if len(record) < hvccHeaderSize {
+		return ""
+	}
+	profileSpace := []string{"", "A", "B", "C"}[record[1]>>6]
+	tier := "L"
+	if record[1]&0x20 != 0 {
+		tier = "H"
+	}
+	profileIDC := record[1] & 0x1f
+	compatibility := bits.Reverse32(binary.BigEndian.Uint32(record[2:6]))
+
+	mime := fmt.Sprintf("hvc1.%s%d.%X.%s%d", profileSpace, profileIDC, compatibility, tier, record[12])
+	// 뒤쪽의 0 인 constraint 바이트는 생략한다.
+	constraints := bytes.TrimRight(record[6:12], "\x00")
+	for _, b := range constraints {
+		mime += fmt.Sprintf(".%X", b)
+	}
+	return mime
+}
+
+func (h *H265) GetBase() codecs.Base {
+	return h.Base
+}
+
+func (h *H265) Equals(codec codecs.Codec) bool {
+	if codec == nil {
+		return false
+	}
+	h265Codec, ok := codec.(*H265)
+	if !ok {
+		return false
+	}
+	if h.Width() != h265Codec.Width() || h.Height() != h265Codec.Height() || h.PixelFormat() != h265Codec.PixelFormat() {
+		return false
+	}
+	return bytes.Equal(h.config.record, h265Codec.config.record)
+}
+
+func (h *H265) Width() int {
+	return h.config.width
+}
+
+func (h *H265) Height() int {
+	return h.config.height
+}
+
+func (h *H265) ClockRate() uint32 {
+	return 90000
+}
+
+func (h *H265) FPS() float64 {
+	return 30
+}
+
+func (h *H265) PixelFormat() int {
+	return h.config.pixelFmt
+}
+
+// ExtraData use readonly
+func (h *H265) ExtraData() []byte {
+	b, _ := h.config.MarshalToExtraData()
+	return b
+}
+
+// VPS use readonly
+func (h *H265) VPS() []byte {
+	return h.config.vps
+}
+
+// SPS use readonly
+func (h *H265) SPS() []byte {
+	return h.config.sps
+}
+
+// PPS use readonly
+func (h *H265) PPS() []byte {
+	return h.config.pps
+}
+
+func (h *H265) SetCodecContext(codecCtx *avcodec.CodecContext, transcodeInfo *codecs.VideoTranscodeInfo) {
+	codecCtx.SetCodecID(h.AVCodecID())
+	codecCtx.SetCodecType(h.AVMediaType())
+	codecCtx.SetWidth(h.Width())
+	codecCtx.SetHeight(h.Height())
+	codecCtx.SetTimeBase(avutil.NewRational(1, 30))
+	codecCtx.SetPixelFormat(avutil.PixelFormat(h.PixelFormat()))
+	codecCtx.SetProfile(int(h.config.spsInfo.ProfileTierLevel.GeneralProfileIdc))
+	codecCtx.SetLevel(h.config.level())
+	codecCtx.SetExtraData(h.ExtraData())
+
+	if transcodeInfo != nil {
+		codecCtx.SetGOP(transcodeInfo.GOPSize)
+		codecCtx.SetFrameRate(avutil.NewRational(transcodeInfo.FPS, 1))
+		codecCtx.SetMaxBFrames(transcodeInfo.MaxBFrameSize)
+	}
+}
+
+func (h *H265) WebRTCCodecCapability() (pion.RTPCodecCapability, error) {
+	return pion.RTPCodecCapability{
+		MimeType:     h.MimeType(),
+		ClockRate:    h.ClockRate(),
+		Channels:     0,
+		SDPFmtpLine:  "",
+		RTCPFeedback: nil,
+	}, nil
+}
+
+func (h *H265) RTPCodecCapability(targetPort int) (engines.RTPCodecParameters, error) {
+	payloadType := 98
+	return engines.RTPCodecParameters{
+		PayloadType: uint8(payloadType),
+		ClockRate:   90000,
+		CodecType:   h.CodecType(),
+		MediaDescription: sdp.MediaDescription{
+			MediaName: sdp.MediaName{
+				Media: h.MediaType().String(),
+				Port: sdp.RangedPort{
+					Value: targetPort,
+				},
+				Protos:  []string{"RTP", "AVP"},
+				Formats: []string{fmt.Sprintf("%d", payloadType)},
+			},
+			Attributes: []sdp.Attribute{
+				{
+					Key:   "rtpmap",
+					Value: fmt.Sprintf("%d %s/%d", payloadType, strings.ToUpper(string(h.CodecType())), h.ClockRate()),
+				},
+			},
+		},
+	}, nil
+}
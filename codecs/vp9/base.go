@@ -0,0 +1,62 @@
+package vp9
+
+import (
+	"errors"
+	"github.com/pion/rtp"
+	pioncodecs "github.com/pion/rtp/codecs"
+	pion "github.com/pion/webrtc/v3"
+	"mediaserver-go/codecs"
+	"mediaserver-go/thirdparty/ffmpeg/avcodec"
+	"mediaserver-go/thirdparty/ffmpeg/avutil"
+	"mediaserver-go/utils/types"
+)
+
+type Base struct {
+}
+
+func (b Base) MimeType() string {
+	return pion.MimeTypeVP9
+}
+
+func (b Base) MediaType() types.MediaType {
+	return types.MediaTypeVideo
+}
+
+func (b Base) AVMediaType() avutil.MediaType {
+	return avutil.AVMEDIA_TYPE_VIDEO
+}
+
+func (b Base) CodecType() types.CodecType {
+	return types.CodecTypeVP9
+}
+
+func (b Base) AVCodecID() avcodec.CodecID {
+	return avcodec.AV_CODEC_ID_VP9
+}
+
+func (b Base) Extension() string {
+	return "mp4"
+}
+
+func (b Base) RTPParser(cb func(codec codecs.Codec)) (codecs.RTPParser, error) {
+	return nil, errors.New("vp9 codec not support rtp parser")
+}
+
+func (b Base) RTPPacketizer(pt uint8, ssrc uint32, clockRate uint32) (rtp.Packetizer, error) {
+	return rtp.NewPacketizer(types.MTUSize, pt, ssrc, &pioncodecs.VP9Payloader{}, rtp.NewRandomSequencer(), clockRate), nil
+}
+
+func (b Base) CodecFromAVCodecParameters(param *avcodec.AvCodecParameters) (codecs.Codec, error) {
+	config := Config{}
+	config.Width = param.Width()
+	config.Height = param.Height()
+	return NewVP9(&config), nil
+}
+
+func (b Base) Decoder() codecs.Decoder {
+	return &Decoder{}
+}
+
+func (b Base) GetBitStreamFilter(fromTranscoding bool) codecs.BitStreamFilter {
+	return &BitStreamEmpty{}
+}
@@ -0,0 +1,12 @@
+package vp9
+
+type BitStreamEmpty struct {
+}
+
+func (h *BitStreamEmpty) AddFilter(payload []byte) []byte {
+	return payload
+}
+
+func (h *BitStreamEmpty) Filter(payload []byte) [][]byte {
+	return [][]byte{payload}
+}
@@ -0,0 +1,35 @@
+package vp9
+
+import (
+	"errors"
+	"github.com/bluenviron/mediacommon/pkg/codecs/vp9"
+)
+
+var (
+	errNotKeyFrame = errors.New("vp9 frame is not a key frame")
+)
+
+type Config struct {
+	Width   int
+	Height  int
+	Profile int
+}
+
+func NewConfig() *Config {
+	return &Config{}
+}
+
+// Unmarshal 은 키 프레임의 헤더에서 크기를 읽는다.
+func (v *Config) Unmarshal(vp9Payload []byte) error {
+	var header vp9.Header
+	if err := header.Unmarshal(vp9Payload); err != nil {
+		return err
+	}
+	if header.NonKeyFrame || header.FrameSize == nil {
+		return errNotKeyFrame
+	}
+	v.Width = header.Width()
+	v.Height = header.Height()
+	v.Profile = int(header.Profile)
+	return nil
+}
@@ -0,0 +1,14 @@
+package vp9
+
+import "github.com/bluenviron/mediacommon/pkg/codecs/vp9"
+
+type Decoder struct {
+}
+
+func (d *Decoder) KeyFrame(vp9Payload []byte) bool {
+	var header vp9.Header
+	if err := header.Unmarshal(vp9Payload); err != nil {
+		return false
+	}
+	return !header.ShowExistingFrame && !header.NonKeyFrame
+}
@@ -0,0 +1,132 @@
+package vp9
+
+import (
+	"fmt"
+	"github.com/pion/sdp/v3"
+	pion "github.com/pion/webrtc/v3"
+	"mediaserver-go/codecs"
+	"mediaserver-go/hubs/engines"
+	"mediaserver-go/thirdparty/ffmpeg/avcodec"
+	"mediaserver-go/thirdparty/ffmpeg/avutil"
+	"strings"
+)
+
+type VP9 struct {
+	Base
+
+	config *Config
+}
+
+func NewVP9(config *Config) *VP9 {
+	return &VP9{
+		Base:   Base{},
+		config: config,
+	}
+}
+
+func (v *VP9) Equals(codec codecs.Codec) bool {
+	if codec == nil {
+		return false
+	}
+	vp9Codec, ok := codec.(*VP9)
+	if !ok {
+		return false
+	}
+	if v.Width() != vp9Codec.Width() || v.Height() != vp9Codec.Height() || v.config.Profile != vp9Codec.config.Profile {
+		return false
+	}
+	return true
+}
+
+func (v *VP9) String() string {
+	return fmt.Sprintf("%s. width:%d,height:%d", v.MimeType(), v.Width(), v.Height())
+}
+
+func (v *VP9) HLSMIME() string {
+	return ""
+}
+
+func (v *VP9) GetBase() codecs.Base {
+	return v.Base
+}
+
+func (v *VP9) Width() int {
+	return v.config.Width
+}
+
+func (v *VP9) Height() int {
+	return v.config.Height
+}
+
+func (v *VP9) ClockRate() uint32 {
+	return 90000
+}
+
+func (v *VP9) FPS() float64 {
+	return 30
+}
+
+func (v *VP9) PixelFormat() int {
+	return avutil.AV_PIX_FMT_YUV420P
+}
+
+// ExtraData use readonly
+func (v *VP9) ExtraData() []byte {
+	return nil
+}
+
+func (v *VP9) SetCodecContext(codecCtx *avcodec.CodecContext, transcodeInfo *codecs.VideoTranscodeInfo) {
+	codecCtx.SetCodecID(v.AVCodecID())
+	codecCtx.SetCodecType(v.AVMediaType())
+	codecCtx.SetWidth(v.Width())
+	codecCtx.SetHeight(v.Height())
+	codecCtx.SetProfile(v.config.Profile)
+	codecCtx.SetTimeBase(avutil.NewRational(1, int(v.FPS())))
+	codecCtx.SetPixelFormat(avutil.PixelFormat(v.PixelFormat()))
+	codecCtx.SetExtraData(v.ExtraData())
+
+	if transcodeInfo != nil {
+		codecCtx.SetGOP(transcodeInfo.GOPSize)
+		codecCtx.SetFrameRate(avutil.NewRational(transcodeInfo.FPS, 1))
+		codecCtx.SetMaxBFrames(transcodeInfo.MaxBFrameSize)
+	}
+}
+
+func (v *VP9) WebRTCCodecCapability() (pion.RTPCodecCapability, error) {
+	return pion.RTPCodecCapability{
+		MimeType:     v.MimeType(),
+		ClockRate:    v.ClockRate(),
+		Channels:     0,
+		SDPFmtpLine:  fmt.Sprintf("profile-id=%d", v.config.Profile),
+		RTCPFeedback: nil,
+	}, nil
+}
+
+func (v *VP9) RTPCodecCapability(targetPort int) (engines.RTPCodecParameters, error) {
+	payloadType := 97
+	return engines.RTPCodecParameters{
+		PayloadType: uint8(payloadType),
+		CodecType:   v.CodecType(),
+		ClockRate:   90000,
+		MediaDescription: sdp.MediaDescription{
+			MediaName: sdp.MediaName{
+				Media: v.MediaType().String(),
+				Port: sdp.RangedPort{
+					Value: targetPort,
+				},
+				Protos:  []string{"RTP", "AVP"},
+				Formats: []string{fmt.Sprintf("%d", payloadType)},
+			},
+			Attributes: []sdp.Attribute{
+				{
+					Key:   "rtpmap",
+					Value: fmt.Sprintf("%d %s/%d", payloadType, strings.ToUpper(string(v.CodecType())), v.ClockRate()),
+				},
+				{
+					Key:   "fmtp",
+					Value: fmt.Sprintf("%d profile-id=%d", payloadType, v.config.Profile),
+				},
+			},
+		},
+	}, nil
+}
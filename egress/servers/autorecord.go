@@ -0,0 +1,150 @@
+package servers
+
+import (
+	"errors"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"mediaserver-go/hubs"
+	"mediaserver-go/utils/configs"
+	"mediaserver-go/utils/dto"
+	"mediaserver-go/utils/log"
+	"mediaserver-go/utils/types"
+)
+
+const (
+	autoRecordRetryInterval = time.Second
+	autoRecordMaxRetry      = 10
+)
+
+// AutoRecorder 는 Hub 에 추가되는 스트림 중 규칙에 맞는 스트림을 자동으로 녹화하고, 스트림이 삭제되면 녹화를 중지한다.
+type AutoRecorder struct {
+	mu sync.Mutex
+
+	hub        *hubs.Hub
+	fileServer *FileServer
+	rules      []configs.RecordingRule
+
+	recording map[string]*hubs.Stream
+}
+
+func NewAutoRecorder(hub *hubs.Hub, fileServer *FileServer, rules []configs.RecordingRule) (*AutoRecorder, error) {
+	for _, rule := range rules {
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			return nil, err
+		}
+		if rule.Path == "" {
+			return nil, errors.New("recording rule path is empty")
+		}
+	}
+	return &AutoRecorder{
+		hub:        hub,
+		fileServer: fileServer,
+		rules:      rules,
+		recording:  make(map[string]*hubs.Stream),
+	}, nil
+}
+
+func (a *AutoRecorder) OnStreamAdded(id string, stream *hubs.Stream) {
+	rule, ok := a.match(id)
+	if !ok {
+		return
+	}
+	a.mu.Lock()
+	a.recording[id] = stream
+	a.mu.Unlock()
+
+	go a.start(id, stream, rule)
+}
+
+func (a *AutoRecorder) OnStreamRemoved(id string, stream *hubs.Stream) {
+	a.mu.Lock()
+	recording, ok := a.recording[id]
+	if ok && recording == stream {
+		delete(a.recording, id)
+	}
+	a.mu.Unlock()
+	if !ok || recording != stream {
+		return
+	}
+
+	if err := a.fileServer.StopSession(id); err != nil && !errors.Is(err, errRecordingNotFound) {
+		log.Logger.Warn("auto recording stop failed", zap.String("streamID", id), zap.Error(err))
+	}
+}
+
+func (a *AutoRecorder) match(id string) (configs.RecordingRule, bool) {
+	for _, rule := range a.rules {
+		if ok, _ := path.Match(rule.Pattern, id); ok {
+			return rule, true
+		}
+	}
+	return configs.RecordingRule{}, false
+}
+
+func (a *AutoRecorder) active(id string, stream *hubs.Stream) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.recording[id] == stream
+}
+
+// start 는 스트림의 소스(코덱)가 준비될 때까지 기다렸다가 녹화를 시작한다.
+// 요청한 미디어 타입이 모두 준비되지 않으면 마지막 시도에서 준비된 것만 녹화한다.
+func (a *AutoRecorder) start(id string, stream *hubs.Stream, rule configs.RecordingRule) {
+	mediaTypes := []types.MediaType{types.MediaTypeVideo, types.MediaTypeAudio}
+	if len(rule.MediaTypes) > 0 {
+		mediaTypes = nil
+		for _, mediaType := range rule.MediaTypes {
+			mediaTypes = append(mediaTypes, types.NewMediaType(mediaType))
+		}
+	}
+
+	var err error
+	for i := 0; i < autoRecordMaxRetry; i++ {
+		time.Sleep(autoRecordRetryInterval)
+		if !a.active(id, stream) {
+			return
+		}
+		sources := stream.SourcesMap()
+		ready := 0
+		for _, mediaType := range mediaTypes {
+			if _, ok := sources[mediaType]; ok {
+				ready++
+			}
+		}
+		if ready == 0 || (ready < len(mediaTypes) && i < autoRecordMaxRetry-1) {
+			continue
+		}
+
+		_, err = a.fileServer.StartSession(id, dto.EgressFileRequest{
+			Path:            recordingPath(rule.Path, id, time.Now()),
+			MediaTypes:      mediaTypes,
+			Format:          rule.Format,
+			SegmentDuration: rule.SegmentDuration,
+			SegmentSize:     rule.SegmentSize,
+		})
+		if err == nil {
+			log.Logger.Info("auto recording started", zap.String("streamID", id), zap.String("pattern", rule.Pattern))
+			// 시작하는 사이에 스트림이 삭제되었으면 바로 중지한다.
+			if !a.active(id, stream) {
+				_ = a.fileServer.StopSession(id)
+			}
+			return
+		}
+	}
+	log.Logger.Warn("auto recording start failed", zap.String("streamID", id), zap.Error(err))
+}
+
+func recordingPath(template, streamID string, now time.Time) string {
+	// 스트림 키로 다른 디렉토리에 쓰지 못하도록 한다.
+	streamID = strings.NewReplacer("/", "_", `\`, "_", "..", "_").Replace(streamID)
+	return strings.NewReplacer(
+		"{stream}", streamID,
+		"{date}", now.Format("20060102"),
+		"{time}", now.Format("150405"),
+	).Replace(template)
+}
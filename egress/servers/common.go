@@ -3,6 +3,8 @@ package servers
 import (
 	"errors"
 	"mediaserver-go/hubs"
+	"mediaserver-go/hubs/filters"
+	"mediaserver-go/utils/dto"
 	"mediaserver-go/utils/types"
 )
 
@@ -23,3 +25,35 @@ func filterMediaTypesInStream(stream *hubs.Stream, mediaTypes []types.MediaType)
 
 	return hubSources, nil
 }
+
+func toOverlay(req *dto.Overlay) filters.Overlay {
+	var overlay filters.Overlay
+	if req == nil {
+		return overlay
+	}
+	for _, image := range req.Images {
+		overlay.Images = append(overlay.Images, filters.ImageOverlay{
+			Path:     image.Path,
+			Position: filters.Position(image.Position),
+			X:        image.X,
+			Y:        image.Y,
+			Opacity:  image.Opacity,
+			Width:    image.Width,
+		})
+	}
+	for _, text := range req.Texts {
+		overlay.Texts = append(overlay.Texts, filters.TextOverlay{
+			Text:     text.Text,
+			Clock:    text.Clock,
+			Position: filters.Position(text.Position),
+			X:        text.X,
+			Y:        text.Y,
+			FontFile: text.FontFile,
+			FontSize: text.FontSize,
+			Color:    text.Color,
+			Opacity:  text.Opacity,
+			Box:      text.Box,
+		})
+	}
+	return overlay
+}
@@ -3,26 +3,39 @@ package servers
 import (
 	"context"
 	"errors"
+	"sync"
 	"time"
 
+	"go.uber.org/zap"
+
 	"mediaserver-go/egress/sessions"
 	"mediaserver-go/egress/sessions/files"
 	"mediaserver-go/hubs"
 	"mediaserver-go/utils/dto"
+	"mediaserver-go/utils/log"
+)
+
+var (
+	errRecordingExists   = errors.New("recording already exists")
+	errRecordingNotFound = errors.New("recording not found")
 )
 
 type FileServer struct {
-	hub *hubs.Hub
+	mu sync.Mutex
+
+	hub      *hubs.Hub
+	sessions map[string]context.CancelFunc
 }
 
 func NewFileServer(hub *hubs.Hub) (FileServer, error) {
 	return FileServer{
-		hub: hub,
+		hub:      hub,
+		sessions: make(map[string]context.CancelFunc),
 	}, nil
 }
 
 func (f *FileServer) StartSession(streamID string, req dto.EgressFileRequest) (dto.EgressFileResponse, error) {
-	stream, ok := f.hub.GetStream(streamID)
+	stream, ok := f.hub.GetOrPullStream(streamID)
 	if !ok {
 		return dto.EgressFileResponse{}, errors.New("stream not found")
 	}
@@ -32,17 +45,58 @@ func (f *FileServer) StartSession(streamID string, req dto.EgressFileRequest) (d
 		return dto.EgressFileResponse{}, err
 	}
 
-	handler := files.NewHandler(req.Path)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.sessions[streamID]; ok {
+		return dto.EgressFileResponse{}, errRecordingExists
+	}
+
+	handler := files.NewHandler(files.Config{
+		Path:            req.Path,
+		Overlay:         toOverlay(req.Overlay),
+		Format:          req.Format,
+		SegmentDuration: time.Duration(req.SegmentDuration) * time.Second,
+		SegmentSize:     req.SegmentSize,
+	})
 	if err := handler.Init(context.Background(), filteredSources); err != nil {
 		return dto.EgressFileResponse{}, err
 	}
 
+	duration := req.Duration
+	if duration == 0 {
+		duration = req.Interval
+	}
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if duration > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), time.Duration(duration)*time.Millisecond)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	f.sessions[streamID] = cancel
+
 	sess := sessions.NewSession[*files.TrackContext](handler)
 	go func() {
-		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(req.Interval)*time.Millisecond)
 		defer cancel()
-		sess.Run(ctx)
+		if err := sess.Run(ctx); err != nil {
+			log.Logger.Error("file session error", zap.String("streamID", streamID), zap.Error(err))
+		}
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		delete(f.sessions, streamID)
 	}()
 
 	return dto.EgressFileResponse{}, nil
 }
+
+func (f *FileServer) StopSession(streamID string) error {
+	f.mu.Lock()
+	cancel, ok := f.sessions[streamID]
+	f.mu.Unlock()
+	if !ok {
+		return errRecordingNotFound
+	}
+	cancel()
+	return nil
+}
@@ -0,0 +1,112 @@
+package servers
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"mediaserver-go/egress/sessions"
+	"mediaserver-go/egress/sessions/flv"
+	"mediaserver-go/hubs"
+	"mediaserver-go/utils/log"
+	"mediaserver-go/utils/types"
+)
+
+const (
+	// 구독자가 모두 나간 세션은 이 시간 후에 중지한다. Opus 트랜스코딩 등이 계속 돌지 않게 한다.
+	flvIdleTimeout = 10 * time.Second
+)
+
+type FLVServer struct {
+	mu sync.Mutex
+
+	hub *hubs.Hub
+	// 스트림별로 GOP 캐시를 보관하는 세션. HTTP-FLV 와 WebSocket-FLV 구독자가 함께 사용한다.
+	handlers map[string]*flv.Handler
+}
+
+func NewFLVServer(hub *hubs.Hub) (FLVServer, error) {
+	return FLVServer{
+		hub:      hub,
+		handlers: make(map[string]*flv.Handler),
+	}, nil
+}
+
+// Subscribe 는 스트림의 FLV 구독자를 만든다. 다 사용하면 Subscriber.Close 를 호출해야 한다.
+func (f *FLVServer) Subscribe(streamID string) (*flv.Subscriber, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	handler, err := f.loadOrStartHandler(streamID)
+	if err != nil {
+		return nil, err
+	}
+	return handler.Subscribe()
+}
+
+// loadOrStartHandler 는 f.mu 를 잡고 호출해야 한다.
+func (f *FLVServer) loadOrStartHandler(streamID string) (*flv.Handler, error) {
+	if handler, ok := f.handlers[streamID]; ok {
+		return handler, nil
+	}
+
+	stream, ok := f.hub.GetOrPullStream(streamID)
+	if !ok {
+		return nil, errors.New("stream not found")
+	}
+
+	filteredSourceTracks, err := filterMediaTypesInStream(stream, []types.MediaType{types.MediaTypeVideo, types.MediaTypeAudio})
+	if err != nil {
+		return nil, err
+	}
+
+	handler := flv.NewHandler()
+	if err := handler.Init(context.Background(), filteredSourceTracks); err != nil {
+		return nil, err
+	}
+	f.handlers[streamID] = handler
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sess := sessions.NewSession[*flv.TrackContext](handler)
+	go func() {
+		defer cancel()
+		sess.Run(ctx)
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.handlers[streamID] == handler {
+			delete(f.handlers, streamID)
+		}
+	}()
+	go f.watch(ctx, cancel, streamID, handler)
+	return handler, nil
+}
+
+// watch 는 구독자가 없는 세션을 중지한다. 중지와 구독이 f.mu 안에서 일어나므로 중지되는 세션에 구독자가 붙지 않는다.
+func (f *FLVServer) watch(ctx context.Context, cancel context.CancelFunc, streamID string, handler *flv.Handler) {
+	ticker := time.NewTicker(flvIdleTimeout)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		f.mu.Lock()
+		if handler.Subscribers() > 0 || f.handlers[streamID] != handler {
+			f.mu.Unlock()
+			continue
+		}
+		delete(f.handlers, streamID)
+		f.mu.Unlock()
+
+		log.Logger.Info("flv session idle", zap.String("streamID", streamID))
+		cancel()
+		return
+	}
+}
@@ -5,128 +5,400 @@ import (
 	"errors"
 	"fmt"
 	"github.com/bluenviron/gohlslib/pkg/playlist"
-	_ "github.com/bluenviron/gohlslib/pkg/playlist"
 	"go.uber.org/zap"
+	"math"
 	"mediaserver-go/egress/sessions"
 	"mediaserver-go/egress/sessions/hls"
 	"mediaserver-go/hubs"
 	"mediaserver-go/utils"
+	"mediaserver-go/utils/configs"
 	"mediaserver-go/utils/dto"
 	"mediaserver-go/utils/log"
 	"mediaserver-go/utils/types"
+	"net/url"
+	"path/filepath"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	hlsStartRetryInterval = time.Second
+	hlsStartMaxRetry      = 10
+	hlsWatchInterval      = time.Second
+	// 스트림이 끝난 후에도 플레이어가 EXT-X-ENDLIST 를 받아가고, 재발행되면 이어서 쓸 수 있도록 이 시간 동안 유지한다.
+	hlsEndedRetention = 30 * time.Second
+	// 처음 시작하는 중인 스트림을 다른 플레이어가 요청하면 시작이 끝날 때까지 기다린다.
+	hlsReadyTimeout = 5 * time.Second
+)
+
+var (
+	errHLSStreamNotFound = errors.New("stream not found")
+)
+
 type HLSServer struct {
 	mu sync.RWMutex
 
 	hub        *hubs.Hub
 	hlsStreams map[string]*HLSHandler
+	// DVR 세그먼트와 VOD 플레이리스트가 <Directory>/<streamID>/<세션 시작 시각> 에 저장된다.
+	config configs.HLS
 }
 
-func NewHLSServer(hub *hubs.Hub) (HLSServer, error) {
+func NewHLSServer(hub *hubs.Hub, config configs.HLS) (HLSServer, error) {
+	switch config.AutoStart {
+	case "", configs.HLSAutoStartPublish, configs.HLSAutoStartRequest:
+	default:
+		return HLSServer{}, fmt.Errorf("invalid hls auto start: %s", config.AutoStart)
+	}
+	if _, err := hls.ParseContainer(config.Container); err != nil {
+		return HLSServer{}, err
+	}
 	return HLSServer{
 		hub:        hub,
 		hlsStreams: make(map[string]*HLSHandler),
+		config:     config,
 	}, nil
 }
 
 func (h *HLSServer) StartSession(streamID string, req dto.HLSRequest) (dto.HLSResponse, error) {
-	stream, ok := h.hub.GetStream(streamID)
+	stream, ok := h.hub.GetOrPullStream(streamID)
 	if !ok {
-		return dto.HLSResponse{}, errors.New("stream not found")
+		return dto.HLSResponse{}, errHLSStreamNotFound
+	}
+	if _, err := h.startSession(streamID, stream, req); err != nil {
+		return dto.HLSResponse{}, err
 	}
+	return dto.HLSResponse{}, nil
+}
 
-	hlsStream := newHLSStream()
+// autoRequest 는 AutoStart 로 시작할 때 사용하는 요청이다.
+func (h *HLSServer) autoRequest() dto.HLSRequest {
+	return dto.HLSRequest{
+		Container:       h.config.Container,
+		DVR:             h.config.DVR,
+		DVRWindow:       h.config.DVRWindow,
+		PartDuration:    h.config.PartDuration,
+		SegmentDuration: h.config.SegmentDuration,
+	}
+}
 
-	handler := hls.NewHandler(hlsStream)
-	if err := handler.Init(context.Background(), stream.Sources()); err != nil {
-		return dto.HLSResponse{}, err
+// startSession 은 HLS 패키징을 시작한다. 이미 실행 중이면 기존 것을 반환하고(중복 요청),
+// 끝난 스트림이 다시 발행되었으면 기존 플레이리스트에 EXT-X-DISCONTINUITY 로 이어서 쓴다.
+func (h *HLSServer) startSession(streamID string, stream *hubs.Stream, req dto.HLSRequest) (*HLSHandler, error) {
+	h.mu.Lock()
+	hlsStream, ok := h.hlsStreams[streamID]
+	if ok && !hlsStream.tryRestart() {
+		h.mu.Unlock()
+		return hlsStream, nil
 	}
+	if !ok {
+		var err error
+		if hlsStream, err = h.newHLSStream(streamID, req); err != nil {
+			h.mu.Unlock()
+			return nil, err
+		}
+		h.hlsStreams[streamID] = hlsStream
+		go h.watch(streamID, hlsStream)
+	}
+	h.mu.Unlock()
 
-	video := handler.CodecString(types.MediaTypeVideo)
-	audio := handler.CodecString(types.MediaTypeAudio)
+	if err := hlsStream.start(stream); err != nil {
+		// 한 번도 시작하지 못했으면 바로 지운다. 재시작에 실패했으면 끝난 상태로 남는다.
+		if !hlsStream.hasStarted() {
+			h.remove(streamID, hlsStream)
+		}
+		return nil, err
+	}
+	return hlsStream, nil
+}
+
+func (h *HLSServer) newHLSStream(streamID string, req dto.HLSRequest) (*HLSHandler, error) {
+	container, err := hls.ParseContainer(req.Container)
+	if err != nil {
+		return nil, err
+	}
+
+	var dvr *dvrStorage
+	if req.DVR {
+		if dvr, err = newDVRStorage(h.vodDirectory(streamID), time.Duration(req.DVRWindow)*time.Second); err != nil {
+			return nil, err
+		}
+	}
+
+	config := hls.Config{
+		Overlay:       toOverlay(req.Overlay),
+		Container:     container,
+		PartTarget:    time.Duration(req.PartDuration) * time.Millisecond,
+		SegmentTarget: time.Duration(req.SegmentDuration) * time.Second,
+	}.WithDefaults()
 
 	version := 10
-	master := playlist.Multivariant{
-		Version:             version,
-		IndependentSegments: true,
-		Variants: []*playlist.MultivariantVariant{
-			{
-				URI:        "video.m3u8",
-				Bandwidth:  1_000_000,
-				Codecs:     []string{video, audio},
-				Resolution: "1280x720",
-				FrameRate:  utils.GetPointer(29.970),
-			},
-		},
+	mediaMap := &playlist.MediaMap{URI: "init.mp4"}
+	if !container.LowLatency() {
+		// MPEG-TS 는 오래된 단말을 위해 init 세그먼트 없는 HLS v3 플레이리스트로 제공한다.
+		version = 3
+		mediaMap = nil
 	}
 
+	// 세그먼트는 키프레임에서 잘리므로 실제 길이에 따라 completeSegment 에서 늘어날 수 있다.
+	targetDuration := int(math.Ceil(config.SegmentTarget.Seconds()))
 	llhlsmedia := playlist.Media{
 		Version:             version,
 		IndependentSegments: true,
-		TargetDuration:      2,
+		TargetDuration:      targetDuration,
 		ServerControl: &playlist.MediaServerControl{
 			CanBlockReload: true,
-			PartHoldBack:   utils.GetPointer(time.Duration(3051) * time.Millisecond),
+			// PART-HOLD-BACK 은 PART-TARGET 의 3배 이상이어야 한다.
+			PartHoldBack: utils.GetPointer(3 * config.PartTarget),
 		},
 		MediaSequence: 0,
-		//DiscontinuitySequence: utils.GetPointer(0),
-		Map:     &playlist.MediaMap{URI: "init.mp4"},
-		PartInf: &playlist.MediaPartInf{PartTarget: time.Second},
+		Map:           &playlist.MediaMap{URI: "init.mp4"},
+		PartInf:       &playlist.MediaPartInf{PartTarget: config.PartTarget},
 	}
 
 	hlsmedia := playlist.Media{
 		Version:             version,
-		IndependentSegments: true,
-		TargetDuration:      2,
+		IndependentSegments: container.LowLatency(),
+		TargetDuration:      targetDuration,
 		MediaSequence:       0,
-		Map:                 &playlist.MediaMap{URI: "init.mp4"},
+		Map:                 mediaMap,
+	}
+	// 제한 없이 모든 세그먼트를 유지하는 경우에만 EVENT 이다. DVR 윈도우가 있으면 오래된 세그먼트가 빠지므로 지정하지 않는다.
+	if dvr != nil && dvr.window == 0 {
+		hlsmedia.PlaylistType = utils.GetPointer(playlist.MediaPlaylistType(playlist.MediaPlaylistTypeEvent))
 	}
 
-	hlsStream.master = &master
+	hlsStream := newHLSStream(dvr)
+	hlsStream.config = config
 	hlsStream.hlsmedia = &hlsmedia
 	hlsStream.llhlsMedia = &llhlsmedia
-	fmt.Println("[TESTDEBUG] mu.Lock..")
+	hlsStream.partTarget = config.PartTarget
+	hlsStream.container = container
+	hlsStream.byteRange = req.ByteRangeParts
+	if container.LowLatency() {
+		llhlsmedia.PreloadHint = hlsStream.preloadHint()
+	}
+	return hlsStream, nil
+}
+
+// watch 는 끝난 스트림을 hlsEndedRetention 후에, 플레이어 요청이 없는 스트림을 IdleTimeout 후에 중지하고 지운다.
+func (h *HLSServer) watch(streamID string, hlsStream *HLSHandler) {
+	ticker := time.NewTicker(hlsWatchInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		idle := hlsStream.idle()
+		switch hlsStream.getState() {
+		case hlsStateEnded:
+			if idle < hlsEndedRetention {
+				continue
+			}
+		case hlsStateRunning:
+			if h.config.IdleTimeout <= 0 || idle < time.Duration(h.config.IdleTimeout)*time.Second {
+				continue
+			}
+			log.Logger.Info("hls idle timeout", zap.String("streamID", streamID), zap.Duration("idle", idle))
+		default:
+			continue
+		}
+
+		if !h.remove(streamID, hlsStream) {
+			return
+		}
+		hlsStream.stop()
+		return
+	}
+}
+
+func (h *HLSServer) remove(streamID string, hlsStream *HLSHandler) bool {
 	h.mu.Lock()
-	h.hlsStreams[streamID] = hlsStream
-	h.mu.Unlock()
+	defer h.mu.Unlock()
 
-	sess := sessions.NewSession[*hls.OnTrackContext](handler)
-	go func() {
-		ctx, cancel := context.WithCancel(context.Background())
-		defer cancel()
-		sess.Run(ctx)
-	}()
+	if h.hlsStreams[streamID] != hlsStream {
+		return false
+	}
+	delete(h.hlsStreams, streamID)
+	return true
+}
 
-	return dto.HLSResponse{}, nil
+func (h *HLSServer) OnStreamAdded(id string, stream *hubs.Stream) {
+	h.mu.RLock()
+	_, ok := h.hlsStreams[id]
+	h.mu.RUnlock()
+	if !ok && h.config.AutoStart != configs.HLSAutoStartPublish {
+		return
+	}
+	go h.autoStart(id, stream)
 }
 
+// OnStreamRemoved 에서는 할 일이 없다. 스트림이 닫히면 트랙이 닫혀서 세션이 끝나고 EXT-X-ENDLIST 가 쓰인다.
+func (h *HLSServer) OnStreamRemoved(id string, stream *hubs.Stream) {}
+
+// autoStart 는 스트림의 소스가 준비될 때까지 기다렸다가 HLS 를 시작한다.
+// 이전 발행의 세션이 아직 끝나지 않았으면 끝날 때까지 기다렸다가 재시작한다.
+func (h *HLSServer) autoStart(id string, stream *hubs.Stream) {
+	var err error
+	for i := 0; i < hlsStartMaxRetry; i++ {
+		time.Sleep(hlsStartRetryInterval)
+		if current, ok := h.hub.GetStream(id); !ok || current != stream {
+			return
+		}
+		sources := stream.SourcesMap()
+		if _, ok := sources[types.MediaTypeVideo]; !ok {
+			continue
+		}
+		// 오디오는 조금 늦게 준비될 수 있으므로 절반까지는 기다린다.
+		if _, ok := sources[types.MediaTypeAudio]; !ok && i < hlsStartMaxRetry/2 {
+			continue
+		}
+
+		var hlsStream *HLSHandler
+		if hlsStream, err = h.startSession(id, stream, h.autoRequest()); err != nil {
+			continue
+		}
+		if hlsStream.source() == stream {
+			log.Logger.Info("hls auto started", zap.String("streamID", id))
+			return
+		}
+		err = errors.New("previous hls session is still running")
+	}
+	log.Logger.Warn("hls auto start failed", zap.String("streamID", id), zap.Error(err))
+}
+
+func (h *HLSServer) vodDirectory(streamID string) string {
+	// app/streamKey 형식의 ID 가 app 별로 겹치지 않게 "/" 를 이스케이프한다.
+	return filepath.Join(h.config.Directory, filepath.Base(url.PathEscape(streamID)))
+}
+
+// GetLatestVODSession 은 스트림의 가장 최근에 끝난 VOD 세션을 반환한다.
+func (h *HLSServer) GetLatestVODSession(streamID string) (string, error) {
+	return latestVODSession(h.vodDirectory(streamID))
+}
+
+// GetVODPayload 는 스트림이 끝난 후 디스크에 남은 VOD 플레이리스트와 세그먼트를 반환한다.
+func (h *HLSServer) GetVODPayload(streamID, session, name string) ([]byte, error) {
+	if session == "" || session != filepath.Base(session) || session == ".." {
+		return nil, errors.New("invalid session")
+	}
+	return readDVRFile(filepath.Join(h.vodDirectory(streamID), session), name)
+}
+
+// GetHLSStream 은 플레이어의 요청마다 호출되어 idle 시간을 갱신한다. AutoStart 가 request 이면 없는 스트림을 시작한다.
 func (h *HLSServer) GetHLSStream(streamID string) (*HLSHandler, error) {
 	h.mu.RLock()
-	defer h.mu.RUnlock()
-	stream, ok := h.hlsStreams[streamID]
+	hlsStream, ok := h.hlsStreams[streamID]
+	h.mu.RUnlock()
+
 	if !ok {
-		return nil, errors.New("stream not found")
+		stream, found := h.hub.GetOrPullStream(streamID)
+		if h.config.AutoStart != configs.HLSAutoStartRequest || !found {
+			return nil, errHLSStreamNotFound
+		}
+		var err error
+		if hlsStream, err = h.startSession(streamID, stream, h.autoRequest()); err != nil {
+			return nil, err
+		}
+	}
+	if !hlsStream.waitReady(hlsReadyTimeout) {
+		return nil, errHLSStreamNotFound
 	}
-	return stream, nil
+	hlsStream.touch()
+	return hlsStream, nil
 }
 
+var (
+	// ErrInvalidBlockingRequest 는 _HLS_msn 이 아직 만들 수 없는 먼 세그먼트를 가리킬 때 반환된다. (400)
+	ErrInvalidBlockingRequest = errors.New("invalid blocking playlist request")
+	// ErrBlockingTimeout 은 요청한 세그먼트/파트가 제시간에 만들어지지 않을 때 반환된다. (503)
+	ErrBlockingTimeout = errors.New("blocking request timeout")
+
+	errLowLatencyUnsupported = errors.New("ll-hls is not supported for this container")
+)
+
+const (
+	// 메모리와 LL-HLS 플레이리스트에 유지하는 세그먼트 개수. DVR 을 사용하지 않으면 HLS 플레이리스트도 같다.
+	liveSegmentCount = 3
+)
+
+type hlsState int
+
+const (
+	hlsStateStarting hlsState = iota
+	hlsStateRunning
+	hlsStateEnded
+)
+
+// HLSHandler 는 스트림 하나의 HLS 플레이리스트와 세그먼트를 가진다. 재발행되면 같은 HLSHandler 에 새 세션이 이어서 쓴다.
 type HLSHandler struct {
 	mu sync.RWMutex
 
-	master *playlist.Multivariant
+	config hls.Config
+	state  hlsState
+	// 한 번이라도 세션이 시작되었는지 여부
+	started bool
+	stream  *hubs.Stream
+	cancel  context.CancelFunc
+	// 처음 시작이 끝나면(성공, 실패 모두) close 된다.
+	ready     chan struct{}
+	readyOnce sync.Once
+	// 마지막으로 플레이어가 요청한 시각 (UnixNano)
+	lastAccess atomic.Int64
+
+	// 채널의 입력이 바뀌어 세션을 다시 시작하는 중이면 true 이다. End 에서 EXT-X-ENDLIST 를 붙이지 않는다.
+	switching bool
+
+	// 재발행 횟수. 발행마다 init 세그먼트가 다르다.
+	era             int
+	discontinuities []discontinuity
 
-	hlsmedia        *playlist.Media
-	hlsTempPayload  []byte
-	hlsTempDuration float64
+	master *playlist.Multivariant
 
+	hlsmedia   *playlist.Media
 	llhlsMedia *playlist.Media
 
-	lastSN       int
+	container  hls.Container
+	partTarget time.Duration
+	// true 이면 LL-HLS 파트를 별도 파일이 아닌 세그먼트의 EXT-X-BYTERANGE 로 제공한다.
+	byteRange bool
+	// 지금 만들고 있는 세그먼트의 Media Sequence Number. 이보다 작은 세그먼트는 완성되었다.
+	msn     int
+	current *hlsSegment
+	// 파트가 추가될 때마다 close 되고 새로 만들어진다. blocking reload 가 기다린다.
+	updated chan struct{}
+
 	mediaPayload map[string]*Media
+
+	// nil 이면 DVR 을 사용하지 않고 최근 3개의 세그먼트만 유지한다.
+	dvr *dvrStorage
+}
+
+// hlsSegment 는 아직 끝나지 않은 세그먼트이다.
+type hlsSegment struct {
+	dateTime time.Time
+	duration time.Duration
+	parts    []*playlist.MediaPart
+	payload  []byte
+}
+
+func (h *HLSHandler) segmentName(msn int) string {
+	return fmt.Sprintf("output_%d.%s", msn, h.container.Extension())
+}
+
+func partName(msn, part int) string {
+	return fmt.Sprintf("output_%d_%d.m4s", msn, part)
+}
+
+// mapURI 는 현재 발행의 init 세그먼트 이름이다. h.mu 를 잡고 호출해야 한다.
+func (h *HLSHandler) mapURI() string {
+	if !h.container.LowLatency() {
+		return ""
+	}
+	if h.era == 0 {
+		return "init.mp4"
+	}
+	return fmt.Sprintf("init_%d.mp4", h.era)
 }
 
 func (h *HLSHandler) loadOrStoreMedia(key string) *Media {
@@ -138,6 +410,18 @@ func (h *HLSHandler) loadOrStoreMedia(key string) *Media {
 	return media
 }
 
+// storeMedia 는 payload 를 저장하고 기다리던 요청(preload hint)을 깨운다.
+func (h *HLSHandler) storeMedia(key string, payload []byte) {
+	media := h.loadOrStoreMedia(key)
+	if media.closed() {
+		// 재시작에 실패한 발행이 쓴 init 세그먼트처럼 같은 이름으로 다시 쓰는 경우
+		media = NewMedia()
+		h.mediaPayload[key] = media
+	}
+	media.payload = payload
+	close(media.closeCh)
+}
+
 type Media struct {
 	closeCh chan struct{}
 	payload []byte
@@ -149,216 +433,472 @@ func NewMedia() *Media {
 	}
 }
 
-func newHLSStream() *HLSHandler {
-	return &HLSHandler{
+func (m *Media) closed() bool {
+	select {
+	case <-m.closeCh:
+		return true
+	default:
+		return false
+	}
+}
+
+func newHLSStream(dvr *dvrStorage) *HLSHandler {
+	h := &HLSHandler{
+		state:        hlsStateStarting,
+		ready:        make(chan struct{}),
 		mediaPayload: make(map[string]*Media),
+		updated:      make(chan struct{}),
+		dvr:          dvr,
 	}
+	h.touch()
+	return h
 }
 
-func (h *HLSHandler) GetMasterM3U8() ([]byte, error) {
+// tryRestart 는 끝난 스트림이면 시작 중 상태로 바꾸고 true 를 반환한다. 실행 중이거나 시작 중이면 false 이다.
+func (h *HLSHandler) tryRestart() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.state != hlsStateEnded {
+		return false
+	}
+	h.state = hlsStateStarting
+	return true
+}
+
+// start 는 stream 으로 새 세션을 시작한다. 재발행이면 EXT-X-DISCONTINUITY 와 새 init 세그먼트로 이어서 쓴다.
+func (h *HLSHandler) start(stream *hubs.Stream) error {
+	defer h.readyOnce.Do(func() { close(h.ready) })
+
+	h.mu.Lock()
+	restart := h.started
+	if restart {
+		h.era++
+		h.discontinuities = append(h.discontinuities, discontinuity{msn: h.msn, mapURI: h.mapURI()})
+		h.hlsmedia.Endlist = false
+		h.llhlsMedia.Endlist = false
+	}
+	h.switching = false
+	h.mu.Unlock()
+
+	switched := stream.Switched()
+	handler := hls.NewHandler(h, h.config)
+	if err := handler.Init(context.Background(), stream.Sources()); err != nil {
+		h.mu.Lock()
+		if restart {
+			h.era--
+			h.discontinuities = h.discontinuities[:len(h.discontinuities)-1]
+			h.hlsmedia.Endlist = true
+			h.llhlsMedia.Endlist = true
+		}
+		h.state = hlsStateEnded
+		h.mu.Unlock()
+		return err
+	}
+
+	video := handler.CodecString(types.MediaTypeVideo)
+	audio := handler.CodecString(types.MediaTypeAudio)
+	codecs := []string{video}
+	if audio != "" {
+		codecs = append(codecs, audio)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h.mu.Lock()
+	h.master = &playlist.Multivariant{
+		Version:             h.hlsmedia.Version,
+		IndependentSegments: h.container.LowLatency(),
+		Variants: []*playlist.MultivariantVariant{
+			{
+				URI:        "video.m3u8",
+				Bandwidth:  1_000_000,
+				Codecs:     codecs,
+				Resolution: "1280x720",
+				FrameRate:  utils.GetPointer(29.970),
+			},
+		},
+	}
+	if h.container.LowLatency() {
+		h.llhlsMedia.PreloadHint = h.preloadHint()
+	}
+	h.state = hlsStateRunning
+	h.started = true
+	h.stream = stream
+	h.cancel = cancel
+	h.mu.Unlock()
+
+	sess := sessions.NewSession[*hls.OnTrackContext](handler)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer cancel()
+		sess.Run(ctx)
+	}()
+	go h.followSwitch(ctx, cancel, done, stream, switched)
+	return nil
+}
+
+// followSwitch 는 채널의 입력이 바뀌어 소스의 코덱이 달라지면 세션을 새 소스로 다시 시작한다.
+// 플레이리스트는 끝나지 않고 EXT-X-DISCONTINUITY 와 새 init 세그먼트로 이어진다.
+func (h *HLSHandler) followSwitch(ctx context.Context, cancel context.CancelFunc, done chan struct{}, stream *hubs.Stream, switched <-chan struct{}) {
+	select {
+	case <-done:
+		return
+	case <-switched:
+	}
+	if ctx.Err() != nil {
+		return
+	}
+
+	h.mu.Lock()
+	h.switching = true
+	h.mu.Unlock()
+	cancel()
+	<-done
+
+	if !h.tryRestart() {
+		return
+	}
+	if err := h.start(stream); err != nil {
+		// start 가 실패하면 플레이리스트는 EXT-X-ENDLIST 로 끝난다.
+		log.Logger.Warn("hls restart after source switch failed", zap.Error(err))
+		h.mu.Lock()
+		h.llhlsMedia.PreloadHint = nil
+		h.mu.Unlock()
+	}
+}
+
+// stop 은 실행 중인 세션을 끝낸다. 세션이 끝나면 End 가 호출된다.
+func (h *HLSHandler) stop() {
+	h.mu.RLock()
+	cancel := h.cancel
+	h.mu.RUnlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+func (h *HLSHandler) hasStarted() bool {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
-	return h.master.Marshal()
+	return h.started
 }
 
-func (h *HLSHandler) getMediaM3U8LLHLS(sn int) ([]byte, error) {
+func (h *HLSHandler) getState() hlsState {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
+	return h.state
+}
 
-	if h.llhlsMedia.MediaSequence > sn {
-		return nil, errors.New("no segments found")
-	}
-	for _, sg := range h.llhlsMedia.Segments {
-		if sg.Title == strconv.Itoa(sn) {
-			fmt.Println("[TESTDEBUG] sg.Title:", sg.Title, ", strconv.Itoa(sn):", strconv.Itoa(sn))
-			return h.llhlsMedia.Marshal()
-		}
+// source 는 현재(또는 마지막) 세션의 스트림이다.
+func (h *HLSHandler) source() *hubs.Stream {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.stream
+}
+
+func (h *HLSHandler) waitReady(timeout time.Duration) bool {
+	select {
+	case <-h.ready:
+	case <-time.After(timeout):
+		return false
 	}
-	return nil, nil
+	return h.hasStarted()
+}
+
+func (h *HLSHandler) touch() {
+	h.lastAccess.Store(time.Now().UnixNano())
+}
+
+func (h *HLSHandler) idle() time.Duration {
+	return time.Since(time.Unix(0, h.lastAccess.Load()))
+}
+
+func (h *HLSHandler) GetMasterM3U8() ([]byte, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.master.Marshal()
 }
 
 func (h *HLSHandler) GetMediaM3U8HLS() ([]byte, error) {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
-	return h.hlsmedia.Marshal()
+	return marshalMedia(h.hlsmedia, h.discontinuities)
 }
 
+// GetMediaM3U8LLHLS 는 _HLS_msn, _HLS_part 가 있으면 해당 세그먼트(파트)가 플레이리스트에 들어갈 때까지 기다린다. (blocking playlist reload)
+// _HLS_part 가 없으면 세그먼트가 완성될 때까지 기다린다.
 func (h *HLSHandler) GetMediaM3U8LLHLS(sn, part string) ([]byte, error) {
+	if !h.container.LowLatency() {
+		return nil, errLowLatencyUnsupported
+	}
 	if sn == "" {
 		h.mu.RLock()
 		defer h.mu.RUnlock()
-		return h.llhlsMedia.Marshal()
+		return marshalMedia(h.llhlsMedia, h.discontinuities)
 	}
 
-	sequenceNumber, err := strconv.Atoi(sn)
+	msn, err := strconv.Atoi(sn)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("_HLS_msn: %w", ErrInvalidBlockingRequest)
 	}
-
-	b, err := h.getMediaM3U8LLHLS(sequenceNumber)
-	if err != nil {
-		return nil, err
+	partIndex := -1
+	if part != "" {
+		if partIndex, err = strconv.Atoi(part); err != nil || partIndex < 0 {
+			return nil, fmt.Errorf("_HLS_part: %w", ErrInvalidBlockingRequest)
+		}
 	}
-	if len(b) > 0 {
-		return b, nil
+
+	h.mu.RLock()
+	timeout := h.blockingTimeout()
+	h.mu.RUnlock()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		h.mu.RLock()
+		if h.contains(msn, partIndex) || h.llhlsMedia.Endlist {
+			b, err := marshalMedia(h.llhlsMedia, h.discontinuities)
+			h.mu.RUnlock()
+			return b, err
+		}
+		// 플레이리스트의 마지막 세그먼트는 지금 만들고 있는 h.msn 이므로 그 다음 세그먼트까지만 기다린다.
+		tooFar := msn > h.msn+1
+		updated := h.updated
+		h.mu.RUnlock()
+
+		if tooFar {
+			return nil, ErrInvalidBlockingRequest
+		}
+		select {
+		case <-updated:
+		case <-timer.C:
+			return nil, ErrBlockingTimeout
+		}
 	}
+}
 
-	output := fmt.Sprintf("output_%s.m4s", sn)
-	if part != "" {
-		output = fmt.Sprintf("output_%s_%s.m4s", sn, part)
+// contains 는 플레이리스트에 msn 세그먼트(part 가 0 이상이면 파트)가 있는지 확인한다. h.mu 를 잡고 호출해야 한다.
+func (h *HLSHandler) contains(msn, part int) bool {
+	if msn < h.msn {
+		return true
+	}
+	if msn > h.msn || part < 0 || h.current == nil {
+		return false
 	}
+	return part < len(h.current.parts)
+}
 
+// GetPayload 는 preload hint 로 알려준 다음 파트를 요청하면 파트가 만들어질 때까지 기다린다.
+func (h *HLSHandler) GetPayload(name string) ([]byte, error) {
 	h.mu.Lock()
-	media := h.loadOrStoreMedia(output)
+	media, ok := h.mediaPayload[name]
+	if !ok && h.llhlsMedia.PreloadHint != nil && h.llhlsMedia.PreloadHint.URI == name && !h.llhlsMedia.Endlist {
+		media, ok = h.loadOrStoreMedia(name), true
+	}
+	timeout := h.blockingTimeout()
 	h.mu.Unlock()
 
+	if !ok {
+		// 메모리에서 지워진 오래된 세그먼트는 디스크에서 읽는다.
+		if h.dvr != nil {
+			return readDVRFile(h.dvr.dir, name)
+		}
+		return nil, errors.New("media not found")
+	}
+
 	select {
-	case <-time.After(4 * time.Second):
-		return nil, errors.New("timeout")
 	case <-media.closeCh:
+	case <-time.After(timeout):
+		return nil, ErrBlockingTimeout
 	}
-
-	h.mu.RLock()
-	defer h.mu.RUnlock()
-	return h.llhlsMedia.Marshal()
+	return media.payload, nil
 }
 
-func (h *HLSHandler) GetPayload(name string) ([]byte, error) {
+// GetPartialPayload 는 byte-range 파트 요청(Range: bytes=offset-)을 위한 것이다.
+// 아직 끝나지 않은 세그먼트는 offset 이후의 데이터가 생길 때까지 기다렸다가 지금까지 쓰인 데이터를 반환한다.
+// complete 는 끝난 세그먼트라서 반환한 데이터가 더 이상 바뀌지 않는지를 나타낸다.
+func (h *HLSHandler) GetPartialPayload(name string, offset int64) (payload []byte, complete bool, err error) {
 	h.mu.RLock()
-	defer h.mu.RUnlock()
+	timeout := h.blockingTimeout()
+	h.mu.RUnlock()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
 
-	media, ok := h.mediaPayload[name]
-	if !ok {
-		return nil, errors.New("media not found")
+	for {
+		h.mu.RLock()
+		if !h.byteRange || h.llhlsMedia.Endlist || name != h.segmentName(h.msn) {
+			h.mu.RUnlock()
+			payload, err := h.GetPayload(name)
+			return payload, err == nil, err
+		}
+		if h.current != nil && int64(len(h.current.payload)) > offset {
+			// 이후의 append 는 len 뒤에 쓰므로 반환한 slice 는 바뀌지 않는다.
+			payload := h.current.payload
+			h.mu.RUnlock()
+			return payload, false, nil
+		}
+		updated := h.updated
+		h.mu.RUnlock()
+
+		select {
+		case <-updated:
+		case <-timer.C:
+			return nil, false, ErrBlockingTimeout
+		}
 	}
-	return media.payload, nil
 }
 
-func (h *HLSHandler) SetPayload(payload []byte, name string) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-
-	media := h.loadOrStoreMedia(name)
-	close(media.closeCh)
-	media.payload = payload
+// blockingTimeout 은 스펙에 따라 TARGETDURATION 의 3배이다. h.mu 를 잡고 호출해야 한다.
+func (h *HLSHandler) blockingTimeout() time.Duration {
+	return 3 * time.Duration(h.llhlsMedia.TargetDuration) * time.Second
 }
 
-func (h *HLSHandler) appendMediaHLS(payload []byte, index, segIndex, partIndex int, duration float64) *playlist.MediaSegment {
+func (h *HLSHandler) SetInit(payload []byte) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	var deleted *playlist.MediaSegment
-
-	segOutput := fmt.Sprintf("output_%d.m4s", segIndex)
+	name := h.mapURI()
+	h.storeMedia(name, payload)
 
-	if partIndex == 0 {
-		h.hlsTempPayload = payload
-		h.hlsTempDuration = duration
-		return nil
-	}
-	if len(h.hlsmedia.Segments) >= 3 {
-		h.hlsmedia.MediaSequence += 1
-		deleted = h.hlsmedia.Segments[0]
-		h.hlsmedia.Segments = h.hlsmedia.Segments[1:]
+	if h.dvr != nil {
+		if err := h.dvr.write(name, payload); err != nil {
+			log.Logger.Warn("dvr write failed", zap.String("name", name), zap.Error(err))
+		}
 	}
-	h.hlsmedia.Segments = append(h.hlsmedia.Segments, &playlist.MediaSegment{
-		URI:      segOutput,
-		Duration: time.Duration(duration*1_000_000)*time.Microsecond + time.Duration(h.hlsTempDuration*1_000_000)*time.Microsecond,
-		Title:    strconv.Itoa(segIndex),
-		DateTime: utils.GetPointer(time.Now().UTC()),
-	})
-
-	media := h.loadOrStoreMedia(segOutput)
-	media.payload = append(h.hlsTempPayload, payload...)
-	close(media.closeCh)
-
-	log.Logger.Info("hls Handler write file end",
-		zap.Int("index", index),
-		zap.Int("segIndex", segIndex),
-		zap.Int("partIndex", partIndex),
-		zap.Int("size", len(payload)))
-
-	return deleted
 }
 
-func (h *HLSHandler) appendMediallhls(payload []byte, index, segIndex, partIndex int, duration float64) *playlist.MediaSegment {
+// AppendPart 는 파트를 LL-HLS 플레이리스트에 추가하고, 세그먼트가 끝나면 세그먼트를 두 플레이리스트에 추가한다.
+func (h *HLSHandler) AppendPart(part hls.Part) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	var deleted *playlist.MediaSegment
-
-	if partIndex == 0 {
-		part0Output := fmt.Sprintf("output_%d_%d.m4s", segIndex, partIndex)
-		nextOutput := fmt.Sprintf("output_%d_%d.m4s", segIndex, 1)
-		h.llhlsMedia.Parts = []*playlist.MediaPart{
-			{
-				Duration:    time.Duration(duration*1_000_000) * time.Microsecond,
-				URI:         part0Output,
-				Independent: true,
-			},
+	if h.current == nil {
+		h.current = &hlsSegment{dateTime: part.SegmentTime}
+	}
+	if h.container.LowLatency() {
+		mediaPart := &playlist.MediaPart{
+			Duration:    part.Duration,
+			Independent: part.Independent,
 		}
-		h.llhlsMedia.PreloadHint = &playlist.MediaPreloadHint{
-			URI: nextOutput,
+		if h.byteRange {
+			// 파트를 세그먼트의 byte range 로 알려주면 CDN 은 세그먼트 하나만 캐시하면 된다.
+			mediaPart.URI = h.segmentName(h.msn)
+			mediaPart.ByteRangeStart = utils.GetPointer(uint64(len(h.current.payload)))
+			mediaPart.ByteRangeLength = utils.GetPointer(uint64(len(part.Payload)))
+		} else {
+			mediaPart.URI = partName(h.msn, len(h.current.parts))
+			h.storeMedia(mediaPart.URI, part.Payload)
 		}
+		h.current.parts = append(h.current.parts, mediaPart)
+	}
+	h.current.payload = append(h.current.payload, part.Payload...)
+	h.current.duration += part.Duration
 
-		media := h.loadOrStoreMedia(part0Output)
-		media.payload = payload
-		close(media.closeCh)
-	} else {
-		part1Output := fmt.Sprintf("output_%d_%d.m4s", segIndex, partIndex)
-		nextOutput := fmt.Sprintf("output_%d_%d.m4s", segIndex+1, 0)
-
-		if len(h.hlsmedia.Segments) > 0 {
-			if len(h.llhlsMedia.Segments) >= 3 {
-				h.llhlsMedia.MediaSequence += 1
-				deleted = h.llhlsMedia.Segments[0]
-				h.llhlsMedia.Segments = h.llhlsMedia.Segments[1:]
-			}
-			lastSeg := h.hlsmedia.Segments[len(h.hlsmedia.Segments)-1]
-			h.llhlsMedia.Segments = append(h.llhlsMedia.Segments, &playlist.MediaSegment{
-				URI:      lastSeg.URI,
-				Duration: lastSeg.Duration,
-				Title:    lastSeg.Title,
-				DateTime: lastSeg.DateTime,
-				Parts: append(h.llhlsMedia.Parts, &playlist.MediaPart{
-					Duration:    time.Duration(duration*1_000_000) * time.Microsecond,
-					URI:         part1Output,
-					Independent: true,
-				}),
-			})
-		}
-		h.llhlsMedia.Parts = nil
+	if part.Last {
+		h.completeSegment()
+	}
 
-		h.llhlsMedia.PreloadHint = &playlist.MediaPreloadHint{
-			URI: nextOutput,
+	if h.container.LowLatency() {
+		h.llhlsMedia.Parts = nil
+		if h.current != nil {
+			h.llhlsMedia.Parts = h.current.parts
 		}
-
-		media1 := h.loadOrStoreMedia(part1Output)
-		media1.payload = payload
-		close(media1.closeCh)
+		h.llhlsMedia.PreloadHint = h.preloadHint()
 	}
 
-	//log.Logger.Info("hls Handler write file end",
-	//	zap.Int("index", index),
-	//	zap.Int("segIndex", segIndex),
-	//	zap.Int("partIndex", partIndex),
-	//	zap.Int("size", len(payload)))
+	close(h.updated)
+	h.updated = make(chan struct{})
+}
 
-	return deleted
+// preloadHint 는 다음에 만들어질 파트를 가리킨다. h.mu 를 잡고 호출해야 한다.
+func (h *HLSHandler) preloadHint() *playlist.MediaPreloadHint {
+	parts := 0
+	if h.current != nil {
+		parts = len(h.current.parts)
+	}
+	if !h.byteRange {
+		return &playlist.MediaPreloadHint{URI: partName(h.msn, parts)}
+	}
+	hint := &playlist.MediaPreloadHint{URI: h.segmentName(h.msn)}
+	if h.current != nil {
+		hint.ByteRangeStart = uint64(len(h.current.payload))
+	}
+	return hint
 }
 
-func (h *HLSHandler) AppendMedia(payload []byte, index int, duration float64) {
-	segIndex := index / 2
-	partIndex := index % 2
+// completeSegment 는 현재 세그먼트를 끝낸다. h.mu 를 잡고 호출해야 한다.
+func (h *HLSHandler) completeSegment() {
+	current := h.current
+	name := h.segmentName(h.msn)
+	h.storeMedia(name, current.payload)
+
+	// EXTINF 를 반올림한 값이 TARGETDURATION 을 넘으면 안 된다. 키프레임 간격이 세그먼트 목표 길이보다 길면 늘어난다.
+	if d := int(math.Round(current.duration.Seconds())); d > h.hlsmedia.TargetDuration {
+		log.Logger.Warn("hls segment longer than target duration", zap.Int("msn", h.msn), zap.Duration("duration", current.duration))
+		h.hlsmedia.TargetDuration = d
+		h.llhlsMedia.TargetDuration = d
+	}
 
-	deleted := h.appendMediaHLS(payload, index, segIndex, partIndex, duration)
+	segment := &playlist.MediaSegment{
+		URI:      name,
+		Duration: current.duration,
+		DateTime: utils.GetPointer(current.dateTime.UTC()),
+	}
+	h.hlsmedia.Segments = append(h.hlsmedia.Segments, segment)
+	h.llhlsMedia.Segments = append(h.llhlsMedia.Segments, &playlist.MediaSegment{
+		URI:      segment.URI,
+		Duration: segment.Duration,
+		DateTime: segment.DateTime,
+		Parts:    current.parts,
+	})
 
-	h.appendMediallhls(payload, index, segIndex, partIndex, duration)
+	if h.dvr != nil {
+		if err := h.dvr.write(name, current.payload); err != nil {
+			log.Logger.Warn("dvr write failed", zap.String("name", name), zap.Error(err))
+		}
+		h.dvr.append(segment)
+		h.hlsmedia.MediaSequence += h.dvr.trim(&h.hlsmedia.Segments)
+	} else if len(h.hlsmedia.Segments) > liveSegmentCount {
+		h.hlsmedia.Segments = h.hlsmedia.Segments[1:]
+		h.hlsmedia.MediaSequence++
+	}
 
-	if deleted == nil {
-		return
+	// 메모리에는 최근 세그먼트만 둔다. DVR 이면 오래된 세그먼트는 디스크에서 읽는다.
+	if len(h.llhlsMedia.Segments) > liveSegmentCount {
+		deleted := h.llhlsMedia.Segments[0]
+		h.llhlsMedia.Segments = h.llhlsMedia.Segments[1:]
+		h.llhlsMedia.MediaSequence++
+		delete(h.mediaPayload, deleted.URI)
+		for _, p := range deleted.Parts {
+			delete(h.mediaPayload, p.URI)
+		}
 	}
+
+	h.current = nil
+	h.msn++
+}
+
+// End 는 스트림이 끝났을 때 호출된다. 라이브 플레이리스트에 EXT-X-ENDLIST 를 붙이고, DVR 을 사용하면 VOD 플레이리스트를 디스크에 쓴다.
+func (h *HLSHandler) End() {
 	h.mu.Lock()
 	defer h.mu.Unlock()
-	delete(h.mediaPayload, deleted.Title)
+
+	h.state = hlsStateEnded
+	h.cancel = nil
+	if h.switching {
+		// 곧 새 소스로 이어서 쓰므로 플레이어가 멈추지 않게 EXT-X-ENDLIST 를 붙이지 않는다.
+		return
+	}
+	h.hlsmedia.Endlist = true
+	h.llhlsMedia.Endlist = true
+	h.llhlsMedia.PreloadHint = nil
+	close(h.updated)
+	h.updated = make(chan struct{})
+	if h.dvr == nil {
+		return
+	}
+	if err := h.dvr.writeVOD(h.master, h.hlsmedia, h.discontinuities); err != nil {
+		log.Logger.Warn("vod write failed", zap.String("dir", h.dvr.dir), zap.Error(err))
+	}
 }
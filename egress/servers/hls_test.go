@@ -0,0 +1,101 @@
+package servers
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bluenviron/gohlslib/pkg/playlist"
+
+	"mediaserver-go/egress/sessions/hls"
+)
+
+// blockingTestHandler 는 세그먼트 0..msn-1 이 완성되고 msn 세그먼트에 parts 개의 파트가 쓰인 LL-HLS 핸들러를 만든다.
+func blockingTestHandler(msn, parts int, targetDuration int) *HLSHandler {
+	h := newHLSStream(nil)
+	h.container = hls.ContainerFMP4
+	h.llhlsMedia = &playlist.Media{Version: 9, TargetDuration: targetDuration}
+	h.msn = msn
+	h.current = &hlsSegment{}
+	for i := 0; i < parts; i++ {
+		h.current.parts = append(h.current.parts, &playlist.MediaPart{Duration: 200 * time.Millisecond})
+	}
+	return h
+}
+
+func TestBlockingReloadBounds(t *testing.T) {
+	tests := []struct {
+		name    string
+		msn     string
+		part    string
+		wantErr error
+	}{
+		{name: "completed segment", msn: "4"},
+		{name: "written part", msn: "5", part: "1"},
+		// 지금 만들고 있는 세그먼트와 그 다음 세그먼트는 기다린다.
+		{name: "current segment", msn: "5", wantErr: ErrBlockingTimeout},
+		{name: "next part", msn: "5", part: "2", wantErr: ErrBlockingTimeout},
+		{name: "next segment", msn: "6", wantErr: ErrBlockingTimeout},
+		{name: "next segment part", msn: "6", part: "0", wantErr: ErrBlockingTimeout},
+		// 그보다 먼 요청은 기다리지 않고 400 이다.
+		{name: "two segments ahead", msn: "7", wantErr: ErrInvalidBlockingRequest},
+		{name: "far ahead", msn: "100", part: "0", wantErr: ErrInvalidBlockingRequest},
+		{name: "invalid msn", msn: "abc", wantErr: ErrInvalidBlockingRequest},
+		{name: "negative part", msn: "5", part: "-1", wantErr: ErrInvalidBlockingRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// TARGETDURATION 이 0 이면 blocking 요청이 바로 timeout 된다.
+			h := blockingTestHandler(5, 2, 0)
+			b, err := h.GetMediaM3U8LLHLS(tt.msn, tt.part)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || len(b) == 0 {
+				t.Fatalf("GetMediaM3U8LLHLS(%s, %s) = %q, %v", tt.msn, tt.part, b, err)
+			}
+		})
+	}
+}
+
+func TestBlockingReloadWaitsForPart(t *testing.T) {
+	h := blockingTestHandler(5, 2, 10)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := h.GetMediaM3U8LLHLS("5", "2")
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("returned before the part was written: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	h.mu.Lock()
+	h.current.parts = append(h.current.parts, &playlist.MediaPart{Duration: 200 * time.Millisecond})
+	close(h.updated)
+	h.updated = make(chan struct{})
+	h.mu.Unlock()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("blocking reload did not return after the part was written")
+	}
+}
+
+func TestBlockingReloadWithoutLowLatency(t *testing.T) {
+	h := blockingTestHandler(5, 0, 0)
+	h.container = hls.ContainerTS
+	if _, err := h.GetMediaM3U8LLHLS("5", ""); !errors.Is(err, errLowLatencyUnsupported) {
+		t.Fatalf("error = %v, want errLowLatencyUnsupported", err)
+	}
+}
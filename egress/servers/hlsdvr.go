@@ -0,0 +1,131 @@
+package servers
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bluenviron/gohlslib/pkg/playlist"
+
+	"mediaserver-go/utils"
+)
+
+const (
+	vodMasterM3U8 = "index.m3u8"
+	vodMediaM3U8  = "video.m3u8"
+	// 세션 디렉토리 이름. 이름 순서가 시작 시각 순서와 같다.
+	vodSessionLayout = "20060102-150405.000"
+)
+
+// dvrStorage 는 HLS 세그먼트를 디스크에 저장하여 늦게 들어온 시청자가 되감기할 수 있게 하고, 스트림이 끝나면 VOD 로 제공한다.
+type dvrStorage struct {
+	dir string
+	// 라이브 플레이리스트에 유지할 길이. 0 이면 모든 세그먼트를 유지한다.
+	window time.Duration
+
+	// VOD 를 위해 디스크에 저장된 모든 세그먼트
+	segments []*playlist.MediaSegment
+}
+
+// newDVRStorage 는 streamDir 아래에 세션 시작 시각으로 디렉토리를 만든다.
+// 같은 스트림을 다시 발행해도 이전 세션의 VOD 는 지우지 않는다.
+func newDVRStorage(streamDir string, window time.Duration) (*dvrStorage, error) {
+	if err := os.MkdirAll(streamDir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating dvr directory: %w", err)
+	}
+	dir := filepath.Join(streamDir, time.Now().Format(vodSessionLayout))
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating dvr session directory: %w", err)
+	}
+	return &dvrStorage{
+		dir:    dir,
+		window: window,
+	}, nil
+}
+
+func (d *dvrStorage) write(name string, payload []byte) error {
+	return os.WriteFile(filepath.Join(d.dir, name), payload, 0666)
+}
+
+func (d *dvrStorage) append(segment *playlist.MediaSegment) {
+	d.segments = append(d.segments, segment)
+}
+
+// trim 은 segments 의 길이가 window 를 넘으면 앞에서부터 제거하고 제거한 개수를 반환한다. 디스크의 파일은 VOD 를 위해 남긴다.
+func (d *dvrStorage) trim(segments *[]*playlist.MediaSegment) int {
+	if d.window == 0 {
+		return 0
+	}
+	var total time.Duration
+	for _, segment := range *segments {
+		total += segment.Duration
+	}
+	removed := 0
+	for len(*segments) > 1 && total > d.window {
+		total -= (*segments)[0].Duration
+		*segments = (*segments)[1:]
+		removed++
+	}
+	return removed
+}
+
+// writeVOD 는 저장된 모든 세그먼트로 EXT-X-ENDLIST 가 붙은 VOD 플레이리스트를 만든다.
+func (d *dvrStorage) writeVOD(master *playlist.Multivariant, live *playlist.Media, discontinuities []discontinuity) error {
+	if len(d.segments) == 0 {
+		return errors.New("no segments")
+	}
+	vod := playlist.Media{
+		Version:             live.Version,
+		IndependentSegments: live.IndependentSegments,
+		TargetDuration:      live.TargetDuration,
+		MediaSequence:       0,
+		PlaylistType:        utils.GetPointer(playlist.MediaPlaylistType(playlist.MediaPlaylistTypeVOD)),
+		Map:                 live.Map,
+		Segments:            d.segments,
+		Endlist:             true,
+	}
+	for _, segment := range d.segments {
+		if target := int(segment.Duration.Round(time.Second) / time.Second); target > vod.TargetDuration {
+			vod.TargetDuration = target
+		}
+	}
+
+	b, err := marshalMedia(&vod, discontinuities)
+	if err != nil {
+		return err
+	}
+	if err := d.write(vodMediaM3U8, b); err != nil {
+		return err
+	}
+	if b, err = master.Marshal(); err != nil {
+		return err
+	}
+	return d.write(vodMasterM3U8, b)
+}
+
+// latestVODSession 은 streamDir 에서 VOD 플레이리스트가 쓰인 가장 최근 세션을 반환한다. 진행 중인 세션은 제외된다.
+func latestVODSession(streamDir string) (string, error) {
+	entries, err := os.ReadDir(streamDir)
+	if err != nil {
+		return "", err
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if !entries[i].IsDir() {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(streamDir, entries[i].Name(), vodMasterM3U8)); err == nil {
+			return entries[i].Name(), nil
+		}
+	}
+	return "", errors.New("vod not found")
+}
+
+// readDVRFile 은 dir 안의 파일만 읽는다.
+func readDVRFile(dir, name string) ([]byte, error) {
+	if name == "" || name != filepath.Base(name) || name == ".." {
+		return nil, errors.New("invalid name")
+	}
+	return os.ReadFile(filepath.Join(dir, name))
+}
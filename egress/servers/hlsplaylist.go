@@ -0,0 +1,69 @@
+package servers
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bluenviron/gohlslib/pkg/playlist"
+)
+
+// discontinuity 는 재발행으로 새 init 세그먼트를 쓰기 시작한 세그먼트이다.
+type discontinuity struct {
+	msn int
+	// 새 init 세그먼트. MPEG-TS 이면 비어있다.
+	mapURI string
+}
+
+// marshalMedia 는 gohlslib 가 지원하지 않는 EXT-X-DISCONTINUITY, EXT-X-DISCONTINUITY-SEQUENCE 와 구간별 EXT-X-MAP 을 넣어서 플레이리스트를 만든다.
+// media 의 세그먼트는 MediaSequence 부터 연속된 번호를 가져야 한다.
+func marshalMedia(media *playlist.Media, discontinuities []discontinuity) ([]byte, error) {
+	if len(discontinuities) == 0 {
+		return media.Marshal()
+	}
+
+	// 플레이리스트에서 빠진 discontinuity 는 DISCONTINUITY-SEQUENCE 로 세고, 첫 세그먼트의 init 세그먼트를 EXT-X-MAP 으로 쓴다.
+	m := *media
+	sequence := 0
+	pending := make(map[int]discontinuity)
+	for _, d := range discontinuities {
+		if d.msn > m.MediaSequence {
+			pending[d.msn] = d
+			continue
+		}
+		sequence++
+		if d.mapURI != "" {
+			m.Map = &playlist.MediaMap{URI: d.mapURI}
+		}
+	}
+	b, err := m.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	var sb strings.Builder
+	msn := m.MediaSequence
+	inSegment := false
+	for _, line := range strings.SplitAfter(string(b), "\n") {
+		if !inSegment && (strings.HasPrefix(line, "#EXT-X-PROGRAM-DATE-TIME:") ||
+			strings.HasPrefix(line, "#EXT-X-PART:") ||
+			strings.HasPrefix(line, "#EXTINF:")) {
+			inSegment = true
+			if d, ok := pending[msn]; ok {
+				sb.WriteString("#EXT-X-DISCONTINUITY\n")
+				if d.mapURI != "" {
+					sb.WriteString(fmt.Sprintf("#EXT-X-MAP:URI=%q\n", d.mapURI))
+				}
+			}
+		}
+		sb.WriteString(line)
+		if strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE:") && sequence > 0 {
+			sb.WriteString(fmt.Sprintf("#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", sequence))
+		}
+		// 세그먼트는 URI 줄로 끝난다.
+		if inSegment && line != "\n" && line != "" && !strings.HasPrefix(line, "#") {
+			inSegment = false
+			msn++
+		}
+	}
+	return []byte(sb.String()), nil
+}
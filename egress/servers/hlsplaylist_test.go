@@ -0,0 +1,121 @@
+package servers
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bluenviron/gohlslib/pkg/playlist"
+)
+
+func testMedia(mediaSequence, segments int, mapURI string) *playlist.Media {
+	media := &playlist.Media{
+		Version:        7,
+		TargetDuration: 2,
+		MediaSequence:  mediaSequence,
+	}
+	if mapURI != "" {
+		media.Map = &playlist.MediaMap{URI: mapURI}
+	}
+	for i := 0; i < segments; i++ {
+		media.Segments = append(media.Segments, &playlist.MediaSegment{
+			Duration: 2 * time.Second,
+			URI:      fmt.Sprintf("seg_%d.m4s", mediaSequence+i),
+		})
+	}
+	return media
+}
+
+// segmentHeaders 는 각 세그먼트 URI 앞에 붙은 태그(#EXTINF 제외)를 반환한다.
+func segmentHeaders(b []byte) map[string][]string {
+	headers := make(map[string][]string)
+	var tags []string
+	inHeader := false
+	for _, line := range strings.Split(string(b), "\n") {
+		switch {
+		case line == "#EXT-X-DISCONTINUITY" || strings.HasPrefix(line, "#EXTINF:"):
+			inHeader = true
+			if !strings.HasPrefix(line, "#EXTINF:") {
+				tags = append(tags, line)
+			}
+		case strings.HasPrefix(line, "#EXT-X-MAP:") && inHeader:
+			tags = append(tags, line)
+		case line != "" && !strings.HasPrefix(line, "#"):
+			headers[line] = tags
+			tags = nil
+			inHeader = false
+		}
+	}
+	return headers
+}
+
+func TestMarshalMediaWithoutDiscontinuity(t *testing.T) {
+	b, err := marshalMedia(testMedia(0, 3, "init_0.mp4"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "DISCONTINUITY") {
+		t.Fatalf("unexpected discontinuity:\n%s", b)
+	}
+}
+
+func TestMarshalMediaDiscontinuity(t *testing.T) {
+	media := testMedia(10, 4, "init_0.mp4")
+	discontinuities := []discontinuity{
+		// 플레이리스트에서 이미 빠진 세그먼트에서 시작된 구간
+		{msn: 8, mapURI: "init_1.mp4"},
+		{msn: 12, mapURI: "init_2.mp4"},
+	}
+	b, err := marshalMedia(media, discontinuities)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := string(b)
+
+	if !strings.Contains(s, "#EXT-X-MEDIA-SEQUENCE:10\n#EXT-X-DISCONTINUITY-SEQUENCE:1\n") {
+		t.Fatalf("missing discontinuity sequence after media sequence:\n%s", s)
+	}
+	// 첫 세그먼트의 init 세그먼트는 빠진 discontinuity 의 것이다.
+	if !strings.Contains(s, `#EXT-X-MAP:URI="init_1.mp4"`) || strings.Contains(s, `init_0.mp4`) {
+		t.Fatalf("playlist must start with the init segment of the removed discontinuity:\n%s", s)
+	}
+	if strings.Count(s, "#EXT-X-DISCONTINUITY\n") != 1 {
+		t.Fatalf("want exactly one EXT-X-DISCONTINUITY:\n%s", s)
+	}
+
+	headers := segmentHeaders(b)
+	for msn := 10; msn < 14; msn++ {
+		uri := fmt.Sprintf("seg_%d.m4s", msn)
+		tags, ok := headers[uri]
+		if !ok {
+			t.Fatalf("segment %s missing:\n%s", uri, s)
+		}
+		var want []string
+		if msn == 12 {
+			want = []string{"#EXT-X-DISCONTINUITY", `#EXT-X-MAP:URI="init_2.mp4"`}
+		}
+		if strings.Join(tags, "|") != strings.Join(want, "|") {
+			t.Fatalf("segment %s tags = %v, want %v:\n%s", uri, tags, want, s)
+		}
+	}
+}
+
+func TestMarshalMediaDiscontinuityWithoutMap(t *testing.T) {
+	// MPEG-TS 는 init 세그먼트가 없으므로 EXT-X-DISCONTINUITY 만 붙는다.
+	b, err := marshalMedia(testMedia(0, 3, ""), []discontinuity{{msn: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := string(b)
+	if strings.Contains(s, "#EXT-X-MAP") || strings.Contains(s, "#EXT-X-DISCONTINUITY-SEQUENCE") {
+		t.Fatalf("unexpected tags:\n%s", s)
+	}
+	headers := segmentHeaders(b)
+	if tags := headers["seg_1.m4s"]; len(tags) != 1 || tags[0] != "#EXT-X-DISCONTINUITY" {
+		t.Fatalf("seg_1 tags = %v:\n%s", tags, s)
+	}
+	if tags := headers["seg_0.m4s"]; len(tags) != 0 {
+		t.Fatalf("seg_0 tags = %v:\n%s", tags, s)
+	}
+}
@@ -3,42 +3,153 @@ package servers
 import (
 	"context"
 	"errors"
+	"sync"
+	"time"
+
 	"mediaserver-go/egress/sessions"
 	"mediaserver-go/egress/sessions/images"
 	"mediaserver-go/hubs"
+	"mediaserver-go/hubs/transcoders"
 	"mediaserver-go/utils/dto"
 	"mediaserver-go/utils/types"
 )
 
+const (
+	snapshotTimeout          = 3 * time.Second
+	defaultThumbnailInterval = 10
+)
+
+var (
+	errThumbnailNotFound = errors.New("thumbnail session not found")
+)
+
 type ImageServer struct {
+	mu sync.Mutex
+
 	hub *hubs.Hub
+	// 스트림별로 최근 키프레임을 보관하는 세션. 스냅샷과 썸네일이 함께 사용한다.
+	handlers   map[string]*images.Handler
+	thumbnails map[string]context.CancelFunc
 }
 
 func NewImageServer(hub *hubs.Hub) (ImageServer, error) {
-	return ImageServer{}, nil
+	return ImageServer{
+		hub:        hub,
+		handlers:   make(map[string]*images.Handler),
+		thumbnails: make(map[string]context.CancelFunc),
+	}, nil
 }
 
+// StartSession 은 req.Interval 초마다 썸네일을 req.Path 에 저장한다. 이미 있으면 교체한다.
 func (i *ImageServer) StartSession(streamID string, req dto.ImagesRequest) (dto.ImagesResponse, error) {
+	format, err := transcoders.ParseImageFormat(req.Encoding)
+	if err != nil {
+		return dto.ImagesResponse{}, err
+	}
+	if req.Path == "" {
+		return dto.ImagesResponse{}, errors.New("path is empty")
+	}
+	interval := req.Interval
+	if interval <= 0 {
+		interval = defaultThumbnailInterval
+	}
+
+	handler, err := i.loadOrStartHandler(streamID)
+	if err != nil {
+		return dto.ImagesResponse{}, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	i.mu.Lock()
+	if prev, ok := i.thumbnails[streamID]; ok {
+		prev()
+	}
+	i.thumbnails[streamID] = cancel
+	i.mu.Unlock()
+
+	go images.RunThumbnail(ctx, handler, req.Path, time.Duration(interval)*time.Second, images.Options{
+		Format: format,
+		Width:  req.Width,
+		Height: req.Height,
+	})
+	return dto.ImagesResponse{}, nil
+}
+
+func (i *ImageServer) StopSession(streamID string) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	cancel, ok := i.thumbnails[streamID]
+	if !ok {
+		return errThumbnailNotFound
+	}
+	cancel()
+	delete(i.thumbnails, streamID)
+	return nil
+}
+
+// Snapshot 은 스트림의 가장 최근 키프레임을 이미지로 만든다.
+func (i *ImageServer) Snapshot(streamID string, req dto.SnapshotRequest) (dto.SnapshotResponse, error) {
+	format, err := transcoders.ParseImageFormat(req.Encoding)
+	if err != nil {
+		return dto.SnapshotResponse{}, err
+	}
+	handler, err := i.loadOrStartHandler(streamID)
+	if err != nil {
+		return dto.SnapshotResponse{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), snapshotTimeout)
+	defer cancel()
+	b, err := handler.Snapshot(ctx, images.Options{
+		Format: format,
+		Width:  req.Width,
+		Height: req.Height,
+	})
+	if err != nil {
+		return dto.SnapshotResponse{}, err
+	}
+	return dto.SnapshotResponse{
+		ContentType: format.ContentType(),
+		Payload:     b,
+	}, nil
+}
+
+func (i *ImageServer) loadOrStartHandler(streamID string) (*images.Handler, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if handler, ok := i.handlers[streamID]; ok {
+		return handler, nil
+	}
+
 	stream, ok := i.hub.GetStream(streamID)
 	if !ok {
-		return dto.ImagesResponse{}, errors.New("stream not found")
+		return nil, errors.New("stream not found")
 	}
 
 	filteredSourceTracks, err := filterMediaTypesInStream(stream, []types.MediaType{types.MediaTypeVideo})
 	if err != nil {
-		return dto.ImagesResponse{}, err
+		return nil, err
 	}
 
-	handler := images.NewHandler(req.Encoding)
+	handler := images.NewHandler()
 	if err := handler.Init(context.Background(), filteredSourceTracks); err != nil {
-		return dto.ImagesResponse{}, err
+		return nil, err
 	}
+	i.handlers[streamID] = handler
 
 	sess := sessions.NewSession[*images.TrackContext](handler)
 	go func() {
 		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
 		sess.Run(ctx)
+
+		i.mu.Lock()
+		defer i.mu.Unlock()
+		if i.handlers[streamID] == handler {
+			delete(i.handlers, streamID)
+		}
 	}()
-	return dto.ImagesResponse{}, nil
+	return handler, nil
 }
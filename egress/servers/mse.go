@@ -0,0 +1,262 @@
+package servers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"mediaserver-go/egress/sessions"
+	"mediaserver-go/egress/sessions/hls"
+	"mediaserver-go/hubs"
+	"mediaserver-go/utils/log"
+	"mediaserver-go/utils/types"
+)
+
+const (
+	// 모든 비디오 프레임마다 fragment 를 만들도록 hls.Handler 의 파트 길이를 프레임 간격보다 짧게 한다.
+	msePartTarget = time.Millisecond
+	// 구독자가 모두 나간 세션은 이 시간 후에 중지한다.
+	mseIdleTimeout = 10 * time.Second
+	// 구독자에게 보내지 못하고 쌓인 fragment 가 이 개수를 넘으면 느린 클라이언트로 보고 끊는다.
+	mseSubscriberBuffer = 1024
+	// 키프레임 간격이 너무 길 때 GOP 캐시가 계속 커지지 않도록 제한한다.
+	mseMaxGOPFragments = 512
+)
+
+var (
+	errMSEClosed = errors.New("mse session closed")
+)
+
+// MSEServer 는 스트림을 HLS 와 같은 fMP4 writer(hls.Handler)로 프레임 단위 fragment 로 만들어 WebSocket 으로 보낸다.
+type MSEServer struct {
+	mu sync.Mutex
+
+	hub     *hubs.Hub
+	streams map[string]*mseStream
+}
+
+func NewMSEServer(hub *hubs.Hub) (MSEServer, error) {
+	return MSEServer{
+		hub:     hub,
+		streams: make(map[string]*mseStream),
+	}, nil
+}
+
+// Subscribe 는 스트림의 fMP4 구독자를 만든다. 다 사용하면 MSESubscriber.Close 를 호출해야 한다.
+func (m *MSEServer) Subscribe(streamID string) (*MSESubscriber, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mseStream, err := m.loadOrStartStream(streamID)
+	if err != nil {
+		return nil, err
+	}
+	return mseStream.subscribe()
+}
+
+// loadOrStartStream 은 m.mu 를 잡고 호출해야 한다.
+func (m *MSEServer) loadOrStartStream(streamID string) (*mseStream, error) {
+	if mseStream, ok := m.streams[streamID]; ok {
+		return mseStream, nil
+	}
+
+	stream, ok := m.hub.GetOrPullStream(streamID)
+	if !ok {
+		return nil, errors.New("stream not found")
+	}
+
+	mseStream := newMSEStream()
+	handler := hls.NewHandler(mseStream, hls.Config{
+		Container:  hls.ContainerFMP4,
+		PartTarget: msePartTarget,
+	})
+	if err := handler.Init(context.Background(), stream.Sources()); err != nil {
+		return nil, err
+	}
+	mseStream.mimeType = mseMimeType(handler)
+	m.streams[streamID] = mseStream
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sess := sessions.NewSession[*hls.OnTrackContext](handler)
+	go func() {
+		defer cancel()
+		sess.Run(ctx)
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.streams[streamID] == mseStream {
+			delete(m.streams, streamID)
+		}
+	}()
+	go m.watch(ctx, cancel, streamID, mseStream)
+	return mseStream, nil
+}
+
+// watch 는 구독자가 없는 세션을 중지한다.
+func (m *MSEServer) watch(ctx context.Context, cancel context.CancelFunc, streamID string, mseStream *mseStream) {
+	ticker := time.NewTicker(mseIdleTimeout)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		m.mu.Lock()
+		if mseStream.subscriberCount() > 0 || m.streams[streamID] != mseStream {
+			m.mu.Unlock()
+			continue
+		}
+		delete(m.streams, streamID)
+		m.mu.Unlock()
+
+		log.Logger.Info("mse session idle", zap.String("streamID", streamID))
+		cancel()
+		return
+	}
+}
+
+// mseMimeType 은 MediaSource.addSourceBuffer 에 넘길 MIME 타입을 만든다.
+func mseMimeType(handler *hls.Handler) string {
+	var codecs []string
+	for _, mediaType := range []types.MediaType{types.MediaTypeVideo, types.MediaTypeAudio} {
+		if codec := handler.CodecString(mediaType); codec != "" {
+			codecs = append(codecs, codec)
+		}
+	}
+	return fmt.Sprintf("video/mp4; codecs=\"%s\"", strings.Join(codecs, ","))
+}
+
+// mseStream 은 hls.Endpoint 로 받은 init 세그먼트와 fragment 를 구독자에게 나눠준다.
+// 마지막 키프레임부터의 fragment(GOP 캐시)를 보관하여 새 구독자가 바로 재생을 시작할 수 있게 한다.
+type mseStream struct {
+	mu sync.Mutex
+
+	mimeType    string
+	init        []byte
+	gop         [][]byte
+	subscribers map[*MSESubscriber]struct{}
+	ended       bool
+}
+
+func newMSEStream() *mseStream {
+	return &mseStream{
+		subscribers: make(map[*MSESubscriber]struct{}),
+	}
+}
+
+func (s *mseStream) subscribe() (*MSESubscriber, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ended {
+		return nil, errMSEClosed
+	}
+	subscriber := &MSESubscriber{
+		stream:   s,
+		mimeType: s.mimeType,
+		ch:       make(chan []byte, mseSubscriberBuffer),
+		// GOP 캐시가 없으면 다음 키프레임부터 보낸다.
+		started: len(s.gop) > 0,
+	}
+	subscriber.ch <- s.init
+	for _, fragment := range s.gop {
+		subscriber.ch <- fragment
+	}
+	s.subscribers[subscriber] = struct{}{}
+	return subscriber, nil
+}
+
+func (s *mseStream) unsubscribe(subscriber *MSESubscriber) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.subscribers[subscriber]; !ok {
+		return
+	}
+	delete(s.subscribers, subscriber)
+	close(subscriber.ch)
+}
+
+func (s *mseStream) subscriberCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.subscribers)
+}
+
+func (s *mseStream) SetInit(payload []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.init = payload
+}
+
+// AppendPart 는 비디오 프레임 하나의 moof/mdat fragment 를 받는다.
+func (s *mseStream) AppendPart(part hls.Part) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if part.Independent || len(s.gop) >= mseMaxGOPFragments {
+		s.gop = nil
+	}
+	// 키프레임 전의 fragment 는 새 구독자가 디코딩할 수 없으므로 보관하지 않는다.
+	if part.Independent || len(s.gop) > 0 {
+		s.gop = append(s.gop, part.Payload)
+	}
+
+	for subscriber := range s.subscribers {
+		if !subscriber.started {
+			if !part.Independent {
+				continue
+			}
+			subscriber.started = true
+		}
+		select {
+		case subscriber.ch <- part.Payload:
+		default:
+			log.Logger.Warn("mse subscriber is too slow, dropped")
+			delete(s.subscribers, subscriber)
+			close(subscriber.ch)
+		}
+	}
+}
+
+func (s *mseStream) End() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ended = true
+	for subscriber := range s.subscribers {
+		close(subscriber.ch)
+	}
+	s.subscribers = make(map[*MSESubscriber]struct{})
+	s.gop = nil
+}
+
+// MSESubscriber 는 WebSocket fMP4 를 재생하는 클라이언트 하나이다.
+type MSESubscriber struct {
+	stream   *mseStream
+	mimeType string
+	ch       chan []byte
+	// 키프레임부터 보내기 시작했는지. stream.mu 로 보호된다.
+	started bool
+}
+
+func (s *MSESubscriber) MimeType() string {
+	return s.mimeType
+}
+
+// Data 는 init 세그먼트와 fragment 를 하나씩 전달한다. 세션이 끝나거나 클라이언트가 너무 느려서 끊기면 닫힌다.
+func (s *MSESubscriber) Data() <-chan []byte {
+	return s.ch
+}
+
+func (s *MSESubscriber) Close() {
+	s.stream.unsubscribe(s)
+}
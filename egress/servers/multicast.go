@@ -0,0 +1,100 @@
+package servers
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/google/uuid"
+
+	"mediaserver-go/egress/sessions"
+	"mediaserver-go/egress/sessions/multicast"
+	"mediaserver-go/hubs"
+	"mediaserver-go/utils/dto"
+	"mediaserver-go/utils/types"
+)
+
+var (
+	errMulticastSessionNotFound = errors.New("multicast session not found")
+)
+
+type MulticastServer struct {
+	mu sync.Mutex
+
+	hub *hubs.Hub
+	// 한 스트림을 여러 곳에 보낼 수 있으므로 세션마다 ID 를 발급한다.
+	sessions map[string]context.CancelFunc
+}
+
+func NewMulticastServer(hub *hubs.Hub) (MulticastServer, error) {
+	return MulticastServer{
+		hub:      hub,
+		sessions: make(map[string]context.CancelFunc),
+	}, nil
+}
+
+func (s *MulticastServer) StartSession(streamID string, req dto.EgressMulticastRequest) (dto.EgressMulticastResponse, error) {
+	stream, ok := s.hub.GetOrPullStream(streamID)
+	if !ok {
+		return dto.EgressMulticastResponse{}, errors.New("stream not found")
+	}
+
+	mediaTypes := req.MediaTypes
+	if len(mediaTypes) == 0 {
+		mediaTypes = []types.MediaType{types.MediaTypeVideo, types.MediaTypeAudio}
+	}
+	filteredSources, err := filterMediaTypesInStream(stream, mediaTypes)
+	if err != nil {
+		return dto.EgressMulticastResponse{}, err
+	}
+
+	config := multicast.Config{
+		Addr:      req.Addr,
+		Port:      req.Port,
+		TTL:       req.TTL,
+		Interface: req.Interface,
+		Bitrate:   req.Bitrate * 1000,
+		RTP:       req.RTP,
+	}
+	if req.FEC != nil {
+		config.FEC = multicast.FECConfig{
+			Columns: req.FEC.Columns,
+			Rows:    req.FEC.Rows,
+		}
+	}
+	handler := multicast.NewHandler(config)
+	if err := handler.Init(context.Background(), filteredSources); err != nil {
+		return dto.EgressMulticastResponse{}, err
+	}
+
+	id := uuid.NewString()
+	ctx, cancel := context.WithCancel(context.Background())
+	s.mu.Lock()
+	s.sessions[id] = cancel
+	s.mu.Unlock()
+
+	sess := sessions.NewSession[*multicast.TrackContext](handler)
+	go func() {
+		defer cancel()
+		sess.Run(ctx)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.sessions, id)
+	}()
+
+	return dto.EgressMulticastResponse{
+		ID: id,
+	}, nil
+}
+
+func (s *MulticastServer) StopSession(id string) error {
+	s.mu.Lock()
+	cancel, ok := s.sessions[id]
+	s.mu.Unlock()
+	if !ok {
+		return errMulticastSessionNotFound
+	}
+	cancel()
+	return nil
+}
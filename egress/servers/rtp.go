@@ -20,7 +20,7 @@ func NewRTPServer(hub *hubs.Hub) (RTPServer, error) {
 }
 
 func (f *RTPServer) StartSession(streamID string, req dto.EgressRTPRequest) (dto.EgressRTPResponse, error) {
-	stream, ok := f.hub.GetStream(streamID)
+	stream, ok := f.hub.GetOrPullStream(streamID)
 	if !ok {
 		return dto.EgressRTPResponse{}, errors.New("stream not found")
 	}
@@ -30,7 +30,17 @@ func (f *RTPServer) StartSession(streamID string, req dto.EgressRTPRequest) (dto
 		return dto.EgressRTPResponse{}, err
 	}
 
-	handler := rtp.NewHandler(req.Addr, req.Port)
+	handler := rtp.NewHandler(rtp.Config{
+		Addr:             req.Addr,
+		Port:             req.Port,
+		VideoPort:        req.VideoPort,
+		AudioPort:        req.AudioPort,
+		RTCPMux:          req.RTCPMux,
+		VideoSSRC:        req.VideoSSRC,
+		AudioSSRC:        req.AudioSSRC,
+		VideoPayloadType: req.VideoPayloadType,
+		AudioPayloadType: req.AudioPayloadType,
+	})
 	if err := handler.Init(context.Background(), filteredSourceTracks); err != nil {
 		return dto.EgressRTPResponse{}, err
 	}
@@ -0,0 +1,98 @@
+package servers
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"mediaserver-go/egress/sessions"
+	"mediaserver-go/egress/sessions/srt"
+	"mediaserver-go/hubs"
+	"mediaserver-go/utils/dto"
+	"mediaserver-go/utils/types"
+)
+
+var (
+	errSRTSessionNotFound = errors.New("srt session not found")
+)
+
+type SRTServer struct {
+	mu sync.Mutex
+
+	hub *hubs.Hub
+	// 한 스트림을 여러 곳에 보낼 수 있으므로 세션마다 ID 를 발급한다.
+	sessions map[string]context.CancelFunc
+}
+
+func NewSRTServer(hub *hubs.Hub) (SRTServer, error) {
+	return SRTServer{
+		hub:      hub,
+		sessions: make(map[string]context.CancelFunc),
+	}, nil
+}
+
+func (s *SRTServer) StartSession(streamID string, req dto.EgressSRTRequest) (dto.EgressSRTResponse, error) {
+	stream, ok := s.hub.GetOrPullStream(streamID)
+	if !ok {
+		return dto.EgressSRTResponse{}, errors.New("stream not found")
+	}
+	mode, err := srt.ParseMode(req.Mode)
+	if err != nil {
+		return dto.EgressSRTResponse{}, err
+	}
+
+	mediaTypes := req.MediaTypes
+	if len(mediaTypes) == 0 {
+		mediaTypes = []types.MediaType{types.MediaTypeVideo, types.MediaTypeAudio}
+	}
+	filteredSources, err := filterMediaTypesInStream(stream, mediaTypes)
+	if err != nil {
+		return dto.EgressSRTResponse{}, err
+	}
+
+	handler := srt.NewHandler(srt.Config{
+		Mode:       mode,
+		Addr:       req.Addr,
+		Port:       req.Port,
+		Latency:    time.Duration(req.Latency) * time.Millisecond,
+		Passphrase: req.Passphrase,
+		StreamID:   req.StreamID,
+	})
+	if err := handler.Init(context.Background(), filteredSources); err != nil {
+		return dto.EgressSRTResponse{}, err
+	}
+
+	id := uuid.NewString()
+	ctx, cancel := context.WithCancel(context.Background())
+	s.mu.Lock()
+	s.sessions[id] = cancel
+	s.mu.Unlock()
+
+	sess := sessions.NewSession[*srt.TrackContext](handler)
+	go func() {
+		defer cancel()
+		sess.Run(ctx)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.sessions, id)
+	}()
+
+	return dto.EgressSRTResponse{
+		ID: id,
+	}, nil
+}
+
+func (s *SRTServer) StopSession(id string) error {
+	s.mu.Lock()
+	cancel, ok := s.sessions[id]
+	s.mu.Unlock()
+	if !ok {
+		return errSRTSessionNotFound
+	}
+	cancel()
+	return nil
+}
@@ -45,7 +45,7 @@ func NewWHEP(hub *hubs.Hub, se pion.SettingEngine) (WebRTCServer, error) {
 }
 
 func (f *WebRTCServer) StartSession(streamID string, req dto.WHEPRequest) (dto.WHEPResponse, error) {
-	stream, ok := f.hub.GetStream(streamID)
+	stream, ok := f.hub.GetOrPullStream(streamID)
 	if !ok {
 		return dto.WHEPResponse{}, errors.New("stream not found")
 	}
@@ -0,0 +1,189 @@
+package servers
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	pion "github.com/pion/webrtc/v3"
+	"go.uber.org/zap"
+
+	"mediaserver-go/egress/sessions"
+	"mediaserver-go/egress/sessions/whep"
+	"mediaserver-go/hubs"
+	"mediaserver-go/hubs/engines"
+	"mediaserver-go/utils/dto"
+	"mediaserver-go/utils/log"
+)
+
+const (
+	whipPublishTimeout      = 10 * time.Second
+	whipReconnectInterval   = 3 * time.Second
+	whipStreamCheckInterval = time.Second
+)
+
+var (
+	errWHIPSessionNotFound = errors.New("whip session not found")
+)
+
+// WHIPClientServer 는 hub 의 스트림을 원격 WHIP endpoint 로 보낸다. 트랙 처리는 WHEP 와 같다.
+type WHIPClientServer struct {
+	mu sync.Mutex
+
+	hub *hubs.Hub
+	se  pion.SettingEngine
+	me  *pion.MediaEngine
+	// 한 스트림을 여러 곳에 보낼 수 있으므로 세션마다 ID 를 발급한다.
+	sessions map[string]context.CancelFunc
+}
+
+func NewWHIPClientServer(hub *hubs.Hub, se pion.SettingEngine) (WHIPClientServer, error) {
+	me := &pion.MediaEngine{}
+	for mediaType, capabilities := range engines.GetWHEPRTPHeaderExtensionCapabilities() {
+		for _, capa := range capabilities {
+			if err := me.RegisterHeaderExtension(capa, mediaType); err != nil {
+				log.Logger.Error("failed to register header extension", zap.Error(err))
+			}
+		}
+	}
+
+	for mediaType, capabilities := range engines.GetWebRTCCapabilities(true) {
+		for _, capa := range capabilities {
+			if err := me.RegisterCodec(capa, mediaType); err != nil {
+				log.Logger.Error("failed to register codec", zap.Error(err))
+			}
+		}
+	}
+
+	// 원격 서버가 ICE lite 일 수 있으므로 offer 를 보내는 쪽은 full ICE 여야 한다. se 는 복사본이다.
+	se.SetLite(false)
+
+	return WHIPClientServer{
+		hub:      hub,
+		se:       se,
+		me:       me,
+		sessions: make(map[string]context.CancelFunc),
+	}, nil
+}
+
+// StartSession 은 첫 연결까지 기다려서 실패하면 에러를 반환한다. 이후 연결이 끊기면 스트림이 남아있는 동안 다시 연결한다.
+func (s *WHIPClientServer) StartSession(streamID string, req dto.EgressWHIPRequest) (dto.EgressWHIPResponse, error) {
+	if req.URL == "" {
+		return dto.EgressWHIPResponse{}, errors.New("url is required")
+	}
+	stream, ok := s.hub.GetOrPullStream(streamID)
+	if !ok {
+		return dto.EgressWHIPResponse{}, errors.New("stream not found")
+	}
+
+	handler, handlerCtx, err := s.publish(context.Background(), req)
+	if err != nil {
+		return dto.EgressWHIPResponse{}, err
+	}
+
+	id := uuid.NewString()
+	ctx, cancel := context.WithCancel(context.Background())
+	s.mu.Lock()
+	s.sessions[id] = cancel
+	s.mu.Unlock()
+
+	go func() {
+		defer cancel()
+		s.run(ctx, streamID, stream, handler, handlerCtx, req)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.sessions, id)
+		log.Logger.Info("whip egress stopped", zap.String("id", id), zap.String("streamID", streamID))
+	}()
+
+	return dto.EgressWHIPResponse{
+		ID: id,
+	}, nil
+}
+
+func (s *WHIPClientServer) StopSession(id string) error {
+	s.mu.Lock()
+	cancel, ok := s.sessions[id]
+	s.mu.Unlock()
+	if !ok {
+		return errWHIPSessionNotFound
+	}
+	cancel()
+	return nil
+}
+
+func (s *WHIPClientServer) publish(ctx context.Context, req dto.EgressWHIPRequest) (*whep.Handler, context.Context, error) {
+	ctx, cancel := context.WithTimeout(ctx, whipPublishTimeout)
+	defer cancel()
+
+	handler, handlerCtx := whep.NewHandler(s.se, s.me)
+	if err := handler.Publish(ctx, req.URL, req.Token); err != nil {
+		handler.OnClosed(ctx)
+		return nil, nil, err
+	}
+	return handler, handlerCtx, nil
+}
+
+// run 은 연결이 끊길 때마다 다시 연결한다. 같은 ID 로 다시 발행된 스트림이 있으면 그 스트림을 보내고, 없으면 끝낸다.
+func (s *WHIPClientServer) run(ctx context.Context, streamID string, stream *hubs.Stream, handler *whep.Handler, handlerCtx context.Context, req dto.EgressWHIPRequest) {
+	for {
+		s.forward(ctx, streamID, stream, handler, handlerCtx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(whipReconnectInterval):
+			}
+			current, ok := s.hub.GetStream(streamID)
+			if !ok {
+				return
+			}
+			stream = current
+
+			var err error
+			handler, handlerCtx, err = s.publish(ctx, req)
+			if err == nil {
+				log.Logger.Info("whip egress reconnected", zap.String("streamID", streamID), zap.String("url", req.URL))
+				break
+			}
+			log.Logger.Warn("whip egress reconnect failed", zap.String("streamID", streamID), zap.String("url", req.URL), zap.Error(err))
+		}
+	}
+}
+
+// forward 는 연결이 끊기거나, 세션이 멈추거나, 스트림이 hub 에서 빠질 때까지 트랙을 보낸다.
+// Session2 가 끝나면서 OnClosed 로 원격 세션에 DELETE 를 보낸다.
+func (s *WHIPClientServer) forward(ctx context.Context, streamID string, stream *hubs.Stream, handler *whep.Handler, handlerCtx context.Context) {
+	runCtx, cancel := context.WithCancel(handlerCtx)
+	defer cancel()
+	stop := context.AfterFunc(ctx, cancel)
+	defer stop()
+
+	go func() {
+		ticker := time.NewTicker(whipStreamCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-runCtx.Done():
+				return
+			case <-ticker.C:
+				if current, ok := s.hub.GetStream(streamID); !ok || current != stream {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	sess := sessions.NewSession2[*whep.TrackContext](handler, stream)
+	if err := sess.Run(runCtx); err != nil {
+		log.Logger.Warn("whip egress session error", zap.String("streamID", streamID), zap.Error(err))
+	}
+}
@@ -6,42 +6,57 @@ import (
 	"fmt"
 	"mediaserver-go/parsers/bitstreams"
 	"os"
+	"path/filepath"
 	"slices"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"go.uber.org/zap"
 
 	"mediaserver-go/codecs"
 	"mediaserver-go/hubs"
+	"mediaserver-go/hubs/filters"
 	"mediaserver-go/hubs/writers"
 	"mediaserver-go/thirdparty/ffmpeg/avcodec"
-	"mediaserver-go/thirdparty/ffmpeg/avformat"
 	"mediaserver-go/thirdparty/ffmpeg/avutil"
 	"mediaserver-go/utils/log"
 	"mediaserver-go/utils/types"
 	"mediaserver-go/utils/units"
 )
 
-const (
-	bufferSize = 1024 * 128
+var (
+	errSegmentClosed = errors.New("no open segment")
 )
 
+type Config struct {
+	// 세그먼트 파일은 <Path>_00000.<확장자>, 매니페스트는 <Path>.json 으로 저장된다.
+	Path    string
+	Overlay filters.Overlay
+	// mp4, webm, mkv. 비어있으면 코덱에 따라 정한다.
+	Format string
+	// 둘 중 하나라도 넘으면 다음 키프레임에서 새 세그먼트로 넘어간다. 0 이면 사용하지 않는다.
+	SegmentDuration time.Duration
+	SegmentSize     int64
+}
+
 type Handler struct {
 	mu sync.RWMutex
 
-	path       string
+	config     Config
 	extension  string
+	hasVideo   bool
 	audioStart atomic.Bool // TODO only audio record
 
 	negotiated []hubs.Track
 
-	outputFormatCtx *avformat.FormatContext
+	segment  *segment
+	manifest Manifest
 }
 
-func NewHandler(path string) *Handler {
+func NewHandler(config Config) *Handler {
 	return &Handler{
-		path: path,
+		config: config,
 	}
 }
 
@@ -65,88 +80,75 @@ func (h *Handler) Init(ctx context.Context, sources []*hubs.HubSource) error {
 				return fmt.Errorf("audio codec not ready: %w", err)
 			}
 		}
+		if source.MediaType() == types.MediaTypeVideo && !h.config.Overlay.Empty() {
+			track, err := source.GetOverlayTrack(h.config.Overlay)
+			if err != nil {
+				return fmt.Errorf("overlay track not ready: %w", err)
+			}
+			// 오버레이 트랙은 H264 로 다시 인코딩된다.
+			overlayCodec, ok := track.GetCodec().(codecs.VideoCodec)
+			if !ok {
+				return errors.New("invalid overlay codec")
+			}
+			videoCodec = overlayCodec
+			negotiated = append(negotiated, track)
+			continue
+		}
 		codec, _ := source.Codec()
 		track := source.GetTrack(codec)
 		negotiated = append(negotiated, track)
 	}
-	extension, err := codecs.GetExtension(videoCodec, audioCodec)
-	if err != nil {
-		return err
-	}
-
-	outputFormatCtx := avformat.NewAvFormatContextNull()
-	if ret := avformat.AvformatAllocOutputContext2(&outputFormatCtx, nil, "", fmt.Sprintf("output.%s", extension)); ret < 0 {
-		return errors.New("avformat context allocation failed")
-	}
-
-	for _, sourceTrack := range negotiated {
-		sourceCodec := sourceTrack.GetCodec()
-		outputStream := outputFormatCtx.AvformatNewStream(nil)
-		if outputStream == nil {
-			return errors.New("avformat stream allocation failed")
-		}
-		avCodec := avcodec.AvcodecFindEncoder(sourceCodec.AVCodecID())
-		if avCodec == nil {
-			return errors.New("encoder not found")
-		}
-		avCodecCtx := avCodec.AvCodecAllocContext3()
-		if avCodecCtx == nil {
-			return errors.New("codec context allocation failed")
-		}
-		sourceCodec.SetCodecContext(avCodecCtx, nil)
-		if ret := avCodecCtx.AvCodecOpen2(avCodec, nil); ret < 0 {
-			return errors.New("codec open failed")
-		}
-		if ret := avcodec.AvCodecParametersFromContext(outputStream.CodecParameters(), avCodecCtx); ret < 0 {
-			return errors.New("codec parameters from context failed")
+	extension := h.config.Format
+	if extension == "" {
+		if extension, err = codecs.GetExtension(videoCodec, audioCodec); err != nil {
+			return err
 		}
 	}
+	if err := os.MkdirAll(filepath.Dir(h.config.Path), 0755); err != nil {
+		return fmt.Errorf("error creating directory: %w", err)
+	}
 
-	outputFormatCtx.SetPb(avformat.AVIOOpenDynBuf())
-
-	if extension == "mp4" {
-		dict := avutil.DictionaryNull()
-		avutil.AvDictSet(&dict, "movflags", "frag_keyframe+empty_moov+default_base_moof", 0)
-		if ret := outputFormatCtx.AvformatWriteHeader(&dict); ret < 0 {
-			return errors.New("avformat write header failed")
-		}
-	} else {
-		if ret := outputFormatCtx.AvformatWriteHeader(nil); ret < 0 {
-			return errors.New("avformat write header failed")
-		}
+	segment, err := newSegment(h.config.Path, 0, extension, negotiated, 0)
+	if err != nil {
+		return err
 	}
 
-	h.outputFormatCtx = outputFormatCtx
+	h.segment = segment
 	h.extension = extension
+	h.hasVideo = videoCodec != nil
 	h.negotiated = negotiated
+	h.manifest = Manifest{
+		Extension: extension,
+		StartTime: segment.startTime,
+	}
+	h.manifest.open(segment)
+	if err := h.manifest.write(h.config.Path); err != nil {
+		log.Logger.Warn("manifest write failed", zap.Error(err))
+	}
 	return nil
 }
 
 func (h *Handler) OnClosed(ctx context.Context) error {
 	log.Logger.Info("file session finish start")
 
-	h.outputFormatCtx.AvWriteTrailer()
-	buf := avformat.AVIOCloseDynBuf(h.outputFormatCtx.Pb())
-	h.outputFormatCtx.AvformatFreeContext()
+	h.mu.Lock()
+	defer h.mu.Unlock()
 
-	filepath := fmt.Sprintf("%s.%s", h.path, h.extension)
-	file, err := os.OpenFile(filepath, os.O_CREATE|os.O_RDWR, 0666)
-	if err != nil {
-		return fmt.Errorf("error opening file: %w", err)
-	}
-	n, err := file.Write(buf)
-	if err != nil {
-		return fmt.Errorf("error copying to file: %w", err)
+	err := h.closeSegment()
+	now := time.Now()
+	h.manifest.EndTime = &now
+	if err := h.manifest.write(h.config.Path); err != nil {
+		log.Logger.Warn("manifest write failed", zap.Error(err))
 	}
 	log.Logger.Info("file session is finished",
-		zap.String("filepath", filepath),
-		zap.Int("size", int(n)))
-	return nil
+		zap.String("path", h.config.Path),
+		zap.Int("segments", len(h.manifest.Segments)))
+	return err
 }
 
 func (h *Handler) OnTrack(ctx context.Context, track hubs.Track) (*TrackContext, error) {
 	index := slices.Index(h.negotiated, track)
-	outputStream := h.outputFormatCtx.Streams()[index]
+	outputStream := h.segment.stream(index)
 
 	codec := track.GetCodec()
 	var bitstream bitstreams.Bitstream
@@ -155,9 +157,9 @@ func (h *Handler) OnTrack(ctx context.Context, track hubs.Track) (*TrackContext,
 		bitstream = &bitstreams.AVCC{}
 	}
 	return &TrackContext{
-		codec:        codec,
-		outputStream: outputStream,
-		writer:       writers.NewWriter(index, outputStream.TimeBase().Den(), track.GetCodec(), codec.Decoder(), bitstream),
+		index:  index,
+		codec:  codec,
+		writer: writers.NewWriter(index, outputStream.TimeBase().Den(), track.GetCodec(), codec.Decoder(), bitstream),
 	}, nil
 }
 
@@ -168,19 +170,22 @@ func (h *Handler) OnVideo(ctx context.Context, trackCtx *TrackContext, u units.U
 		return nil
 	}
 	pkt := writer.WriteVideoPkt(unit)
+	defer pkt.AvPacketUnref()
 
 	h.audioStart.Store(true)
 	h.mu.Lock()
-	_ = h.outputFormatCtx.AvInterleavedWriteFrame(pkt)
-	h.mu.Unlock()
-
-	pkt.AvPacketUnref()
+	defer h.mu.Unlock()
 
-	return nil
+	if unit.FrameInfo.Flag == 1 {
+		if err := h.rotateIfNeeded(pkt); err != nil {
+			return err
+		}
+	}
+	return h.write(pkt)
 }
 
 func (h *Handler) OnAudio(ctx context.Context, trackCtx *TrackContext, unit units.Unit) error {
-	if !h.audioStart.Load() {
+	if h.hasVideo && !h.audioStart.Load() {
 		return nil
 	}
 	writer := trackCtx.writer
@@ -188,9 +193,69 @@ func (h *Handler) OnAudio(ctx context.Context, trackCtx *TrackContext, unit unit
 	if pkt == nil {
 		return nil
 	}
+	defer pkt.AvPacketUnref()
+
 	h.mu.Lock()
-	_ = h.outputFormatCtx.AvInterleavedWriteFrame(pkt)
-	h.mu.Unlock()
-	pkt.AvPacketUnref()
+	defer h.mu.Unlock()
+
+	// 비디오가 없으면 오디오 패킷마다 나눌 수 있다.
+	if !h.hasVideo {
+		if err := h.rotateIfNeeded(pkt); err != nil {
+			return err
+		}
+	}
+	return h.write(pkt)
+}
+
+func (h *Handler) write(pkt *avcodec.Packet) error {
+	// 다음 세그먼트를 열지 못했으면 녹화를 이어갈 수 없으므로 세션을 끝낸다.
+	if h.segment == nil {
+		return errSegmentClosed
+	}
+	if err := h.segment.write(pkt); err != nil {
+		log.Logger.Warn("segment write failed", zap.String("path", h.segment.filepath), zap.Error(err))
+	}
+	return nil
+}
+
+// rotateIfNeeded 는 현재 세그먼트가 설정한 길이나 크기를 넘었으면 pkt 부터 새 세그먼트에 쓰도록 한다.
+func (h *Handler) rotateIfNeeded(pkt *avcodec.Packet) error {
+	current := h.segment
+	if current == nil {
+		return nil
+	}
+	overDuration := h.config.SegmentDuration > 0 && time.Duration(current.duration)*time.Microsecond >= h.config.SegmentDuration
+	overSize := h.config.SegmentSize > 0 && current.size >= h.config.SegmentSize
+	if !overDuration && !overSize {
+		return nil
+	}
+
+	timeBase := current.stream(pkt.StreamIndex()).TimeBase()
+	baseTime := avutil.AvRescaleQ(pkt.PTS(), timeBase, avutil.NewRational(1, 1_000_000))
+	if err := h.closeSegment(); err != nil {
+		log.Logger.Warn("segment close failed", zap.Error(err))
+	}
+
+	next, err := newSegment(h.config.Path, current.index+1, h.extension, h.negotiated, baseTime)
+	if err != nil {
+		// 에러를 반환하면 세션이 끝나고 OnClosed 에서 매니페스트가 마무리된다.
+		return fmt.Errorf("failed to open next segment: %w", err)
+	}
+	h.segment = next
+	h.manifest.open(next)
+	if err := h.manifest.write(h.config.Path); err != nil {
+		log.Logger.Warn("manifest write failed", zap.Error(err))
+	}
+	log.Logger.Info("file segment rotated", zap.String("filepath", next.filepath))
 	return nil
 }
+
+func (h *Handler) closeSegment() error {
+	if h.segment == nil {
+		return nil
+	}
+	err := h.segment.close()
+	h.manifest.update(h.segment, true)
+	h.segment = nil
+	return err
+}
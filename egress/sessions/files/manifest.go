@@ -0,0 +1,67 @@
+package files
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type ManifestSegment struct {
+	Index     int        `json:"index"`
+	Path      string     `json:"path"`
+	StartTime time.Time  `json:"startTime"`
+	EndTime   *time.Time `json:"endTime,omitempty"`
+	Duration  float64    `json:"duration"` // seconds
+	Size      int64      `json:"size"`
+	Complete  bool       `json:"complete"`
+}
+
+// Manifest 는 녹화 세션이 만든 세그먼트 목록이다. 세그먼트가 열리고 닫힐 때마다 <path>.json 으로 갱신된다.
+type Manifest struct {
+	Extension string            `json:"extension"`
+	StartTime time.Time         `json:"startTime"`
+	EndTime   *time.Time        `json:"endTime,omitempty"`
+	Segments  []ManifestSegment `json:"segments"`
+}
+
+func manifestPath(path string) string {
+	return fmt.Sprintf("%s.json", path)
+}
+
+func (m *Manifest) open(s *segment) {
+	m.Segments = append(m.Segments, ManifestSegment{
+		Index:     s.index,
+		Path:      filepath.Base(s.filepath),
+		StartTime: s.startTime,
+	})
+}
+
+func (m *Manifest) update(s *segment, complete bool) {
+	for i := range m.Segments {
+		if m.Segments[i].Index != s.index {
+			continue
+		}
+		m.Segments[i].Duration = float64(s.duration) / 1_000_000
+		m.Segments[i].Size = s.size
+		if complete {
+			now := time.Now()
+			m.Segments[i].EndTime = &now
+			m.Segments[i].Complete = true
+		}
+	}
+}
+
+// write 는 읽는 쪽에서 쓰다 만 파일을 보지 않도록 임시 파일에 쓴 후 rename 한다.
+func (m *Manifest) write(path string) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := manifestPath(path) + ".tmp"
+	if err := os.WriteFile(tmp, b, 0666); err != nil {
+		return fmt.Errorf("error writing manifest: %w", err)
+	}
+	return os.Rename(tmp, manifestPath(path))
+}
@@ -0,0 +1,179 @@
+package files
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"mediaserver-go/hubs"
+	"mediaserver-go/thirdparty/ffmpeg/avcodec"
+	"mediaserver-go/thirdparty/ffmpeg/avformat"
+	"mediaserver-go/thirdparty/ffmpeg/avutil"
+)
+
+const (
+	// flushInterval 마다 버퍼에 쌓인 데이터를 파일에 쓰고 fsync 한다.
+	flushInterval = time.Second
+)
+
+// segment 는 하나의 녹화 파일이다. 헤더부터 독립적으로 재생할 수 있도록 파일마다 새로운 FormatContext 를 사용한다.
+// mp4 는 fragmented mp4 로 쓰기 때문에 비정상 종료되어도 마지막 flush 까지는 재생할 수 있다.
+// muxer 가 파일에 직접 쓰므로 trailer 에서 헤더로 seek 해서 고치는 muxer(WebM 의 크기, duration, Cues 등)도 그대로 동작한다.
+type segment struct {
+	index    int
+	filepath string
+	// fsync 와 크기 확인에만 쓴다. 쓰기는 muxer 의 AVIOContext 가 같은 파일에 한다.
+	file      *os.File
+	startTime time.Time
+
+	outputFormatCtx *avformat.FormatContext
+
+	// 세그먼트의 시작 시점(세션 기준, microseconds). 패킷의 timestamp 는 이 값을 빼서 0 부터 시작하게 한다.
+	baseTime int64
+	duration int64 // microseconds
+	size     int64
+
+	lastFlush time.Time
+}
+
+func segmentPath(path string, index int, extension string) string {
+	return fmt.Sprintf("%s_%05d.%s", path, index, extension)
+}
+
+func newSegment(path string, index int, extension string, tracks []hubs.Track, baseTime int64) (*segment, error) {
+	outputFormatCtx := avformat.NewAvFormatContextNull()
+	if ret := avformat.AvformatAllocOutputContext2(&outputFormatCtx, nil, "", fmt.Sprintf("output.%s", extension)); ret < 0 {
+		return nil, errors.New("avformat context allocation failed")
+	}
+
+	for _, track := range tracks {
+		sourceCodec := track.GetCodec()
+		outputStream := outputFormatCtx.AvformatNewStream(nil)
+		if outputStream == nil {
+			outputFormatCtx.AvformatFreeContext()
+			return nil, errors.New("avformat stream allocation failed")
+		}
+		avCodec := avcodec.AvcodecFindEncoder(sourceCodec.AVCodecID())
+		if avCodec == nil {
+			outputFormatCtx.AvformatFreeContext()
+			return nil, errors.New("encoder not found")
+		}
+		avCodecCtx := avCodec.AvCodecAllocContext3()
+		if avCodecCtx == nil {
+			outputFormatCtx.AvformatFreeContext()
+			return nil, errors.New("codec context allocation failed")
+		}
+		sourceCodec.SetCodecContext(avCodecCtx, nil)
+		ret := avCodecCtx.AvCodecOpen2(avCodec, nil)
+		if ret >= 0 {
+			ret = avcodec.AvCodecParametersFromContext(outputStream.CodecParameters(), avCodecCtx)
+		}
+		avcodec.AvCodecFreeContext(&avCodecCtx)
+		if ret < 0 {
+			outputFormatCtx.AvformatFreeContext()
+			return nil, errors.New("codec parameters from context failed")
+		}
+	}
+
+	filepath := segmentPath(path, index, extension)
+	if ret := avformat.AvIOOpen(outputFormatCtx.Pb2(), filepath, avformat.AVIO_FLAG_WRITE); ret < 0 {
+		outputFormatCtx.AvformatFreeContext()
+		return nil, fmt.Errorf("error opening file: %s", avutil.AvErr2str(ret))
+	}
+	file, err := os.OpenFile(filepath, os.O_WRONLY, 0666)
+	if err != nil {
+		avformat.AVIOCloseP(outputFormatCtx.Pb2())
+		outputFormatCtx.AvformatFreeContext()
+		return nil, fmt.Errorf("error opening file: %w", err)
+	}
+
+	var ret int
+	if extension == "mp4" {
+		dict := avutil.DictionaryNull()
+		avutil.AvDictSet(&dict, "movflags", "frag_keyframe+empty_moov+default_base_moof", 0)
+		ret = outputFormatCtx.AvformatWriteHeader(&dict)
+	} else {
+		ret = outputFormatCtx.AvformatWriteHeader(nil)
+	}
+	if ret < 0 {
+		avformat.AVIOCloseP(outputFormatCtx.Pb2())
+		outputFormatCtx.AvformatFreeContext()
+		file.Close()
+		return nil, errors.New("avformat write header failed")
+	}
+
+	s := &segment{
+		index:           index,
+		filepath:        filepath,
+		file:            file,
+		startTime:       time.Now(),
+		outputFormatCtx: outputFormatCtx,
+		baseTime:        baseTime,
+	}
+	if err := s.flush(); err != nil {
+		s.close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *segment) stream(index int) *avformat.Stream {
+	return s.outputFormatCtx.Streams()[index]
+}
+
+// write 는 세션 기준 timestamp 를 가진 pkt 를 세그먼트 기준으로 바꿔서 쓴다. 세그먼트 시작 이전의 패킷은 버린다.
+func (s *segment) write(pkt *avcodec.Packet) error {
+	timeBase := s.stream(pkt.StreamIndex()).TimeBase()
+	base := avutil.AvRescaleQ(s.baseTime, avutil.NewRational(1, 1_000_000), timeBase)
+	pts, dts := pkt.PTS()-base, pkt.DTS()-base
+	if pts < 0 || dts < 0 {
+		return nil
+	}
+	pkt.SetPTS(pts)
+	pkt.SetDTS(dts)
+
+	end := avutil.AvRescaleQ(pts+pkt.Duration(), timeBase, avutil.NewRational(1, 1_000_000))
+	if end > s.duration {
+		s.duration = end
+	}
+	if ret := s.outputFormatCtx.AvInterleavedWriteFrame(pkt); ret < 0 {
+		return fmt.Errorf("write frame failed: %s", avutil.AvErr2str(ret))
+	}
+
+	if time.Since(s.lastFlush) >= flushInterval {
+		return s.flush()
+	}
+	return nil
+}
+
+// flush 는 버퍼에 쌓인 데이터를 파일에 쓰고 fsync 한다.
+func (s *segment) flush() error {
+	s.lastFlush = time.Now()
+	if ret := avformat.AvIOFlush(s.outputFormatCtx.Pb()); ret < 0 {
+		return fmt.Errorf("error writing file: %s", avutil.AvErr2str(ret))
+	}
+	if err := s.file.Sync(); err != nil {
+		return fmt.Errorf("error syncing file: %w", err)
+	}
+	info, err := s.file.Stat()
+	if err != nil {
+		return fmt.Errorf("error checking file: %w", err)
+	}
+	s.size = info.Size()
+	return nil
+}
+
+func (s *segment) close() error {
+	var err error
+	if s.outputFormatCtx.Pb() != nil {
+		s.outputFormatCtx.AvWriteTrailer()
+		err = s.flush()
+		avformat.AVIOCloseP(s.outputFormatCtx.Pb2())
+	}
+	s.outputFormatCtx.AvformatFreeContext()
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,17 @@
+package flv
+
+import (
+	"mediaserver-go/codecs"
+)
+
+type TrackContext struct {
+	codec codecs.Codec
+
+	// 현재 모으고 있는 액세스 유닛. AVCC(4바이트 길이 + NAL) 형식이다.
+	au       []byte
+	pending  bool
+	dts      int64
+	pts      int64
+	timeBase int
+	keyFrame bool
+}
@@ -0,0 +1,394 @@
+package flv
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/bluenviron/mediacommon/pkg/codecs/h264"
+	"github.com/bluenviron/mediacommon/pkg/codecs/mpeg4audio"
+	goflv "github.com/yutopp/go-flv"
+	flvtag "github.com/yutopp/go-flv/tag"
+
+	"mediaserver-go/codecs"
+	"mediaserver-go/codecs/aac"
+	"mediaserver-go/hubs"
+	"mediaserver-go/thirdparty/ffmpeg/avutil"
+	"mediaserver-go/utils/log"
+	"mediaserver-go/utils/types"
+	"mediaserver-go/utils/units"
+)
+
+const (
+	// 구독자에게 보내지 못하고 쌓인 태그가 이 개수를 넘으면 느린 클라이언트로 보고 끊는다.
+	subscriberBuffer = 1024
+	// 키프레임 간격이 너무 길 때 GOP 캐시가 계속 커지지 않도록 제한한다.
+	maxGOPTags = 4096
+)
+
+var (
+	errClosed = errors.New("flv session closed")
+)
+
+// cachedTag 는 PreviousTagSize 까지 인코딩된 FLV 태그이다.
+type cachedTag struct {
+	timestamp uint32
+	keyFrame  bool
+	payload   []byte
+}
+
+// Handler 는 스트림을 FLV 태그로 만들어 구독자(HTTP-FLV, WebSocket-FLV)에게 나눠준다.
+// 마지막 키프레임부터의 태그(GOP 캐시)를 보관하여 새 구독자가 바로 재생을 시작할 수 있게 한다.
+type Handler struct {
+	mu sync.Mutex
+
+	negotiated []hubs.Track
+
+	hasVideo bool
+	// AVCDecoderConfigurationRecord
+	videoHeader []byte
+	// AudioSpecificConfig
+	audioHeader []byte
+
+	// 첫 유닛의 시간을 0 으로 하는 밀리초 타임스탬프를 사용한다.
+	baseSet       bool
+	base          int64
+	lastTimestamp uint32
+
+	gop         []cachedTag
+	subscribers map[*Subscriber]struct{}
+	closed      bool
+}
+
+func NewHandler() *Handler {
+	return &Handler{
+		subscribers: make(map[*Subscriber]struct{}),
+	}
+}
+
+func (h *Handler) NegotiatedTracks() []hubs.Track {
+	ret := make([]hubs.Track, 0, len(h.negotiated))
+	return append(ret, h.negotiated...)
+}
+
+func (h *Handler) Init(ctx context.Context, sources []*hubs.HubSource) error {
+	var negotiated []hubs.Track
+	for _, source := range sources {
+		switch source.MediaType() {
+		case types.MediaTypeVideo:
+			videoCodec, err := source.VideoCodec()
+			if err != nil {
+				return fmt.Errorf("video codec not ready: %w", err)
+			}
+			if videoCodec.CodecType() != types.CodecTypeH264 {
+				return errors.New("unsupported video codec for flv")
+			}
+			track := source.GetTrack(videoCodec)
+			if track == nil {
+				return fmt.Errorf("track not ready: %s", videoCodec.String())
+			}
+			h.hasVideo = true
+			h.videoHeader = videoCodec.ExtraData()
+			negotiated = append(negotiated, track)
+		case types.MediaTypeAudio:
+			audioCodec, err := source.AudioCodec()
+			if err != nil {
+				return fmt.Errorf("audio codec not ready: %w", err)
+			}
+			var codec codecs.Codec = audioCodec
+			if audioCodec.CodecType() != types.CodecTypeAAC {
+				// FLV 는 AAC 만 사용하므로 Opus 등은 AAC 로 트랜스코딩한다.
+				codec = aac.NewAAC(aac.NewConfig(aac.Parameters{
+					SampleRate:   audioCodec.SampleRate(),
+					Channels:     audioCodec.Channels(),
+					SampleFormat: int(avutil.AV_SAMPLE_FMT_FLTP),
+				}))
+			}
+			track := source.GetTrack(codec)
+			if track == nil {
+				return fmt.Errorf("track not ready: %s", codec.String())
+			}
+			asc, err := mpeg4audio.AudioSpecificConfig{
+				Type:         mpeg4audio.ObjectTypeAACLC,
+				SampleRate:   audioCodec.SampleRate(),
+				ChannelCount: audioCodec.Channels(),
+			}.Marshal()
+			if err != nil {
+				return err
+			}
+			h.audioHeader = asc
+			negotiated = append(negotiated, track)
+		}
+	}
+	if len(negotiated) == 0 {
+		return errors.New("no source tracks found")
+	}
+	h.negotiated = negotiated
+	return nil
+}
+
+// Subscribe 는 FLV 헤더, 시퀀스 헤더, GOP 캐시부터 시작하는 구독자를 만든다.
+func (h *Handler) Subscribe() (*Subscriber, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return nil, errClosed
+	}
+
+	timestamp := h.lastTimestamp
+	if len(h.gop) > 0 {
+		timestamp = h.gop[0].timestamp
+	}
+	var buf bytes.Buffer
+	if err := h.writeHeader(&buf, timestamp); err != nil {
+		return nil, err
+	}
+	for _, tag := range h.gop {
+		buf.Write(tag.payload)
+	}
+
+	s := &Subscriber{
+		handler: h,
+		ch:      make(chan []byte, subscriberBuffer),
+		// GOP 캐시가 없으면 다음 키프레임부터 비디오를 보낸다.
+		started: !h.hasVideo || len(h.gop) > 0,
+	}
+	s.ch <- buf.Bytes()
+	h.subscribers[s] = struct{}{}
+	return s, nil
+}
+
+// Subscribers 는 현재 구독자 수를 반환한다.
+func (h *Handler) Subscribers() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subscribers)
+}
+
+func (h *Handler) unsubscribe(s *Subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.subscribers[s]; !ok {
+		return
+	}
+	delete(h.subscribers, s)
+	close(s.ch)
+}
+
+// writeHeader 는 FLV 헤더와 시퀀스 헤더 태그를 쓴다. h.mu 를 잡고 호출해야 한다.
+func (h *Handler) writeHeader(buf *bytes.Buffer, timestamp uint32) error {
+	var flags goflv.Flags
+	if h.hasVideo {
+		flags |= goflv.FlagsVideo
+	}
+	if h.audioHeader != nil {
+		flags |= goflv.FlagsAudio
+	}
+	if err := goflv.EncodeFlvHeader(buf, &goflv.Header{
+		Version:    1,
+		Flags:      flags,
+		DataOffset: goflv.HeaderLength,
+	}); err != nil {
+		return err
+	}
+	// PreviousTagSize0
+	buf.Write(make([]byte, 4))
+
+	if h.hasVideo {
+		b, err := encodeTag(videoTag(timestamp, flvtag.FrameTypeKeyFrame, flvtag.AVCPacketTypeSequenceHeader, 0, h.videoHeader))
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+	}
+	if h.audioHeader != nil {
+		b, err := encodeTag(audioTag(timestamp, flvtag.AACPacketTypeSequenceHeader, h.audioHeader))
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+	}
+	return nil
+}
+
+func (h *Handler) OnClosed(ctx context.Context) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for s := range h.subscribers {
+		close(s.ch)
+	}
+	h.subscribers = make(map[*Subscriber]struct{})
+	h.gop = nil
+	return nil
+}
+
+func (h *Handler) OnTrack(ctx context.Context, track hubs.Track) (*TrackContext, error) {
+	return &TrackContext{
+		codec: track.GetCodec(),
+	}, nil
+}
+
+func (h *Handler) OnVideo(ctx context.Context, trackCtx *TrackContext, unit units.Unit) error {
+	if len(unit.Payload) == 0 {
+		return nil
+	}
+	// RTMP 인입은 NAL 마다 Marker 가 있으므로 Marker 대신 DTS 가 바뀔 때 이전 액세스 유닛을 내보낸다.
+	if trackCtx.pending && unit.DTS != trackCtx.dts {
+		if err := h.writeVideo(trackCtx); err != nil {
+			return err
+		}
+	}
+
+	switch h264.NALUType(unit.Payload[0] & 0x1f) {
+	case h264.NALUTypeSPS, h264.NALUTypePPS, h264.NALUTypeAccessUnitDelimiter:
+		// SPS, PPS 는 시퀀스 헤더로 전달된다.
+		return nil
+	case h264.NALUTypeIDR:
+		trackCtx.keyFrame = true
+	}
+	if !trackCtx.pending {
+		trackCtx.pending = true
+		trackCtx.dts = unit.DTS
+		trackCtx.pts = unit.PTS
+		trackCtx.timeBase = unit.TimeBase
+	}
+	trackCtx.au = binary.BigEndian.AppendUint32(trackCtx.au, uint32(len(unit.Payload)))
+	trackCtx.au = append(trackCtx.au, unit.Payload...)
+	return nil
+}
+
+func (h *Handler) writeVideo(trackCtx *TrackContext) error {
+	defer func() {
+		trackCtx.au = trackCtx.au[:0]
+		trackCtx.pending = false
+		trackCtx.keyFrame = false
+	}()
+
+	frameType := flvtag.FrameTypeInterFrame
+	if trackCtx.keyFrame {
+		frameType = flvtag.FrameTypeKeyFrame
+	}
+	compositionTime := int32(toMillis(trackCtx.pts-trackCtx.dts, trackCtx.timeBase))
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	timestamp := h.timestamp(toMillis(trackCtx.dts, trackCtx.timeBase))
+	payload, err := encodeTag(videoTag(timestamp, frameType, flvtag.AVCPacketTypeNALU, compositionTime, trackCtx.au))
+	if err != nil {
+		return err
+	}
+	h.broadcast(cachedTag{timestamp: timestamp, keyFrame: trackCtx.keyFrame, payload: payload}, true)
+	return nil
+}
+
+func (h *Handler) OnAudio(ctx context.Context, trackCtx *TrackContext, unit units.Unit) error {
+	if len(unit.Payload) == 0 {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	timestamp := h.timestamp(toMillis(unit.DTS, unit.TimeBase))
+	payload, err := encodeTag(audioTag(timestamp, flvtag.AACPacketTypeRaw, unit.Payload))
+	if err != nil {
+		return err
+	}
+	h.broadcast(cachedTag{timestamp: timestamp, payload: payload}, false)
+	return nil
+}
+
+// timestamp 는 첫 유닛부터의 밀리초를 반환한다. h.mu 를 잡고 호출해야 한다.
+func (h *Handler) timestamp(ms int64) uint32 {
+	if !h.baseSet {
+		h.base = ms
+		h.baseSet = true
+	}
+	h.lastTimestamp = uint32(max(ms-h.base, 0))
+	return h.lastTimestamp
+}
+
+// broadcast 는 태그를 GOP 캐시에 넣고 구독자에게 보낸다. 버퍼가 가득 찬 구독자는 끊는다. h.mu 를 잡고 호출해야 한다.
+func (h *Handler) broadcast(tag cachedTag, video bool) {
+	if h.hasVideo {
+		if tag.keyFrame {
+			h.gop = nil
+		}
+		// 키프레임 전의 태그는 새 구독자가 디코딩할 수 없으므로 보관하지 않는다.
+		if len(h.gop) >= maxGOPTags {
+			h.gop = nil
+		} else if tag.keyFrame || len(h.gop) > 0 {
+			h.gop = append(h.gop, tag)
+		}
+	}
+
+	for s := range h.subscribers {
+		if !s.started {
+			if !video || !tag.keyFrame {
+				continue
+			}
+			s.started = true
+		}
+		select {
+		case s.ch <- tag.payload:
+		default:
+			log.Logger.Warn("flv subscriber is too slow, dropped")
+			delete(h.subscribers, s)
+			close(s.ch)
+		}
+	}
+}
+
+func videoTag(timestamp uint32, frameType flvtag.FrameType, packetType flvtag.AVCPacketType, compositionTime int32, data []byte) *flvtag.FlvTag {
+	return &flvtag.FlvTag{
+		TagType:   flvtag.TagTypeVideo,
+		Timestamp: timestamp,
+		Data: &flvtag.VideoData{
+			FrameType:       frameType,
+			CodecID:         flvtag.CodecIDAVC,
+			AVCPacketType:   packetType,
+			CompositionTime: compositionTime,
+			Data:            bytes.NewReader(data),
+		},
+	}
+}
+
+// audioTag 는 AAC 태그를 만든다. AAC 는 SoundRate, SoundSize, SoundType 을 항상 44kHz, 16bit, stereo 로 쓴다.
+func audioTag(timestamp uint32, packetType flvtag.AACPacketType, data []byte) *flvtag.FlvTag {
+	return &flvtag.FlvTag{
+		TagType:   flvtag.TagTypeAudio,
+		Timestamp: timestamp,
+		Data: &flvtag.AudioData{
+			SoundFormat:   flvtag.SoundFormatAAC,
+			SoundRate:     flvtag.SoundRate44kHz,
+			SoundSize:     flvtag.SoundSize16Bit,
+			SoundType:     flvtag.SoundTypeStereo,
+			AACPacketType: packetType,
+			Data:          bytes.NewReader(data),
+		},
+	}
+}
+
+// encodeTag 는 태그 뒤에 PreviousTagSize 를 붙여서 인코딩한다.
+func encodeTag(tag *flvtag.FlvTag) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := flvtag.EncodeFlvTag(&buf, tag); err != nil {
+		return nil, err
+	}
+	return binary.BigEndian.AppendUint32(buf.Bytes(), uint32(buf.Len())), nil
+}
+
+func toMillis(v int64, timeBase int) int64 {
+	if timeBase <= 0 || timeBase == 1000 {
+		return v
+	}
+	return v * 1000 / int64(timeBase)
+}
@@ -0,0 +1,18 @@
+package flv
+
+// Subscriber 는 FLV 를 재생하는 클라이언트 하나이다.
+type Subscriber struct {
+	handler *Handler
+	ch      chan []byte
+	// 키프레임부터 보내기 시작했는지. handler.mu 로 보호된다.
+	started bool
+}
+
+// Data 는 FLV 바이트 스트림을 전달한다. 세션이 끝나거나 클라이언트가 너무 느려서 끊기면 닫힌다.
+func (s *Subscriber) Data() <-chan []byte {
+	return s.ch
+}
+
+func (s *Subscriber) Close() {
+	s.handler.unsubscribe(s)
+}
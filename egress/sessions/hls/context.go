@@ -4,7 +4,6 @@ import (
 	"mediaserver-go/hubs"
 	"mediaserver-go/hubs/writers"
 	"mediaserver-go/thirdparty/ffmpeg/avformat"
-	"time"
 )
 
 type OnTrackContext struct {
@@ -13,6 +12,4 @@ type OnTrackContext struct {
 	writer       *writers.Writer
 	count        int
 	setup        bool
-	prevTime     time.Time
-	prevPTS      int64
 }
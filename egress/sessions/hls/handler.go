@@ -8,12 +8,15 @@ import (
 	"mediaserver-go/parsers/bitstreams"
 	"mediaserver-go/thirdparty/ffmpeg/avutil"
 	"slices"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"mediaserver-go/codecs"
+	"mediaserver-go/codecs/aac"
 	"mediaserver-go/hubs"
+	"mediaserver-go/hubs/filters"
 	"mediaserver-go/hubs/writers"
 	"mediaserver-go/thirdparty/ffmpeg/avcodec"
 	"mediaserver-go/thirdparty/ffmpeg/avformat"
@@ -22,26 +25,114 @@ import (
 	"mediaserver-go/utils/units"
 )
 
+const (
+	DefaultPartTarget    = 500 * time.Millisecond
+	DefaultSegmentTarget = 2 * time.Second
+)
+
+type Container string
+
+const (
+	// ContainerFMP4 은 fMP4 세그먼트와 LL-HLS 파트를 만든다.
+	ContainerFMP4 Container = "fmp4"
+	// ContainerTS 는 fMP4 를 재생하지 못하는 오래된 단말을 위한 MPEG-TS 세그먼트(H264/AAC)를 만든다. 파트는 만들지 않는다.
+	ContainerTS Container = "ts"
+)
+
+// ParseContainer 는 fmp4(mp4), ts 를 허용한다. 비어있으면 fmp4 이다.
+func ParseContainer(s string) (Container, error) {
+	switch strings.ToLower(s) {
+	case "", "fmp4", "mp4":
+		return ContainerFMP4, nil
+	case "ts", "mpegts":
+		return ContainerTS, nil
+	default:
+		return "", fmt.Errorf("unsupported hls container: %s", s)
+	}
+}
+
+func (c Container) Extension() string {
+	if c == ContainerTS {
+		return "ts"
+	}
+	return "m4s"
+}
+
+// LowLatency 는 LL-HLS 파트를 만드는지 여부이다.
+func (c Container) LowLatency() bool {
+	return c != ContainerTS
+}
+
+// Part 는 LL-HLS 의 파트(fMP4 fragment) 하나이다. 세그먼트는 파트를 이어붙인 것이다.
+type Part struct {
+	Payload  []byte
+	Duration time.Duration
+	// 키프레임으로 시작하는 파트이다. (EXT-X-PART INDEPENDENT=YES)
+	Independent bool
+	// 이 파트로 세그먼트가 끝난다.
+	Last bool
+	// 파트가 속한 세그먼트의 시작 시각 (EXT-X-PROGRAM-DATE-TIME)
+	SegmentTime time.Time
+}
+
 type Endpoint interface {
-	SetPayload(payload []byte, name string)
-	AppendMedia(payload []byte, index int, duration float64)
+	// SetInit 은 fMP4 init 세그먼트를 전달한다. 세션마다(재발행마다) 한 번 호출된다.
+	SetInit(payload []byte)
+	AppendPart(part Part)
+	// End 는 세션이 끝나면(스트림이 닫히면) 호출된다.
+	End()
+}
+
+type Config struct {
+	Overlay   filters.Overlay
+	Container Container
+	// 파트의 목표 길이. 파트는 이 길이를 넘지 않는다.
+	PartTarget time.Duration
+	// 세그먼트의 목표 길이. 이 길이를 넘은 후 처음 오는 키프레임(IDR)에서 새 세그먼트가 시작된다.
+	SegmentTarget time.Duration
 }
 
 type Handler struct {
 	mu sync.RWMutex
 
 	endpoint Endpoint
+	config   Config
 
 	audioStart      atomic.Bool
 	extension       string
 	negotiated      []hubs.Track
 	outputFormatCtx *avformat.FormatContext
-	index           int
+
+	// 아래 시간은 비디오 DTS 기준이다.
+	started         bool
+	startDTS        time.Duration
+	startTime       time.Time
+	lastDTS         time.Duration
+	frameDuration   time.Duration
+	partStart       time.Duration
+	partIndependent bool
+	segmentStart    time.Duration
+	segmentTime     time.Time
+}
+
+// WithDefaults 는 비어있는 값을 기본값으로 채운다.
+func (c Config) WithDefaults() Config {
+	if c.Container == "" {
+		c.Container = ContainerFMP4
+	}
+	if c.PartTarget <= 0 {
+		c.PartTarget = DefaultPartTarget
+	}
+	if c.SegmentTarget < c.PartTarget {
+		c.SegmentTarget = max(DefaultSegmentTarget, c.PartTarget)
+	}
+	return c
 }
 
-func NewHandler(endpoint Endpoint) *Handler {
+func NewHandler(endpoint Endpoint, config Config) *Handler {
 	return &Handler{
 		endpoint: endpoint,
+		config:   config.WithDefaults(),
 	}
 }
 
@@ -76,22 +167,59 @@ func (h *Handler) Init(ctx context.Context, sources []*hubs.HubSource) error {
 				return fmt.Errorf("audio codec not ready: %w", err)
 			}
 		}
+		if source.MediaType() == types.MediaTypeVideo && !h.config.Overlay.Empty() {
+			track, err := source.GetOverlayTrack(h.config.Overlay)
+			if err != nil {
+				return fmt.Errorf("overlay track not ready: %w", err)
+			}
+			// 오버레이 트랙은 H264 로 다시 인코딩된다.
+			overlayCodec, ok := track.GetCodec().(codecs.VideoCodec)
+			if !ok {
+				return errors.New("invalid overlay codec")
+			}
+			videoCodec = overlayCodec
+			negotiated = append(negotiated, track)
+			continue
+		}
 		codec, _ := source.Codec()
+		if h.config.Container == ContainerTS && source.MediaType() == types.MediaTypeAudio && codec.CodecType() != types.CodecTypeAAC {
+			// MPEG-TS 는 AAC 만 사용하므로 Opus 등은 AAC 로 트랜스코딩한다.
+			codec = aac.NewAAC(aac.NewConfig(aac.Parameters{
+				SampleRate:   audioCodec.SampleRate(),
+				Channels:     audioCodec.Channels(),
+				SampleFormat: int(avutil.AV_SAMPLE_FMT_FLTP),
+			}))
+		}
 		track := source.GetTrack(codec)
+		if track == nil {
+			return fmt.Errorf("track not ready: %s", codec.String())
+		}
 		negotiated = append(negotiated, track)
 	}
 
-	if videoCodec.CodecType() != types.CodecTypeH264 && videoCodec.CodecType() != types.CodecTypeAV1 {
-		return errors.New("unsupported video codec")
+	if videoCodec == nil {
+		return errors.New("video source not found")
 	}
-
-	if audioCodec.CodecType() != types.CodecTypeAAC && audioCodec.CodecType() != types.CodecTypeOpus {
-		return errors.New("unsupported audio codec")
+	if h.config.Container == ContainerTS {
+		if videoCodec.CodecType() != types.CodecTypeH264 {
+			return errors.New("unsupported video codec for mpegts")
+		}
+	} else {
+		if videoCodec.CodecType() != types.CodecTypeH264 && videoCodec.CodecType() != types.CodecTypeAV1 {
+			return errors.New("unsupported video codec")
+		}
+		if audioCodec != nil && audioCodec.CodecType() != types.CodecTypeAAC && audioCodec.CodecType() != types.CodecTypeOpus {
+			return errors.New("unsupported audio codec")
+		}
 	}
 
-	extension := "m4s"
+	extension := h.config.Container.Extension()
 	outputFormatCtx := avformat.NewAvFormatContextNull()
-	if ret := avformat.AvformatAllocOutputContext2(&outputFormatCtx, nil, "", fmt.Sprintf("output.mp4")); ret < 0 {
+	filename := "output.mp4"
+	if h.config.Container == ContainerTS {
+		filename = "output.ts"
+	}
+	if ret := avformat.AvformatAllocOutputContext2(&outputFormatCtx, nil, "", filename); ret < 0 {
 		return errors.New("avformat context allocation failed")
 	}
 	h.outputFormatCtx = outputFormatCtx
@@ -120,29 +248,29 @@ func (h *Handler) Init(ctx context.Context, sources []*hubs.HubSource) error {
 		if sourceCodec.MediaType() == types.MediaTypeVideo {
 			outputStream.SetTimeBase(1, 15360)
 		}
-		fmt.Println("[TESTDEBUG] outputStream.CodecID:", outputStream.CodecParameters().CodecID())
-		fmt.Println("[TESTDEBUG] outputStream.CodecType:", outputStream.CodecParameters().CodecType())
-		fmt.Println("[TESTDEBUG] outputStream.Width:", outputStream.CodecParameters().Width())
-		fmt.Println("[TESTDEBUG] outputStream.Height:", outputStream.CodecParameters().Height())
-		fmt.Println("[TESTDEBUG] outputStream.TimeBase:", outputStream.TimeBase())
-		fmt.Println("[TESTDEBUG] outputStream.Level:", outputStream.CodecParameters().Level())
-		fmt.Println("[TESTDEBUG] outputStream.CodecParameters().ExtraData:", outputStream.CodecParameters().ExtraData())
-
 	}
 
 	h.outputFormatCtx.SetPb(avformat.AVIOOpenDynBuf())
 
-	dict := avutil.DictionaryNull()
-	avutil.AvDictSet(&dict, "movflags", "frag_keyframe+empty_moov+default_base_moof", 0)
+	if h.config.Container == ContainerTS {
+		// MPEG-TS 는 init 세그먼트가 없다. PAT/PMT 는 키프레임마다 다시 쓰이므로 각 세그먼트를 따로 재생할 수 있다.
+		if ret := outputFormatCtx.AvformatWriteHeader(nil); ret < 0 {
+			return errors.New("avformat write header failed")
+		}
+	} else {
+		dict := avutil.DictionaryNull()
+		// 파트를 키프레임이 아닌 곳에서도 자르기 위해 fragment 는 직접 flush 한다.
+		avutil.AvDictSet(&dict, "movflags", "frag_custom+empty_moov+default_base_moof", 0)
 
-	if ret := outputFormatCtx.AvformatWriteHeader(&dict); ret < 0 {
-		return errors.New("avformat write header failed")
-	}
+		if ret := outputFormatCtx.AvformatWriteHeader(&dict); ret < 0 {
+			return errors.New("avformat write header failed")
+		}
 
-	buf := avformat.AVIOCloseDynBuf(h.outputFormatCtx.Pb())
-	h.endpoint.SetPayload(buf, "init.mp4")
+		buf := avformat.AVIOCloseDynBuf(h.outputFormatCtx.Pb())
+		h.endpoint.SetInit(buf)
 
-	h.outputFormatCtx.SetPb(avformat.AVIOOpenDynBuf())
+		h.outputFormatCtx.SetPb(avformat.AVIOOpenDynBuf())
+	}
 
 	h.extension = extension
 	h.negotiated = negotiated
@@ -151,8 +279,20 @@ func (h *Handler) Init(ctx context.Context, sources []*hubs.HubSource) error {
 
 func (h *Handler) OnClosed(ctx context.Context) error {
 	log.Logger.Info("hls Handler finish start")
-
-	// TODO 남아있는 것 모두 정리.
+	h.mu.Lock()
+	if h.started {
+		h.flushPart(h.lastDTS+h.frameDuration, true)
+	}
+	if h.outputFormatCtx != nil {
+		if h.outputFormatCtx.Pb() != nil {
+			avformat.AVIOCloseDynBuf(h.outputFormatCtx.Pb())
+			h.outputFormatCtx.SetPb(nil)
+		}
+		h.outputFormatCtx.AvformatFreeContext()
+		h.outputFormatCtx = nil
+	}
+	h.mu.Unlock()
+	h.endpoint.End()
 	return nil
 }
 
@@ -184,38 +324,69 @@ func (h *Handler) OnVideo(ctx context.Context, trackCtx *OnTrackContext, u units
 	}
 
 	pkt := writer.WriteVideoPkt(unit)
+	defer pkt.AvPacketUnref()
+	keyFrame := unit.FrameInfo.Flag == 1
+	dts := time.Duration(avutil.AvRescaleQ(pkt.DTS(), trackCtx.outputStream.TimeBase(), avutil.NewRational(1, 1_000_000))) * time.Microsecond
 
 	h.audioStart.Store(true)
 
 	h.mu.Lock()
-	now := time.Now()
-	if trackCtx.prevTime.IsZero() {
-		trackCtx.prevTime = now
-	}
-	if now.Sub(trackCtx.prevTime) >= 1*time.Second {
-		trackCtx.prevTime = now
-
-		buf := avformat.AVIOCloseDynBuf(h.outputFormatCtx.Pb())
-
-		diff := pkt.PTS() - trackCtx.prevPTS
-		trackCtx.prevPTS = pkt.PTS()
-		fDuration := float64(diff) / float64(trackCtx.outputStream.TimeBase().Den())
-		h.endpoint.AppendMedia(buf, h.index, fDuration)
-		h.index++
-
-		avioCtx := avformat.AVIOOpenDynBuf()
-		h.outputFormatCtx.SetPb(avioCtx)
+	defer h.mu.Unlock()
+
+	if !h.started {
+		// BitStreamSummary 는 키프레임부터 시작하므로 첫 세그먼트도 IDR 로 시작한다.
+		h.started = true
+		h.startDTS = dts
+		h.startTime = time.Now()
+		h.partStart, h.segmentStart = dts, dts
+		h.partIndependent = true
+		h.segmentTime = h.startTime
+	} else if dts > h.lastDTS {
+		h.frameDuration = dts - h.lastDTS
+		// 세그먼트는 목표 길이를 넘은 후 첫 키프레임에서, 파트는 이 프레임을 넣으면 목표 길이를 넘을 때 자른다.
+		segmentEnd := keyFrame && dts-h.segmentStart >= h.config.SegmentTarget
+		partEnd := h.config.Container.LowLatency() && dts-h.partStart+h.frameDuration > h.config.PartTarget
+		if segmentEnd || partEnd {
+			h.flushPart(dts, segmentEnd)
+			h.partIndependent = keyFrame
+		}
 	}
+	h.lastDTS = dts
 
 	if h.outputFormatCtx.Pb() != nil {
 		_ = h.outputFormatCtx.AvInterleavedWriteFrame(pkt)
 	}
-
-	h.mu.Unlock()
-	pkt.AvPacketUnref()
 	return nil
 }
 
+// flushPart 는 end 까지 쓴 패킷을 하나의 파트로 내보낸다. last 이면 세그먼트도 끝난다. h.mu 를 잡고 호출해야 한다.
+func (h *Handler) flushPart(end time.Duration, last bool) {
+	if h.outputFormatCtx.Pb() == nil || end <= h.partStart {
+		return
+	}
+	// 인터리빙 큐에 남은 패킷을 쓰고 frag_custom 의 fragment 를 끝낸다.
+	_ = h.outputFormatCtx.AvInterleavedWriteFrame(nil)
+	_ = h.outputFormatCtx.AvWriteFrame(nil)
+	buf := avformat.AVIOCloseDynBuf(h.outputFormatCtx.Pb())
+	h.outputFormatCtx.SetPb(avformat.AVIOOpenDynBuf())
+
+	if len(buf) > 0 {
+		h.endpoint.AppendPart(Part{
+			Payload:     buf,
+			Duration:    end - h.partStart,
+			Independent: h.partIndependent,
+			Last:        last,
+			SegmentTime: h.segmentTime,
+		})
+	}
+	h.partStart = end
+	if last {
+		h.segmentStart = end
+		// wall clock 이 아닌 미디어 시간으로 계산해야 세그먼트 길이와 어긋나지 않는다.
+		h.segmentTime = h.startTime.Add(end - h.startDTS)
+	}
+}
+
 func (h *Handler) OnAudio(ctx context.Context, trackCtx *OnTrackContext, unit units.Unit) error {
 	if !h.audioStart.Load() {
 		return nil
@@ -1,4 +1,15 @@
 package images
 
+import (
+	"mediaserver-go/codecs"
+	"mediaserver-go/utils/units"
+)
+
 type TrackContext struct {
+	codec   codecs.Codec
+	decoder codecs.Decoder
+
+	// 현재 모으고 있는 액세스 유닛
+	au       []units.Unit
+	keyFrame bool
 }
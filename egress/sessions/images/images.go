@@ -1,22 +1,47 @@
 package images
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"mediaserver-go/codecs"
 	"mediaserver-go/hubs"
+	"mediaserver-go/hubs/transcoders"
+	"mediaserver-go/thirdparty/ffmpeg/avutil"
+	"mediaserver-go/utils/types"
 	"mediaserver-go/utils/units"
-	"sync"
 )
 
+var (
+	errNoKeyFrame = errors.New("no key frame")
+	errClosed     = errors.New("image session closed")
+)
+
+type Options struct {
+	Format transcoders.ImageFormat
+	Width  int
+	Height int
+}
+
+// Handler 는 비디오 트랙의 가장 최근 키프레임(액세스 유닛)을 보관하고, 요청이 오면 그 키프레임만 디코딩하여 이미지로 만든다.
 type Handler struct {
 	mu sync.RWMutex
 
-	encoding   string
 	negotiated []hubs.Track
+
+	codec    codecs.Codec
+	keyFrame []units.Unit
+	ready    chan struct{}
+	closed   chan struct{}
 }
 
-func NewHandler(encoding string) *Handler {
+func NewHandler() *Handler {
 	return &Handler{
-		encoding: encoding,
+		ready:  make(chan struct{}),
+		closed: make(chan struct{}),
 	}
 }
 
@@ -28,29 +53,127 @@ func (h *Handler) NegotiatedTracks() []hubs.Track {
 func (h *Handler) Init(ctx context.Context, sources []*hubs.HubSource) error {
 	var negotiated []hubs.Track
 	for _, source := range sources {
+		if source.MediaType() != types.MediaTypeVideo {
+			continue
+		}
 		codec, err := source.Codec()
 		if err != nil {
 			return err
 		}
 		negotiated = append(negotiated, source.GetTrack(codec))
+		break
+	}
+	if len(negotiated) == 0 {
+		return errors.New("no video track")
 	}
 	h.negotiated = negotiated
 	return nil
 }
 
+// Done 은 세션이 종료되면 닫힌다.
+func (h *Handler) Done() <-chan struct{} {
+	return h.closed
+}
+
 func (h *Handler) OnClosed(ctx context.Context) error {
+	close(h.closed)
 	return nil
 }
 
 func (h *Handler) OnTrack(ctx context.Context, track hubs.Track) (*TrackContext, error) {
-	return nil, nil
+	codec := track.GetCodec()
+	return &TrackContext{
+		codec:   codec,
+		decoder: codec.Decoder(),
+	}, nil
 }
 
 func (h *Handler) OnVideo(ctx context.Context, trackCtx *TrackContext, unit units.Unit) error {
+	if len(unit.Payload) == 0 {
+		return nil
+	}
+	if trackCtx.decoder.KeyFrame(unit.Payload) {
+		trackCtx.keyFrame = true
+	}
+	// 키프레임이 아닌 액세스 유닛은 보관할 필요가 없다.
+	if trackCtx.keyFrame {
+		unit.Payload = bytes.Clone(unit.Payload)
+		trackCtx.au = append(trackCtx.au, unit)
+	} else if len(trackCtx.au) < 8 {
+		// SPS, PPS 등 키프레임 앞에 오는 유닛을 위해 일부만 유지한다.
+		unit.Payload = bytes.Clone(unit.Payload)
+		trackCtx.au = append(trackCtx.au, unit)
+	}
+	if !unit.Marker {
+		return nil
+	}
 
+	if trackCtx.keyFrame {
+		h.mu.Lock()
+		h.codec = trackCtx.codec
+		h.keyFrame = trackCtx.au
+		if h.ready != nil {
+			close(h.ready)
+			h.ready = nil
+		}
+		h.mu.Unlock()
+	}
+	trackCtx.au = nil
+	trackCtx.keyFrame = false
 	return nil
 }
 
 func (h *Handler) OnAudio(ctx context.Context, trackCtx *TrackContext, unit units.Unit) error {
 	return nil
 }
+
+// lastKeyFrame 은 키프레임이 올 때까지 기다린 후 가장 최근 키프레임을 반환한다.
+func (h *Handler) lastKeyFrame(ctx context.Context) (codecs.Codec, []units.Unit, error) {
+	h.mu.RLock()
+	ready := h.ready
+	h.mu.RUnlock()
+
+	if ready != nil {
+		select {
+		case <-ready:
+		case <-h.closed:
+			return nil, nil, errClosed
+		case <-ctx.Done():
+			return nil, nil, fmt.Errorf("%v: %w", ctx.Err(), errNoKeyFrame)
+		}
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.codec, h.keyFrame, nil
+}
+
+// Snapshot 은 가장 최근 키프레임을 디코딩하여 options 의 포맷, 크기로 인코딩한다.
+func (h *Handler) Snapshot(ctx context.Context, options Options) ([]byte, error) {
+	codec, keyFrame, err := h.lastKeyFrame(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder, err := transcoders.NewVideoDecoder(codec)
+	if err != nil {
+		return nil, err
+	}
+	defer decoder.Close()
+
+	var frames []*avutil.Frame
+	for _, unit := range keyFrame {
+		frames = append(frames, decoder.Decode(unit)...)
+	}
+	// 디코더에 남아있는 프레임을 꺼낸다.
+	frames = append(frames, decoder.Flush()...)
+	defer func() {
+		for _, frame := range frames {
+			frame.AvFrameFree()
+		}
+	}()
+	if len(frames) == 0 {
+		return nil, fmt.Errorf("key frame not decoded: %w", errNoKeyFrame)
+	}
+	return transcoders.EncodeImage(frames[0], options.Format, options.Width, options.Height)
+}
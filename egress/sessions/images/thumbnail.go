@@ -0,0 +1,48 @@
+package images
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+
+	"mediaserver-go/utils/log"
+)
+
+// RunThumbnail 은 interval 마다 스냅샷을 만들어 path.<확장자> 로 저장한다. ctx 가 끝나거나 세션이 종료되면 반환한다.
+// 읽는 쪽에서 쓰다 만 파일을 보지 않도록 임시 파일에 쓴 후 rename 한다.
+func RunThumbnail(ctx context.Context, handler *Handler, path string, interval time.Duration, options Options) {
+	filepath := fmt.Sprintf("%s.%s", path, options.Format.Extension())
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := writeThumbnail(ctx, handler, filepath, options); err != nil {
+			log.Logger.Warn("thumbnail failed", zap.String("path", filepath), zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-handler.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func writeThumbnail(ctx context.Context, handler *Handler, filepath string, options Options) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	b, err := handler.Snapshot(ctx, options)
+	if err != nil {
+		return err
+	}
+	tmp := filepath + ".tmp"
+	if err := os.WriteFile(tmp, b, 0666); err != nil {
+		return fmt.Errorf("error writing file: %w", err)
+	}
+	return os.Rename(tmp, filepath)
+}
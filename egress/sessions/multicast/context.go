@@ -0,0 +1,13 @@
+package multicast
+
+import (
+	"mediaserver-go/hubs"
+	"mediaserver-go/hubs/writers"
+	"mediaserver-go/thirdparty/ffmpeg/avformat"
+)
+
+type TrackContext struct {
+	track        hubs.Track
+	outputStream *avformat.Stream
+	writer       *writers.Writer
+}
@@ -0,0 +1,145 @@
+package multicast
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/pion/rtp"
+)
+
+const (
+	fecPayloadType = 96
+	fecHeaderSize  = 16
+)
+
+// FECConfig 는 SMPTE 2022-1 FEC 행렬 크기이다. Columns(L) 개의 미디어 패킷이 한 행, Rows(D) 개의 행이 한 행렬이다.
+// 열 FEC 는 Port+2, 행 FEC 는 Port+4 로 보낸다.
+type FECConfig struct {
+	Columns int
+	Rows    int
+}
+
+func (c FECConfig) enabled() bool {
+	return c.Columns > 0 || c.Rows > 0
+}
+
+// validate 는 SMPTE 2022-1 의 제한(L 1~20, D 4~20, L*D <= 100)을 확인한다.
+func (c FECConfig) validate() error {
+	if c.Columns < 1 || c.Columns > 20 || c.Rows < 4 || c.Rows > 20 || c.Columns*c.Rows > 100 {
+		return fmt.Errorf("invalid fec matrix: columns=%d rows=%d", c.Columns, c.Rows)
+	}
+	return nil
+}
+
+// fecPacket 은 보호하는 미디어 패킷들의 XOR 이다.
+type fecPacket struct {
+	snBase         uint16
+	lengthRecovery uint16
+	ptRecovery     uint8
+	tsRecovery     uint32
+	payload        []byte
+	count          int
+}
+
+func (f *fecPacket) add(packet *rtp.Packet) {
+	if f.count == 0 {
+		f.snBase = packet.SequenceNumber
+	}
+	f.count++
+	f.lengthRecovery ^= uint16(len(packet.Payload))
+	f.ptRecovery ^= packet.PayloadType
+	f.tsRecovery ^= packet.Timestamp
+	if len(f.payload) < len(packet.Payload) {
+		f.payload = append(f.payload, make([]byte, len(packet.Payload)-len(f.payload))...)
+	}
+	for i, b := range packet.Payload {
+		f.payload[i] ^= b
+	}
+}
+
+// marshal 은 RTP 헤더와 SMPTE 2022-1 FEC 헤더를 붙인다. row 이면 D 비트를 켠다.
+func (f *fecPacket) marshal(sequenceNumber uint16, timestamp uint32, row bool, offset, na int) ([]byte, error) {
+	header := make([]byte, fecHeaderSize)
+	binary.BigEndian.PutUint16(header[0:], f.snBase)
+	binary.BigEndian.PutUint16(header[2:], f.lengthRecovery)
+	// E 비트는 항상 1 이고 mask 는 사용하지 않는다.
+	header[4] = 0x80 | (f.ptRecovery & 0x7f)
+	binary.BigEndian.PutUint32(header[8:], f.tsRecovery)
+	if row {
+		header[12] = 0x40
+	}
+	header[13] = uint8(offset)
+	header[14] = uint8(na)
+
+	packet := rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			PayloadType:    fecPayloadType,
+			SequenceNumber: sequenceNumber,
+			Timestamp:      timestamp,
+		},
+		Payload: append(header, f.payload...),
+	}
+	return packet.Marshal()
+}
+
+// fecEncoder 는 미디어 패킷으로 열, 행 FEC 패킷을 만든다.
+type fecEncoder struct {
+	config FECConfig
+
+	columns   []*fecPacket
+	row       *fecPacket
+	index     int
+	columnSeq uint16
+	rowSeq    uint16
+
+	// 열 FEC 는 행렬이 끝날 때 한꺼번에 만들어지므로, 다음 행렬 동안 미디어 패킷 하나마다 하나씩 보낸다.
+	pendingColumns [][]byte
+}
+
+func newFECEncoder(config FECConfig) *fecEncoder {
+	return &fecEncoder{
+		config:  config,
+		columns: make([]*fecPacket, config.Columns),
+		row:     &fecPacket{},
+	}
+}
+
+// push 는 미디어 패킷을 행렬에 넣고, 이번에 보낼 열, 행 FEC 패킷을 돌려준다.
+func (e *fecEncoder) push(packet *rtp.Packet) (column, row []byte) {
+	c := e.index % e.config.Columns
+	if e.columns[c] == nil {
+		e.columns[c] = &fecPacket{}
+	}
+	e.columns[c].add(packet)
+	e.row.add(packet)
+	e.index++
+
+	if len(e.pendingColumns) > 0 {
+		column = e.pendingColumns[0]
+		e.pendingColumns = e.pendingColumns[1:]
+	}
+
+	if e.row.count == e.config.Columns {
+		b, err := e.row.marshal(e.rowSeq, packet.Timestamp, true, 1, e.config.Columns)
+		if err == nil {
+			row = b
+			e.rowSeq++
+		}
+		e.row = &fecPacket{}
+	}
+
+	if e.index == e.config.Columns*e.config.Rows {
+		for i, f := range e.columns {
+			b, err := f.marshal(e.columnSeq, packet.Timestamp, false, e.config.Columns, e.config.Rows)
+			if err != nil {
+				continue
+			}
+			e.pendingColumns = append(e.pendingColumns, b)
+			e.columnSeq++
+			e.columns[i] = nil
+		}
+		e.index = 0
+	}
+	return column, row
+}
@@ -0,0 +1,316 @@
+package multicast
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+
+	"mediaserver-go/codecs"
+	"mediaserver-go/codecs/aac"
+	"mediaserver-go/hubs"
+	"mediaserver-go/hubs/writers"
+	"mediaserver-go/parsers/bitstreams"
+	"mediaserver-go/thirdparty/ffmpeg/avcodec"
+	"mediaserver-go/thirdparty/ffmpeg/avformat"
+	"mediaserver-go/thirdparty/ffmpeg/avutil"
+	"mediaserver-go/utils/log"
+	"mediaserver-go/utils/types"
+	"mediaserver-go/utils/units"
+)
+
+const (
+	DefaultTTL = 1
+)
+
+type Config struct {
+	// 멀티캐스트 그룹(또는 유니캐스트) IPv4 주소
+	Addr string
+	Port int
+	// 멀티캐스트 TTL. 0 이면 DefaultTTL 이다.
+	TTL int
+	// 멀티캐스트를 보낼 네트워크 인터페이스 이름(eth0, lo 등). 비어있으면 라우팅 테이블을 따른다.
+	Interface string
+	// bps. 0 보다 크면 null 패킷을 채워 CBR 로 mux 하고 이 비트레이트로 보낸다. 스트림의 최대 비트레이트보다 커야 한다.
+	Bitrate int
+	// RTP(RFC 2250) 로 감싸서 보낸다. FEC 는 RTP 일 때만 쓸 수 있다.
+	RTP bool
+	FEC FECConfig
+}
+
+func (c Config) validate() error {
+	if c.Port <= 0 || c.Port > 65535 {
+		return fmt.Errorf("invalid multicast port: %d", c.Port)
+	}
+	if c.TTL < 0 || c.TTL > 255 {
+		return fmt.Errorf("invalid multicast ttl: %d", c.TTL)
+	}
+	if c.Bitrate < 0 {
+		return fmt.Errorf("invalid multicast bitrate: %d", c.Bitrate)
+	}
+	if c.FEC.enabled() {
+		if !c.RTP {
+			return errors.New("fec requires rtp")
+		}
+		if err := c.FEC.validate(); err != nil {
+			return err
+		}
+		if c.Port+4 > 65535 {
+			return fmt.Errorf("invalid multicast port for fec: %d", c.Port)
+		}
+	}
+	return nil
+}
+
+// Handler 는 트랙을 MPEG-TS 로 묶어서 UDP(멀티캐스트)로 보낸다. 수신기는 아무때나 들어올 수 있으므로 비디오 프레임마다 PAT/PMT 를 쓴다.
+type Handler struct {
+	mu sync.Mutex
+
+	config     Config
+	hasVideo   bool
+	videoStart atomic.Bool
+
+	negotiated      []hubs.Track
+	outputFormatCtx *avformat.FormatContext
+	sender          *sender
+
+	// datagram 크기에 모자라서 다음 패킷과 함께 보낼 TS 데이터
+	residual []byte
+	lastDTS  int64
+	closed   bool
+}
+
+func NewHandler(config Config) *Handler {
+	return &Handler{
+		config: config,
+	}
+}
+
+func (h *Handler) NegotiatedTracks() []hubs.Track {
+	ret := make([]hubs.Track, 0, len(h.negotiated))
+	return append(ret, h.negotiated...)
+}
+
+func (h *Handler) Init(ctx context.Context, sources []*hubs.HubSource) error {
+	if err := h.config.validate(); err != nil {
+		return err
+	}
+
+	var negotiated []hubs.Track
+	for _, source := range sources {
+		codec, err := source.Codec()
+		if err != nil {
+			return fmt.Errorf("codec not ready: %w", err)
+		}
+		switch source.MediaType() {
+		case types.MediaTypeVideo:
+			if codec.CodecType() != types.CodecTypeH264 {
+				return errors.New("unsupported video codec for mpegts")
+			}
+			h.hasVideo = true
+		case types.MediaTypeAudio:
+			if codec.CodecType() != types.CodecTypeAAC {
+				// MPEG-TS 는 AAC 만 사용하므로 Opus 등은 AAC 로 트랜스코딩한다.
+				audioCodec, err := source.AudioCodec()
+				if err != nil {
+					return fmt.Errorf("audio codec not ready: %w", err)
+				}
+				codec = aac.NewAAC(aac.NewConfig(aac.Parameters{
+					SampleRate:   audioCodec.SampleRate(),
+					Channels:     audioCodec.Channels(),
+					SampleFormat: int(avutil.AV_SAMPLE_FMT_FLTP),
+				}))
+			}
+		default:
+			continue
+		}
+		track := source.GetTrack(codec)
+		if track == nil {
+			return fmt.Errorf("track not ready: %s", codec.String())
+		}
+		negotiated = append(negotiated, track)
+	}
+	if len(negotiated) == 0 {
+		return errors.New("no source tracks found")
+	}
+
+	outputFormatCtx := avformat.NewAvFormatContextNull()
+	if ret := avformat.AvformatAllocOutputContext2(&outputFormatCtx, nil, "", "output.ts"); ret < 0 {
+		return errors.New("avformat context allocation failed")
+	}
+	for _, track := range negotiated {
+		if err := newOutputStream(outputFormatCtx, track.GetCodec()); err != nil {
+			outputFormatCtx.AvformatFreeContext()
+			return err
+		}
+	}
+
+	outputFormatCtx.SetPb(avformat.AVIOOpenDynBuf())
+	dict := avutil.DictionaryNull()
+	avutil.AvDictSet(&dict, "mpegts_flags", "+pat_pmt_at_frames", 0)
+	if h.config.Bitrate > 0 {
+		// muxrate 를 정하면 mpegts muxer 가 null 패킷을 채워 CBR 로 만들고 PCR 도 그에 맞춘다.
+		avutil.AvDictSet(&dict, "muxrate", strconv.Itoa(h.config.Bitrate), 0)
+	}
+	if ret := outputFormatCtx.AvformatWriteHeader(&dict); ret < 0 {
+		avformat.AVIOCloseDynBuf(outputFormatCtx.Pb())
+		outputFormatCtx.AvformatFreeContext()
+		return errors.New("avformat write header failed")
+	}
+	// 헤더(PAT/PMT)는 패킷마다 다시 쓰이므로 버린다.
+	avformat.AVIOCloseDynBuf(outputFormatCtx.Pb())
+	outputFormatCtx.SetPb(avformat.AVIOOpenDynBuf())
+
+	sender, err := newSender(h.config)
+	if err != nil {
+		avformat.AVIOCloseDynBuf(outputFormatCtx.Pb())
+		outputFormatCtx.AvformatFreeContext()
+		return err
+	}
+
+	h.outputFormatCtx = outputFormatCtx
+	h.sender = sender
+	h.negotiated = negotiated
+	return nil
+}
+
+func newOutputStream(outputFormatCtx *avformat.FormatContext, codec codecs.Codec) error {
+	outputStream := outputFormatCtx.AvformatNewStream(nil)
+	if outputStream == nil {
+		return errors.New("avformat stream allocation failed")
+	}
+	avCodec := avcodec.AvcodecFindEncoder(codec.AVCodecID())
+	if avCodec == nil {
+		return errors.New("encoder not found")
+	}
+	avCodecCtx := avCodec.AvCodecAllocContext3()
+	if avCodecCtx == nil {
+		return errors.New("codec context allocation failed")
+	}
+	defer avcodec.AvCodecFreeContext(&avCodecCtx)
+
+	codec.SetCodecContext(avCodecCtx, nil)
+	if ret := avCodecCtx.AvCodecOpen2(avCodec, nil); ret < 0 {
+		return errors.New("codec open failed")
+	}
+	if ret := avcodec.AvCodecParametersFromContext(outputStream.CodecParameters(), avCodecCtx); ret < 0 {
+		return errors.New("codec parameters from context failed")
+	}
+	return nil
+}
+
+func (h *Handler) OnClosed(ctx context.Context) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return nil
+	}
+	h.closed = true
+	if h.sender != nil {
+		if len(h.residual) > 0 {
+			h.sender.push(batch{chunks: [][]byte{h.residual}, dts: h.lastDTS})
+			h.residual = nil
+		}
+		close(h.sender.ch)
+	}
+	if h.outputFormatCtx != nil {
+		avformat.AVIOCloseDynBuf(h.outputFormatCtx.Pb())
+		h.outputFormatCtx.SetPb(nil)
+		h.outputFormatCtx.AvformatFreeContext()
+		h.outputFormatCtx = nil
+	}
+	return nil
+}
+
+func (h *Handler) OnTrack(ctx context.Context, track hubs.Track) (*TrackContext, error) {
+	index := slices.Index(h.negotiated, track)
+	stream := h.outputFormatCtx.Streams()[index]
+
+	codec := track.GetCodec()
+	var bitstream bitstreams.Bitstream
+	bitstream = &bitstreams.Empty{}
+	if codec.CodecType() == types.CodecTypeH264 {
+		bitstream = &bitstreams.AVCC{}
+	}
+	return &TrackContext{
+		track:        track,
+		outputStream: stream,
+		writer:       writers.NewWriter(index, stream.TimeBase().Den(), codec, codec.Decoder(), bitstream),
+	}, nil
+}
+
+func (h *Handler) OnVideo(ctx context.Context, trackCtx *TrackContext, u units.Unit) error {
+	writer := trackCtx.writer
+	unit, ok := writer.BitStreamSummary(u)
+	if !ok {
+		return nil
+	}
+	// 수신기가 바로 디코딩할 수 있도록 첫 키프레임부터 보낸다.
+	if !h.videoStart.Load() {
+		if unit.FrameInfo.Flag != 1 {
+			return nil
+		}
+		h.videoStart.Store(true)
+	}
+	pkt := writer.WriteVideoPkt(unit)
+	defer pkt.AvPacketUnref()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.write(pkt)
+	return nil
+}
+
+func (h *Handler) OnAudio(ctx context.Context, trackCtx *TrackContext, unit units.Unit) error {
+	if h.hasVideo && !h.videoStart.Load() {
+		return nil
+	}
+	writer := trackCtx.writer
+	pkt := writer.WriteAudioPkt(unit)
+	if pkt == nil {
+		return nil
+	}
+	defer pkt.AvPacketUnref()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.write(pkt)
+	return nil
+}
+
+// write 는 pkt 를 TS 로 묶어서 datagram 크기로 나누어 보낸다. h.mu 를 잡고 호출해야 한다.
+func (h *Handler) write(pkt *avcodec.Packet) {
+	if h.closed {
+		return
+	}
+	// mpegts 의 time base 는 1/90000 이다. 쓰고 나면 pkt 가 비워지므로 먼저 읽는다.
+	h.lastDTS = pkt.DTS()
+	if ret := h.outputFormatCtx.AvInterleavedWriteFrame(pkt); ret < 0 {
+		log.Logger.Warn("multicast write frame failed", zap.String("error", avutil.AvErr2str(ret)))
+	}
+	buf := avformat.AVIOCloseDynBuf(h.outputFormatCtx.Pb())
+	h.outputFormatCtx.SetPb(avformat.AVIOOpenDynBuf())
+	if len(buf) == 0 {
+		return
+	}
+
+	data := append(h.residual, buf...)
+	var chunks [][]byte
+	for len(data) >= tsDatagramSize {
+		chunks = append(chunks, data[:tsDatagramSize:tsDatagramSize])
+		data = data[tsDatagramSize:]
+	}
+	h.residual = append([]byte(nil), data...)
+	if len(chunks) == 0 {
+		return
+	}
+	if err := h.sender.push(batch{chunks: chunks, dts: h.lastDTS}); err != nil {
+		log.Logger.Warn("multicast sender is too slow, dropped", zap.Error(err))
+	}
+}
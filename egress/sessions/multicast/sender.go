@@ -0,0 +1,218 @@
+package multicast
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/pion/rtp"
+	"go.uber.org/zap"
+	"golang.org/x/net/ipv4"
+
+	"mediaserver-go/utils"
+	"mediaserver-go/utils/log"
+)
+
+const (
+	tsPacketSize = 188
+	// 이더넷 MTU 에 들어가는 TS 패킷 7 개를 한 datagram 으로 보낸다.
+	tsDatagramSize = tsPacketSize * 7
+	// RFC 2250 MPEG-TS payload type
+	mp2tPayloadType = 33
+
+	senderBuffer = 256
+	// 보내지 못한 묶음이 이보다 많으면 페이싱을 멈추고 바로 보낸다.
+	senderBacklog = 32
+	// 두 묶음의 DTS 차이가 이보다 크면 끊긴 것으로 보고 나누어 보내지 않는다.
+	maxSpread = 500 * time.Millisecond
+	// 보내기가 예정보다 이만큼 늦으면 예정 시각을 현재로 맞춘다.
+	maxLag = 200 * time.Millisecond
+)
+
+var (
+	errSenderFull = errors.New("multicast sender queue is full")
+)
+
+// batch 는 패킷 하나를 mux 한 TS datagram 들과 그 패킷의 DTS(90kHz) 이다.
+type batch struct {
+	chunks [][]byte
+	dts    int64
+}
+
+// sender 는 TS datagram 을 DTS 간격 또는 고정 비트레이트에 맞춰 나누어 보낸다. 프레임마다 몰아서 보내면 수신측 버퍼가 넘칠 수 있다.
+type sender struct {
+	config Config
+
+	conn      *net.UDPConn
+	dst       *net.UDPAddr
+	columnDst *net.UDPAddr
+	rowDst    *net.UDPAddr
+
+	ch   chan batch
+	next time.Time
+
+	sequencer       rtp.Sequencer
+	ssrc            uint32
+	timestampOffset uint32
+	fec             *fecEncoder
+
+	writeFailed bool
+}
+
+func newSender(config Config) (*sender, error) {
+	ip := net.ParseIP(config.Addr).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ipv4 address: %s", config.Addr)
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := config.TTL
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	p := ipv4.NewPacketConn(conn)
+	if ip.IsMulticast() {
+		if err := p.SetMulticastTTL(ttl); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		// 같은 호스트의 수신기(loopback 테스트)도 받을 수 있게 한다.
+		if err := p.SetMulticastLoopback(true); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if config.Interface != "" {
+			ifi, err := net.InterfaceByName(config.Interface)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+			if err := p.SetMulticastInterface(ifi); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+	} else if err := p.SetTTL(ttl); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	s := &sender{
+		config:    config,
+		conn:      conn,
+		dst:       &net.UDPAddr{IP: ip, Port: config.Port},
+		ch:        make(chan batch, senderBuffer),
+		sequencer: rtp.NewRandomSequencer(),
+		ssrc:      utils.RandomUint32(),
+		// 수신측이 시작 값을 예측하지 못하도록 임의 값에서 시작한다. (RFC 3550 5.1)
+		timestampOffset: utils.RandomUint32(),
+	}
+	if config.FEC.enabled() {
+		s.columnDst = &net.UDPAddr{IP: ip, Port: config.Port + 2}
+		s.rowDst = &net.UDPAddr{IP: ip, Port: config.Port + 4}
+		s.fec = newFECEncoder(config.FEC)
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *sender) run() {
+	defer s.conn.Close()
+
+	var prev *batch
+	for b := range s.ch {
+		if prev != nil {
+			s.send(*prev, s.interval(*prev, b))
+		}
+		prev = &b
+	}
+	if prev != nil {
+		s.send(*prev, 0)
+	}
+}
+
+// interval 은 prev 의 datagram 사이 간격이다. 비트레이트가 정해져 있으면 그에 맞추고, 아니면 다음 묶음의 DTS 까지 고르게 나눈다.
+func (s *sender) interval(prev, next batch) time.Duration {
+	if len(s.ch) > senderBacklog {
+		return 0
+	}
+	if s.config.Bitrate > 0 {
+		return time.Duration(tsDatagramSize*8) * time.Second / time.Duration(s.config.Bitrate)
+	}
+	d := time.Duration(next.dts-prev.dts) * time.Second / 90000
+	if d <= 0 || d > maxSpread {
+		return 0
+	}
+	return d / time.Duration(len(prev.chunks))
+}
+
+func (s *sender) send(b batch, interval time.Duration) {
+	for _, chunk := range b.chunks {
+		now := time.Now()
+		if s.next.Before(now.Add(-maxLag)) {
+			s.next = now
+		}
+		if wait := s.next.Sub(now); wait > 0 {
+			time.Sleep(wait)
+		}
+		s.write(chunk, b.dts)
+		s.next = s.next.Add(interval)
+	}
+}
+
+func (s *sender) write(chunk []byte, dts int64) {
+	if !s.config.RTP {
+		s.writeTo(chunk, s.dst)
+		return
+	}
+
+	packet := &rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			PayloadType:    mp2tPayloadType,
+			SequenceNumber: s.sequencer.NextSequenceNumber(),
+			Timestamp:      s.timestampOffset + uint32(dts),
+			SSRC:           s.ssrc,
+		},
+		Payload: chunk,
+	}
+	b, err := packet.Marshal()
+	if err != nil {
+		return
+	}
+	s.writeTo(b, s.dst)
+
+	if s.fec == nil {
+		return
+	}
+	column, row := s.fec.push(packet)
+	if column != nil {
+		s.writeTo(column, s.columnDst)
+	}
+	if row != nil {
+		s.writeTo(row, s.rowDst)
+	}
+}
+
+// writeTo 는 UDP 에러가 나도 계속 보낸다. 로그는 에러가 처음 날 때만 남긴다.
+func (s *sender) writeTo(b []byte, dst *net.UDPAddr) {
+	_, err := s.conn.WriteToUDP(b, dst)
+	if err != nil && !s.writeFailed {
+		log.Logger.Warn("multicast write failed", zap.String("addr", dst.String()), zap.Error(err))
+	}
+	s.writeFailed = err != nil
+}
+
+// push 는 묶음을 보낼 큐에 넣는다. 큐가 가득 차면 버린다.
+func (s *sender) push(b batch) error {
+	select {
+	case s.ch <- b:
+		return nil
+	default:
+		return errSenderFull
+	}
+}
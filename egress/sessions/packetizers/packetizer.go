@@ -2,88 +2,131 @@ package packetizers
 
 import (
 	"errors"
+
 	"github.com/bluenviron/mediacommon/pkg/codecs/h264"
 	"github.com/pion/rtp"
 	rtpcodecs "github.com/pion/rtp/codecs"
+
 	hubcodecs "mediaserver-go/codecs"
 	h2642 "mediaserver-go/codecs/h264"
 	"mediaserver-go/hubs/engines"
 	"mediaserver-go/utils"
 	"mediaserver-go/utils/types"
+	"mediaserver-go/utils/units"
 )
 
 type Packetizer interface {
-	Packetize(payload []byte) []*rtp.Packet
+	// Packetize 는 유닛 하나를 RTP 패킷으로 만든다. RTP timestamp 는 unit.PTS 를 클럭 레이트로 바꾼 값이다.
+	Packetize(unit units.Unit) []*rtp.Packet
 }
 
-type CommonPacketizer struct {
-	samples    uint32
-	packetizer rtp.Packetizer
-}
-
-func NewPacketizer(parameters engines.RTPCodecParameters, codec hubcodecs.Codec) (Packetizer, error) {
-	ssrc := utils.RandomUint32()
+func NewPacketizer(parameters engines.RTPCodecParameters, ssrc uint32, codec hubcodecs.Codec) (Packetizer, error) {
+	base := basePacketizer{
+		payloadType: parameters.PayloadType,
+		ssrc:        ssrc,
+		clockRate:   parameters.ClockRate,
+		sequencer:   rtp.NewRandomSequencer(),
+		// 수신측이 시작 값을 예측하지 못하도록 임의 값에서 시작한다. (RFC 3550 5.1)
+		timestampOffset: utils.RandomUint32(),
+	}
 	switch parameters.CodecType {
 	case types.CodecTypeVP8:
-		return &CommonPacketizer{
-			samples:    parameters.ClockRate / 30,
-			packetizer: rtp.NewPacketizer(types.MTUSize, parameters.PayloadType, ssrc, &rtpcodecs.VP8Payloader{}, rtp.NewRandomSequencer(), parameters.ClockRate),
-		}, nil
+		base.payloader = &rtpcodecs.VP8Payloader{}
+		return &CommonPacketizer{basePacketizer: base, marker: true}, nil
 	case types.CodecTypeH264:
 		videoCodec, ok := codec.(*h2642.H264)
 		if !ok {
 			return nil, errors.New("invalid codec type")
 		}
+		base.payloader = &rtpcodecs.H264Payloader{}
 		return &H264Packetizer{
-			packetizer: rtp.NewPacketizer(types.MTUSize, parameters.PayloadType, ssrc, &rtpcodecs.H264Payloader{}, rtp.NewRandomSequencer(), parameters.ClockRate),
-			sps:        videoCodec.SPS(),
-			pps:        videoCodec.PPS(),
-			samples:    parameters.ClockRate / 30,
+			basePacketizer: base,
+			codec:          videoCodec,
 		}, nil
 	case types.CodecTypeOpus:
-		return &CommonPacketizer{
-			samples:    parameters.ClockRate / 50, // 20 ms
-			packetizer: rtp.NewPacketizer(types.MTUSize, parameters.PayloadType, ssrc, &rtpcodecs.OpusPayloader{}, rtp.NewRandomSequencer(), parameters.ClockRate),
-		}, nil
+		base.payloader = &rtpcodecs.OpusPayloader{}
+		return &CommonPacketizer{basePacketizer: base}, nil
 	default:
 		return nil, errors.New("unsupported codec type")
 	}
+}
 
+type basePacketizer struct {
+	payloader       rtp.Payloader
+	sequencer       rtp.Sequencer
+	payloadType     uint8
+	ssrc            uint32
+	clockRate       uint32
+	timestampOffset uint32
 }
 
-func (p *CommonPacketizer) Packetize(payload []byte) []*rtp.Packet {
-	return p.packetizer.Packetize(payload, p.samples)
+func (p *basePacketizer) timestamp(unit units.Unit) uint32 {
+	pts := unit.PTS
+	if unit.TimeBase > 0 && uint32(unit.TimeBase) != p.clockRate {
+		pts = pts * int64(p.clockRate) / int64(unit.TimeBase)
+	}
+	return p.timestampOffset + uint32(pts)
 }
 
-type H264Packetizer struct {
-	packetizer rtp.Packetizer
-	config     h2642.Config
-	codec      *h2642.H264
-	samples    uint32
+// packetize 는 payload 를 MTU 에 맞게 나눈다. marker 이면 마지막 패킷에 marker 비트를 켠다.
+func (p *basePacketizer) packetize(payload []byte, timestamp uint32, marker bool) []*rtp.Packet {
+	payloads := p.payloader.Payload(types.MTUSize-12, payload)
+	packets := make([]*rtp.Packet, len(payloads))
+	for i, pp := range payloads {
+		packets[i] = &rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         marker && i == len(payloads)-1,
+				PayloadType:    p.payloadType,
+				SequenceNumber: p.sequencer.NextSequenceNumber(),
+				Timestamp:      timestamp,
+				SSRC:           p.ssrc,
+			},
+			Payload: pp,
+		}
+	}
+	return packets
+}
 
-	sps, pps []byte
+type CommonPacketizer struct {
+	basePacketizer
+	// 비디오는 프레임의 마지막 패킷에 marker 를 켠다.
+	marker bool
+}
 
-	sps2, pps2 []byte
+func (p *CommonPacketizer) Packetize(unit units.Unit) []*rtp.Packet {
+	return p.packetize(unit.Payload, p.timestamp(unit), p.marker && unit.Marker)
 }
 
-func (h *H264Packetizer) Packetize(payload []byte) []*rtp.Packet {
-	naluTyp := h264.NALUType(payload[0] & 0x1f)
-	if naluTyp == h264.NALUTypeSPS {
-		h.sps2 = payload
-		return nil
-	}
-	if naluTyp == h264.NALUTypePPS {
-		h.pps2 = payload
+type H264Packetizer struct {
+	basePacketizer
+	codec *h2642.H264
+
+	// 마지막 IDR 이후 SPS, PPS 를 받았는지. 없으면 IDR 앞에 코덱의 SPS, PPS 를 넣는다.
+	hasSPS, hasPPS bool
+}
+
+func (h *H264Packetizer) Packetize(unit units.Unit) []*rtp.Packet {
+	if len(unit.Payload) == 0 {
 		return nil
 	}
-	if naluTyp == h264.NALUTypeIDR {
-		if err := h.config.UnmarshalFromSPSPPS(h.sps2, h.pps2); err != nil {
-			return nil
-		}
+	timestamp := h.timestamp(unit)
 
-		_ = h.packetizer.Packetize(h.sps2, h.samples)
-		_ = h.packetizer.Packetize(h.pps2, h.samples)
+	switch h264.NALUType(unit.Payload[0] & 0x1f) {
+	case h264.NALUTypeSPS:
+		h.hasSPS = true
+	case h264.NALUTypePPS:
+		h.hasPPS = true
+	case h264.NALUTypeIDR:
+		// RTMP 처럼 SPS, PPS 를 시퀀스 헤더로만 보내는 소스도 수신측이 IDR 부터 디코딩할 수 있게 한다.
+		// H264Payloader 는 SPS, PPS 를 모아두었다가 다음 NAL 앞에 STAP-A 로 보낸다.
+		if !h.hasSPS {
+			h.packetize(h.codec.SPS(), timestamp, false)
+		}
+		if !h.hasPPS {
+			h.packetize(h.codec.PPS(), timestamp, false)
+		}
+		h.hasSPS, h.hasPPS = false, false
 	}
-
-	return h.packetizer.Packetize(payload, h.samples)
+	return h.packetize(unit.Payload, timestamp, unit.Marker)
 }
@@ -1,8 +1,26 @@
 package rtp
 
-import "mediaserver-go/egress/sessions/packetizers"
+import (
+	"net"
+	"sync/atomic"
+
+	"mediaserver-go/egress/sessions/packetizers"
+)
 
 type TrackContext struct {
 	packetizer packetizers.Packetizer
 	buf        []byte
+
+	ssrc     uint32
+	rtpConn  *net.UDPConn
+	rtcpConn *net.UDPConn
+	stats    *Stats
+}
+
+// Stats 는 sender report 에 쓰인다. lastNTP, lastTS 는 마지막 패킷을 보낸 시각과 그 패킷의 RTP timestamp 이다.
+type Stats struct {
+	lastNTP    atomic.Uint64
+	lastTS     atomic.Uint32
+	sendCount  atomic.Uint32
+	sendLength atomic.Uint32
 }
@@ -2,40 +2,87 @@ package rtp
 
 import (
 	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/rtcp"
 	"github.com/pion/sdp/v3"
+	"go.uber.org/zap"
+
+	"mediaserver-go/codecs"
+	"mediaserver-go/codecs/h264"
+	"mediaserver-go/codecs/opus"
 	"mediaserver-go/egress/sessions/packetizers"
 	"mediaserver-go/hubs"
+	"mediaserver-go/thirdparty/ffmpeg/avutil"
+	"mediaserver-go/utils"
+	"mediaserver-go/utils/log"
+	"mediaserver-go/utils/ntp"
 	"mediaserver-go/utils/types"
 	"mediaserver-go/utils/units"
-	"net"
 )
 
-type CodecInfo struct {
-	PayloadType uint8
-	ClockRate   uint32
+const (
+	senderReportInterval = time.Second
+)
+
+var (
+	errUnsupportedCodec   = errors.New("unsupported codec")
+	errInvalidPayloadType = errors.New("invalid payload type")
+	errDuplicateSSRC      = errors.New("video and audio ssrc must differ")
+	errPortConflict       = errors.New("rtp/rtcp ports overlap")
+)
+
+// Config 는 미디어마다의 전송 설정이다. 0 인 값은 기본값을 쓴다.
+type Config struct {
+	Addr string
+	// VideoPort, AudioPort 가 없을 때 쓰는 포트. 비디오가 Port, 오디오가 Port+2 를 쓴다. (비디오가 없으면 오디오가 Port)
+	Port      int
+	VideoPort int
+	AudioPort int
+	// RTCPMux 이면 RTCP 를 RTP 와 같은 포트로 보낸다. 아니면 RTP 포트 + 1 로 보낸다.
+	RTCPMux bool
+
+	VideoSSRC        uint32
+	AudioSSRC        uint32
+	VideoPayloadType uint8
+	AudioPayloadType uint8
+}
+
+type media struct {
+	port        int
+	ssrc        uint32
+	payloadType uint8
+	rtpConn     *net.UDPConn
+	rtcpConn    *net.UDPConn
 }
 
 type Handler struct {
-	conn         *net.UDPConn
-	sourceTracks []*hubs.HubSource
+	config Config
+	// 같은 CNAME 을 쓰면 수신측이 비디오와 오디오를 같은 소스로 보고 sender report 로 립싱크를 맞춘다.
+	cname string
 
-	targetAddr  string
-	targetPort  int
-	sd          sdp.SessionDescription
-	negotidated []hubs.Track
+	medias     map[types.MediaType]*media
+	sd         sdp.SessionDescription
+	negotiated []hubs.Track
 }
 
-func NewHandler(targetAddr string, targetPort int) *Handler {
+func NewHandler(config Config) *Handler {
 	return &Handler{
-		targetAddr: targetAddr,
-		targetPort: targetPort,
+		config: config,
+		cname:  uuid.NewString(),
+		medias: make(map[types.MediaType]*media),
 	}
 }
 
 func (h *Handler) NegotiatedTracks() []hubs.Track {
-	ret := make([]hubs.Track, 0, len(h.negotidated))
-	return append(ret, h.negotidated...)
+	ret := make([]hubs.Track, 0, len(h.negotiated))
+	return append(ret, h.negotiated...)
 }
 
 func (h *Handler) SDP() string {
@@ -43,92 +90,299 @@ func (h *Handler) SDP() string {
 	if err != nil {
 		return ""
 	}
-	fmt.Println(string(b))
 	return string(b)
 }
 
-func (h *Handler) Init(ctx context.Context, sources []*hubs.HubSource) error {
-	target, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", h.targetAddr, h.targetPort))
-	if err != nil {
-		return err
+// preferredCodec 은 RTP 로 보낼 수 있는 코덱을 고른다. 비디오는 그대로 보내고, Opus 가 아닌 오디오는 Opus 로 트랜스코딩한다.
+func preferredCodec(codec codecs.Codec) (codecs.Codec, error) {
+	switch codec.CodecType() {
+	case types.CodecTypeH264, types.CodecTypeVP8, types.CodecTypeOpus:
+		return codec, nil
 	}
-	conn, err := net.DialUDP("udp", nil, target)
-	if err != nil {
+	if codec.MediaType() != types.MediaTypeAudio {
+		return nil, errUnsupportedCodec
+	}
+	return opus.NewOpus(opus.NewConfig(opus.Parameters{
+		Channels:     2,
+		SampleRate:   48000,
+		SampleFormat: int(avutil.AV_SAMPLE_FMT_FLT),
+	})), nil
+}
+
+func (h *Handler) Init(ctx context.Context, sources []*hubs.HubSource) error {
+	if err := h.assignMedias(sources); err != nil {
 		return err
 	}
-	var negotidated []hubs.Track
+
+	var negotiated []hubs.Track
 	sd := h.makeSessionDescription()
 	for _, source := range sources {
-		codec, err := source.Codec()
+		sourceCodec, err := source.Codec()
 		if err != nil {
+			h.closeConns()
 			return err
 		}
-		capa, err := codec.RTPCodecCapability(h.targetPort)
+		codec, err := preferredCodec(sourceCodec)
 		if err != nil {
+			h.closeConns()
+			return err
+		}
+		m := h.medias[codec.MediaType()]
+		if err := m.dial(h.config.Addr, h.config.RTCPMux); err != nil {
+			h.closeConns()
 			return err
 		}
-		sd.MediaDescriptions = append(sd.MediaDescriptions, &capa.MediaDescription)
-		track := source.GetTrack(codec)
-		negotidated = append(negotidated, track)
+		md, err := h.makeMediaDescription(m, codec)
+		if err != nil {
+			h.closeConns()
+			return err
+		}
+		sd.MediaDescriptions = append(sd.MediaDescriptions, md)
+		negotiated = append(negotiated, source.GetTrack(codec))
 	}
 
-	h.conn = conn
 	h.sd = sd
-	h.negotidated = negotidated
+	h.negotiated = negotiated
+	return nil
+}
+
+// assignMedias 는 미디어마다 포트, SSRC, payload type 을 정한다.
+func (h *Handler) assignMedias(sources []*hubs.HubSource) error {
+	hasVideo := false
+	for _, source := range sources {
+		if source.MediaType() == types.MediaTypeVideo {
+			hasVideo = true
+		}
+	}
+
+	usedPorts := make(map[int]bool)
+	for _, source := range sources {
+		m := &media{}
+		switch source.MediaType() {
+		case types.MediaTypeVideo:
+			m.port, m.ssrc, m.payloadType = h.config.VideoPort, h.config.VideoSSRC, h.config.VideoPayloadType
+			if m.port == 0 {
+				m.port = h.config.Port
+			}
+		case types.MediaTypeAudio:
+			m.port, m.ssrc, m.payloadType = h.config.AudioPort, h.config.AudioSSRC, h.config.AudioPayloadType
+			if m.port == 0 {
+				m.port = h.config.Port
+				if hasVideo {
+					m.port += 2
+				}
+			}
+		default:
+			continue
+		}
+		if m.payloadType > 127 {
+			return errInvalidPayloadType
+		}
+		if m.ssrc == 0 {
+			m.ssrc = utils.RandomUint32()
+		}
+		ports := []int{m.port}
+		if !h.config.RTCPMux {
+			ports = append(ports, m.port+1)
+		}
+		for _, port := range ports {
+			if usedPorts[port] {
+				return errPortConflict
+			}
+			usedPorts[port] = true
+		}
+		h.medias[source.MediaType()] = m
+	}
+
+	video, audio := h.medias[types.MediaTypeVideo], h.medias[types.MediaTypeAudio]
+	if video != nil && audio != nil && video.ssrc == audio.ssrc {
+		return errDuplicateSSRC
+	}
+	return nil
+}
+
+func (m *media) dial(addr string, rtcpMux bool) error {
+	rtpConn, err := dialUDP(addr, m.port)
+	if err != nil {
+		return err
+	}
+	m.rtpConn, m.rtcpConn = rtpConn, rtpConn
+	if rtcpMux {
+		return nil
+	}
+	rtcpConn, err := dialUDP(addr, m.port+1)
+	if err != nil {
+		return err
+	}
+	m.rtcpConn = rtcpConn
 	return nil
 }
 
+func (m *media) close() {
+	if m.rtpConn != nil {
+		m.rtpConn.Close()
+	}
+	if m.rtcpConn != nil && m.rtcpConn != m.rtpConn {
+		m.rtcpConn.Close()
+	}
+}
+
+func dialUDP(addr string, port int) (*net.UDPConn, error) {
+	target, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", addr, port))
+	if err != nil {
+		return nil, err
+	}
+	return net.DialUDP("udp", nil, target)
+}
+
+func (h *Handler) closeConns() {
+	for _, m := range h.medias {
+		m.close()
+	}
+}
+
 func (h *Handler) OnTrack(ctx context.Context, track hubs.Track) (*TrackContext, error) {
 	codec := track.GetCodec()
-	rtpCapability, err := codec.RTPCodecCapability(h.targetPort)
+	m, ok := h.medias[codec.MediaType()]
+	if !ok {
+		return nil, errUnsupportedCodec
+	}
+	parameters, err := codec.RTPCodecCapability(m.port)
 	if err != nil {
 		return nil, err
 	}
-	packetizer, err := packetizers.NewPacketizer(rtpCapability, codec)
+	if m.payloadType != 0 {
+		parameters.PayloadType = m.payloadType
+	}
+	packetizer, err := packetizers.NewPacketizer(parameters, m.ssrc, codec)
 	if err != nil {
 		return nil, err
 	}
 
-	return &TrackContext{
+	trackCtx := &TrackContext{
 		packetizer: packetizer,
 		buf:        make([]byte, types.ReadBufferSize),
-	}, nil
+		ssrc:       m.ssrc,
+		rtpConn:    m.rtpConn,
+		rtcpConn:   m.rtcpConn,
+		stats:      &Stats{},
+	}
+	go h.sendSenderReports(ctx, trackCtx)
+	return trackCtx, nil
 }
 
 func (h *Handler) OnClosed(ctx context.Context) error {
-	h.conn.Close()
+	for _, m := range h.medias {
+		if m.rtcpConn != nil {
+			bye := rtcp.Goodbye{Sources: []uint32{m.ssrc}}
+			if b, err := bye.Marshal(); err == nil {
+				m.rtcpConn.Write(b)
+			}
+		}
+		m.close()
+	}
 	return nil
 }
 
 func (h *Handler) OnVideo(ctx context.Context, trackCtx *TrackContext, unit units.Unit) error {
-	packetizer := trackCtx.packetizer
+	return h.write(trackCtx, unit)
+}
+
+func (h *Handler) OnAudio(ctx context.Context, trackCtx *TrackContext, unit units.Unit) error {
+	return h.write(trackCtx, unit)
+}
+
+func (h *Handler) write(trackCtx *TrackContext, unit units.Unit) error {
 	buf := trackCtx.buf
-	for _, rtpPacket := range packetizer.Packetize(unit.Payload) {
+	for _, rtpPacket := range trackCtx.packetizer.Packetize(unit) {
 		n, err := rtpPacket.MarshalTo(buf)
 		if err != nil {
 			continue
 		}
-		if _, err := h.conn.Write(buf[:n]); err != nil {
+		if _, err := trackCtx.rtpConn.Write(buf[:n]); err != nil {
 			return err
 		}
+		trackCtx.stats.sendCount.Add(1)
+		trackCtx.stats.sendLength.Add(uint32(len(rtpPacket.Payload)))
+		trackCtx.stats.lastNTP.Store(uint64(ntp.GetNTPTime(time.Now())))
+		trackCtx.stats.lastTS.Store(rtpPacket.Timestamp)
 	}
-
 	return nil
 }
 
-func (h *Handler) OnAudio(ctx context.Context, trackCtx *TrackContext, unit units.Unit) error {
-	packetizer := trackCtx.packetizer
-	buf := trackCtx.buf
-	for _, rtpPacket := range packetizer.Packetize(unit.Payload) {
-		n, err := rtpPacket.MarshalTo(buf)
-		if err != nil {
-			continue
+// sendSenderReports 는 NTP 시각과 RTP timestamp 의 대응을 주기적으로 보낸다. 수신측은 이것으로 비디오와 오디오를 맞춘다.
+func (h *Handler) sendSenderReports(ctx context.Context, trackCtx *TrackContext) {
+	ticker := time.NewTicker(senderReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if trackCtx.stats.sendCount.Load() == 0 {
+				continue
+			}
+			packets := []rtcp.Packet{
+				&rtcp.SenderReport{
+					SSRC:        trackCtx.ssrc,
+					NTPTime:     trackCtx.stats.lastNTP.Load(),
+					RTPTime:     trackCtx.stats.lastTS.Load(),
+					PacketCount: trackCtx.stats.sendCount.Load(),
+					OctetCount:  trackCtx.stats.sendLength.Load(),
+				},
+				&rtcp.SourceDescription{
+					Chunks: []rtcp.SourceDescriptionChunk{{
+						Source: trackCtx.ssrc,
+						Items:  []rtcp.SourceDescriptionItem{{Type: rtcp.SDESCNAME, Text: h.cname}},
+					}},
+				},
+			}
+			b, err := rtcp.Marshal(packets)
+			if err != nil {
+				continue
+			}
+			if _, err := trackCtx.rtcpConn.Write(b); err != nil {
+				log.Logger.Warn("write rtcp err", zap.Error(err))
+				return
+			}
 		}
-		if _, err := h.conn.Write(buf[:n]); err != nil {
-			return err
+	}
+}
+
+// makeMediaDescription 은 정해진 포트, payload type, SSRC 에 맞는 m= 섹션을 만든다.
+func (h *Handler) makeMediaDescription(m *media, codec codecs.Codec) (*sdp.MediaDescription, error) {
+	capa, err := codec.RTPCodecCapability(m.port)
+	if err != nil {
+		return nil, err
+	}
+	payloadType := capa.PayloadType
+	if m.payloadType != 0 {
+		payloadType = m.payloadType
+	}
+
+	md := &sdp.MediaDescription{
+		MediaName: capa.MediaDescription.MediaName,
+	}
+	md.MediaName.Formats = []string{fmt.Sprintf("%d", payloadType)}
+	for _, attr := range capa.MediaDescription.Attributes {
+		value := strings.TrimPrefix(attr.Value, fmt.Sprintf("%d ", capa.PayloadType))
+		if attr.Key == "fmtp" {
+			if videoCodec, ok := codec.(*h264.H264); ok {
+				value += fmt.Sprintf(";sprop-parameter-sets=%s,%s",
+					base64.StdEncoding.EncodeToString(videoCodec.SPS()),
+					base64.StdEncoding.EncodeToString(videoCodec.PPS()))
+			}
 		}
+		md.WithValueAttribute(attr.Key, fmt.Sprintf("%d %s", payloadType, value))
 	}
-	return nil
+	if h.config.RTCPMux {
+		md.WithPropertyAttribute("rtcp-mux")
+	} else {
+		md.WithValueAttribute("rtcp", fmt.Sprintf("%d", m.port+1))
+	}
+	md.WithValueAttribute("ssrc", fmt.Sprintf("%d cname:%s", m.ssrc, h.cname))
+	md.WithPropertyAttribute("sendonly")
+	return md, nil
 }
 
 func (h *Handler) makeSessionDescription() sdp.SessionDescription {
@@ -139,13 +393,14 @@ func (h *Handler) makeSessionDescription() sdp.SessionDescription {
 			SessionVersion: 0,
 			NetworkType:    "IN",
 			AddressType:    "IP4",
-			UnicastAddress: h.targetAddr,
+			UnicastAddress: h.config.Addr,
 		},
+		SessionName: "-",
 		ConnectionInformation: &sdp.ConnectionInformation{
 			NetworkType: "IN",
 			AddressType: "IP4",
 			Address: &sdp.Address{
-				Address: h.targetAddr,
+				Address: h.config.Addr,
 			},
 		},
 		TimeDescriptions: []sdp.TimeDescription{
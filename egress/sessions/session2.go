@@ -44,48 +44,62 @@ func (s *Session2[T]) Run(ctx context.Context) error {
 	}()
 	g, ctx := errgroup.WithContext(ctx)
 
-	for source := range s.stream.Subscribe() {
-		log.Logger.Info("whep onSource",
-			zap.String("codec", string(source.CodecType())),
-			zap.String("rid", source.RID()),
-		)
-		codec, err := source.Codec()
-		if err != nil {
-			return err
+	// 세션 중에 추가되는 소스(늦게 발행된 오디오 등)도 받는다.
+	sourceCh := s.stream.Subscribe()
+	defer s.stream.Unsubscribe(sourceCh)
+	for {
+		select {
+		case <-ctx.Done():
+			return g.Wait()
+		case source := <-sourceCh:
+			g.Go(func() error {
+				return s.runSource(ctx, source)
+			})
 		}
-		codec = s.handler.PreferredCodec(codec)
-		track := source.GetTrack(codec)
+	}
+}
 
-		consumerCh := track.AddConsumer()
-		g.Go(func() error {
-			defer track.RemoveConsumer(consumerCh)
+func (s *Session2[T]) runSource(ctx context.Context, source *hubs.HubSource) error {
+	log.Logger.Info("whep onSource",
+		zap.String("codec", string(source.CodecType())),
+		zap.String("rid", source.RID()),
+	)
+	codec, err := source.WaitCodec(ctx)
+	if err != nil {
+		return nil
+	}
+	codec = s.handler.PreferredCodec(codec)
+	track := source.GetTrack(codec)
+	if track == nil {
+		log.Logger.Warn("source skipped", zap.String("codec", string(source.CodecType())))
+		return nil
+	}
 
-			handle, err := s.handler.OnTrack(ctx, track)
-			if err != nil {
-				return err
-			}
+	consumerCh := track.AddConsumer()
+	defer track.RemoveConsumer(consumerCh)
 
-			for {
-				select {
-				case <-ctx.Done():
-					return nil
-				case unit, ok := <-consumerCh:
-					if !ok {
-						return nil
-					}
-					if track.GetCodec().MediaType() == types.MediaTypeVideo {
-						if err := s.handler.OnVideo(ctx, handle, unit, source.RID()); err != nil {
-							return err
-						}
-					} else if track.GetCodec().MediaType() == types.MediaTypeAudio {
-						if err := s.handler.OnAudio(ctx, handle, unit, source.RID()); err != nil {
-							return err
-						}
-					}
+	handle, err := s.handler.OnTrack(ctx, track)
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case unit, ok := <-consumerCh:
+			if !ok {
+				return nil
+			}
+			if track.GetCodec().MediaType() == types.MediaTypeVideo {
+				if err := s.handler.OnVideo(ctx, handle, unit, source.RID()); err != nil {
+					return err
+				}
+			} else if track.GetCodec().MediaType() == types.MediaTypeAudio {
+				if err := s.handler.OnAudio(ctx, handle, unit, source.RID()); err != nil {
+					return err
 				}
 			}
-		})
+		}
 	}
-
-	return g.Wait()
 }
@@ -0,0 +1,62 @@
+package srt
+
+import (
+	"fmt"
+
+	"go.uber.org/zap"
+
+	"mediaserver-go/thirdparty/ffmpeg/avformat"
+	"mediaserver-go/thirdparty/ffmpeg/avutil"
+	"mediaserver-go/utils/log"
+)
+
+const (
+	// 보내지 못하고 쌓인 TS 데이터가 이 개수를 넘으면 느린 연결로 보고 끊는다.
+	connBuffer = 1024
+)
+
+// conn 은 ffmpeg libsrt 로 연결된 SRT 소켓 하나이다. 쓰기는 연결마다 따로 고루틴에서 하므로 느린 상대가 다른 상대를 막지 않는다.
+type conn struct {
+	pb *avformat.AvIOContext
+	// Handler 가 보내고 닫는다. Handler.mu 로 보호된다.
+	ch chan []byte
+	// 쓰기 고루틴이 끝나면(연결이 끊기면) 닫힌다.
+	done chan struct{}
+}
+
+// dial 은 caller 이면 원격에 연결하고, listener 이면 상대가 연결할 때까지 기다린다.
+func dial(url string) (*conn, error) {
+	var pb *avformat.AvIOContext
+	if ret := avformat.AvIOOpen(&pb, url, avformat.AVIO_FLAG_WRITE); ret < 0 {
+		return nil, fmt.Errorf("srt open failed: %s", avutil.AvErr2str(ret))
+	}
+	c := &conn{
+		pb:   pb,
+		ch:   make(chan []byte, connBuffer),
+		done: make(chan struct{}),
+	}
+	go c.run()
+	return c, nil
+}
+
+func (c *conn) run() {
+	defer close(c.done)
+	defer avformat.AVIOCloseP(&c.pb)
+
+	for b := range c.ch {
+		if ret := avformat.AvIOWrite(c.pb, b); ret < 0 {
+			log.Logger.Warn("srt write failed", zap.String("error", avutil.AvErr2str(ret)))
+			return
+		}
+	}
+}
+
+// closed 는 연결이 끊겼는지 확인한다.
+func (c *conn) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
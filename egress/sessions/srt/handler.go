@@ -0,0 +1,430 @@
+package srt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"mediaserver-go/codecs"
+	"mediaserver-go/codecs/aac"
+	"mediaserver-go/hubs"
+	"mediaserver-go/hubs/writers"
+	"mediaserver-go/parsers/bitstreams"
+	"mediaserver-go/thirdparty/ffmpeg/avcodec"
+	"mediaserver-go/thirdparty/ffmpeg/avformat"
+	"mediaserver-go/thirdparty/ffmpeg/avutil"
+	"mediaserver-go/utils/log"
+	"mediaserver-go/utils/types"
+	"mediaserver-go/utils/units"
+)
+
+const (
+	DefaultLatency = 120 * time.Millisecond
+
+	// caller 가 연결에 실패하거나 끊기면 이 간격으로 다시 연결한다.
+	retryInterval = 3 * time.Second
+	// listener 가 상대를 기다리다가 세션 종료를 확인하는 간격
+	acceptTimeout = time.Second
+)
+
+type Mode string
+
+const (
+	// ModeCaller 는 원격(Addr:Port)에 연결하여 보낸다.
+	ModeCaller Mode = "caller"
+	// ModeListener 는 Addr:Port 에서 기다리다가 연결한 상대에게 보낸다. 여러 상대가 연결할 수 있다.
+	ModeListener Mode = "listener"
+)
+
+func ParseMode(s string) (Mode, error) {
+	switch s {
+	case "", "caller":
+		return ModeCaller, nil
+	case "listener":
+		return ModeListener, nil
+	default:
+		return "", fmt.Errorf("unsupported srt mode: %s", s)
+	}
+}
+
+type Config struct {
+	Mode Mode
+	// caller 는 원격 주소, listener 는 bind 할 주소이다.
+	Addr string
+	Port int
+	// SRT 수신 버퍼 지연. 0 이면 DefaultLatency 이다.
+	Latency time.Duration
+	// 비어있으면 암호화하지 않는다. 10~79 자이다.
+	Passphrase string
+	// caller 가 원격에 보내는 SRT streamid. libsrt 는 들어온 연결의 streamid 를 알려주지 않으므로
+	// listener 는 streamid 로 상대를 나눌 수 없고, 스트림마다 다른 포트를 써야 한다.
+	StreamID string
+}
+
+func (c Config) validate() error {
+	if c.Port <= 0 || c.Port > 65535 {
+		return fmt.Errorf("invalid srt port: %d", c.Port)
+	}
+	if c.Mode == ModeCaller && c.Addr == "" {
+		return errors.New("srt caller requires addr")
+	}
+	if c.Mode == ModeListener && c.StreamID != "" {
+		return errors.New("srt listener does not support streamid, use a port per stream")
+	}
+	if c.Passphrase != "" && (len(c.Passphrase) < 10 || len(c.Passphrase) > 79) {
+		return errors.New("srt passphrase must be 10 to 79 characters")
+	}
+	return nil
+}
+
+// url 은 ffmpeg libsrt 의 URL 을 만든다. libsrt 의 latency, listen_timeout 은 microseconds, connect_timeout 은 milliseconds 이다.
+func (c Config) url() string {
+	addr := c.Addr
+	if addr == "" {
+		addr = "0.0.0.0"
+	}
+	latency := c.Latency
+	if latency <= 0 {
+		latency = DefaultLatency
+	}
+
+	query := url.Values{}
+	query.Set("mode", string(c.Mode))
+	query.Set("transtype", "live")
+	query.Set("latency", strconv.FormatInt(latency.Microseconds(), 10))
+	if c.Mode == ModeListener {
+		query.Set("listen_timeout", strconv.FormatInt(acceptTimeout.Microseconds(), 10))
+	} else {
+		query.Set("connect_timeout", strconv.FormatInt(retryInterval.Milliseconds(), 10))
+	}
+	if c.Passphrase != "" {
+		query.Set("passphrase", c.Passphrase)
+	}
+	if c.StreamID != "" {
+		query.Set("streamid", c.StreamID)
+	}
+	return fmt.Sprintf("srt://%s:%d?%s", addr, c.Port, query.Encode())
+}
+
+// Handler 는 트랙을 MPEG-TS 로 묶어서 SRT 로 보낸다. caller 는 끊기면 다시 연결하고, listener 는 연결하는 상대마다 같은 TS 를 보낸다.
+type Handler struct {
+	mu sync.Mutex
+
+	config     Config
+	hasVideo   bool
+	audioStart atomic.Bool
+
+	negotiated      []hubs.Track
+	outputFormatCtx *avformat.FormatContext
+
+	// 키프레임부터 받고 있는 연결
+	conns map[*conn]struct{}
+	// 다음 키프레임부터 받을 연결
+	pending []*conn
+	closed  bool
+	done    chan struct{}
+}
+
+func NewHandler(config Config) *Handler {
+	return &Handler{
+		config: config,
+		conns:  make(map[*conn]struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+func (h *Handler) NegotiatedTracks() []hubs.Track {
+	ret := make([]hubs.Track, 0, len(h.negotiated))
+	return append(ret, h.negotiated...)
+}
+
+func (h *Handler) Init(ctx context.Context, sources []*hubs.HubSource) error {
+	if err := h.config.validate(); err != nil {
+		return err
+	}
+
+	var negotiated []hubs.Track
+	for _, source := range sources {
+		codec, err := source.Codec()
+		if err != nil {
+			return fmt.Errorf("codec not ready: %w", err)
+		}
+		switch source.MediaType() {
+		case types.MediaTypeVideo:
+			if codec.CodecType() != types.CodecTypeH264 {
+				return errors.New("unsupported video codec for mpegts")
+			}
+			h.hasVideo = true
+		case types.MediaTypeAudio:
+			if codec.CodecType() != types.CodecTypeAAC {
+				// MPEG-TS 는 AAC 만 사용하므로 Opus 등은 AAC 로 트랜스코딩한다.
+				audioCodec, err := source.AudioCodec()
+				if err != nil {
+					return fmt.Errorf("audio codec not ready: %w", err)
+				}
+				codec = aac.NewAAC(aac.NewConfig(aac.Parameters{
+					SampleRate:   audioCodec.SampleRate(),
+					Channels:     audioCodec.Channels(),
+					SampleFormat: int(avutil.AV_SAMPLE_FMT_FLTP),
+				}))
+			}
+		default:
+			continue
+		}
+		track := source.GetTrack(codec)
+		if track == nil {
+			return fmt.Errorf("track not ready: %s", codec.String())
+		}
+		negotiated = append(negotiated, track)
+	}
+	if len(negotiated) == 0 {
+		return errors.New("no source tracks found")
+	}
+
+	outputFormatCtx := avformat.NewAvFormatContextNull()
+	if ret := avformat.AvformatAllocOutputContext2(&outputFormatCtx, nil, "", "output.ts"); ret < 0 {
+		return errors.New("avformat context allocation failed")
+	}
+	for _, track := range negotiated {
+		if err := newOutputStream(outputFormatCtx, track.GetCodec()); err != nil {
+			outputFormatCtx.AvformatFreeContext()
+			return err
+		}
+	}
+
+	outputFormatCtx.SetPb(avformat.AVIOOpenDynBuf())
+	dict := avutil.DictionaryNull()
+	// 상대가 중간에 연결해도 다음 키프레임부터 바로 디코딩할 수 있도록 비디오 프레임마다 PAT/PMT 를 쓴다.
+	avutil.AvDictSet(&dict, "mpegts_flags", "+pat_pmt_at_frames", 0)
+	if ret := outputFormatCtx.AvformatWriteHeader(&dict); ret < 0 {
+		avformat.AVIOCloseDynBuf(outputFormatCtx.Pb())
+		outputFormatCtx.AvformatFreeContext()
+		return errors.New("avformat write header failed")
+	}
+	// 헤더(PAT/PMT)는 패킷마다 다시 쓰이므로 버린다.
+	avformat.AVIOCloseDynBuf(outputFormatCtx.Pb())
+	outputFormatCtx.SetPb(avformat.AVIOOpenDynBuf())
+
+	h.outputFormatCtx = outputFormatCtx
+	h.negotiated = negotiated
+
+	go h.connect()
+	return nil
+}
+
+func newOutputStream(outputFormatCtx *avformat.FormatContext, codec codecs.Codec) error {
+	outputStream := outputFormatCtx.AvformatNewStream(nil)
+	if outputStream == nil {
+		return errors.New("avformat stream allocation failed")
+	}
+	avCodec := avcodec.AvcodecFindEncoder(codec.AVCodecID())
+	if avCodec == nil {
+		return errors.New("encoder not found")
+	}
+	avCodecCtx := avCodec.AvCodecAllocContext3()
+	if avCodecCtx == nil {
+		return errors.New("codec context allocation failed")
+	}
+	defer avcodec.AvCodecFreeContext(&avCodecCtx)
+
+	codec.SetCodecContext(avCodecCtx, nil)
+	if ret := avCodecCtx.AvCodecOpen2(avCodec, nil); ret < 0 {
+		return errors.New("codec open failed")
+	}
+	if ret := avcodec.AvCodecParametersFromContext(outputStream.CodecParameters(), avCodecCtx); ret < 0 {
+		return errors.New("codec parameters from context failed")
+	}
+	return nil
+}
+
+// connect 는 세션이 끝날 때까지 연결을 만든다. caller 는 연결이 끊기면 다시 연결하고, listener 는 계속 다음 상대를 기다린다.
+func (h *Handler) connect() {
+	url := h.config.url()
+	for {
+		select {
+		case <-h.done:
+			return
+		default:
+		}
+
+		c, err := dial(url)
+		if err != nil {
+			// listener 는 acceptTimeout 마다 상대가 없다는 에러로 돌아온다.
+			if h.config.Mode == ModeCaller {
+				log.Logger.Warn("srt connect failed", zap.String("addr", h.config.Addr), zap.Int("port", h.config.Port), zap.Error(err))
+				h.wait(retryInterval)
+			}
+			continue
+		}
+		log.Logger.Info("srt connected", zap.String("mode", string(h.config.Mode)), zap.Int("port", h.config.Port))
+		h.addConn(c)
+
+		if h.config.Mode == ModeCaller {
+			select {
+			case <-c.done:
+				log.Logger.Warn("srt disconnected, reconnecting", zap.String("addr", h.config.Addr), zap.Int("port", h.config.Port))
+				h.wait(retryInterval)
+			case <-h.done:
+				return
+			}
+		}
+	}
+}
+
+func (h *Handler) wait(d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-h.done:
+	}
+}
+
+func (h *Handler) addConn(c *conn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		close(c.ch)
+		return
+	}
+	if !h.hasVideo {
+		h.conns[c] = struct{}{}
+		return
+	}
+	h.pending = append(h.pending, c)
+}
+
+func (h *Handler) OnClosed(ctx context.Context) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.outputFormatCtx != nil && !h.closed {
+		// 인터리빙 큐에 남은 패킷과 트레일러를 연결을 닫기 전에 보낸다.
+		if ret := h.outputFormatCtx.AvWriteTrailer(); ret < 0 {
+			log.Logger.Warn("srt write trailer failed", zap.String("error", avutil.AvErr2str(ret)))
+		}
+		buf := avformat.AVIOCloseDynBuf(h.outputFormatCtx.Pb())
+		h.outputFormatCtx.SetPb(avformat.AVIOOpenDynBuf())
+		h.send(buf)
+	}
+
+	h.closed = true
+	close(h.done)
+	for c := range h.conns {
+		close(c.ch)
+	}
+	for _, c := range h.pending {
+		close(c.ch)
+	}
+	h.conns = make(map[*conn]struct{})
+	h.pending = nil
+
+	if h.outputFormatCtx != nil {
+		avformat.AVIOCloseDynBuf(h.outputFormatCtx.Pb())
+		h.outputFormatCtx.SetPb(nil)
+		h.outputFormatCtx.AvformatFreeContext()
+		h.outputFormatCtx = nil
+	}
+	return nil
+}
+
+func (h *Handler) OnTrack(ctx context.Context, track hubs.Track) (*TrackContext, error) {
+	index := slices.Index(h.negotiated, track)
+	stream := h.outputFormatCtx.Streams()[index]
+
+	codec := track.GetCodec()
+	var bitstream bitstreams.Bitstream
+	bitstream = &bitstreams.Empty{}
+	if codec.CodecType() == types.CodecTypeH264 {
+		bitstream = &bitstreams.AVCC{}
+	}
+	return &TrackContext{
+		track:        track,
+		outputStream: stream,
+		writer:       writers.NewWriter(index, stream.TimeBase().Den(), codec, codec.Decoder(), bitstream),
+	}, nil
+}
+
+func (h *Handler) OnVideo(ctx context.Context, trackCtx *TrackContext, u units.Unit) error {
+	writer := trackCtx.writer
+	unit, ok := writer.BitStreamSummary(u)
+	if !ok {
+		return nil
+	}
+	pkt := writer.WriteVideoPkt(unit)
+	defer pkt.AvPacketUnref()
+
+	h.audioStart.Store(true)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if unit.FrameInfo.Flag == 1 {
+		// 인터리빙 큐에 남은 이전 GOP 의 패킷을 먼저 보내고, 기다리던 연결은 이 키프레임부터 받는다.
+		h.write(nil)
+		for _, c := range h.pending {
+			h.conns[c] = struct{}{}
+		}
+		h.pending = nil
+	}
+	h.write(pkt)
+	return nil
+}
+
+func (h *Handler) OnAudio(ctx context.Context, trackCtx *TrackContext, unit units.Unit) error {
+	if h.hasVideo && !h.audioStart.Load() {
+		return nil
+	}
+	writer := trackCtx.writer
+	pkt := writer.WriteAudioPkt(unit)
+	if pkt == nil {
+		return nil
+	}
+	defer pkt.AvPacketUnref()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.write(pkt)
+	return nil
+}
+
+// write 는 pkt 를 TS 로 묶어서 모든 연결에 보낸다. pkt 가 nil 이면 인터리빙 큐를 비운다. h.mu 를 잡고 호출해야 한다.
+func (h *Handler) write(pkt *avcodec.Packet) {
+	if h.closed {
+		return
+	}
+	if ret := h.outputFormatCtx.AvInterleavedWriteFrame(pkt); ret < 0 {
+		log.Logger.Warn("srt write frame failed", zap.String("error", avutil.AvErr2str(ret)))
+	}
+	buf := avformat.AVIOCloseDynBuf(h.outputFormatCtx.Pb())
+	h.outputFormatCtx.SetPb(avformat.AVIOOpenDynBuf())
+	h.send(buf)
+}
+
+// send 는 buf 를 모든 연결에 보낸다. h.mu 를 잡고 호출해야 한다.
+func (h *Handler) send(buf []byte) {
+	if len(buf) == 0 {
+		return
+	}
+
+	for c := range h.conns {
+		if c.closed() {
+			delete(h.conns, c)
+			close(c.ch)
+			continue
+		}
+		select {
+		case c.ch <- buf:
+		default:
+			log.Logger.Warn("srt connection is too slow, dropped")
+			delete(h.conns, c)
+			close(c.ch)
+		}
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/pion/interceptor/pkg/twcc"
 	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
 	pion "github.com/pion/webrtc/v3"
 	"go.uber.org/zap"
 	"mediaserver-go/codecs"
@@ -21,32 +22,49 @@ import (
 	"mediaserver-go/utils/log"
 	"mediaserver-go/utils/types"
 	"mediaserver-go/utils/units"
+	"slices"
 	"strings"
+	"sync"
 )
 
 type TrackContext struct {
 	track hubs.Track
+	// offer 에 없는 미디어 타입이면 nil 이고 보내지 않는다.
+	remoteTrackHandler *RemoteTrackHandler
 }
 
 type Handler struct {
-	cancel             context.CancelFunc
-	se                 pion.SettingEngine
-	me                 *pion.MediaEngine
+	ctx    context.Context
+	cancel context.CancelFunc
+	se     pion.SettingEngine
+	me     *pion.MediaEngine
+	rtcpCh chan rtcp.Packet
+
+	mu sync.Mutex
+	// offer 의 미디어 타입마다 미리 만든 transceiver. 소스가 늦게 추가되어도 재협상 없이 트랙을 붙인다.
+	transceivers       map[types.MediaType]*pion.RTPTransceiver
 	remoteTrackHandler map[types.MediaType]*RemoteTrackHandler
-	rtcpCh             chan rtcp.Packet
+	streamID           string
+	bwe                cc.BandwidthEstimator
 
 	api               *pion.API
 	pc                *pion.PeerConnection
 	onConnectionState chan pion.PeerConnectionState
+
+	// Publish 로 원격 WHIP 서버에 보낼 때 만들어진 세션 URL(Location). 끝나면 DELETE 한다.
+	resource string
+	token    string
 }
 
 func NewHandler(se pion.SettingEngine, me *pion.MediaEngine) (*Handler, context.Context) {
 	ctx, cancel := context.WithCancel(context.Background())
 	return &Handler{
+		ctx:                ctx,
 		cancel:             cancel,
 		se:                 se,
 		me:                 me,
 		rtcpCh:             make(chan rtcp.Packet, 10),
+		transceivers:       make(map[types.MediaType]*pion.RTPTransceiver),
 		remoteTrackHandler: make(map[types.MediaType]*RemoteTrackHandler),
 	}, ctx
 }
@@ -69,13 +87,14 @@ func (h *Handler) Answer() string {
 	return h.pc.LocalDescription().SDP
 }
 
-func (h *Handler) Init(ctx context.Context, stream *hubs.Stream, offer string) error {
+// newPeerConnection 은 송신 대역폭 추정(GCC)을 붙인 PeerConnection 을 만든다.
+func (h *Handler) newPeerConnection() (*pion.API, *pion.PeerConnection, cc.BandwidthEstimator, error) {
 	interceptorRegistry := &interceptor.Registry{}
 	f, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
 		return gcc.NewSendSideBWE(gcc.SendSideBWEMinBitrate(500_000), gcc.SendSideBWEMaxBitrate(3_000_000), gcc.SendSideBWEInitialBitrate(500_000))
 	})
 	if err != nil {
-		return err
+		return nil, nil, nil, err
 	}
 	bweCh := make(chan cc.BandwidthEstimator, 1)
 	f.OnNewPeerConnection(func(id string, estimator cc.BandwidthEstimator) {
@@ -88,38 +107,51 @@ func (h *Handler) Init(ctx context.Context, stream *hubs.Stream, offer string) e
 	pc, err := api.NewPeerConnection(pion.Configuration{
 		SDPSemantics: pion.SDPSemanticsUnifiedPlan,
 	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return api, pc, <-bweCh, nil
+}
+
+// addTransceivers 는 미디어 타입마다 sendonly transceiver 를 미리 만든다.
+// 트랙은 소스가 준비되면 OnTrack 에서 붙인다. 오디오만 또는 비디오만 있는 스트림은 나머지 transceiver 로 아무것도 보내지 않는다.
+func (h *Handler) addTransceivers(pc *pion.PeerConnection, mediaTypes []types.MediaType) error {
+	for _, mediaType := range mediaTypes {
+		transceiver, err := pc.AddTransceiverFromKind(pion.NewRTPCodecType(string(mediaType)), pion.RTPTransceiverInit{
+			Direction: pion.RTPTransceiverDirectionSendonly,
+		})
+		if err != nil {
+			return err
+		}
+		h.transceivers[mediaType] = transceiver
+	}
+	return nil
+}
+
+func (h *Handler) onConnectionStateChange(connectionState pion.PeerConnectionState) {
+	log.Logger.Info("connection state changed", zap.String("state", connectionState.String()))
+	switch connectionState {
+	case pion.PeerConnectionStateClosed, pion.PeerConnectionStateFailed, pion.PeerConnectionStateDisconnected:
+		h.cancel()
+	}
+}
+
+func (h *Handler) Init(ctx context.Context, stream *hubs.Stream, offer string) error {
+	api, pc, bwe, err := h.newPeerConnection()
 	if err != nil {
 		return err
 	}
-	bwe := <-bweCh
 
 	streamID, err := uuid.NewRandom()
 	if err != nil {
 		return err
 	}
-	localTrackMap := make(map[types.MediaType]*pion.TrackLocalStaticRTP)
-	for mediaType, codec := range stream.GetCodecs() {
-		trackID, err := uuid.NewRandom()
-		if err != nil {
-			return err
-		}
-		availableCodec := h.PreferredCodec(codec)
-		webrtcCodecCapability, err := availableCodec.WebRTCCodecCapability()
-		if err != nil {
-			return err
-		}
-		localTrack, err := pion.NewTrackLocalStaticRTP(webrtcCodecCapability, trackID.String(), streamID.String())
-		if err != nil {
-			return err
-		}
-		localTrackMap[mediaType] = localTrack
-		transceiver, err := pc.AddTransceiverFromTrack(localTrack)
-		if err != nil {
-			return err
-		}
-		if transceiver.Sender() == nil {
-			return fmt.Errorf("transceiver sender is nil")
-		}
+	mediaTypes, err := offerMediaTypes(offer)
+	if err != nil {
+		return err
+	}
+	if err := h.addTransceivers(pc, mediaTypes); err != nil {
+		return err
 	}
 
 	if err := pc.SetRemoteDescription(pion.SessionDescription{
@@ -138,13 +170,7 @@ func (h *Handler) Init(ctx context.Context, stream *hubs.Stream, offer string) e
 		}
 		candidateCh <- candidate
 	})
-	pc.OnConnectionStateChange(func(connectionState pion.PeerConnectionState) {
-		log.Logger.Info("connection state changed", zap.String("state", connectionState.String()))
-		switch connectionState {
-		case pion.PeerConnectionStateClosed, pion.PeerConnectionStateFailed, pion.PeerConnectionStateDisconnected:
-			h.cancel()
-		}
-	})
+	pc.OnConnectionStateChange(h.onConnectionStateChange)
 	pc.OnTrack(func(remote *pion.TrackRemote, receiver *pion.RTPReceiver) {
 	})
 
@@ -160,71 +186,155 @@ func (h *Handler) Init(ctx context.Context, stream *hubs.Stream, offer string) e
 	for range candidateCh {
 	}
 
-	for _, transceiver := range pc.GetTransceivers() {
-		mediaType := types.NewMediaType(transceiver.Kind().String())
-		codec := stream.GetCodecs()[mediaType]
-		availableCodec := h.PreferredCodec(codec)
-		packetizer, remoteRTXHandler, err := getPacketizerAndRemoteRTX(transceiver.Sender(), availableCodec.MimeType())
+	h.streamID = streamID.String()
+	h.bwe = bwe
+	h.api = api
+	h.pc = pc
+	//log.Logger.Info("whep negotiated end", zap.Int("negotiated", len(negotidated)))
+	return nil
+}
+
+// offerMediaTypes 는 offer 의 m-line 에 있는 미디어 타입을 순서대로 반환한다.
+func offerMediaTypes(offer string) ([]types.MediaType, error) {
+	var sd sdp.SessionDescription
+	if err := sd.Unmarshal([]byte(offer)); err != nil {
+		return nil, err
+	}
+	var mediaTypes []types.MediaType
+	for _, media := range sd.MediaDescriptions {
+		mediaType := types.NewMediaType(media.MediaName.Media)
+		if mediaType != types.MediaTypeVideo && mediaType != types.MediaTypeAudio || slices.Contains(mediaTypes, mediaType) {
+			continue
+		}
+		mediaTypes = append(mediaTypes, mediaType)
+	}
+	return mediaTypes, nil
+}
+
+// attach 는 미디어 타입의 첫 트랙을 미리 만든 transceiver 에 붙이고 RemoteTrackHandler 를 시작한다.
+// 같은 미디어 타입의 다음 트랙(simulcast 레이어)은 같은 RemoteTrackHandler 를 쓴다.
+// 채널의 입력이 바뀌어 코덱이 달라진 트랙이면 같은 sender 에 트랙만 바꿔서 SSRC 를 유지한다.
+func (h *Handler) attach(codec codecs.Codec) (*RemoteTrackHandler, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	mediaType := codec.MediaType()
+	transceiver, ok := h.transceivers[mediaType]
+	if !ok {
+		return nil, nil
+	}
+	if remoteTrackHandler, ok := h.remoteTrackHandler[mediaType]; ok {
+		if remoteTrackHandler.mimeType() == codec.MimeType() {
+			return remoteTrackHandler, nil
+		}
+		localTrack, packetizer, remoteRTXHandler, err := h.replaceTrack(transceiver, codec)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		remoteTrackHandler.switchTrack(localTrack, packetizer, remoteRTXHandler)
+		log.Logger.Info("whep track switched", zap.String("mediaType", string(mediaType)), zap.String("codec", codec.MimeType()))
+		return remoteTrackHandler, nil
+	}
 
-		var playoutDelayHandler *playoutdelay.Handler
-		var getExtensions []func() (int, []byte, bool)
-		for _, ext := range transceiver.Sender().GetParameters().HeaderExtensions {
-			switch ext.URI {
-			case "http://www.webrtc.org/experiments/rtp-hdrext/playout-delay":
-				playoutDelayHandler = playoutdelay.NewHandler(ext.ID, true)
-				getExtensions = append(getExtensions, playoutDelayHandler.GetPayload)
-			case "http://www.webrtc.org/experiments/rtp-hdrext/abs-send-time":
-				packetizer.EnableAbsSendTime(ext.ID)
-			}
+	localTrack, packetizer, remoteRTXHandler, err := h.replaceTrack(transceiver, codec)
+	if err != nil {
+		return nil, err
+	}
+
+	var playoutDelayHandler *playoutdelay.Handler
+	var getExtensions []func() (int, []byte, bool)
+	for _, ext := range transceiver.Sender().GetParameters().HeaderExtensions {
+		if ext.URI == "http://www.webrtc.org/experiments/rtp-hdrext/playout-delay" {
+			playoutDelayHandler = playoutdelay.NewHandler(ext.ID, true)
+			getExtensions = append(getExtensions, playoutDelayHandler.GetPayload)
 		}
+	}
 
-		stats := NewStats()
-
-		remoteTrackHandler := NewRemoteTrackHandler(Args{
-			mediaType:              mediaType,
-			localTrack:             localTrackMap[mediaType],
-			transceiver:            transceiver,
-			sender:                 transceiver.Sender(),
-			stats:                  stats,
-			packetizer:             packetizer,
-			remoteRTXHandler:       remoteRTXHandler,
-			playoutDelayHandler:    playoutDelayHandler,
-			getExtensions:          getExtensions,
-			adaptiveBitrateHandler: NewABSHandler(stats, bwe),
-			pc:                     pc,
-		})
-		go remoteTrackHandler.Run(ctx)
+	stats := NewStats()
+
+	remoteTrackHandler := NewRemoteTrackHandler(Args{
+		mediaType:              mediaType,
+		localTrack:             localTrack,
+		transceiver:            transceiver,
+		sender:                 transceiver.Sender(),
+		stats:                  stats,
+		packetizer:             packetizer,
+		remoteRTXHandler:       remoteRTXHandler,
+		playoutDelayHandler:    playoutDelayHandler,
+		getExtensions:          getExtensions,
+		adaptiveBitrateHandler: NewABSHandler(stats, h.bwe),
+		pc:                     h.pc,
+	})
+	go remoteTrackHandler.Run(h.ctx)
 
-		h.remoteTrackHandler[mediaType] = remoteTrackHandler
+	h.remoteTrackHandler[mediaType] = remoteTrackHandler
+	log.Logger.Info("whep track attached", zap.String("mediaType", string(mediaType)), zap.String("codec", codec.MimeType()))
+	return remoteTrackHandler, nil
+}
+
+// replaceTrack 은 codec 의 로컬 트랙을 transceiver 에 붙이고 그 트랙에 쓸 packetizer 를 만든다.
+func (h *Handler) replaceTrack(transceiver *pion.RTPTransceiver, codec codecs.Codec) (*pion.TrackLocalStaticRTP, rtp.Packetizer, *remoteRTX, error) {
+	webrtcCodecCapability, err := codec.WebRTCCodecCapability()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	trackID, err := uuid.NewRandom()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	localTrack, err := pion.NewTrackLocalStaticRTP(webrtcCodecCapability, trackID.String(), h.streamID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	// 브라우저가 offer 에 넣은 코덱이면 재협상 없이 바꿀 수 있다.
+	if err := transceiver.Sender().ReplaceTrack(localTrack); err != nil {
+		return nil, nil, nil, fmt.Errorf("replace %s track failed: %w", codec.MediaType(), err)
 	}
 
-	h.api = api
-	h.pc = pc
-	//log.Logger.Info("whep negotiated end", zap.Int("negotiated", len(negotidated)))
-	return nil
+	packetizer, remoteRTXHandler, err := getPacketizerAndRemoteRTX(transceiver.Sender(), codec.MimeType())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for _, ext := range transceiver.Sender().GetParameters().HeaderExtensions {
+		if ext.URI == "http://www.webrtc.org/experiments/rtp-hdrext/abs-send-time" {
+			packetizer.EnableAbsSendTime(ext.ID)
+		}
+	}
+	return localTrack, packetizer, remoteRTXHandler, nil
 }
 
 func (h *Handler) OnClosed(ctx context.Context) error {
 	h.cancel()
+	if h.pc == nil {
+		return nil
+	}
 	h.pc.Close()
-
+	if h.resource != "" {
+		return deleteWHIPResource(h.resource, h.token)
+	}
 	return nil
 }
 
 func (h *Handler) OnTrack(ctx context.Context, track hubs.Track) (*TrackContext, error) {
-	codec := track.GetCodec()
-	mediaType := codec.MediaType()
-	h.remoteTrackHandler[mediaType].adaptiveBitrateHandler.SetMaxSpatialLayer(track.RID())
+	remoteTrackHandler, err := h.attach(track.GetCodec())
+	if err != nil {
+		// 코덱을 보낼 수 없는 트랙만 버리고 다른 트랙은 계속 보낸다.
+		log.Logger.Warn("whep track skipped", zap.String("codec", track.GetCodec().MimeType()), zap.Error(err))
+	}
+	if remoteTrackHandler != nil && track.GetCodec().MediaType() == types.MediaTypeVideo {
+		remoteTrackHandler.adaptiveBitrateHandler.SetMaxSpatialLayer(track.RID())
+	}
 	return &TrackContext{
-		track: track,
+		track:              track,
+		remoteTrackHandler: remoteTrackHandler,
 	}, nil
 }
 
 func (h *Handler) OnVideo(ctx context.Context, trackCtx *TrackContext, unit units.Unit, rid string) error {
-	remoteHandler := h.remoteTrackHandler[types.MediaTypeVideo]
+	remoteHandler := trackCtx.remoteTrackHandler
+	if remoteHandler == nil {
+		return nil
+	}
 	if rid == "" {
 		return remoteHandler.onVideo(ctx, trackCtx.track, unit, rid)
 	}
@@ -241,8 +351,11 @@ func (h *Handler) OnVideo(ctx context.Context, trackCtx *TrackContext, unit unit
 	return nil
 }
 
-func (h *Handler) OnAudio(ctx context.Context, _ *TrackContext, unit units.Unit, rid string) error {
-	remoteHandler := h.remoteTrackHandler[types.MediaTypeAudio]
+func (h *Handler) OnAudio(ctx context.Context, trackCtx *TrackContext, unit units.Unit, rid string) error {
+	remoteHandler := trackCtx.remoteTrackHandler
+	if remoteHandler == nil {
+		return nil
+	}
 
 	return remoteHandler.onAudio(ctx, nil, unit)
 }
@@ -37,6 +37,13 @@ type RemoteTrackHandler struct {
 	getExtensions          []func() (int, []byte, bool)
 	remoteRTXHandler       *remoteRTX
 	adaptiveBitrateHandler *ABSHandler
+
+	// switchTrack 으로 트랙을 바꾼 뒤에도 같은 SSRC 의 sequence number 와 timestamp 가 이어지도록 더하는 값
+	resequence bool
+	seqOffset  uint16
+	tsOffset   uint32
+	lastSeq    uint16
+	lastTS     uint32
 }
 
 type Args struct {
@@ -103,7 +110,40 @@ func (r *RemoteTrackHandler) Run(ctx context.Context) error {
 	}
 }
 
+func (r *RemoteTrackHandler) mimeType() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.localTrack.Codec().MimeType
+}
+
+// switchTrack 은 채널의 입력이 바뀌어 코덱이 달라졌을 때 sender 에 새로 붙인 트랙과 packetizer 로 바꾼다.
+func (r *RemoteTrackHandler) switchTrack(localTrack *pion.TrackLocalStaticRTP, packetizer rtp.Packetizer, remoteRTXHandler *remoteRTX) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.localTrack = localTrack
+	r.packetizer = packetizer
+	r.remoteRTXHandler = remoteRTXHandler
+	r.resequence = true
+}
+
+// continueSequence 는 트랙을 바꾼 뒤 첫 패킷이 이전 트랙의 마지막 패킷에 이어지도록 offset 을 정하고 적용한다.
+func (r *RemoteTrackHandler) continueSequence(rtpPacket *rtp.Packet, samples uint32) {
+	if r.resequence {
+		r.seqOffset = r.lastSeq + 1 - rtpPacket.SequenceNumber
+		r.tsOffset = r.lastTS + samples - rtpPacket.Timestamp
+		r.resequence = false
+	}
+	rtpPacket.SequenceNumber += r.seqOffset
+	rtpPacket.Timestamp += r.tsOffset
+	r.lastSeq = rtpPacket.SequenceNumber
+	r.lastTS = rtpPacket.Timestamp
+}
+
 func (r *RemoteTrackHandler) onVideo(ctx context.Context, track hubs.Track, unit units.Unit, rid string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	if !r.adaptiveBitrateHandler.isCurrentSpatialLayer(rid) {
 		return nil
 	}
@@ -122,6 +162,7 @@ func (r *RemoteTrackHandler) onVideo(ctx context.Context, track hubs.Track, unit
 
 	rtpPackets := r.packetizer.Packetize(unit.Payload, 3000)
 	for _, rtpPacket := range rtpPackets {
+		r.continueSequence(rtpPacket, 3000)
 		for _, getExt := range r.getExtensions {
 			id, payload, ok := getExt()
 			if !ok {
@@ -145,7 +186,11 @@ func (r *RemoteTrackHandler) onVideo(ctx context.Context, track hubs.Track, unit
 }
 
 func (r *RemoteTrackHandler) onAudio(ctx context.Context, track hubs.Track, unit units.Unit) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	for _, rtpPacket := range r.packetizer.Packetize(unit.Payload, 960) { // todo. 추상화 필요. opus 로 가정함
+		r.continueSequence(rtpPacket, 960)
 		n, err := rtpPacket.MarshalTo(r.buf)
 		if err != nil {
 			fmt.Println("marshal rtp err:", err)
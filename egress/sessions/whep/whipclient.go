@@ -0,0 +1,133 @@
+package whep
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	pion "github.com/pion/webrtc/v3"
+
+	"mediaserver-go/utils/types"
+)
+
+const (
+	whipDeleteTimeout = 5 * time.Second
+)
+
+var (
+	errWHIPStatus     = errors.New("unexpected whip response status")
+	errWHIPNoLocation = errors.New("whip response has no location")
+)
+
+// Publish 는 WHEP 와 같은 트랙 처리로 원격 WHIP endpoint 에 스트림을 보낸다. 이 서버가 offer 를 만든다.
+// 연결이 끊기면 Init 과 같이 handler 의 ctx 가 끝난다.
+func (h *Handler) Publish(ctx context.Context, endpoint, token string) error {
+	api, pc, bwe, err := h.newPeerConnection()
+	if err != nil {
+		return err
+	}
+	h.api = api
+	h.pc = pc
+	h.bwe = bwe
+
+	streamID, err := uuid.NewRandom()
+	if err != nil {
+		return err
+	}
+	h.streamID = streamID.String()
+	if err := h.addTransceivers(pc, []types.MediaType{types.MediaTypeVideo, types.MediaTypeAudio}); err != nil {
+		return err
+	}
+	pc.OnConnectionStateChange(h.onConnectionStateChange)
+
+	sd, err := pc.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+	// 원격 서버가 trickle ICE 를 받지 않을 수 있으므로 후보를 모두 모은 뒤 보낸다.
+	gatherComplete := pion.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(sd); err != nil {
+		return err
+	}
+	select {
+	case <-gatherComplete:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	answer, resource, err := postWHIPOffer(ctx, endpoint, token, pc.LocalDescription().SDP)
+	if err != nil {
+		return err
+	}
+	h.resource, h.token = resource, token
+	return pc.SetRemoteDescription(pion.SessionDescription{
+		Type: pion.SDPTypeAnswer,
+		SDP:  answer,
+	})
+}
+
+// postWHIPOffer 는 offer 를 보내고 answer 와 세션 URL 을 받는다. Location 이 상대 경로이면 endpoint 기준으로 바꾼다.
+func postWHIPOffer(ctx context.Context, endpoint, token, offer string) (string, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(offer))
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Content-Type", "application/sdp")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("%w: %s %d", errWHIPStatus, endpoint, resp.StatusCode)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", "", err
+	}
+
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return "", "", errWHIPNoLocation
+	}
+	base, err := url.Parse(endpoint)
+	if err != nil {
+		return "", "", err
+	}
+	resource, err := base.Parse(location)
+	if err != nil {
+		return "", "", err
+	}
+	return string(b), resource.String(), nil
+}
+
+// deleteWHIPResource 는 원격 서버의 세션을 끝낸다. 원격 서버가 DELETE 를 지원하지 않아도 연결이 끊기면 정리된다.
+func deleteWHIPResource(resource, token string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), whipDeleteTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, resource, nil)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,100 @@
+package endpoints
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"mediaserver-go/utils/dto"
+)
+
+type ChannelServer interface {
+	StartSession(streamID string, request dto.ChannelRequest) (dto.ChannelResponse, error)
+	Switch(streamID string, request dto.ChannelSwitchRequest) (dto.ChannelResponse, error)
+	GetChannel(streamID string) (dto.ChannelResponse, error)
+	StopSession(streamID string) error
+}
+
+type ChannelHandler struct {
+	channelServer ChannelServer
+}
+
+func NewChannelHandler(channelServer ChannelServer) ChannelHandler {
+	return ChannelHandler{
+		channelServer: channelServer,
+	}
+}
+
+func (h *ChannelHandler) Register(e *echo.Echo) {
+	e.POST("/v1/channels", h.Handle)
+	e.GET("/v1/channels", h.HandleGet)
+	e.PATCH("/v1/channels", h.HandleSwitch)
+	e.DELETE("/v1/channels", h.HandleStop)
+}
+
+func (h *ChannelHandler) Handle(c echo.Context) error {
+	token, err := getToken(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid token")
+	}
+
+	var req dto.ChannelRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid request")
+	}
+
+	streamID := token
+	resp, err := h.channelServer.StartSession(streamID, req)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (h *ChannelHandler) HandleGet(c echo.Context) error {
+	token, err := getToken(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid token")
+	}
+
+	streamID := token
+	resp, err := h.channelServer.GetChannel(streamID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err)
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (h *ChannelHandler) HandleSwitch(c echo.Context) error {
+	token, err := getToken(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid token")
+	}
+
+	var req dto.ChannelSwitchRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid request")
+	}
+
+	streamID := token
+	resp, err := h.channelServer.Switch(streamID, req)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (h *ChannelHandler) HandleStop(c echo.Context) error {
+	token, err := getToken(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid token")
+	}
+
+	streamID := token
+	if err := h.channelServer.StopSession(streamID); err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err)
+	}
+
+	c.Response().WriteHeader(http.StatusOK)
+	return nil
+}
@@ -0,0 +1,87 @@
+package endpoints
+
+import (
+	"github.com/labstack/echo/v4"
+	"mediaserver-go/utils/dto"
+	"net/http"
+)
+
+type CompositorServer interface {
+	StartSession(streamID string, request dto.CompositorRequest) (dto.CompositorResponse, error)
+	UpdateLayout(streamID string, request dto.CompositorLayoutRequest) error
+	StopSession(streamID string) error
+}
+
+type CompositorHandler struct {
+	compositorServer CompositorServer
+}
+
+func NewCompositorHandler(compositorServer CompositorServer) CompositorHandler {
+	return CompositorHandler{
+		compositorServer: compositorServer,
+	}
+}
+
+func (h *CompositorHandler) Register(e *echo.Echo) {
+	e.POST("/v1/compositor", h.Handle)
+	e.PATCH("/v1/compositor", h.HandleLayout)
+	e.DELETE("/v1/compositor", h.HandleStop)
+}
+
+func (h *CompositorHandler) Handle(c echo.Context) error {
+	token, err := getToken(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid token")
+	}
+
+	var req dto.CompositorRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid request")
+	}
+	if len(req.Inputs) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "no inputs")
+	}
+
+	streamID := token
+	if _, err := h.compositorServer.StartSession(streamID, req); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+
+	c.Response().WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (h *CompositorHandler) HandleLayout(c echo.Context) error {
+	token, err := getToken(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid token")
+	}
+
+	var req dto.CompositorLayoutRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid request")
+	}
+
+	streamID := token
+	if err := h.compositorServer.UpdateLayout(streamID, req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+
+	c.Response().WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (h *CompositorHandler) HandleStop(c echo.Context) error {
+	token, err := getToken(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid token")
+	}
+
+	streamID := token
+	if err := h.compositorServer.StopSession(streamID); err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err)
+	}
+
+	c.Response().WriteHeader(http.StatusOK)
+	return nil
+}
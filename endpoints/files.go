@@ -38,6 +38,21 @@ func (w *IngressFileHandler) Handle(c echo.Context) error {
 	return nil
 }
 
+func (w *IngressFileHandler) HandleStop(c echo.Context) error {
+	token, err := getToken(c)
+	if err != nil {
+		return err
+	}
+
+	streamID := token
+	if err := w.ingressServer.StopSession(streamID); err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err)
+	}
+
+	c.Response().WriteHeader(http.StatusOK)
+	return nil
+}
+
 type EgressFileHandler struct {
 	egressServer EgressFileServer
 }
@@ -69,3 +84,18 @@ func (w *EgressFileHandler) Handle(c echo.Context) error {
 	c.Response().WriteHeader(http.StatusOK)
 	return nil
 }
+
+func (w *EgressFileHandler) HandleStop(c echo.Context) error {
+	token, err := getToken(c)
+	if err != nil {
+		return err
+	}
+
+	streamID := token
+	if err := w.egressServer.StopSession(streamID); err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err)
+	}
+
+	c.Response().WriteHeader(http.StatusOK)
+	return nil
+}
@@ -0,0 +1,138 @@
+package endpoints
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+
+	"mediaserver-go/egress/sessions/flv"
+)
+
+const (
+	webSocketWriteTimeout = 10 * time.Second
+)
+
+type FLVServer interface {
+	Subscribe(streamID string) (*flv.Subscriber, error)
+}
+
+type FLVHandler struct {
+	upgrader  websocket.Upgrader
+	flvServer FLVServer
+}
+
+func NewFLVHandler(flvServer FLVServer) FLVHandler {
+	return FLVHandler{
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool {
+				return true
+			},
+		},
+		flvServer: flvServer,
+	}
+}
+
+func (f *FLVHandler) Register(e *echo.Echo) {
+	// flv.js, mpegts.js 는 다른 origin 의 웹 페이지에서 요청한다.
+	cors := middleware.CORSWithConfig(middleware.CORSConfig{
+		AllowOrigins: []string{"*"},
+		AllowMethods: []string{http.MethodGet, http.MethodOptions},
+	})
+	e.Match([]string{http.MethodGet, http.MethodOptions}, "/v1/flv/:streamID", f.handleHTTP, cors)
+	e.GET("/v1/ws-flv/:streamID", f.handleWebSocket)
+}
+
+// handleHTTP 는 GET /v1/flv/:streamID.flv 로 FLV 를 끝없는 응답 본문(chunked)으로 보낸다.
+func (f *FLVHandler) handleHTTP(c echo.Context) error {
+	streamID, ok := flvStreamID(c)
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid parameters")
+	}
+	subscriber, err := f.flvServer.Subscribe(streamID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err)
+	}
+	defer subscriber.Close()
+
+	header := c.Response().Header()
+	header.Set(echo.HeaderContentType, "video/x-flv")
+	header.Set("Cache-Control", "no-cache")
+	c.Response().WriteHeader(http.StatusOK)
+
+	ctx := c.Request().Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case b, ok := <-subscriber.Data():
+			if !ok {
+				return nil
+			}
+			if _, err := c.Response().Write(b); err != nil {
+				return nil
+			}
+			c.Response().Flush()
+		}
+	}
+}
+
+// handleWebSocket 은 GET /v1/ws-flv/:streamID.flv 로 FLV 를 바이너리 메시지로 보낸다.
+func (f *FLVHandler) handleWebSocket(c echo.Context) error {
+	streamID, ok := flvStreamID(c)
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid parameters")
+	}
+	subscriber, err := f.flvServer.Subscribe(streamID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err)
+	}
+	defer subscriber.Close()
+
+	conn, err := f.upgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	writeWebSocket(conn, subscriber.Data())
+	return nil
+}
+
+// writeWebSocket 은 data 가 닫히거나 클라이언트가 연결을 끊을 때까지 data 를 바이너리 메시지로 보낸다.
+func writeWebSocket(conn *websocket.Conn, data <-chan []byte) {
+	// 클라이언트가 보내는 메시지는 없다. 연결이 끊긴 것을 알기 위해서만 읽는다.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case b, ok := <-data:
+			if !ok {
+				_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+				return
+			}
+			_ = conn.SetWriteDeadline(time.Now().Add(webSocketWriteTimeout))
+			if err := conn.WriteMessage(websocket.BinaryMessage, b); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func flvStreamID(c echo.Context) (string, bool) {
+	streamID, ok := strings.CutSuffix(streamIDParam(c), ".flv")
+	return streamID, ok && streamID != ""
+}
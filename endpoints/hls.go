@@ -1,11 +1,33 @@
 package endpoints
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"mediaserver-go/egress/servers"
 	"mediaserver-go/utils/dto"
 	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+const (
+	// 세그먼트, 파트, init 세그먼트는 이름이 바뀌지 않는 한 내용도 바뀌지 않는다.
+	cacheControlImmutable = "public, max-age=31536000, immutable"
+	// 아직 쓰고 있는 세그먼트는 요청마다 길이가 달라진다.
+	cacheControlInProgress = "no-cache"
+	// _HLS_msn 이 붙은 blocking 요청은 URL 마다 응답이 정해진다.
+	cacheControlBlocking = "public, max-age=60"
+	// 라이브 플레이리스트는 세그먼트가 추가될 때마다 바뀐다.
+	cacheControlPlaylist = "public, max-age=1"
+	cacheControlMaster   = "public, max-age=10"
 )
 
 type HLSHandler struct {
@@ -20,83 +42,208 @@ func NewHLSHandler(hlsServer HLSServer) HLSHandler {
 
 func (h *HLSHandler) Register(e *echo.Echo) {
 	e.POST("/v1/hls", h.Handle)
-	e.GET("/v1/llhls/:streamID/:target", func(c echo.Context) error {
-		streamID, target := c.Param("streamID"), c.Param("target")
-		if streamID == "" || target == "" {
-			return echo.NewHTTPError(http.StatusBadRequest, "invalid parameters")
-		}
-		handle, err := h.hlsServer.GetHLSStream(streamID)
+
+	// 플레이어는 다른 origin(CDN, 웹 페이지)에서 요청하므로 CORS 를 허용하고, 플레이리스트만 gzip 으로 압축한다.
+	cors := middleware.CORSWithConfig(middleware.CORSConfig{
+		AllowOrigins:  []string{"*"},
+		AllowMethods:  []string{http.MethodGet, http.MethodHead, http.MethodOptions},
+		AllowHeaders:  []string{"Range", "If-None-Match"},
+		ExposeHeaders: []string{echo.HeaderContentLength, "Content-Range", "Accept-Ranges", "ETag"},
+	})
+	gzip := middleware.GzipWithConfig(middleware.GzipConfig{
+		Skipper: func(c echo.Context) bool {
+			return path.Ext(c.Param("target")) != ".m3u8"
+		},
+	})
+	methods := []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+	e.Match(methods, "/v1/vod/:streamID/:target", h.handleLatestVOD, cors)
+	e.Match(methods, "/v1/vod/:streamID/:session/:target", h.handleVOD, cors, gzip)
+	e.Match(methods, "/v1/llhls/:streamID/:target", h.handleLLHLS, cors, gzip)
+	e.Match(methods, "/v1/hls/:streamID/:target", h.handleHLS, cors, gzip)
+}
+
+func (h *HLSHandler) handleLLHLS(c echo.Context) error {
+	streamID, target := streamIDParam(c), c.Param("target")
+	if streamID == "" || target == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid parameters")
+	}
+	handle, err := h.hlsServer.GetHLSStream(streamID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err)
+	}
+	switch target {
+	case "index.m3u8":
+		b, err := handle.GetMasterM3U8()
 		if err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, err)
 		}
-		switch target {
-		case "index.m3u8":
-			b, err := handle.GetMasterM3U8()
-			if err != nil {
-				return echo.NewHTTPError(http.StatusInternalServerError, err)
-			}
-			return c.Blob(http.StatusOK, "application/vnd.apple.mpegurl", b)
-		case "video.m3u8":
-			medisSN, part := c.QueryParam("_HLS_msn"), c.QueryParam("_HLS_part")
-			b, err := handle.GetMediaM3U8LLHLS(medisSN, part)
-			if err != nil {
-				return echo.NewHTTPError(http.StatusInternalServerError, err)
-			}
-			return c.Blob(http.StatusOK, "application/vnd.apple.mpegurl", b)
-		case "init.mp4":
-			b, err := handle.GetPayload(target)
-			if err != nil {
-				return echo.NewHTTPError(http.StatusInternalServerError, err)
-			}
-			fmt.Println("[TESTDEBUG] init mp4 byte:", len(b))
-			return c.Blob(http.StatusOK, "video/mp4", b)
-		default:
-			b, err := handle.GetPayload(target)
-			fmt.Println("[TESTDEBUG] target:", target, ", mp4 byte:", len(b))
-			if err != nil {
-				return echo.NewHTTPError(http.StatusInternalServerError, err)
-			}
-			return c.Blob(http.StatusOK, "video/mp4", b)
+		return serveHLS(c, target, b, cacheControlMaster)
+	case "video.m3u8":
+		mediaSN, part := c.QueryParam("_HLS_msn"), c.QueryParam("_HLS_part")
+		b, err := handle.GetMediaM3U8LLHLS(mediaSN, part)
+		if err != nil {
+			return blockingError(err)
+		}
+		cacheControl := cacheControlPlaylist
+		if mediaSN != "" {
+			cacheControl = cacheControlBlocking
 		}
-	})
-	e.GET("/v1/hls/:streamID/:target", func(c echo.Context) error {
-		streamID, target := c.Param("streamID"), c.Param("target")
-		if streamID == "" || target == "" {
-			return echo.NewHTTPError(http.StatusBadRequest, "invalid parameters")
+		return serveHLS(c, target, b, cacheControl)
+	default:
+		return h.servePayload(c, handle, target)
+	}
+}
+
+func (h *HLSHandler) handleHLS(c echo.Context) error {
+	streamID, target := streamIDParam(c), c.Param("target")
+	if streamID == "" || target == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid parameters")
+	}
+	handle, err := h.hlsServer.GetHLSStream(streamID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err)
+	}
+	switch target {
+	case "index.m3u8":
+		b, err := handle.GetMasterM3U8()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err)
 		}
-		handle, err := h.hlsServer.GetHLSStream(streamID)
+		return serveHLS(c, target, b, cacheControlMaster)
+	case "video.m3u8":
+		b, err := handle.GetMediaM3U8HLS()
 		if err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, err)
 		}
-		switch target {
-		case "index.m3u8":
-			b, err := handle.GetMasterM3U8()
-			if err != nil {
-				return echo.NewHTTPError(http.StatusInternalServerError, err)
-			}
-			return c.Blob(http.StatusOK, "application/vnd.apple.mpegurl", b)
-		case "video.m3u8":
-			b, err := handle.GetMediaM3U8HLS()
-			if err != nil {
-				return echo.NewHTTPError(http.StatusInternalServerError, err)
-			}
-			return c.Blob(http.StatusOK, "application/vnd.apple.mpegurl", b)
-		case "init.mp4":
-			b, err := handle.GetPayload(target)
-			if err != nil {
-				return echo.NewHTTPError(http.StatusInternalServerError, err)
-			}
-			fmt.Println("[TESTDEBUG] hls target:", target, ",  len:", len(b))
-			return c.Blob(http.StatusOK, "video/mp4", b)
-		default:
-			b, err := handle.GetPayload(target)
-			if err != nil {
-				return echo.NewHTTPError(http.StatusInternalServerError, err)
-			}
-			fmt.Println("[TESTDEBUG] hls target:", target, ",  len:", len(b))
-			return c.Blob(http.StatusOK, "video/mp4", b)
+		return serveHLS(c, target, b, cacheControlPlaylist)
+	default:
+		return h.servePayload(c, handle, target)
+	}
+}
+
+// servePayload 는 세그먼트, 파트, init 세그먼트를 반환한다. Range 요청이면 아직 쓰고 있는 세그먼트(byte-range 파트)도 기다렸다가 반환한다.
+func (h *HLSHandler) servePayload(c echo.Context, handle *servers.HLSHandler, target string) error {
+	start, end, ok := parseRange(c.Request().Header.Get("Range"))
+	if !ok {
+		b, err := handle.GetPayload(target)
+		if err != nil {
+			return blockingError(err)
 		}
-	})
+		return serveHLS(c, target, b, cacheControlImmutable)
+	}
+
+	b, complete, err := handle.GetPartialPayload(target, start)
+	if err != nil {
+		return blockingError(err)
+	}
+	if !complete {
+		return servePartial(c, target, b, start, end)
+	}
+	return serveHLS(c, target, b, cacheControlImmutable)
+}
+
+// handleLatestVOD 는 가장 최근에 끝난 세션으로 redirect 한다. 세션마다 URL 이 다르므로 다시 발행되어도 캐시된 VOD 와 섞이지 않는다.
+func (h *HLSHandler) handleLatestVOD(c echo.Context) error {
+	streamID, target := streamIDParam(c), c.Param("target")
+	if streamID == "" || target == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid parameters")
+	}
+	session, err := h.hlsServer.GetLatestVODSession(streamID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err)
+	}
+	c.Response().Header().Set("Cache-Control", cacheControlPlaylist)
+	// 요청 URL 기준의 상대 경로라서 streamID 를 다시 이스케이프하지 않아도 된다.
+	return c.Redirect(http.StatusFound, url.PathEscape(session)+"/"+url.PathEscape(target))
+}
+
+func (h *HLSHandler) handleVOD(c echo.Context) error {
+	streamID, session, target := streamIDParam(c), c.Param("session"), c.Param("target")
+	if streamID == "" || session == "" || target == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid parameters")
+	}
+	b, err := h.hlsServer.GetVODPayload(streamID, session, target)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err)
+	}
+	// VOD 는 스트림이 끝난 후 만들어지므로 플레이리스트도 바뀌지 않는다.
+	return serveHLS(c, target, b, cacheControlImmutable)
+}
+
+// serveHLS 는 ETag/If-None-Match, Range, HEAD 를 http.ServeContent 로 처리한다.
+func serveHLS(c echo.Context, name string, b []byte, cacheControl string) error {
+	header := c.Response().Header()
+	header.Set(echo.HeaderContentType, hlsContentType(name))
+	header.Set("Cache-Control", cacheControl)
+	header.Set("ETag", fmt.Sprintf(`"%x-%x"`, len(b), crc32.ChecksumIEEE(b)))
+	http.ServeContent(c.Response(), c.Request(), name, time.Time{}, bytes.NewReader(b))
+	return nil
+}
+
+// servePartial 은 아직 쓰고 있는 세그먼트의 Range 응답을 보낸다. 내용이 계속 늘어나므로 캐시하지 않고 ETag 도 붙이지 않으며,
+// 전체 길이를 모르므로 Content-Range 의 길이는 * 이다. b 는 start 보다 길다.
+func servePartial(c echo.Context, name string, b []byte, start, end int64) error {
+	last := int64(len(b)) - 1
+	if end >= 0 && end < last {
+		last = end
+	}
+	header := c.Response().Header()
+	header.Set(echo.HeaderContentType, hlsContentType(name))
+	header.Set("Cache-Control", cacheControlInProgress)
+	header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/*", start, last))
+	header.Set(echo.HeaderContentLength, strconv.FormatInt(last-start+1, 10))
+	c.Response().WriteHeader(http.StatusPartialContent)
+	if c.Request().Method == http.MethodHead {
+		return nil
+	}
+	_, err := c.Response().Write(b[start : last+1])
+	return err
+}
+
+func hlsContentType(name string) string {
+	switch path.Ext(name) {
+	case ".m3u8":
+		return "application/vnd.apple.mpegurl"
+	case ".m4s":
+		return "video/iso.segment"
+	case ".ts":
+		return "video/mp2t"
+	default:
+		return "video/mp4"
+	}
+}
+
+// parseRange 는 "bytes=start-[end]" 에서 start, end 를 반환한다. end 가 없으면 -1 이다.
+func parseRange(header string) (int64, int64, bool) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	first, last, _ := strings.Cut(spec, "-")
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false
+	}
+	if last == "" {
+		return start, -1, true
+	}
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil || end < start {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+// blockingError 는 LL-HLS blocking 요청의 에러를 스펙에 맞는 상태 코드로 바꾼다.
+func blockingError(err error) error {
+	switch {
+	case errors.Is(err, servers.ErrInvalidBlockingRequest):
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	case errors.Is(err, servers.ErrBlockingTimeout):
+		return echo.NewHTTPError(http.StatusServiceUnavailable, err)
+	default:
+		return echo.NewHTTPError(http.StatusNotFound, err)
+	}
 }
 
 func (h *HLSHandler) Handle(c echo.Context) error {
@@ -105,8 +252,13 @@ func (h *HLSHandler) Handle(c echo.Context) error {
 		return err
 	}
 
+	var req dto.HLSRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
 	streamID := token
-	resp, err := h.hlsServer.StartSession(streamID, dto.HLSRequest{})
+	resp, err := h.hlsServer.StartSession(streamID, req)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,98 @@
+package endpoints
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+
+	"mediaserver-go/egress/servers"
+	"mediaserver-go/utils/dto"
+	"mediaserver-go/utils/log"
+)
+
+func init() {
+	if log.Logger == nil {
+		log.Logger = zap.NewNop()
+	}
+}
+
+type testHLSServer struct{}
+
+func (testHLSServer) StartSession(string, dto.HLSRequest) (dto.HLSResponse, error) {
+	return dto.HLSResponse{}, nil
+}
+
+func (testHLSServer) GetHLSStream(streamID string) (*servers.HLSHandler, error) {
+	return nil, fmt.Errorf("stream %s not found", streamID)
+}
+
+func (testHLSServer) GetLatestVODSession(streamID string) (string, error) {
+	return "", errors.New("vod not found")
+}
+
+func (testHLSServer) GetVODPayload(streamID, session, name string) ([]byte, error) {
+	return nil, errors.New("vod not found")
+}
+
+func newTestEcho() *echo.Echo {
+	e := echo.New()
+	e.HTTPErrorHandler = newHTTPErrorHandler(e)
+	return e
+}
+
+func TestBlockingErrorStatus(t *testing.T) {
+	e := newTestEcho()
+	e.GET("/invalid", func(c echo.Context) error {
+		return blockingError(fmt.Errorf("_HLS_msn: %w", servers.ErrInvalidBlockingRequest))
+	})
+	e.GET("/timeout", func(c echo.Context) error {
+		return blockingError(servers.ErrBlockingTimeout)
+	})
+	e.GET("/missing", func(c echo.Context) error {
+		return blockingError(errors.New("not found"))
+	})
+
+	tests := map[string]int{
+		"/invalid": http.StatusBadRequest,
+		"/timeout": http.StatusServiceUnavailable,
+		"/missing": http.StatusNotFound,
+	}
+	for target, want := range tests {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != want {
+			t.Fatalf("GET %s status = %d, want %d", target, rec.Code, want)
+		}
+		if rec.Body.Len() == 0 {
+			t.Fatalf("GET %s has an empty body", target)
+		}
+	}
+}
+
+func TestHLSEndpointStatus(t *testing.T) {
+	e := newTestEcho()
+	handler := NewHLSHandler(testHLSServer{})
+	handler.Register(e)
+
+	tests := []struct {
+		method, target string
+		want           int
+	}{
+		{http.MethodGet, "/v1/llhls/live%2Fcam1/video.m3u8?_HLS_msn=3", http.StatusNotFound},
+		{http.MethodGet, "/v1/hls/cam1/index.m3u8", http.StatusNotFound},
+		{http.MethodGet, "/v1/vod/cam1/index.m3u8", http.StatusNotFound},
+		{http.MethodHead, "/v1/vod/cam1/20260101-000000.000/index.m3u8", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.target, nil))
+		if rec.Code != tt.want {
+			t.Fatalf("%s %s status = %d, want %d", tt.method, tt.target, rec.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package endpoints
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"mediaserver-go/utils/dto"
+)
+
+type IngressHLSServer interface {
+	StartSession(streamID string, request dto.IngressHLSRequest) (dto.IngressHLSResponse, error)
+	StopSession(streamID string) error
+}
+
+type IngressHLSHandler struct {
+	ingressHLSServer IngressHLSServer
+}
+
+func NewIngressHLSHandler(ingressHLSServer IngressHLSServer) IngressHLSHandler {
+	return IngressHLSHandler{
+		ingressHLSServer: ingressHLSServer,
+	}
+}
+
+func (i *IngressHLSHandler) Register(e *echo.Echo) {
+	e.POST("/v1/ingress/hls", i.Handle)
+	e.DELETE("/v1/ingress/hls", i.HandleStop)
+}
+
+func (i *IngressHLSHandler) Handle(c echo.Context) error {
+	token, err := getToken(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid token")
+	}
+
+	var req dto.IngressHLSRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid request")
+	}
+
+	streamID := token
+	resp, err := i.ingressHLSServer.StartSession(streamID, req)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (i *IngressHLSHandler) HandleStop(c echo.Context) error {
+	token, err := getToken(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid token")
+	}
+	if err := i.ingressHLSServer.StopSession(token); err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err)
+	}
+	c.Response().WriteHeader(http.StatusOK)
+	return nil
+}
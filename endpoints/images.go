@@ -4,10 +4,13 @@ import (
 	"github.com/labstack/echo/v4"
 	"mediaserver-go/utils/dto"
 	"net/http"
+	"strconv"
 )
 
 type ImageServer interface {
 	StartSession(streamID string, request dto.ImagesRequest) (dto.ImagesResponse, error)
+	StopSession(streamID string) error
+	Snapshot(streamID string, request dto.SnapshotRequest) (dto.SnapshotResponse, error)
 }
 
 type ImagesHandler struct {
@@ -21,7 +24,11 @@ func NewImagesHandler(imageServer ImageServer) ImagesHandler {
 }
 
 func (i *ImagesHandler) Register(e *echo.Echo) {
-	//e.POST("/v1/hls", i.Handle)
+	e.POST("/v1/egress/images", i.Handle)
+	e.DELETE("/v1/egress/images", i.HandleStop)
+	e.GET("/v1/streams/:streamID/snapshot.jpg", i.snapshot("jpeg"))
+	e.GET("/v1/streams/:streamID/snapshot.png", i.snapshot("png"))
+	e.GET("/v1/streams/:streamID/snapshot.webp", i.snapshot("webp"))
 }
 
 func (i *ImagesHandler) Handle(c echo.Context) error {
@@ -45,3 +52,52 @@ func (i *ImagesHandler) Handle(c echo.Context) error {
 	c.Response().WriteHeader(http.StatusOK)
 	return nil
 }
+
+func (i *ImagesHandler) HandleStop(c echo.Context) error {
+	token, err := getToken(c)
+	if err != nil {
+		return err
+	}
+
+	streamID := token
+	if err := i.imageServer.StopSession(streamID); err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err)
+	}
+
+	c.Response().WriteHeader(http.StatusOK)
+	return nil
+}
+
+// snapshot 은 width, height 쿼리로 크기를 지정할 수 있다. 하나만 주면 비율을 유지한다.
+func (i *ImagesHandler) snapshot(encoding string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		streamID := streamIDParam(c)
+		if streamID == "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid parameters")
+		}
+		req := dto.SnapshotRequest{
+			Encoding: encoding,
+		}
+		if width := c.QueryParam("width"); width != "" {
+			v, err := strconv.Atoi(width)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "invalid width")
+			}
+			req.Width = v
+		}
+		if height := c.QueryParam("height"); height != "" {
+			v, err := strconv.Atoi(height)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "invalid height")
+			}
+			req.Height = v
+		}
+
+		resp, err := i.imageServer.Snapshot(streamID, req)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err)
+		}
+		c.Response().Header().Set("Cache-Control", "no-cache")
+		return c.Blob(http.StatusOK, resp.ContentType, resp.Payload)
+	}
+}
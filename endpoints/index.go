@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"mediaserver-go/egress/servers"
+	"net/url"
 	"time"
 
 	"github.com/labstack/echo/v4"
@@ -19,9 +20,11 @@ type WHIPServer interface {
 }
 type IngressRTPServer interface {
 	StartSession(streamID string, request dto.IngressRTPRequest) (dto.IngressRTPResponse, error)
+	StopSession(streamID string) error
 }
 type IngressFileServer interface {
 	StartSession(streamID string, request dto.IngressFileRequest) (dto.IngressFileResponse, error)
+	StopSession(streamID string) error
 }
 
 type WHEPServer interface {
@@ -29,6 +32,7 @@ type WHEPServer interface {
 }
 type EgressFileServer interface {
 	StartSession(streamID string, request dto.EgressFileRequest) (dto.EgressFileResponse, error)
+	StopSession(streamID string) error
 }
 type EgressRTPServer interface {
 	StartSession(streamID string, request dto.EgressRTPRequest) (dto.EgressRTPResponse, error)
@@ -36,6 +40,8 @@ type EgressRTPServer interface {
 type HLSServer interface {
 	StartSession(streamID string, request dto.HLSRequest) (dto.HLSResponse, error)
 	GetHLSStream(streamID string) (*servers.HLSHandler, error)
+	GetLatestVODSession(streamID string) (string, error)
+	GetVODPayload(streamID, session, name string) ([]byte, error)
 }
 
 type Request struct {
@@ -52,16 +58,20 @@ func Initialize(
 	egressRTPServer EgressRTPServer,
 	hlsServer HLSServer,
 	imageServer ImageServer,
+	compositorServer CompositorServer,
+	flvServer FLVServer,
+	mseServer MSEServer,
+	egressSRTServer EgressSRTServer,
+	egressMulticastServer EgressMulticastServer,
+	ingressMPEGTSServer IngressMPEGTSServer,
+	ingressHLSServer IngressHLSServer,
+	egressWHIPServer EgressWHIPServer,
+	channelServer ChannelServer,
 ) *echo.Echo {
 	// Create a new Echo instance
 	e := echo.New()
 
-	e.HTTPErrorHandler = func(err error, c echo.Context) {
-		log.Logger.Warn("http error",
-			zap.String("request_url", c.Request().URL.String()),
-			zap.Error(err),
-		)
-	}
+	e.HTTPErrorHandler = newHTTPErrorHandler(e)
 
 	e.Use(RequestLogger)
 
@@ -75,7 +85,9 @@ func Initialize(
 	ingressRTPHandler := NewIngressRTPHandler(ingressRTPServer)
 	e.POST("/v1/whip", whipHandler.Handle)
 	e.POST("/v1/ingress/files", ingressFileHandler.Handle)
+	e.DELETE("/v1/ingress/files", ingressFileHandler.HandleStop)
 	e.POST("/v1/ingress/rtp", ingressRTPHandler.HandleIngress)
+	e.DELETE("/v1/ingress/rtp", ingressRTPHandler.HandleStop)
 
 	whepHandler := NewWHEPHandler(whepServer)
 	egressFileHandler := NewEgressFileHandler(egressFileServer)
@@ -84,12 +96,36 @@ func Initialize(
 
 	e.POST("/v1/whep", whepHandler.Handle)
 	e.POST("/v1/egress/files", egressFileHandler.Handle)
+	e.DELETE("/v1/egress/files", egressFileHandler.HandleStop)
 	e.POST("/v1/egress/rtp", egressRTPHandler.HandleEgress)
 	hlsHandler.Register(e)
 
 	imageHandler := NewImagesHandler(imageServer)
 	imageHandler.Register(e)
 
+	compositorHandler := NewCompositorHandler(compositorServer)
+	compositorHandler.Register(e)
+
+	channelHandler := NewChannelHandler(channelServer)
+	channelHandler.Register(e)
+
+	flvHandler := NewFLVHandler(flvServer)
+	flvHandler.Register(e)
+
+	mseHandler := NewMSEHandler(mseServer)
+	mseHandler.Register(e)
+
+	egressSRTHandler := NewEgressSRTHandler(egressSRTServer)
+	egressSRTHandler.Register(e)
+	egressMulticastHandler := NewEgressMulticastHandler(egressMulticastServer)
+	egressMulticastHandler.Register(e)
+	egressWHIPHandler := NewEgressWHIPHandler(egressWHIPServer)
+	egressWHIPHandler.Register(e)
+	ingressMPEGTSHandler := NewIngressMPEGTSHandler(ingressMPEGTSServer)
+	ingressMPEGTSHandler.Register(e)
+	ingressHLSHandler := NewIngressHLSHandler(ingressHLSServer)
+	ingressHLSHandler.Register(e)
+
 	wsHandler := NewWebSocketHandler()
 	e.GET("/v1/wss", wsHandler.Handle)
 
@@ -104,6 +140,26 @@ func getToken(c echo.Context) (string, error) {
 	return "", errors.New("no token")
 }
 
+// newHTTPErrorHandler 는 에러를 로그로 남기고 echo 의 기본 핸들러로 상태 코드와 메시지를 응답한다.
+func newHTTPErrorHandler(e *echo.Echo) echo.HTTPErrorHandler {
+	return func(err error, c echo.Context) {
+		log.Logger.Warn("http error",
+			zap.String("request_url", c.Request().URL.String()),
+			zap.Error(err),
+		)
+		e.DefaultHTTPErrorHandler(err, c)
+	}
+}
+
+// streamIDParam 은 경로의 :streamID 를 읽는다. RTMP 스트림의 ID(app/streamKey)는 "/" 를 %2F 로 이스케이프해서 넣는다.
+func streamIDParam(c echo.Context) string {
+	streamID := c.Param("streamID")
+	if unescaped, err := url.PathUnescape(streamID); err == nil {
+		return unescaped
+	}
+	return streamID
+}
+
 // RequestLogger logs all requests including 404s
 func RequestLogger(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
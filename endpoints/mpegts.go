@@ -0,0 +1,60 @@
+package endpoints
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"mediaserver-go/utils/dto"
+)
+
+type IngressMPEGTSServer interface {
+	StartSession(streamID string, request dto.IngressMPEGTSRequest) (dto.IngressMPEGTSResponse, error)
+	StopSession(streamID string) error
+}
+
+type IngressMPEGTSHandler struct {
+	ingressMPEGTSServer IngressMPEGTSServer
+}
+
+func NewIngressMPEGTSHandler(ingressMPEGTSServer IngressMPEGTSServer) IngressMPEGTSHandler {
+	return IngressMPEGTSHandler{
+		ingressMPEGTSServer: ingressMPEGTSServer,
+	}
+}
+
+func (i *IngressMPEGTSHandler) Register(e *echo.Echo) {
+	e.POST("/v1/ingress/mpegts", i.Handle)
+	e.DELETE("/v1/ingress/mpegts", i.HandleStop)
+}
+
+func (i *IngressMPEGTSHandler) Handle(c echo.Context) error {
+	token, err := getToken(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid token")
+	}
+
+	var req dto.IngressMPEGTSRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid request")
+	}
+
+	streamID := token
+	resp, err := i.ingressMPEGTSServer.StartSession(streamID, req)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (i *IngressMPEGTSHandler) HandleStop(c echo.Context) error {
+	token, err := getToken(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid token")
+	}
+	if err := i.ingressMPEGTSServer.StopSession(token); err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err)
+	}
+	c.Response().WriteHeader(http.StatusOK)
+	return nil
+}
@@ -0,0 +1,60 @@
+package endpoints
+
+import (
+	"net/http"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+
+	"mediaserver-go/egress/servers"
+	"mediaserver-go/utils/dto"
+)
+
+type MSEServer interface {
+	Subscribe(streamID string) (*servers.MSESubscriber, error)
+}
+
+type MSEHandler struct {
+	upgrader  websocket.Upgrader
+	mseServer MSEServer
+}
+
+func NewMSEHandler(mseServer MSEServer) MSEHandler {
+	return MSEHandler{
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool {
+				return true
+			},
+		},
+		mseServer: mseServer,
+	}
+}
+
+func (m *MSEHandler) Register(e *echo.Echo) {
+	e.GET("/v1/ws-mse/:streamID", m.Handle)
+}
+
+// Handle 은 MIME 타입(dto.MSEInit)을 텍스트 메시지로 보낸 후 init 세그먼트와 프레임마다의 moof/mdat fragment 를 바이너리 메시지로 보낸다.
+func (m *MSEHandler) Handle(c echo.Context) error {
+	streamID := streamIDParam(c)
+	if streamID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid parameters")
+	}
+	subscriber, err := m.mseServer.Subscribe(streamID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err)
+	}
+	defer subscriber.Close()
+
+	conn, err := m.upgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.WriteJSON(dto.MSEInit{MimeType: subscriber.MimeType()}); err != nil {
+		return nil
+	}
+	writeWebSocket(conn, subscriber.Data())
+	return nil
+}
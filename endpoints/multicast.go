@@ -0,0 +1,56 @@
+package endpoints
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"mediaserver-go/utils/dto"
+)
+
+type EgressMulticastServer interface {
+	StartSession(streamID string, request dto.EgressMulticastRequest) (dto.EgressMulticastResponse, error)
+	StopSession(id string) error
+}
+
+type EgressMulticastHandler struct {
+	egressMulticastServer EgressMulticastServer
+}
+
+func NewEgressMulticastHandler(egressMulticastServer EgressMulticastServer) EgressMulticastHandler {
+	return EgressMulticastHandler{
+		egressMulticastServer: egressMulticastServer,
+	}
+}
+
+func (s *EgressMulticastHandler) Register(e *echo.Echo) {
+	e.POST("/v1/egress/multicast", s.Handle)
+	e.DELETE("/v1/egress/multicast/:id", s.HandleStop)
+}
+
+func (s *EgressMulticastHandler) Handle(c echo.Context) error {
+	token, err := getToken(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid token")
+	}
+
+	var req dto.EgressMulticastRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid request")
+	}
+
+	streamID := token
+	resp, err := s.egressMulticastServer.StartSession(streamID, req)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (s *EgressMulticastHandler) HandleStop(c echo.Context) error {
+	if err := s.egressMulticastServer.StopSession(c.Param("id")); err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err)
+	}
+	c.Response().WriteHeader(http.StatusOK)
+	return nil
+}
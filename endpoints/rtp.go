@@ -44,6 +44,18 @@ func (i *IngressRTPHandler) HandleIngress(c echo.Context) error {
 	return nil
 }
 
+func (i *IngressRTPHandler) HandleStop(c echo.Context) error {
+	token, err := getToken(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid token")
+	}
+	if err := i.ingressRTPServer.StopSession(token); err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err)
+	}
+	c.Response().WriteHeader(http.StatusOK)
+	return nil
+}
+
 type EgressRTPPHandler struct {
 	egressRTPServer EgressRTPServer
 }
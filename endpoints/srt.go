@@ -0,0 +1,56 @@
+package endpoints
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"mediaserver-go/utils/dto"
+)
+
+type EgressSRTServer interface {
+	StartSession(streamID string, request dto.EgressSRTRequest) (dto.EgressSRTResponse, error)
+	StopSession(id string) error
+}
+
+type EgressSRTHandler struct {
+	egressSRTServer EgressSRTServer
+}
+
+func NewEgressSRTHandler(egressSRTServer EgressSRTServer) EgressSRTHandler {
+	return EgressSRTHandler{
+		egressSRTServer: egressSRTServer,
+	}
+}
+
+func (s *EgressSRTHandler) Register(e *echo.Echo) {
+	e.POST("/v1/egress/srt", s.Handle)
+	e.DELETE("/v1/egress/srt/:id", s.HandleStop)
+}
+
+func (s *EgressSRTHandler) Handle(c echo.Context) error {
+	token, err := getToken(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid token")
+	}
+
+	var req dto.EgressSRTRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid request")
+	}
+
+	streamID := token
+	resp, err := s.egressSRTServer.StartSession(streamID, req)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (s *EgressSRTHandler) HandleStop(c echo.Context) error {
+	if err := s.egressSRTServer.StopSession(c.Param("id")); err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err)
+	}
+	c.Response().WriteHeader(http.StatusOK)
+	return nil
+}
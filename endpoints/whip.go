@@ -0,0 +1,56 @@
+package endpoints
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"mediaserver-go/utils/dto"
+)
+
+type EgressWHIPServer interface {
+	StartSession(streamID string, request dto.EgressWHIPRequest) (dto.EgressWHIPResponse, error)
+	StopSession(id string) error
+}
+
+type EgressWHIPHandler struct {
+	egressWHIPServer EgressWHIPServer
+}
+
+func NewEgressWHIPHandler(egressWHIPServer EgressWHIPServer) EgressWHIPHandler {
+	return EgressWHIPHandler{
+		egressWHIPServer: egressWHIPServer,
+	}
+}
+
+func (s *EgressWHIPHandler) Register(e *echo.Echo) {
+	e.POST("/v1/egress/whip", s.Handle)
+	e.DELETE("/v1/egress/whip/:id", s.HandleStop)
+}
+
+func (s *EgressWHIPHandler) Handle(c echo.Context) error {
+	token, err := getToken(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid token")
+	}
+
+	var req dto.EgressWHIPRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid request")
+	}
+
+	streamID := token
+	resp, err := s.egressWHIPServer.StartSession(streamID, req)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (s *EgressWHIPHandler) HandleStop(c echo.Context) error {
+	if err := s.egressWHIPServer.StopSession(c.Param("id")); err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err)
+	}
+	c.Response().WriteHeader(http.StatusOK)
+	return nil
+}
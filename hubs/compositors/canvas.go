@@ -0,0 +1,155 @@
+package compositors
+
+import (
+	"errors"
+	"fmt"
+	"mediaserver-go/thirdparty/ffmpeg/avutil"
+	"strconv"
+	"strings"
+)
+
+var (
+	errInvalidColor  = errors.New("invalid color")
+	errInvalidCanvas = errors.New("invalid canvas")
+)
+
+// Color 는 YUV(BT.601, limited range) 색상이다.
+type Color struct {
+	Y, U, V uint8
+}
+
+var Black = Color{Y: 16, U: 128, V: 128}
+
+// ParseColor 는 "#RRGGBB" 또는 "RRGGBB" 형식을 YUV 로 변환한다. 빈 문자열은 검은색이다.
+func ParseColor(s string) (Color, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "#")
+	if s == "" {
+		return Black, nil
+	}
+	if len(s) != 6 {
+		return Color{}, fmt.Errorf("%q: %w", s, errInvalidColor)
+	}
+	rgb, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return Color{}, fmt.Errorf("%q: %w", s, errInvalidColor)
+	}
+	r, g, b := float64(rgb>>16&0xff), float64(rgb>>8&0xff), float64(rgb&0xff)
+	return Color{
+		Y: clamp(16 + 0.257*r + 0.504*g + 0.098*b),
+		U: clamp(128 - 0.148*r - 0.291*g + 0.439*b),
+		V: clamp(128 + 0.439*r - 0.368*g - 0.071*b),
+	}, nil
+}
+
+func clamp(v float64) uint8 {
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return uint8(v + 0.5)
+}
+
+// Canvas 는 YUV420P 프레임 위에 다른 프레임들을 배치한다.
+type Canvas struct {
+	frame      *avutil.Frame
+	width      int
+	height     int
+	background Color
+}
+
+func NewCanvas(width, height int, background Color) (*Canvas, error) {
+	if width <= 0 || height <= 0 || width%2 != 0 || height%2 != 0 {
+		return nil, fmt.Errorf("size %dx%d: %w", width, height, errInvalidCanvas)
+	}
+	frame := avutil.AvFrameAlloc()
+	frame.SetWidth(width)
+	frame.SetHeight(height)
+	frame.SetFormat(avutil.AV_PIX_FMT_YUV420P)
+	if ret := frame.AvFrameGetBuffer(0); ret < 0 {
+		frame.AvFrameFree()
+		return nil, fmt.Errorf("frame get buffer failed: %s, %w", avutil.AvErr2str(ret), errInvalidCanvas)
+	}
+	return &Canvas{
+		frame:      frame,
+		width:      width,
+		height:     height,
+		background: background,
+	}, nil
+}
+
+func (c *Canvas) Width() int {
+	return c.width
+}
+
+func (c *Canvas) Height() int {
+	return c.height
+}
+
+func (c *Canvas) Frame() *avutil.Frame {
+	return c.frame
+}
+
+func (c *Canvas) SetBackground(background Color) {
+	c.background = background
+}
+
+func (c *Canvas) Close() {
+	if c.frame != nil {
+		c.frame.AvFrameFree()
+		c.frame = nil
+	}
+}
+
+// Clear 는 캔버스를 배경색으로 채운다. 인코더가 이전 프레임을 참조하고 있을 수 있으므로 먼저 writable 하게 만든다.
+func (c *Canvas) Clear() error {
+	if ret := c.frame.AvFrameMakeWritable(); ret < 0 {
+		return fmt.Errorf("frame make writable failed: %s, %w", avutil.AvErr2str(ret), errInvalidCanvas)
+	}
+	c.FillRect(Rect{X: 0, Y: 0, Width: c.width, Height: c.height}, c.background)
+	return nil
+}
+
+func (c *Canvas) FillRect(rect Rect, color Color) {
+	rect = rect.clip(c.width, c.height).even()
+	fillPlane(c.frame.Plane(0, c.height), c.frame.Linesize(0), rect.X, rect.Y, rect.Width, rect.Height, color.Y)
+	fillPlane(c.frame.Plane(1, c.height/2), c.frame.Linesize(1), rect.X/2, rect.Y/2, rect.Width/2, rect.Height/2, color.U)
+	fillPlane(c.frame.Plane(2, c.height/2), c.frame.Linesize(2), rect.X/2, rect.Y/2, rect.Width/2, rect.Height/2, color.V)
+}
+
+// Blit 는 YUV420P 프레임 src 를 (x, y) 위치에 그대로 복사한다. 캔버스를 벗어나는 부분은 잘린다.
+func (c *Canvas) Blit(src *avutil.Frame, x, y int) {
+	if src.Format() != avutil.AV_PIX_FMT_YUV420P {
+		return
+	}
+	rect := Rect{X: x, Y: y, Width: src.Width(), Height: src.Height()}.even()
+	clipped := rect.clip(c.width, c.height).even()
+	if clipped.Width <= 0 || clipped.Height <= 0 {
+		return
+	}
+	offX, offY := clipped.X-rect.X, clipped.Y-rect.Y
+	copyPlane(c.frame.Plane(0, c.height), c.frame.Linesize(0), clipped.X, clipped.Y,
+		src.Plane(0, src.Height()), src.Linesize(0), offX, offY, clipped.Width, clipped.Height)
+	for plane := 1; plane <= 2; plane++ {
+		copyPlane(c.frame.Plane(plane, c.height/2), c.frame.Linesize(plane), clipped.X/2, clipped.Y/2,
+			src.Plane(plane, (src.Height()+1)/2), src.Linesize(plane), offX/2, offY/2, clipped.Width/2, clipped.Height/2)
+	}
+}
+
+func fillPlane(plane []byte, linesize, x, y, w, h int, value uint8) {
+	for row := y; row < y+h; row++ {
+		line := plane[row*linesize+x : row*linesize+x+w]
+		for i := range line {
+			line[i] = value
+		}
+	}
+}
+
+func copyPlane(dst []byte, dstLinesize, dstX, dstY int, src []byte, srcLinesize, srcX, srcY, w, h int) {
+	for row := 0; row < h; row++ {
+		d := (dstY+row)*dstLinesize + dstX
+		s := (srcY+row)*srcLinesize + srcX
+		copy(dst[d:d+w], src[s:s+w])
+	}
+}
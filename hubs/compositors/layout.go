@@ -0,0 +1,148 @@
+package compositors
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+var (
+	errInvalidLayout = errors.New("invalid layout")
+)
+
+type LayoutType string
+
+const (
+	LayoutGrid    LayoutType = "grid"
+	LayoutSpeaker LayoutType = "speaker" // 메인 화면 + 하단 썸네일
+	LayoutPIP     LayoutType = "pip"     // 메인 화면 전체 + 우하단 작은 화면
+)
+
+type Rect struct {
+	X, Y          int
+	Width, Height int
+}
+
+func (r Rect) even() Rect {
+	return Rect{X: r.X &^ 1, Y: r.Y &^ 1, Width: r.Width &^ 1, Height: r.Height &^ 1}
+}
+
+func (r Rect) clip(width, height int) Rect {
+	x0, y0 := max(r.X, 0), max(r.Y, 0)
+	x1, y1 := min(r.X+r.Width, width), min(r.Y+r.Height, height)
+	if x1 <= x0 || y1 <= y0 {
+		return Rect{}
+	}
+	return Rect{X: x0, Y: y0, Width: x1 - x0, Height: y1 - y0}
+}
+
+// Fit 은 srcW x srcH 의 비율을 유지하면서 r 안에 들어가는 가운데 정렬된 영역을 반환한다.
+func (r Rect) Fit(srcW, srcH int) Rect {
+	if srcW <= 0 || srcH <= 0 {
+		return r.even()
+	}
+	w, h := r.Width, r.Width*srcH/srcW
+	if h > r.Height {
+		w, h = r.Height*srcW/srcH, r.Height
+	}
+	return Rect{X: r.X + (r.Width-w)/2, Y: r.Y + (r.Height-h)/2, Width: w, Height: h}.even()
+}
+
+type Layout struct {
+	Type LayoutType
+	// Main 은 speaker, pip 레이아웃에서 크게 보일 입력의 인덱스이다.
+	Main int
+}
+
+func ParseLayoutType(s string) (LayoutType, error) {
+	switch LayoutType(s) {
+	case "":
+		return LayoutGrid, nil
+	case LayoutGrid, LayoutSpeaker, LayoutPIP:
+		return LayoutType(s), nil
+	default:
+		return "", fmt.Errorf("layout %q: %w", s, errInvalidLayout)
+	}
+}
+
+// Rects 는 n 개의 입력이 width x height 캔버스에 배치될 영역을 입력 순서대로 반환한다.
+func (l Layout) Rects(n, width, height int) []Rect {
+	if n <= 0 {
+		return nil
+	}
+	main := l.Main
+	if main < 0 || main >= n {
+		main = 0
+	}
+	switch l.Type {
+	case LayoutSpeaker:
+		return speakerRects(n, main, width, height)
+	case LayoutPIP:
+		return pipRects(n, main, width, height)
+	default:
+		return gridRects(n, width, height)
+	}
+}
+
+func gridRects(n, width, height int) []Rect {
+	cols := int(math.Ceil(math.Sqrt(float64(n))))
+	rows := (n + cols - 1) / cols
+	w, h := width/cols, height/rows
+
+	rects := make([]Rect, 0, n)
+	for i := 0; i < n; i++ {
+		row, col := i/cols, i%cols
+		x := col * w
+		// 마지막 줄은 가운데 정렬
+		if row == rows-1 {
+			if last := n - row*cols; last < cols {
+				x += (cols - last) * w / 2
+			}
+		}
+		rects = append(rects, Rect{X: x, Y: row * h, Width: w, Height: h}.even())
+	}
+	return rects
+}
+
+func speakerRects(n, main, width, height int) []Rect {
+	rects := make([]Rect, n)
+	if n == 1 {
+		rects[main] = Rect{Width: width, Height: height}.even()
+		return rects
+	}
+	thumbH := height / 5
+	rects[main] = Rect{Width: width, Height: height - thumbH}.even()
+
+	thumbs := n - 1
+	thumbW := min(width/thumbs, thumbH*16/9)
+	x := (width - thumbW*thumbs) / 2
+	for i := 0; i < n; i++ {
+		if i == main {
+			continue
+		}
+		rects[i] = Rect{X: x, Y: height - thumbH, Width: thumbW, Height: thumbH}.even()
+		x += thumbW
+	}
+	return rects
+}
+
+func pipRects(n, main, width, height int) []Rect {
+	rects := make([]Rect, n)
+	rects[main] = Rect{Width: width, Height: height}.even()
+
+	margin := height / 40
+	w, h := width/4, height/4
+	x, y := width-w-margin, height-h-margin
+	for i := 0; i < n; i++ {
+		if i == main {
+			continue
+		}
+		rects[i] = Rect{X: x, Y: y, Width: w, Height: h}.even()
+		y -= h + margin
+		if y < 0 {
+			y = height - h - margin
+			x -= w + margin
+		}
+	}
+	return rects
+}
@@ -0,0 +1,122 @@
+package compositors
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestLayoutRects(t *testing.T) {
+	tests := []struct {
+		name          string
+		layout        Layout
+		n             int
+		width, height int
+		want          []Rect
+	}{
+		{
+			name:   "grid 4",
+			layout: Layout{Type: LayoutGrid},
+			n:      4, width: 1280, height: 720,
+			want: []Rect{{0, 0, 640, 360}, {640, 0, 640, 360}, {0, 360, 640, 360}, {640, 360, 640, 360}},
+		},
+		{
+			// 마지막 줄이 덜 차면 가운데 정렬된다.
+			name:   "grid 3",
+			layout: Layout{Type: LayoutGrid},
+			n:      3, width: 1280, height: 720,
+			want: []Rect{{0, 0, 640, 360}, {640, 0, 640, 360}, {320, 360, 640, 360}},
+		},
+		{
+			name:   "grid 5",
+			layout: Layout{Type: LayoutGrid},
+			n:      5, width: 1920, height: 1080,
+			want: []Rect{{0, 0, 640, 540}, {640, 0, 640, 540}, {1280, 0, 640, 540}, {320, 540, 640, 540}, {960, 540, 640, 540}},
+		},
+		{
+			name:   "speaker",
+			layout: Layout{Type: LayoutSpeaker, Main: 1},
+			n:      3, width: 1280, height: 720,
+			want: []Rect{{384, 576, 256, 144}, {0, 0, 1280, 576}, {640, 576, 256, 144}},
+		},
+		{
+			name:   "speaker single",
+			layout: Layout{Type: LayoutSpeaker},
+			n:      1, width: 1280, height: 720,
+			want: []Rect{{0, 0, 1280, 720}},
+		},
+		{
+			name:   "pip",
+			layout: Layout{Type: LayoutPIP},
+			n:      2, width: 1280, height: 720,
+			want: []Rect{{0, 0, 1280, 720}, {942, 522, 320, 180}},
+		},
+		{
+			// 범위를 벗어난 Main 은 첫 번째 입력으로 바뀐다.
+			name:   "pip main out of range",
+			layout: Layout{Type: LayoutPIP, Main: 5},
+			n:      2, width: 1280, height: 720,
+			want: []Rect{{0, 0, 1280, 720}, {942, 522, 320, 180}},
+		},
+		{
+			name:   "empty",
+			layout: Layout{Type: LayoutGrid},
+			n:      0, width: 1280, height: 720,
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.layout.Rects(tt.n, tt.width, tt.height)
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("Rects(%d, %d, %d) = %v, want %v", tt.n, tt.width, tt.height, got, tt.want)
+			}
+			for i, r := range got {
+				if r.X%2 != 0 || r.Y%2 != 0 || r.Width%2 != 0 || r.Height%2 != 0 {
+					t.Fatalf("rect %d is not aligned to even pixels: %v", i, r)
+				}
+			}
+		})
+	}
+}
+
+func TestRectFit(t *testing.T) {
+	r := Rect{Width: 1280, Height: 720}
+	tests := []struct {
+		srcW, srcH int
+		want       Rect
+	}{
+		{1920, 1080, Rect{0, 0, 1280, 720}},
+		{640, 480, Rect{160, 0, 960, 720}},
+		// 세로 영상은 좌우에 여백이 생기고 짝수로 맞춰진다.
+		{1080, 1920, Rect{436, 0, 404, 720}},
+		// 크기를 모르면 영역 전체를 쓴다.
+		{0, 0, Rect{0, 0, 1280, 720}},
+	}
+	for _, tt := range tests {
+		if got := r.Fit(tt.srcW, tt.srcH); got != tt.want {
+			t.Fatalf("Fit(%d, %d) = %v, want %v", tt.srcW, tt.srcH, got, tt.want)
+		}
+	}
+}
+
+func TestRectClip(t *testing.T) {
+	if got, want := (Rect{X: -10, Y: -10, Width: 100, Height: 100}).clip(50, 50), (Rect{0, 0, 50, 50}); got != want {
+		t.Fatalf("clip = %v, want %v", got, want)
+	}
+	if got := (Rect{X: 60, Y: 0, Width: 10, Height: 10}).clip(50, 50); got != (Rect{}) {
+		t.Fatalf("clip outside = %v, want empty", got)
+	}
+}
+
+func TestParseLayoutType(t *testing.T) {
+	if got, err := ParseLayoutType(""); err != nil || got != LayoutGrid {
+		t.Fatalf(`ParseLayoutType("") = %q, %v`, got, err)
+	}
+	if got, err := ParseLayoutType("pip"); err != nil || got != LayoutPIP {
+		t.Fatalf(`ParseLayoutType("pip") = %q, %v`, got, err)
+	}
+	if _, err := ParseLayoutType("mosaic"); !errors.Is(err, errInvalidLayout) {
+		t.Fatalf(`ParseLayoutType("mosaic") error = %v, want errInvalidLayout`, err)
+	}
+}
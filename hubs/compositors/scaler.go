@@ -0,0 +1,68 @@
+package compositors
+
+import (
+	"errors"
+	"fmt"
+	"mediaserver-go/thirdparty/ffmpeg/avutil"
+	"mediaserver-go/thirdparty/ffmpeg/swscale"
+)
+
+var (
+	errFailedToScale = errors.New("failed to scale")
+)
+
+// Scaler 는 임의의 포맷/크기의 프레임을 지정한 크기의 YUV420P 프레임으로 변환한다.
+// 출력 프레임은 재사용되므로 다음 Scale 호출 전까지만 유효하다.
+type Scaler struct {
+	swsCtx *swscale.SwsContext
+	dst    *avutil.Frame
+}
+
+func NewScaler() *Scaler {
+	return &Scaler{}
+}
+
+func (s *Scaler) Scale(src *avutil.Frame, width, height int) (*avutil.Frame, error) {
+	width, height = width&^1, height&^1
+	if width <= 0 || height <= 0 {
+		return nil, fmt.Errorf("size %dx%d: %w", width, height, errFailedToScale)
+	}
+
+	s.swsCtx = swscale.SwsGetCachedContext(s.swsCtx,
+		src.Width(), src.Height(), avutil.PixelFormat(src.Format()),
+		width, height, avutil.AV_PIX_FMT_YUV420P, swscale.SWS_BILINEAR)
+	if s.swsCtx == nil {
+		return nil, fmt.Errorf("sws context: %w", errFailedToScale)
+	}
+
+	if s.dst == nil || s.dst.Width() != width || s.dst.Height() != height {
+		if s.dst != nil {
+			s.dst.AvFrameFree()
+		}
+		s.dst = avutil.AvFrameAlloc()
+		s.dst.SetWidth(width)
+		s.dst.SetHeight(height)
+		s.dst.SetFormat(avutil.AV_PIX_FMT_YUV420P)
+		if ret := s.dst.AvFrameGetBuffer(0); ret < 0 {
+			s.dst.AvFrameFree()
+			s.dst = nil
+			return nil, fmt.Errorf("frame get buffer failed: %s, %w", avutil.AvErr2str(ret), errFailedToScale)
+		}
+	}
+
+	if ret := s.swsCtx.SwsScaleFrame(s.dst, src); ret < 0 {
+		return nil, fmt.Errorf("sws scale frame failed: %s, %w", avutil.AvErr2str(ret), errFailedToScale)
+	}
+	return s.dst, nil
+}
+
+func (s *Scaler) Close() {
+	if s.swsCtx != nil {
+		swscale.SwsFreeContext(s.swsCtx)
+		s.swsCtx = nil
+	}
+	if s.dst != nil {
+		s.dst.AvFrameFree()
+		s.dst = nil
+	}
+}
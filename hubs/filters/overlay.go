@@ -0,0 +1,201 @@
+package filters
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	errInvalidOverlay = errors.New("invalid overlay")
+)
+
+type Position string
+
+const (
+	PositionTopLeft     Position = "top-left"
+	PositionTopRight    Position = "top-right"
+	PositionBottomLeft  Position = "bottom-left"
+	PositionBottomRight Position = "bottom-right"
+	PositionCenter      Position = "center"
+)
+
+const (
+	overlayMargin       = 16
+	overlayDefaultFont  = 24
+	overlayDefaultColor = "white"
+)
+
+// ImageOverlay 는 PNG 등 이미지 파일을 영상 위에 합성한다.
+type ImageOverlay struct {
+	Path     string
+	Position Position
+	// Position 이 비어있으면 X, Y 를 사용한다.
+	X, Y    int
+	Opacity float64 // 0 ~ 1. 0 이면 1 로 취급한다.
+	// Width 가 0 보다 크면 비율을 유지하며 해당 너비로 조절한다.
+	Width int
+}
+
+// TextOverlay 는 고정 문자열 혹은 현재 시각을 영상 위에 그린다.
+type TextOverlay struct {
+	Text string
+	// Clock 이 true 이면 Text 대신 현재 시각(localtime)을 그린다. Text 가 있으면 시각 앞에 붙인다.
+	Clock    bool
+	Position Position
+	X, Y     int
+	FontFile string
+	FontSize int
+	Color    string // ffmpeg color. ex) white, #FFFFFF
+	Opacity  float64
+	Box      bool
+}
+
+type Overlay struct {
+	Images []ImageOverlay
+	Texts  []TextOverlay
+}
+
+func (o Overlay) Empty() bool {
+	return len(o.Images) == 0 && len(o.Texts) == 0
+}
+
+// Key 는 같은 오버레이 설정을 공유하기 위한 식별자이다.
+func (o Overlay) Key() string {
+	return fmt.Sprintf("%+v", o)
+}
+
+func (o Overlay) validate() error {
+	for _, image := range o.Images {
+		if image.Path == "" {
+			return fmt.Errorf("image path is empty: %w", errInvalidOverlay)
+		}
+		if image.Opacity < 0 || image.Opacity > 1 {
+			return fmt.Errorf("image opacity %v: %w", image.Opacity, errInvalidOverlay)
+		}
+		if err := image.Position.validate(); err != nil {
+			return err
+		}
+	}
+	for _, text := range o.Texts {
+		if text.Text == "" && !text.Clock {
+			return fmt.Errorf("text is empty: %w", errInvalidOverlay)
+		}
+		if text.Opacity < 0 || text.Opacity > 1 {
+			return fmt.Errorf("text opacity %v: %w", text.Opacity, errInvalidOverlay)
+		}
+		if err := text.Position.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p Position) validate() error {
+	switch p {
+	case "", PositionTopLeft, PositionTopRight, PositionBottomLeft, PositionBottomRight, PositionCenter:
+		return nil
+	default:
+		return fmt.Errorf("position %q: %w", p, errInvalidOverlay)
+	}
+}
+
+// expr 는 위치를 ffmpeg 표현식으로 변환한다. mainW, mainH 는 바탕 영상, w, h 는 올려질 대상의 크기 변수 이름이다.
+func (p Position) expr(x, y int, mainW, mainH, w, h string) (string, string) {
+	m := overlayMargin
+	switch p {
+	case PositionTopLeft:
+		return fmt.Sprintf("%d", m), fmt.Sprintf("%d", m)
+	case PositionTopRight:
+		return fmt.Sprintf("%s-%s-%d", mainW, w, m), fmt.Sprintf("%d", m)
+	case PositionBottomLeft:
+		return fmt.Sprintf("%d", m), fmt.Sprintf("%s-%s-%d", mainH, h, m)
+	case PositionBottomRight:
+		return fmt.Sprintf("%s-%s-%d", mainW, w, m), fmt.Sprintf("%s-%s-%d", mainH, h, m)
+	case PositionCenter:
+		return fmt.Sprintf("(%s-%s)/2", mainW, w), fmt.Sprintf("(%s-%s)/2", mainH, h)
+	default:
+		return fmt.Sprintf("%d", x), fmt.Sprintf("%d", y)
+	}
+}
+
+func opacity(v float64) float64 {
+	if v <= 0 {
+		return 1
+	}
+	return v
+}
+
+// Description 은 [in] 을 받아 [out] 으로 내보내는 filtergraph 문자열을 만든다.
+// 출력은 width x height 의 yuv420p 로 고정된다.
+func (o Overlay) Description(width, height int) (string, error) {
+	if err := o.validate(); err != nil {
+		return "", err
+	}
+
+	var chains []string
+	cur := "in"
+	for i, image := range o.Images {
+		wm := fmt.Sprintf("wm%d", i)
+		next := fmt.Sprintf("ov%d", i)
+		src := fmt.Sprintf("movie=filename=%s,format=rgba", escape(image.Path))
+		if image.Width > 0 {
+			src += fmt.Sprintf(",scale=%d:-1", image.Width)
+		}
+		if a := opacity(image.Opacity); a < 1 {
+			src += fmt.Sprintf(",colorchannelmixer=aa=%.3f", a)
+		}
+		chains = append(chains, fmt.Sprintf("%s[%s]", src, wm))
+
+		x, y := image.Position.expr(image.X, image.Y, "main_w", "main_h", "overlay_w", "overlay_h")
+		chains = append(chains, fmt.Sprintf("[%s][%s]overlay=x=%s:y=%s:format=auto[%s]", cur, wm, x, y, next))
+		cur = next
+	}
+	for i, text := range o.Texts {
+		next := fmt.Sprintf("tx%d", i)
+		chains = append(chains, fmt.Sprintf("[%s]%s[%s]", cur, text.description(), next))
+		cur = next
+	}
+	chains = append(chains, fmt.Sprintf("[%s]scale=%d:%d,format=yuv420p[out]", cur, width, height))
+	return strings.Join(chains, ";"), nil
+}
+
+func (t TextOverlay) description() string {
+	fontSize := t.FontSize
+	if fontSize <= 0 {
+		fontSize = overlayDefaultFont
+	}
+	color := t.Color
+	if color == "" {
+		color = overlayDefaultColor
+	}
+	x, y := t.Position.expr(t.X, t.Y, "w", "h", "tw", "th")
+
+	options := []string{
+		fmt.Sprintf("fontsize=%d", fontSize),
+		fmt.Sprintf("fontcolor=%s", escape(fmt.Sprintf("%s@%.3f", color, opacity(t.Opacity)))),
+		fmt.Sprintf("x=%s", x),
+		fmt.Sprintf("y=%s", y),
+	}
+	if t.FontFile != "" {
+		options = append(options, fmt.Sprintf("fontfile=%s", escape(t.FontFile)))
+	}
+	if t.Box {
+		options = append(options, "box=1", "boxcolor=black@0.4", "boxborderw=8")
+	}
+	if t.Clock {
+		// localtime 의 인자 구분자(:)와 겹치지 않도록 시각 포맷의 ':' 는 한번 더 escape 한다.
+		text := strings.NewReplacer(`\`, `\\`, `%`, `\%`).Replace(t.Text) + `%{localtime:%Y-%m-%d %H\:%M\:%S}`
+		options = append(options, "expansion=normal", fmt.Sprintf("text=%s", escape(text)))
+	} else {
+		options = append(options, "expansion=none", fmt.Sprintf("text=%s", escape(t.Text)))
+	}
+	return "drawtext=" + strings.Join(options, ":")
+}
+
+// escape 는 filter 옵션 값과 filtergraph 두 단계의 escape 를 적용한다.
+func escape(value string) string {
+	optionEscaper := strings.NewReplacer(`\`, `\\`, `'`, `\'`, `:`, `\:`)
+	graphEscaper := strings.NewReplacer(`\`, `\\`, `'`, `\'`, `[`, `\[`, `]`, `\]`, `,`, `\,`, `;`, `\;`)
+	return graphEscaper.Replace(optionEscaper.Replace(value))
+}
@@ -0,0 +1,69 @@
+package filters
+
+import (
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"mediaserver-go/thirdparty/ffmpeg/avfilter"
+	"mediaserver-go/thirdparty/ffmpeg/avutil"
+	"mediaserver-go/utils/log"
+)
+
+var (
+	errFailedToSetFilter = errors.New("failed to set filter")
+)
+
+// VideoFilter 는 avfilter 그래프로 디코딩된 프레임을 가공한다.
+type VideoFilter struct {
+	graph *avfilter.Graph
+	src   *avfilter.FilterContext
+	sink  *avfilter.FilterContext
+}
+
+// NewVideoFilter 는 width x height(pixFmt), timeBase 인 입력을 받는 그래프를 만든다. descr 은 Overlay.Description 참고.
+func NewVideoFilter(descr string, width, height int, pixFmt avutil.PixelFormat, timeBase int) (*VideoFilter, error) {
+	graph := avfilter.AvfilterGraphAlloc()
+	if graph == nil {
+		return nil, fmt.Errorf("could not allocate filter graph: %w", errFailedToSetFilter)
+	}
+	args := fmt.Sprintf("video_size=%dx%d:pix_fmt=%d:time_base=1/%d:pixel_aspect=1/1", width, height, int(pixFmt), timeBase)
+	src, sink, ret := graph.BuildGraph(args, descr)
+	if ret < 0 {
+		avfilter.AvfilterGraphFree(graph)
+		return nil, fmt.Errorf("could not build filter graph(%s): %s, %w", descr, avutil.AvErr2str(ret), errFailedToSetFilter)
+	}
+	return &VideoFilter{
+		graph: graph,
+		src:   src,
+		sink:  sink,
+	}, nil
+}
+
+// Filter 는 frame 을 그래프에 넣고 나온 프레임들을 반환한다. frame 의 데이터는 그래프로 옮겨지며 frame 은 호출자가 해제한다.
+// 반환된 프레임은 호출자가 AvFrameFree 해야 한다.
+func (f *VideoFilter) Filter(frame *avutil.Frame) []*avutil.Frame {
+	if ret := f.src.AvBuffersrcAddFrame(frame); ret < 0 {
+		log.Logger.Warn("av_buffersrc_add_frame failed", zap.Error(errors.New(avutil.AvErr2str(ret))))
+		return nil
+	}
+
+	var frames []*avutil.Frame
+	for {
+		filtered := avutil.AvFrameAlloc()
+		if ret := f.sink.AvBuffersinkGetFrame(filtered); ret < 0 {
+			filtered.AvFrameFree()
+			if !avutil.AvAgain(ret) {
+				log.Logger.Warn("av_buffersink_get_frame failed", zap.Error(errors.New(avutil.AvErr2str(ret))))
+			}
+			return frames
+		}
+		frames = append(frames, filtered)
+	}
+}
+
+func (f *VideoFilter) Close() {
+	if f.graph != nil {
+		avfilter.AvfilterGraphFree(f.graph)
+		f.graph = nil
+	}
+}
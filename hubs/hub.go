@@ -6,10 +6,25 @@ import (
 	"sync"
 )
 
+// StreamObserver 는 Hub 에 스트림이 추가, 삭제될 때 알림을 받는다.
+// Hub 의 lock 밖에서 호출되지만 ingress 를 막지 않도록 오래 걸리는 작업은 별도 goroutine 에서 해야 한다.
+type StreamObserver interface {
+	OnStreamAdded(id string, stream *Stream)
+	OnStreamRemoved(id string, stream *Stream)
+}
+
+// StreamPuller 는 Hub 에 없는 스트림을 다른 서버에서 가져와 Hub 에 넣는다.
+// 가져올 수 없는 스트림이면 false 를 반환한다.
+type StreamPuller interface {
+	PullStream(id string) (*Stream, bool)
+}
+
 type Hub struct {
 	mu sync.RWMutex
 
-	streams map[ /*streamID*/ string]*Stream
+	streams   map[ /*streamID*/ string]*Stream
+	observers []StreamObserver
+	puller    StreamPuller
 }
 
 func NewHub() *Hub {
@@ -18,20 +33,47 @@ func NewHub() *Hub {
 	}
 }
 
-func (h *Hub) AddStream(id string, stream *Stream) {
+func (h *Hub) AddObserver(observer StreamObserver) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.observers = append(h.observers, observer)
+}
+
+// SetStreamPuller 는 GetOrPullStream 이 없는 스트림을 가져올 때 쓸 StreamPuller 를 정한다.
+func (h *Hub) SetStreamPuller(puller StreamPuller) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
+	h.puller = puller
+}
+
+func (h *Hub) AddStream(id string, stream *Stream) {
+	h.mu.Lock()
 	h.streams[id] = stream
+	observers := append([]StreamObserver(nil), h.observers...)
+	h.mu.Unlock()
+
 	log.Logger.Info("stream added", zap.String("streamkey", id))
+	for _, observer := range observers {
+		observer.OnStreamAdded(id, stream)
+	}
 }
 
 func (h *Hub) RemoveStream(id string) {
 	h.mu.Lock()
-	defer h.mu.Unlock()
-
+	stream, ok := h.streams[id]
 	delete(h.streams, id)
+	observers := append([]StreamObserver(nil), h.observers...)
+	h.mu.Unlock()
+
 	log.Logger.Info("stream deleted", zap.String("streamkey", id))
+	if !ok {
+		return
+	}
+	for _, observer := range observers {
+		observer.OnStreamRemoved(id, stream)
+	}
 }
 
 func (h *Hub) GetStream(id string) (*Stream, bool) {
@@ -41,3 +83,17 @@ func (h *Hub) GetStream(id string) (*Stream, bool) {
 	stream, ok := h.streams[id]
 	return stream, ok
 }
+
+// GetOrPullStream 은 시청자를 위한 egress 가 스트림을 찾을 때 쓴다. Hub 에 없으면 StreamPuller 로 가져온다.
+// ingress 가 중복 발행을 확인할 때는 GetStream 을 써야 한다.
+func (h *Hub) GetOrPullStream(id string) (*Stream, bool) {
+	h.mu.RLock()
+	stream, ok := h.streams[id]
+	puller := h.puller
+	h.mu.RUnlock()
+
+	if ok || puller == nil {
+		return stream, ok
+	}
+	return puller.PullStream(id)
+}
@@ -1,9 +1,11 @@
 package hubs
 
 import (
+	"context"
 	"errors"
 	"go.uber.org/zap"
 	"golang.org/x/exp/maps"
+	"mediaserver-go/hubs/filters"
 	"mediaserver-go/hubs/tracks"
 	"mediaserver-go/hubs/transcoders"
 	"mediaserver-go/utils/log"
@@ -26,6 +28,8 @@ type HubSource struct {
 	closed atomic.Bool
 
 	tracks map[string]Track
+	// 마지막으로 Write 된 시각 (UnixNano). 입력이 끊겼는지 판단할 때 쓴다.
+	lastWrite atomic.Int64
 
 	base codecs.Base
 	rid  string
@@ -129,6 +133,19 @@ func (t *HubSource) Codec() (codecs.Codec, error) {
 	return t.codec, nil
 }
 
+// WaitCodec 은 코덱이 정해질 때까지 기다린다. 코덱을 늦게 알게 되는 소스(SPS 를 기다리는 ingress 등)에 쓴다.
+func (t *HubSource) WaitCodec(ctx context.Context) (codecs.Codec, error) {
+	select {
+	case <-t.codecset:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.codec, nil
+}
+
 func (t *HubSource) VideoCodec() (codecs.VideoCodec, error) {
 	select {
 	case <-t.codecset:
@@ -162,6 +179,8 @@ func (t *HubSource) AudioCodec() (codecs.AudioCodec, error) {
 }
 
 func (t *HubSource) Write(unit units.Unit) {
+	t.lastWrite.Store(time.Now().UnixNano())
+
 	var us []units.Unit
 	if t.transcoder != nil {
 		us = []units.Unit{unit}
@@ -180,6 +199,27 @@ func (t *HubSource) Write(unit units.Unit) {
 	}
 }
 
+// LastWrite 는 마지막으로 unit 이 들어온 시각이다. 한 번도 들어오지 않았으면 zero time 이다.
+func (t *HubSource) LastWrite() time.Time {
+	lastWrite := t.lastWrite.Load()
+	if lastWrite == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, lastWrite)
+}
+
+// ConsumerCount 는 이 소스의 모든 트랙을 읽고 있는 consumer 의 수이다.
+func (t *HubSource) ConsumerCount() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	count := 0
+	for _, track := range t.tracks {
+		count += track.ConsumerCount()
+	}
+	return count
+}
+
 func (t *HubSource) GetTrack(codec codecs.Codec) Track {
 	t.mu.Lock()
 	defer t.mu.Unlock()
@@ -218,3 +258,36 @@ func (t *HubSource) GetTrack(codec codecs.Codec) Track {
 	}
 	return iTrack
 }
+
+// GetOverlayTrack 은 오버레이가 적용된(디코딩 → 오버레이 → H264 인코딩) 트랙을 반환한다. 같은 오버레이 설정은 트랙을 공유한다.
+func (t *HubSource) GetOverlayTrack(overlay filters.Overlay) (Track, error) {
+	if t.MediaType() != types.MediaTypeVideo {
+		return nil, errors.New("overlay is only supported for video")
+	}
+	codec, err := t.Codec()
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := "overlay:" + overlay.Key()
+	if iTrack, ok := t.tracks[key]; ok {
+		return iTrack, nil
+	}
+
+	transcoder := transcoders.NewOverlayTranscoder(codec, overlay)
+	if err := transcoder.Setup(); err != nil {
+		return nil, err
+	}
+	transcoderTrack := tracks.NewTranscoderTrack(transcoder, t.rid)
+	go transcoderTrack.Run()
+
+	log.Logger.Info("NewOverlayTranscoder",
+		zap.String("sourceCodec", codec.String()),
+		zap.String("targetCodec", transcoder.Target().String()),
+	)
+	t.tracks[key] = transcoderTrack
+	return transcoderTrack, nil
+}
@@ -12,6 +12,8 @@ type Stream struct {
 	subscribers []chan *HubSource
 
 	source []*HubSource
+	// ReplaceSource 로 소스가 바뀔 때마다 닫히고 새로 만들어진다.
+	switched chan struct{}
 }
 
 func NewStream() *Stream {
@@ -46,6 +48,19 @@ func (s *Stream) Subscribe() chan *HubSource {
 	return ch
 }
 
+// Unsubscribe 는 Subscribe 로 받은 채널을 더 이상 쓰지 않을 때 호출한다. 읽지 않는 채널 때문에 AddSource 가 막히지 않게 한다.
+func (s *Stream) Unsubscribe(ch chan *HubSource) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, subscriber := range s.subscribers {
+		if subscriber == ch {
+			s.subscribers = append(s.subscribers[:i], s.subscribers[i+1:]...)
+			return
+		}
+	}
+}
+
 func (s *Stream) AddSource(source *HubSource) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -56,6 +71,44 @@ func (s *Stream) AddSource(source *HubSource) {
 	}
 }
 
+// ReplaceSource 는 old 를 source 로 바꾸고 old 를 닫는다. 채널의 입력이 바뀌어 코덱이 달라졌을 때 쓴다.
+// 구독자는 새 소스를 받고, old 의 트랙을 읽던 egress 는 트랙이 닫혀서 끝난다.
+func (s *Stream) ReplaceSource(old, source *HubSource) {
+	s.mu.Lock()
+	replaced := false
+	for i, t := range s.source {
+		if t == old {
+			s.source[i] = source
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		s.source = append(s.source, source)
+	}
+	if s.switched != nil {
+		close(s.switched)
+		s.switched = nil
+	}
+	for _, subscriber := range s.subscribers {
+		subscriber <- source
+	}
+	s.mu.Unlock()
+
+	old.Close()
+}
+
+// Switched 는 다음 ReplaceSource 때 닫히는 채널을 반환한다. 소스 목록을 처음에 한 번만 읽는 egress 가 다시 시작할 때를 알 수 있다.
+func (s *Stream) Switched() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.switched == nil {
+		s.switched = make(chan struct{})
+	}
+	return s.switched
+}
+
 func (s *Stream) RemoveSource(source *HubSource) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -85,6 +138,18 @@ func (s *Stream) SourcesMap() map[types.MediaType]*HubSource {
 	return sources
 }
 
+// ConsumerCount 는 스트림을 보고 있는 egress 의 수를 센다. 시청자가 없는 relay 를 정리할 때 쓴다.
+func (s *Stream) ConsumerCount() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	count := 0
+	for _, source := range s.source {
+		count += source.ConsumerCount()
+	}
+	return count
+}
+
 func (s *Stream) Close() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -14,4 +14,5 @@ type Track interface {
 	GetCodec() codecs.Codec
 	AddConsumer() chan units.Unit
 	RemoveConsumer(consumerCh chan units.Unit)
+	ConsumerCount() int
 }
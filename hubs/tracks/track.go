@@ -101,6 +101,13 @@ func (t *Track) AddConsumer() chan units.Unit {
 	return consumerCh
 }
 
+func (t *Track) ConsumerCount() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return len(t.consumers)
+}
+
 func (t *Track) RemoveConsumer(consumerCh chan units.Unit) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
@@ -3,17 +3,25 @@ package tracks
 import (
 	"context"
 	"go.uber.org/zap"
-	"mediaserver-go/hubs/transcoders"
+	"mediaserver-go/codecs"
 	"mediaserver-go/utils/log"
+	"mediaserver-go/utils/units"
 )
 
+type Transcoder interface {
+	Source() codecs.Codec
+	Target() codecs.Codec
+	Transcode(unit units.Unit) []units.Unit
+	Close()
+}
+
 type TranscoderTrack struct {
 	*Track
 
-	transcoder *transcoders.AudioTranscoder
+	transcoder Transcoder
 }
 
-func NewTranscoderTrack(transcoder *transcoders.AudioTranscoder, rid string) *TranscoderTrack {
+func NewTranscoderTrack(transcoder Transcoder, rid string) *TranscoderTrack {
 	return &TranscoderTrack{
 		Track:      NewTrack(transcoder.Target(), rid),
 		transcoder: transcoder,
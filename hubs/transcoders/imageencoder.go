@@ -0,0 +1,141 @@
+package transcoders
+
+import (
+	"errors"
+	"fmt"
+	"mediaserver-go/thirdparty/ffmpeg/avcodec"
+	"mediaserver-go/thirdparty/ffmpeg/avutil"
+	"mediaserver-go/thirdparty/ffmpeg/swscale"
+	"strings"
+)
+
+var (
+	errFailedToEncodeImage = errors.New("failed to encode image")
+)
+
+type ImageFormat string
+
+const (
+	ImageFormatJPEG ImageFormat = "jpeg"
+	ImageFormatPNG  ImageFormat = "png"
+	ImageFormatWEBP ImageFormat = "webp"
+)
+
+// ParseImageFormat 은 jpeg(jpg), png, webp 를 허용한다. 비어있으면 jpeg 이다.
+func ParseImageFormat(s string) (ImageFormat, error) {
+	switch strings.ToLower(s) {
+	case "", "jpg", "jpeg":
+		return ImageFormatJPEG, nil
+	case "png":
+		return ImageFormatPNG, nil
+	case "webp":
+		return ImageFormatWEBP, nil
+	default:
+		return "", fmt.Errorf("image format %q: %w", s, errFailedToEncodeImage)
+	}
+}
+
+func (f ImageFormat) Extension() string {
+	if f == ImageFormatJPEG {
+		return "jpg"
+	}
+	return string(f)
+}
+
+func (f ImageFormat) ContentType() string {
+	return "image/" + string(f)
+}
+
+func (f ImageFormat) codecID() avcodec.CodecID {
+	switch f {
+	case ImageFormatPNG:
+		return avcodec.AV_CODEC_ID_PNG
+	case ImageFormatWEBP:
+		return avcodec.AV_CODEC_ID_WEBP
+	default:
+		return avcodec.AV_CODEC_ID_MJPEG
+	}
+}
+
+func (f ImageFormat) pixelFormat() avutil.PixelFormat {
+	switch f {
+	case ImageFormatPNG:
+		return avutil.AV_PIX_FMT_RGB24
+	case ImageFormatWEBP:
+		return avutil.AV_PIX_FMT_YUV420P
+	default:
+		return avutil.AV_PIX_FMT_YUVJ420P
+	}
+}
+
+// ImageSize 는 width, height 중 하나만 지정되면 frame 의 비율을 유지하여 나머지를 구한다. 둘 다 0 이면 원본 크기이다.
+func ImageSize(frame *avutil.Frame, width, height int) (int, int) {
+	srcW, srcH := frame.Width(), frame.Height()
+	switch {
+	case width <= 0 && height <= 0:
+		width, height = srcW, srcH
+	case width <= 0:
+		width = srcW * height / srcH
+	case height <= 0:
+		height = srcH * width / srcW
+	}
+	return max(width&^1, 2), max(height&^1, 2)
+}
+
+// EncodeImage 는 디코딩된 frame 을 width x height 의 이미지 한 장으로 인코딩한다.
+func EncodeImage(frame *avutil.Frame, format ImageFormat, width, height int) ([]byte, error) {
+	width, height = ImageSize(frame, width, height)
+	pixFmt := format.pixelFormat()
+
+	encoder := avcodec.AvcodecFindEncoder(format.codecID())
+	if encoder == nil {
+		return nil, fmt.Errorf("could not find %s encoder: %w", format, errFailedToEncodeImage)
+	}
+	encoderCtx := encoder.AvCodecAllocContext3()
+	if encoderCtx == nil {
+		return nil, fmt.Errorf("could not allocate codec context: %w", errFailedToEncodeImage)
+	}
+	defer avcodec.AvCodecFreeContext(&encoderCtx)
+	encoderCtx.SetCodecType(avutil.AVMEDIA_TYPE_VIDEO)
+	encoderCtx.SetWidth(width)
+	encoderCtx.SetHeight(height)
+	encoderCtx.SetPixelFormat(pixFmt)
+	encoderCtx.SetTimeBase(avutil.NewRational(1, 25))
+	if ret := encoderCtx.AvCodecOpen2(encoder, nil); ret < 0 {
+		return nil, fmt.Errorf("could not open codec: %s, %w", avutil.AvErr2str(ret), errFailedToEncodeImage)
+	}
+
+	swsCtx := swscale.SwsGetContext(frame.Width(), frame.Height(), avutil.PixelFormat(frame.Format()),
+		width, height, pixFmt, swscale.SWS_BICUBIC)
+	if swsCtx == nil {
+		return nil, fmt.Errorf("sws context: %w", errFailedToEncodeImage)
+	}
+	defer swscale.SwsFreeContext(swsCtx)
+
+	dst := avutil.AvFrameAlloc()
+	defer dst.AvFrameFree()
+	dst.SetWidth(width)
+	dst.SetHeight(height)
+	dst.SetFormat(int(pixFmt))
+	if ret := dst.AvFrameGetBuffer(0); ret < 0 {
+		return nil, fmt.Errorf("frame get buffer failed: %s, %w", avutil.AvErr2str(ret), errFailedToEncodeImage)
+	}
+	if ret := swsCtx.SwsScaleFrame(dst, frame); ret < 0 {
+		return nil, fmt.Errorf("sws scale frame failed: %s, %w", avutil.AvErr2str(ret), errFailedToEncodeImage)
+	}
+	dst.SetPTS(0)
+
+	if ret := encoderCtx.AvCodecSendFrame(dst); ret < 0 {
+		return nil, fmt.Errorf("send frame failed: %s, %w", avutil.AvErr2str(ret), errFailedToEncodeImage)
+	}
+	// 한 장만 인코딩하므로 바로 flush 한다.
+	encoderCtx.AvCodecSendFrame(nil)
+
+	pkt := avcodec.AvPacketAlloc()
+	defer pkt.AvPacketFree()
+	if ret := encoderCtx.AvCodecReceivePacket(pkt); ret < 0 {
+		return nil, fmt.Errorf("receive packet failed: %s, %w", avutil.AvErr2str(ret), errFailedToEncodeImage)
+	}
+	defer pkt.AvPacketUnref()
+	return pkt.Data(), nil
+}
@@ -0,0 +1,119 @@
+package transcoders
+
+import (
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"mediaserver-go/codecs"
+	"mediaserver-go/hubs/filters"
+	"mediaserver-go/thirdparty/ffmpeg/avutil"
+	"mediaserver-go/utils/log"
+	"mediaserver-go/utils/units"
+)
+
+var (
+	errFailedToSetOverlay = errors.New("failed to set overlay transcoder")
+)
+
+// OverlayTranscoder 는 비디오를 디코딩하여 오버레이(이미지, 텍스트)를 입힌 후 H264 로 다시 인코딩한다.
+type OverlayTranscoder struct {
+	source  codecs.Codec
+	overlay filters.Overlay
+	descr   string
+
+	decoder *VideoDecoder
+	filter  *filters.VideoFilter
+	encoder *VideoEncoder
+}
+
+func NewOverlayTranscoder(source codecs.Codec, overlay filters.Overlay) *OverlayTranscoder {
+	return &OverlayTranscoder{
+		source:  source,
+		overlay: overlay,
+	}
+}
+
+func (t *OverlayTranscoder) Source() codecs.Codec {
+	return t.source
+}
+
+func (t *OverlayTranscoder) Target() codecs.Codec {
+	if t.encoder == nil {
+		return nil
+	}
+	return t.encoder.Codec()
+}
+
+func (t *OverlayTranscoder) Setup() error {
+	source, ok := t.source.(codecs.VideoCodec)
+	if !ok {
+		return fmt.Errorf("invalid source codec: %w", errFailedToSetOverlay)
+	}
+	width, height := source.Width()&^1, source.Height()&^1
+	descr, err := t.overlay.Description(width, height)
+	if err != nil {
+		return fmt.Errorf("%v: %w", err, errFailedToSetOverlay)
+	}
+
+	decoder, err := NewVideoDecoder(source)
+	if err != nil {
+		return err
+	}
+	encoder, err := NewVideoEncoder(VideoEncoderConfig{
+		Width:  width,
+		Height: height,
+		FPS:    int(source.FPS()),
+	}, nil)
+	if err != nil {
+		decoder.Close()
+		return err
+	}
+	if encoder.Codec() == nil {
+		decoder.Close()
+		encoder.Close()
+		return fmt.Errorf("encoder codec not ready: %w", errFailedToSetOverlay)
+	}
+
+	t.descr = descr
+	t.decoder = decoder
+	t.encoder = encoder
+	return nil
+}
+
+func (t *OverlayTranscoder) Close() {
+	if t.decoder != nil {
+		t.decoder.Close()
+	}
+	if t.filter != nil {
+		t.filter.Close()
+	}
+	if t.encoder != nil {
+		t.encoder.Close()
+	}
+}
+
+func (t *OverlayTranscoder) Transcode(unit units.Unit) []units.Unit {
+	var result []units.Unit
+	for _, frame := range t.decoder.Decode(unit) {
+		// 그래프는 실제 디코딩된 프레임의 크기/포맷으로 만든다.
+		if t.filter == nil {
+			filter, err := filters.NewVideoFilter(t.descr, frame.Width(), frame.Height(), avutil.PixelFormat(frame.Format()), unit.TimeBase)
+			if err != nil {
+				log.Logger.Error("overlay filter setup failed", zap.Error(err))
+				frame.AvFrameFree()
+				return nil
+			}
+			t.filter = filter
+		}
+
+		filtered := t.filter.Filter(frame)
+		frame.AvFrameFree()
+		for _, f := range filtered {
+			pts := avutil.AvRescaleQ(int64(f.PTS()), avutil.NewRational(1, unit.TimeBase), avutil.NewRational(1, VideoEncoderTimeBase))
+			f.SetPTS(pts)
+			result = append(result, t.encoder.Encode(f)...)
+			f.AvFrameFree()
+		}
+	}
+	return result
+}
@@ -0,0 +1,108 @@
+package transcoders
+
+import (
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"mediaserver-go/codecs"
+	"mediaserver-go/thirdparty/ffmpeg/avcodec"
+	"mediaserver-go/thirdparty/ffmpeg/avutil"
+	"mediaserver-go/utils/log"
+	"mediaserver-go/utils/units"
+)
+
+var (
+	errFailedToSetDecoder = errors.New("failed to set decoder")
+)
+
+// VideoDecoder 는 HubSource 의 유닛(NAL, OBU 등)을 모아 액세스 유닛 단위로 디코딩한다.
+type VideoDecoder struct {
+	codec           codecs.Codec
+	bitStreamFilter codecs.BitStreamFilter
+	decoderCtx      *avcodec.CodecContext
+	pkt             *avcodec.Packet
+
+	buf []byte
+}
+
+func NewVideoDecoder(codec codecs.Codec) (*VideoDecoder, error) {
+	decoder := avcodec.AvcodecFindDecoder(codec.AVCodecID())
+	if decoder == nil {
+		return nil, fmt.Errorf("could not find decoder: %w", errFailedToSetDecoder)
+	}
+	decoderCtx := decoder.AvCodecAllocContext3()
+	if decoderCtx == nil {
+		return nil, fmt.Errorf("could not allocate codec context: %w", errFailedToSetDecoder)
+	}
+	codec.SetCodecContext(decoderCtx, nil)
+	if ret := decoderCtx.AvCodecOpen2(decoder, nil); ret < 0 {
+		avcodec.AvCodecFreeContext(&decoderCtx)
+		return nil, fmt.Errorf("could not open codec: %s, %w", avutil.AvErr2str(ret), errFailedToSetDecoder)
+	}
+	return &VideoDecoder{
+		codec:           codec,
+		bitStreamFilter: codec.GetBitStreamFilter(false),
+		decoderCtx:      decoderCtx,
+		pkt:             avcodec.AvPacketAlloc(),
+	}, nil
+}
+
+func (d *VideoDecoder) Codec() codecs.Codec {
+	return d.codec
+}
+
+func (d *VideoDecoder) Close() {
+	if d.decoderCtx != nil {
+		avcodec.AvCodecFreeContext(&d.decoderCtx)
+	}
+	if d.pkt != nil {
+		d.pkt.AvPacketFree()
+		d.pkt = nil
+	}
+}
+
+// Decode 는 unit 을 누적하다가 Marker 가 오면 디코딩하여 나온 프레임들을 반환한다.
+// 반환된 프레임은 호출자가 AvFrameFree 해야 한다.
+func (d *VideoDecoder) Decode(unit units.Unit) []*avutil.Frame {
+	d.buf = append(d.buf, d.bitStreamFilter.AddFilter(unit.Payload)...)
+	if !unit.Marker {
+		return nil
+	}
+	payload := d.buf
+	d.buf = nil
+
+	d.pkt.SetPTS(unit.PTS)
+	d.pkt.SetDTS(unit.DTS)
+	d.pkt.SetDuration(unit.Duration)
+	d.pkt.SetData(payload)
+	ret := d.decoderCtx.AvCodecSendPacket(d.pkt)
+	d.pkt.AvPacketUnref()
+	if ret < 0 {
+		log.Logger.Warn("AvCodecSendPacket failed", zap.Error(errors.New(avutil.AvErr2str(ret))))
+		return nil
+	}
+	return d.receiveFrames()
+}
+
+// Flush 는 디코더에 남아있는 프레임들을 모두 꺼낸다. 이후에는 더 이상 Decode 할 수 없다.
+func (d *VideoDecoder) Flush() []*avutil.Frame {
+	if ret := d.decoderCtx.AvCodecSendPacket(nil); ret < 0 {
+		return nil
+	}
+	return d.receiveFrames()
+}
+
+func (d *VideoDecoder) receiveFrames() []*avutil.Frame {
+	var frames []*avutil.Frame
+	for {
+		frame := avutil.AvFrameAlloc()
+		if ret := d.decoderCtx.AvCodecReceiveFrame(frame); ret < 0 {
+			frame.AvFrameFree()
+			if !avutil.AvAgain(ret) {
+				log.Logger.Warn("AvCodecReceiveFrame failed", zap.Error(errors.New(avutil.AvErr2str(ret))))
+			}
+			return frames
+		}
+		frames = append(frames, frame)
+	}
+}
@@ -0,0 +1,195 @@
+package transcoders
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	commonh264 "github.com/bluenviron/mediacommon/pkg/codecs/h264"
+	"go.uber.org/zap"
+	"mediaserver-go/codecs"
+	"mediaserver-go/codecs/h264"
+	"mediaserver-go/thirdparty/ffmpeg/avcodec"
+	"mediaserver-go/thirdparty/ffmpeg/avutil"
+	"mediaserver-go/utils/log"
+	"mediaserver-go/utils/units"
+)
+
+const (
+	VideoEncoderTimeBase = 90000
+)
+
+var (
+	errFailedToSetEncoder = errors.New("failed to set encoder")
+)
+
+type VideoEncoderConfig struct {
+	Width   int
+	Height  int
+	FPS     int
+	GOPSize int
+	BitRate int64
+}
+
+// VideoEncoder 는 YUV420P 프레임을 H264 로 인코딩하여 HubSource 에 쓸 수 있는 NAL 유닛들로 반환한다.
+// 프레임의 PTS 는 VideoEncoderTimeBase 기준이어야 한다.
+type VideoEncoder struct {
+	config     VideoEncoderConfig
+	encoderCtx *avcodec.CodecContext
+	pkt        *avcodec.Packet
+
+	// SPS, PPS 가 변경되면 호출된다.
+	onCodec  func(codec codecs.Codec)
+	codec    codecs.Codec
+	sps, pps []byte
+}
+
+func NewVideoEncoder(config VideoEncoderConfig, onCodec func(codec codecs.Codec)) (*VideoEncoder, error) {
+	if config.Width <= 0 || config.Height <= 0 || config.Width%2 != 0 || config.Height%2 != 0 {
+		return nil, fmt.Errorf("invalid size %dx%d: %w", config.Width, config.Height, errFailedToSetEncoder)
+	}
+	if config.FPS <= 0 {
+		config.FPS = 30
+	}
+	if config.GOPSize <= 0 {
+		config.GOPSize = config.FPS
+	}
+
+	encoder := avcodec.AvcodecFindEncoder(avcodec.AV_CODEC_ID_H264)
+	if encoder == nil {
+		return nil, fmt.Errorf("could not find encoder: %w", errFailedToSetEncoder)
+	}
+	encoderCtx := encoder.AvCodecAllocContext3()
+	if encoderCtx == nil {
+		return nil, fmt.Errorf("could not allocate codec context: %w", errFailedToSetEncoder)
+	}
+	encoderCtx.SetCodecID(avcodec.AV_CODEC_ID_H264)
+	encoderCtx.SetCodecType(avutil.AVMEDIA_TYPE_VIDEO)
+	encoderCtx.SetWidth(config.Width)
+	encoderCtx.SetHeight(config.Height)
+	encoderCtx.SetPixelFormat(avutil.AV_PIX_FMT_YUV420P)
+	encoderCtx.SetTimeBase(avutil.NewRational(1, VideoEncoderTimeBase))
+	encoderCtx.SetFrameRate(avutil.NewRational(config.FPS, 1))
+	encoderCtx.SetGOP(config.GOPSize)
+	encoderCtx.SetMaxBFrames(0)
+	if config.BitRate > 0 {
+		encoderCtx.SetBitRate(config.BitRate)
+	}
+	avutil.AvOptSet(encoderCtx.PrivData(), "preset", "veryfast", 0)
+	avutil.AvOptSet(encoderCtx.PrivData(), "tune", "zerolatency", 0)
+	avutil.AvOptSet(encoderCtx.PrivData(), "profile", "baseline", 0)
+	// extradata 로 코덱 정보를 미리 알 수 있도록 global header 를 쓰고, RTP/WebRTC 를 위해 키프레임마다 SPS/PPS 를 반복한다.
+	avutil.AvOptSet(encoderCtx.PrivData(), "x264-params", "repeat-headers=1", 0)
+	encoderCtx.SetFlags(encoderCtx.Flags() | avcodec.AV_CODEC_FLAG_GLOBAL_HEADER)
+	if ret := encoderCtx.AvCodecOpen2(encoder, nil); ret < 0 {
+		avcodec.AvCodecFreeContext(&encoderCtx)
+		return nil, fmt.Errorf("could not open codec: %s, %w", avutil.AvErr2str(ret), errFailedToSetEncoder)
+	}
+
+	e := &VideoEncoder{
+		config:     config,
+		encoderCtx: encoderCtx,
+		pkt:        avcodec.AvPacketAlloc(),
+		onCodec:    onCodec,
+	}
+	if nalus, err := commonh264.AnnexBUnmarshal(encoderCtx.ExtraData()); err == nil {
+		e.updateCodec(nalus)
+	}
+	return e, nil
+}
+
+// Codec 은 인코더의 출력 코덱을 반환한다. 아직 SPS/PPS 를 알 수 없으면 nil 이다.
+func (e *VideoEncoder) Codec() codecs.Codec {
+	return e.codec
+}
+
+func (e *VideoEncoder) Config() VideoEncoderConfig {
+	return e.config
+}
+
+func (e *VideoEncoder) Close() {
+	if e.encoderCtx != nil {
+		avcodec.AvCodecFreeContext(&e.encoderCtx)
+	}
+	if e.pkt != nil {
+		e.pkt.AvPacketFree()
+		e.pkt = nil
+	}
+}
+
+func (e *VideoEncoder) Encode(frame *avutil.Frame) []units.Unit {
+	frame.SetPictType(avutil.AV_PICTURE_TYPE_NONE)
+	if ret := e.encoderCtx.AvCodecSendFrame(frame); ret < 0 {
+		log.Logger.Warn("AvCodecSendFrame failed", zap.Error(errors.New(avutil.AvErr2str(ret))))
+		return nil
+	}
+
+	var result []units.Unit
+	for {
+		if ret := e.encoderCtx.AvCodecReceivePacket(e.pkt); ret < 0 {
+			if !avutil.AvAgain(ret) {
+				log.Logger.Warn("AvCodecReceivePacket failed", zap.Error(errors.New(avutil.AvErr2str(ret))))
+			}
+			return result
+		}
+		result = append(result, e.packetToUnits(e.pkt)...)
+		e.pkt.AvPacketUnref()
+	}
+}
+
+func (e *VideoEncoder) packetToUnits(pkt *avcodec.Packet) []units.Unit {
+	nalus, err := commonh264.AnnexBUnmarshal(pkt.Data())
+	if err != nil {
+		log.Logger.Warn("invalid annexb from encoder", zap.Error(err))
+		return nil
+	}
+
+	e.updateCodec(nalus)
+
+	keyFrame := 0
+	if pkt.Flag()&avcodec.AV_PKT_FLAG_KEY != 0 {
+		keyFrame = 1
+	}
+	result := make([]units.Unit, 0, len(nalus))
+	for i, nalu := range nalus {
+		result = append(result, units.Unit{
+			Payload:  nalu,
+			PTS:      pkt.PTS(),
+			DTS:      pkt.DTS(),
+			Duration: int64(VideoEncoderTimeBase / e.config.FPS),
+			TimeBase: VideoEncoderTimeBase,
+			Marker:   i == len(nalus)-1,
+			FrameInfo: units.FrameInfo{
+				Flag: keyFrame,
+			},
+		})
+	}
+	return result
+}
+
+func (e *VideoEncoder) updateCodec(nalus [][]byte) {
+	var sps, pps []byte
+	for _, nalu := range nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+		switch commonh264.NALUType(nalu[0] & 0x1f) {
+		case commonh264.NALUTypeSPS:
+			sps = nalu
+		case commonh264.NALUTypePPS:
+			pps = nalu
+		}
+	}
+	if sps == nil || pps == nil || (bytes.Equal(sps, e.sps) && bytes.Equal(pps, e.pps)) {
+		return
+	}
+	config := &h264.Config{}
+	if err := config.UnmarshalFromSPSPPS(sps, pps); err != nil {
+		log.Logger.Warn("invalid sps pps from encoder", zap.Error(err))
+		return
+	}
+	e.sps, e.pps = bytes.Clone(sps), bytes.Clone(pps)
+	e.codec = h264.NewH264(config)
+	if e.onCodec != nil {
+		e.onCodec(e.codec)
+	}
+}
@@ -2,8 +2,11 @@ package writers
 
 import (
 	"github.com/bluenviron/mediacommon/pkg/codecs/h264"
+	commonh265 "github.com/bluenviron/mediacommon/pkg/codecs/h265"
 	"mediaserver-go/codecs"
 	"mediaserver-go/codecs/av1"
+	"mediaserver-go/codecs/h265"
+	"mediaserver-go/codecs/vp9"
 	"mediaserver-go/parsers/bitstreams"
 	"mediaserver-go/thirdparty/ffmpeg/avcodec"
 	"mediaserver-go/thirdparty/ffmpeg/avutil"
@@ -83,6 +86,21 @@ func (v *Writer) BitStreamSummary(unit units.Unit) (units.Unit, bool) {
 			v.keyFrame = true
 		}
 		v.buf = unit.Payload
+	} else if v.codec.CodecType() == types.CodecTypeH265 {
+		switch h265.NALUType(unit.Payload) {
+		case commonh265.NALUType_VPS_NUT, commonh265.NALUType_SPS_NUT, commonh265.NALUType_PPS_NUT,
+			commonh265.NALUType_PREFIX_SEI_NUT, commonh265.NALUType_SUFFIX_SEI_NUT, commonh265.NALUType_AUD_NUT:
+			return units.Unit{}, false // drop
+		}
+		if (&h265.Decoder{}).KeyFrame(unit.Payload) {
+			v.keyFrame = true
+		}
+		v.buf = unit.Payload
+	} else if v.codec.CodecType() == types.CodecTypeVP9 {
+		if (&vp9.Decoder{}).KeyFrame(unit.Payload) {
+			v.keyFrame = true
+		}
+		v.buf = unit.Payload
 	} else if v.codec.CodecType() == types.CodecTypeAV1 {
 		offset := 0
 		obuType := unit.Payload[offset] >> 3
@@ -0,0 +1,136 @@
+package servers
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"mediaserver-go/hubs"
+	"mediaserver-go/ingress/sessions"
+	"mediaserver-go/utils/dto"
+	"mediaserver-go/utils/log"
+)
+
+var (
+	errChannelNotFound     = errors.New("channel not found")
+	errChannelExists       = errors.New("channel already exists")
+	errChannelInvalidInput = errors.New("primary and backup must be different streams other than the channel")
+)
+
+type channel struct {
+	session *sessions.ChannelSession
+	req     dto.ChannelRequest
+	cancel  context.CancelFunc
+}
+
+// ChannelServer 는 primary, backup 입력을 가진 채널을 만든다. 채널은 입력과 별개의 스트림이므로
+// 발행자가 끊겨서 입력이 바뀌어도 시청자는 채널 스트림을 계속 본다.
+type ChannelServer struct {
+	mu sync.RWMutex
+
+	hub      *hubs.Hub
+	channels map[string]*channel
+}
+
+func NewChannelServer(hub *hubs.Hub) (ChannelServer, error) {
+	return ChannelServer{
+		hub:      hub,
+		channels: make(map[string]*channel),
+	}, nil
+}
+
+func (c *ChannelServer) StartSession(streamID string, req dto.ChannelRequest) (dto.ChannelResponse, error) {
+	if req.Primary == "" || req.Backup == "" || req.Primary == req.Backup || req.Primary == streamID || req.Backup == streamID {
+		return dto.ChannelResponse{}, errChannelInvalidInput
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.channels[streamID]; ok {
+		return dto.ChannelResponse{}, errChannelExists
+	}
+	if _, ok := c.hub.GetStream(streamID); ok {
+		return dto.ChannelResponse{}, errChannelExists
+	}
+
+	stream := hubs.NewStream()
+	session := sessions.NewChannelSession(req, c.hub, stream)
+	c.hub.AddStream(streamID, stream)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := &channel{
+		session: session,
+		req:     req,
+		cancel:  cancel,
+	}
+	c.channels[streamID] = ch
+
+	go func() {
+		defer func() {
+			c.mu.Lock()
+			delete(c.channels, streamID)
+			c.mu.Unlock()
+			c.hub.RemoveStream(streamID)
+		}()
+		if err := session.Run(ctx); err != nil {
+			log.Logger.Error("channel session error", zap.Error(err))
+		}
+	}()
+	return channelResponse(ch), nil
+}
+
+func (c *ChannelServer) Switch(streamID string, req dto.ChannelSwitchRequest) (dto.ChannelResponse, error) {
+	ch, err := c.channel(streamID)
+	if err != nil {
+		return dto.ChannelResponse{}, err
+	}
+	input, err := sessions.ParseChannelInput(req.Input)
+	if err != nil {
+		return dto.ChannelResponse{}, err
+	}
+	if err := ch.session.Switch(input); err != nil {
+		return dto.ChannelResponse{}, err
+	}
+	return channelResponse(ch), nil
+}
+
+func (c *ChannelServer) GetChannel(streamID string) (dto.ChannelResponse, error) {
+	ch, err := c.channel(streamID)
+	if err != nil {
+		return dto.ChannelResponse{}, err
+	}
+	return channelResponse(ch), nil
+}
+
+func (c *ChannelServer) StopSession(streamID string) error {
+	ch, err := c.channel(streamID)
+	if err != nil {
+		return err
+	}
+	ch.cancel()
+	return nil
+}
+
+func (c *ChannelServer) channel(streamID string) (*channel, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	ch, ok := c.channels[streamID]
+	if !ok {
+		return nil, errChannelNotFound
+	}
+	return ch, nil
+}
+
+func channelResponse(ch *channel) dto.ChannelResponse {
+	active, live := ch.session.Status()
+	return dto.ChannelResponse{
+		Primary: ch.req.Primary,
+		Backup:  ch.req.Backup,
+		Active:  string(active),
+		Live:    live,
+	}
+}
@@ -0,0 +1,103 @@
+package servers
+
+import (
+	"context"
+	"errors"
+	"go.uber.org/zap"
+	"mediaserver-go/hubs"
+	"mediaserver-go/ingress/sessions"
+	"mediaserver-go/utils/dto"
+	"mediaserver-go/utils/log"
+	"sync"
+)
+
+var (
+	errCompositorNotFound = errors.New("compositor not found")
+	errCompositorExists   = errors.New("compositor already exists")
+)
+
+type compositor struct {
+	session *sessions.CompositorSession
+	cancel  context.CancelFunc
+}
+
+type CompositorServer struct {
+	mu sync.RWMutex
+
+	hub         *hubs.Hub
+	compositors map[string]*compositor
+}
+
+func NewCompositorServer(hub *hubs.Hub) (CompositorServer, error) {
+	return CompositorServer{
+		hub:         hub,
+		compositors: make(map[string]*compositor),
+	}, nil
+}
+
+func (c *CompositorServer) StartSession(streamID string, req dto.CompositorRequest) (dto.CompositorResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.compositors[streamID]; ok {
+		return dto.CompositorResponse{}, errCompositorExists
+	}
+
+	stream := hubs.NewStream()
+	session, err := sessions.NewCompositorSession(req, c.hub, stream)
+	if err != nil {
+		return dto.CompositorResponse{}, err
+	}
+	c.hub.AddStream(streamID, stream)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.compositors[streamID] = &compositor{
+		session: session,
+		cancel:  cancel,
+	}
+
+	go func() {
+		defer func() {
+			c.mu.Lock()
+			delete(c.compositors, streamID)
+			c.mu.Unlock()
+			c.hub.RemoveStream(streamID)
+		}()
+		if err := session.Run(ctx); err != nil {
+			log.Logger.Error("compositor session error", zap.Error(err))
+		}
+	}()
+	return dto.CompositorResponse{}, nil
+}
+
+func (c *CompositorServer) UpdateLayout(streamID string, req dto.CompositorLayoutRequest) error {
+	c.mu.RLock()
+	comp, ok := c.compositors[streamID]
+	c.mu.RUnlock()
+	if !ok {
+		return errCompositorNotFound
+	}
+
+	// 레이아웃만 바뀌고 입력은 실패하지 않도록 먼저 확인한다.
+	if err := sessions.ValidateCompositorInputs(req.Inputs); err != nil {
+		return err
+	}
+	if err := comp.session.SetLayout(req); err != nil {
+		return err
+	}
+	if req.Inputs != nil {
+		return comp.session.SetInputs(req.Inputs)
+	}
+	return nil
+}
+
+func (c *CompositorServer) StopSession(streamID string) error {
+	c.mu.RLock()
+	comp, ok := c.compositors[streamID]
+	c.mu.RUnlock()
+	if !ok {
+		return errCompositorNotFound
+	}
+	comp.cancel()
+	return nil
+}
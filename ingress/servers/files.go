@@ -2,33 +2,92 @@ package servers
 
 import (
 	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
 	"mediaserver-go/hubs"
 	"mediaserver-go/ingress/sessions"
 	"mediaserver-go/utils/dto"
+	"mediaserver-go/utils/log"
+)
+
+var (
+	errFileStreamExists    = errors.New("stream already exists")
+	errFileSessionNotFound = errors.New("file session not found")
 )
 
 type FileServer struct {
-	hub *hubs.Hub
+	mu sync.Mutex
+
+	hub      *hubs.Hub
+	sessions map[string]context.CancelFunc
 }
 
 func NewFileServer(hub *hubs.Hub) (FileServer, error) {
 	return FileServer{
-		hub: hub,
+		hub:      hub,
+		sessions: make(map[string]context.CancelFunc),
 	}, nil
 }
 
 func (f *FileServer) StartSession(streamID string, req dto.IngressFileRequest) (dto.IngressFileResponse, error) {
-	stream := hubs.NewStream()
-	f.hub.AddStream(streamID, stream)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.sessions[streamID]; ok {
+		return dto.IngressFileResponse{}, errFileStreamExists
+	}
+	if _, ok := f.hub.GetStream(streamID); ok {
+		return dto.IngressFileResponse{}, errFileStreamExists
+	}
+
+	var paths []string
+	if req.Path != "" {
+		paths = append(paths, req.Path)
+	}
+	paths = append(paths, req.Paths...)
 
-	fileSession, err := sessions.NewFileSession(req.Path, req.MediaTypes, req.Live, stream)
+	stream := hubs.NewStream()
+	fileSession, err := sessions.NewFileSession(sessions.FileSessionConfig{
+		Paths:      paths,
+		MediaTypes: req.MediaTypes,
+		Live:       req.Live,
+		Loop:       req.Loop,
+		Start:      time.Duration(req.Start) * time.Millisecond,
+		Speed:      req.Speed,
+	}, stream)
 	if err != nil {
 		return dto.IngressFileResponse{}, err
 	}
+	f.hub.AddStream(streamID, stream)
 
 	ctx, cancel := context.WithCancel(context.Background())
-	_ = cancel
-	go fileSession.Run(ctx)
+	f.sessions[streamID] = cancel
+	go func() {
+		defer cancel()
+		if err := fileSession.Run(ctx); err != nil {
+			log.Logger.Warn("file session stopped", zap.String("streamID", streamID), zap.Error(err))
+		}
+		f.hub.RemoveStream(streamID)
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		delete(f.sessions, streamID)
+	}()
 
 	return dto.IngressFileResponse{}, nil
 }
+
+func (f *FileServer) StopSession(streamID string) error {
+	f.mu.Lock()
+	cancel, ok := f.sessions[streamID]
+	f.mu.Unlock()
+	if !ok {
+		return errFileSessionNotFound
+	}
+	cancel()
+	return nil
+}
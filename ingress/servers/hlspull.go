@@ -0,0 +1,79 @@
+package servers
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"mediaserver-go/hubs"
+	"mediaserver-go/ingress/sessions"
+	"mediaserver-go/utils/dto"
+	"mediaserver-go/utils/log"
+)
+
+var (
+	errHLSPullSessionExists   = errors.New("hls pull session already exists")
+	errHLSPullSessionNotFound = errors.New("hls pull session not found")
+)
+
+type HLSPullServer struct {
+	mu sync.Mutex
+
+	hub      *hubs.Hub
+	sessions map[string]context.CancelFunc
+}
+
+func NewHLSPullServer(hub *hubs.Hub) (HLSPullServer, error) {
+	return HLSPullServer{
+		hub:      hub,
+		sessions: make(map[string]context.CancelFunc),
+	}, nil
+}
+
+func (h *HLSPullServer) StartSession(streamID string, req dto.IngressHLSRequest) (dto.IngressHLSResponse, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.sessions[streamID]; ok {
+		return dto.IngressHLSResponse{}, errHLSPullSessionExists
+	}
+
+	stream := hubs.NewStream()
+	session, err := sessions.NewHLSPullSession(sessions.HLSPullConfig{
+		URL:          req.URL,
+		MaxBandwidth: req.MaxBandwidth,
+	}, stream)
+	if err != nil {
+		return dto.IngressHLSResponse{}, err
+	}
+	h.hub.AddStream(streamID, stream)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h.sessions[streamID] = cancel
+	go func() {
+		defer cancel()
+		if err := session.Run(ctx); err != nil {
+			log.Logger.Warn("hls pull session stopped", zap.String("streamID", streamID), zap.Error(err))
+		}
+		h.hub.RemoveStream(streamID)
+
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.sessions, streamID)
+	}()
+
+	return dto.IngressHLSResponse{}, nil
+}
+
+func (h *HLSPullServer) StopSession(streamID string) error {
+	h.mu.Lock()
+	cancel, ok := h.sessions[streamID]
+	h.mu.Unlock()
+	if !ok {
+		return errHLSPullSessionNotFound
+	}
+	cancel()
+	return nil
+}
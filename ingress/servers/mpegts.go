@@ -0,0 +1,81 @@
+package servers
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"mediaserver-go/hubs"
+	"mediaserver-go/ingress/sessions"
+	"mediaserver-go/utils/dto"
+	"mediaserver-go/utils/log"
+)
+
+var (
+	errMPEGTSSessionExists   = errors.New("mpegts session already exists")
+	errMPEGTSSessionNotFound = errors.New("mpegts session not found")
+)
+
+type MPEGTSServer struct {
+	mu sync.Mutex
+
+	hub      *hubs.Hub
+	sessions map[string]context.CancelFunc
+}
+
+func NewMPEGTSServer(hub *hubs.Hub) (MPEGTSServer, error) {
+	return MPEGTSServer{
+		hub:      hub,
+		sessions: make(map[string]context.CancelFunc),
+	}, nil
+}
+
+func (m *MPEGTSServer) StartSession(streamID string, req dto.IngressMPEGTSRequest) (dto.IngressMPEGTSResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.sessions[streamID]; ok {
+		return dto.IngressMPEGTSResponse{}, errMPEGTSSessionExists
+	}
+
+	stream := hubs.NewStream()
+	session, err := sessions.NewMPEGTSSession(sessions.MPEGTSConfig{
+		Protocol:  req.Protocol,
+		Addr:      req.Addr,
+		Port:      req.Port,
+		Interface: req.Interface,
+	}, stream)
+	if err != nil {
+		return dto.IngressMPEGTSResponse{}, err
+	}
+	m.hub.AddStream(streamID, stream)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m.sessions[streamID] = cancel
+	go func() {
+		defer cancel()
+		if err := session.Run(ctx); err != nil {
+			log.Logger.Warn("mpegts session stopped", zap.String("streamID", streamID), zap.Error(err))
+		}
+		m.hub.RemoveStream(streamID)
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.sessions, streamID)
+	}()
+
+	return dto.IngressMPEGTSResponse{}, nil
+}
+
+func (m *MPEGTSServer) StopSession(streamID string) error {
+	m.mu.Lock()
+	cancel, ok := m.sessions[streamID]
+	m.mu.Unlock()
+	if !ok {
+		return errMPEGTSSessionNotFound
+	}
+	cancel()
+	return nil
+}
@@ -0,0 +1,225 @@
+package servers
+
+import (
+	"context"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	pion "github.com/pion/webrtc/v3"
+	"go.uber.org/zap"
+
+	"mediaserver-go/hubs"
+	"mediaserver-go/hubs/engines"
+	"mediaserver-go/ingress/sessions"
+	"mediaserver-go/utils/configs"
+	"mediaserver-go/utils/log"
+)
+
+const (
+	relayIdleCheckInterval = time.Second
+)
+
+// RelayServer 는 hubs.StreamPuller 이다. 시청자가 없는 스트림을 요청하면 origin 서버에서 WHEP 로 가져오고,
+// 시청자가 모두 떠나면 끊는다.
+type RelayServer struct {
+	hub    *hubs.Hub
+	api    *pion.API
+	config configs.Relay
+
+	mu sync.Mutex
+	// 가져오는 중이거나 가져온 스트림. 같은 스트림을 동시에 요청해도 한 번만 가져온다.
+	relays map[string]*relay
+}
+
+// relay 는 스트림 하나의 pull 이다. ready 가 닫히기 전에는 origin 과 협상 중이고, 닫힌 뒤 err 가 nil 이면 hub 에 들어가 있다.
+type relay struct {
+	stream *hubs.Stream
+	ready  chan struct{}
+	err    error
+}
+
+func NewRelayServer(hub *hubs.Hub, se pion.SettingEngine, config configs.Relay) (RelayServer, error) {
+	me := &pion.MediaEngine{}
+	for kind, capabilities := range engines.GetWebRTCCapabilities(false) {
+		for _, capability := range capabilities {
+			if err := me.RegisterCodec(capability, kind); err != nil {
+				log.Logger.Error("Failed to register codec", zap.Error(err))
+			}
+		}
+	}
+
+	// origin 도 ICE lite 이므로 offer 를 보내는 쪽은 full ICE 여야 연결된다. se 는 복사본이다.
+	se.SetLite(false)
+
+	return RelayServer{
+		hub:    hub,
+		api:    pion.NewAPI(pion.WithSettingEngine(se), pion.WithMediaEngine(me)),
+		config: config,
+		relays: make(map[string]*relay),
+	}, nil
+}
+
+func (r *RelayServer) Enabled() bool {
+	return r.config.Origin != ""
+}
+
+func (r *RelayServer) match(streamID string) bool {
+	if len(r.config.Streams) == 0 {
+		return true
+	}
+	for _, pattern := range r.config.Streams {
+		if ok, _ := path.Match(pattern, streamID); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// PullStream 은 origin 의 트랙이 도착하고 코덱이 정해지면 스트림을 hub 에 넣고 반환한다.
+// 다른 스트림의 pull 은 따로 진행되고, 같은 스트림을 가져오는 중이면 그 결과를 기다린다.
+func (r *RelayServer) PullStream(streamID string) (*hubs.Stream, bool) {
+	if !r.Enabled() || !r.match(streamID) {
+		return nil, false
+	}
+
+	r.mu.Lock()
+	if p, ok := r.relays[streamID]; ok {
+		r.mu.Unlock()
+		<-p.ready
+		return p.stream, p.err == nil
+	}
+	// lock 을 기다리는 동안 다른 ingress 가 발행했을 수 있다.
+	if stream, ok := r.hub.GetStream(streamID); ok {
+		r.mu.Unlock()
+		return stream, true
+	}
+	p := &relay{
+		stream: hubs.NewStream(),
+		ready:  make(chan struct{}),
+	}
+	r.relays[streamID] = p
+	r.mu.Unlock()
+
+	stream, err := r.pull(streamID, p)
+
+	r.mu.Lock()
+	p.stream, p.err = stream, err
+	if err != nil {
+		r.removeRelay(streamID, p)
+	}
+	close(p.ready)
+	r.mu.Unlock()
+
+	if err != nil {
+		log.Logger.Warn("relay connect failed", zap.String("streamID", streamID), zap.String("origin", r.config.Origin), zap.Error(err))
+		return nil, false
+	}
+	return stream, true
+}
+
+// pull 은 origin 과 WHEP 로 연결하고 소스가 준비될 때까지 ConnectTimeout 동안 기다린다.
+// 그 사이에 같은 ID 로 발행된 스트림이 있으면 relay 를 끊고 그 스트림을 반환한다.
+func (r *RelayServer) pull(streamID string, p *relay) (*hubs.Stream, error) {
+	// p.stream 은 pull 이 끝나면 반환한 스트림으로 바뀌므로 relay 의 스트림을 따로 잡아둔다.
+	stream := p.stream
+	connectCtx, cancelConnect := context.WithTimeout(context.Background(), time.Duration(r.config.ConnectTimeout)*time.Second)
+	defer cancelConnect()
+	endpoint := strings.TrimSuffix(r.config.Origin, "/") + "/v1/whep"
+	session, err := sessions.NewWHEPClientSession(connectCtx, endpoint, streamID, r.api, stream)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		defer cancel()
+		if err := session.Run(ctx); err != nil {
+			log.Logger.Warn("relay session stopped", zap.String("streamID", streamID), zap.Error(err))
+		}
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.removeRelay(streamID, p)
+		if current, ok := r.hub.GetStream(streamID); ok && current == stream {
+			r.hub.RemoveStream(streamID)
+		}
+		log.Logger.Info("relay stopped", zap.String("streamID", streamID))
+	}()
+
+	// 트랙이 없는 스트림을 넣으면 WHEP 외의 egress 는 소스를 찾지 못해 바로 실패한다.
+	if err := waitSources(connectCtx, stream, session.ExpectedTracks()); err != nil {
+		cancel()
+		return nil, err
+	}
+	if published, ok := r.hub.GetStream(streamID); ok {
+		cancel()
+		return published, nil
+	}
+	r.hub.AddStream(streamID, stream)
+	log.Logger.Info("relay started", zap.String("streamID", streamID), zap.String("origin", r.config.Origin))
+
+	go r.watchIdle(ctx, cancel, streamID, stream)
+	return stream, nil
+}
+
+// removeRelay 는 streamID 의 relay 가 아직 p 이면 지운다. r.mu 를 잡고 호출해야 한다.
+func (r *RelayServer) removeRelay(streamID string, p *relay) {
+	if current, ok := r.relays[streamID]; ok && current == p {
+		delete(r.relays, streamID)
+	}
+}
+
+// waitSources 는 expected 개의 소스가 추가되고 코덱이 정해질 때까지 기다린다. expected 가 0 이면 하나만 기다린다.
+// ctx 가 끝났을 때 준비된 소스가 있으면 그것만으로 시작하고, 늦게 오는 트랙은 이후에 추가된다.
+func waitSources(ctx context.Context, stream *hubs.Stream, expected int) error {
+	expected = max(expected, 1)
+	ch := stream.Subscribe()
+	defer stream.Unsubscribe(ch)
+
+	ready := 0
+	for ready < expected {
+		select {
+		case source := <-ch:
+			if _, err := source.WaitCodec(ctx); err != nil {
+				if ready > 0 {
+					return nil
+				}
+				return err
+			}
+			ready++
+		case <-ctx.Done():
+			if ready > 0 {
+				return nil
+			}
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// watchIdle 은 consumer 가 없는 채로 IdleTimeout 이 지나면 relay 를 끊는다. 처음 시청자가 붙을 때까지도 같은 시간을 기다린다.
+func (r *RelayServer) watchIdle(ctx context.Context, cancel context.CancelFunc, streamID string, stream *hubs.Stream) {
+	idleTimeout := time.Duration(r.config.IdleTimeout) * time.Second
+	ticker := time.NewTicker(relayIdleCheckInterval)
+	defer ticker.Stop()
+
+	lastActive := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if stream.ConsumerCount() > 0 {
+				lastActive = time.Now()
+				continue
+			}
+			if time.Since(lastActive) >= idleTimeout {
+				log.Logger.Info("relay idle", zap.String("streamID", streamID))
+				cancel()
+				return
+			}
+		}
+	}
+}
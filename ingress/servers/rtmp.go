@@ -1,33 +1,67 @@
 package servers
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/yutopp/go-rtmp"
+	"go.uber.org/zap"
 	"io"
+	"mediaserver-go/egress/sessions/flv"
 	"mediaserver-go/hubs"
 	"mediaserver-go/ingress/sessions"
+	"mediaserver-go/utils/configs"
 	"mediaserver-go/utils/log"
 	"net"
+	"sync"
 )
 
+var (
+	errRTMPStreamExists = errors.New("stream is already publishing")
+)
+
+// FLVSubscriber 는 RTMP 재생에 쓰는 FLV egress 이다.
+type FLVSubscriber interface {
+	Subscribe(streamID string) (*flv.Subscriber, error)
+}
+
 type RTMPServer struct {
-	rtmpServer *rtmp.Server
-	hub        *hubs.Hub
+	hub       *hubs.Hub
+	config    configs.RTMP
+	validator RTMPPublishValidator
+	flvServer FLVSubscriber
+
+	mu sync.Mutex
+	// 스트림 ID 별 발행 중인 세션
+	publishers map[string]*sessions.RTMPSession
+}
+
+func NewRTMPServer(hub *hubs.Hub, config configs.RTMP, flvServer FLVSubscriber) (RTMPServer, error) {
+	return RTMPServer{
+		hub:        hub,
+		config:     config,
+		validator:  NewRTMPPublishValidator(config),
+		flvServer:  flvServer,
+		publishers: make(map[string]*sessions.RTMPSession),
+	}, nil
 }
 
-func NewRTMPServer(hub *hubs.Hub) (RTMPServer, error) {
-	rtmpServer := rtmp.NewServer(&rtmp.ServerConfig{
+func (r *RTMPServer) newRTMPServer() *rtmp.Server {
+	return rtmp.NewServer(&rtmp.ServerConfig{
 		OnConnect: func(conn net.Conn) (io.ReadWriteCloser, *rtmp.ConnConfig) {
-			log.Logger.Info("new rtmp server onConnect")
-			return conn, &rtmp.ConnConfig{
-				Handler: sessions.NewRTMPSession(hub),
+			log.Logger.Info("new rtmp server onConnect", zap.String("remoteAddr", conn.RemoteAddr().String()))
+			session := sessions.NewRTMPSession(r, conn.RemoteAddr().String())
+			return session.WrapConn(conn), &rtmp.ConnConfig{
+				Handler: session,
 			}
 		},
 	})
-	return RTMPServer{
-		rtmpServer: rtmpServer,
-		hub:        hub,
-	}, nil
+}
+
+// SetValidator 는 [Rtmp] Auth 대신 사용할 발행 validator 를 정한다. Start 전에 호출해야 한다.
+func (r *RTMPServer) SetValidator(validator RTMPPublishValidator) {
+	r.validator = validator
 }
 
 func (r *RTMPServer) Start(addr string) error {
@@ -40,5 +74,71 @@ func (r *RTMPServer) Start(addr string) error {
 	if err != nil {
 		return fmt.Errorf("failed to listen tcp: %w", err)
 	}
-	return r.rtmpServer.Serve(listener)
+	return r.newRTMPServer().Serve(listener)
+}
+
+// StartTLS 는 같은 서버로 RTMPS 를 받는다.
+func (r *RTMPServer) StartTLS(addr, certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load rtmps certificate: %w", err)
+	}
+	listener, err := tls.Listen("tcp", addr, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to listen tls: %w", err)
+	}
+	return r.newRTMPServer().Serve(listener)
+}
+
+// Publish 는 인증 후 중복 발행 정책에 따라 stream 을 hub 에 넣는다. RTMP 가 아닌 ingress 의 스트림은 가져가지 않는다.
+func (r *RTMPServer) Publish(session *sessions.RTMPSession, req sessions.RTMPPublishRequest, stream *hubs.Stream) error {
+	if err := r.validator.Validate(context.Background(), req); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	prev, ok := r.publishers[req.StreamID]
+	if !ok {
+		if _, exists := r.hub.GetStream(req.StreamID); exists {
+			r.mu.Unlock()
+			return fmt.Errorf("%w: %s", errRTMPStreamExists, req.StreamID)
+		}
+	} else if r.config.DuplicatePublisher != configs.RTMPDuplicateTakeover {
+		r.mu.Unlock()
+		return fmt.Errorf("%w: %s", errRTMPStreamExists, req.StreamID)
+	}
+	if ok {
+		r.hub.RemoveStream(req.StreamID)
+	}
+	r.publishers[req.StreamID] = session
+	r.hub.AddStream(req.StreamID, stream)
+	r.mu.Unlock()
+
+	if ok {
+		// Kick 이 부르는 OnClose 가 Unpublish 로 r.mu 를 잡으므로 lock 밖에서 끊는다.
+		log.Logger.Info("rtmp publisher taken over", zap.String("streamID", req.StreamID))
+		prev.Kick()
+	}
+	return nil
+}
+
+func (r *RTMPServer) Unpublish(session *sessions.RTMPSession, streamID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.publishers[streamID] != session {
+		return
+	}
+	delete(r.publishers, streamID)
+	r.hub.RemoveStream(streamID)
+}
+
+func (r *RTMPServer) Subscribe(streamID string) (sessions.RTMPSubscriber, error) {
+	subscriber, err := r.flvServer.Subscribe(streamID)
+	if err != nil {
+		return nil, err
+	}
+	return subscriber, nil
 }
@@ -0,0 +1,118 @@
+package servers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"mediaserver-go/ingress/sessions"
+	"mediaserver-go/utils/configs"
+	"mediaserver-go/utils/dto"
+)
+
+const (
+	defaultRTMPAuthTimeout = 5 * time.Second
+)
+
+var (
+	errRTMPUnauthorized = errors.New("rtmp publish unauthorized")
+)
+
+// RTMPPublishValidator 는 RTMP 발행을 허용할지 정한다. nil 을 반환하면 허용한다.
+type RTMPPublishValidator interface {
+	Validate(ctx context.Context, req sessions.RTMPPublishRequest) error
+}
+
+// NewRTMPPublishValidator 는 [Rtmp] Auth 설정에 맞는 validator 를 만든다. Auth 가 비어있으면 모두 허용한다.
+func NewRTMPPublishValidator(config configs.RTMP) RTMPPublishValidator {
+	switch config.Auth {
+	case configs.RTMPAuthStatic:
+		return NewStaticRTMPValidator(config.StreamKeys)
+	case configs.RTMPAuthHTTP:
+		timeout := time.Duration(config.AuthTimeout) * time.Second
+		if timeout <= 0 {
+			timeout = defaultRTMPAuthTimeout
+		}
+		return NewHTTPRTMPValidator(config.AuthURL, timeout)
+	default:
+		return allowAllRTMPValidator{}
+	}
+}
+
+type allowAllRTMPValidator struct{}
+
+func (allowAllRTMPValidator) Validate(context.Context, sessions.RTMPPublishRequest) error {
+	return nil
+}
+
+// StaticRTMPValidator 는 정해진 스트림 키만 허용한다. "app/streamKey" 는 그 app 에서만, "/" 가 없는 키는 모든 app 에서 허용한다.
+type StaticRTMPValidator struct {
+	keys map[string]struct{}
+}
+
+func NewStaticRTMPValidator(keys []string) *StaticRTMPValidator {
+	v := &StaticRTMPValidator{
+		keys: make(map[string]struct{}, len(keys)),
+	}
+	for _, key := range keys {
+		v.keys[key] = struct{}{}
+	}
+	return v
+}
+
+func (s *StaticRTMPValidator) Validate(_ context.Context, req sessions.RTMPPublishRequest) error {
+	if _, ok := s.keys[req.StreamID]; ok {
+		return nil
+	}
+	if _, ok := s.keys[req.StreamKey]; ok && !strings.Contains(req.StreamKey, "/") {
+		return nil
+	}
+	return errRTMPUnauthorized
+}
+
+// HTTPRTMPValidator 는 발행 정보(dto.RTMPAuthRequest)를 url 로 POST 하고 2xx 응답이면 허용한다.
+type HTTPRTMPValidator struct {
+	url    string
+	client *http.Client
+}
+
+func NewHTTPRTMPValidator(url string, timeout time.Duration) *HTTPRTMPValidator {
+	return &HTTPRTMPValidator{
+		url:    url,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+func (h *HTTPRTMPValidator) Validate(ctx context.Context, req sessions.RTMPPublishRequest) error {
+	body, err := json.Marshal(dto.RTMPAuthRequest{
+		App:        req.App,
+		StreamKey:  req.StreamKey,
+		StreamID:   req.StreamID,
+		Query:      req.Query,
+		RemoteAddr: req.RemoteAddr,
+	})
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := h.client.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("rtmp auth callback failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%w: callback status %d", errRTMPUnauthorized, resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package servers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"mediaserver-go/ingress/sessions"
+	"mediaserver-go/utils/configs"
+	"mediaserver-go/utils/dto"
+)
+
+func rtmpPublishRequest(app, streamKey string) sessions.RTMPPublishRequest {
+	return sessions.RTMPPublishRequest{
+		App:        app,
+		StreamKey:  streamKey,
+		StreamID:   sessions.RTMPStreamID(app, streamKey),
+		Query:      url.Values{"token": {"xyz"}},
+		RemoteAddr: "192.0.2.1:50000",
+	}
+}
+
+func TestStaticRTMPValidator(t *testing.T) {
+	v := NewStaticRTMPValidator([]string{"live/cam1", "cam2"})
+	tests := []struct {
+		app, streamKey string
+		allowed        bool
+	}{
+		// app 이 붙은 키는 그 app 에서만 허용한다.
+		{"live", "cam1", true},
+		{"other", "cam1", false},
+		// app 이 없는 키는 모든 app 에서 허용한다.
+		{"live", "cam2", true},
+		{"other", "cam2", true},
+		{"", "cam2", true},
+		{"live", "cam3", false},
+	}
+	for _, tt := range tests {
+		err := v.Validate(context.Background(), rtmpPublishRequest(tt.app, tt.streamKey))
+		if tt.allowed && err != nil {
+			t.Fatalf("%s/%s rejected: %v", tt.app, tt.streamKey, err)
+		}
+		if !tt.allowed && !errors.Is(err, errRTMPUnauthorized) {
+			t.Fatalf("%s/%s error = %v, want errRTMPUnauthorized", tt.app, tt.streamKey, err)
+		}
+	}
+}
+
+func TestHTTPRTMPValidator(t *testing.T) {
+	var got dto.RTMPAuthRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if got.StreamKey == "denied" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	v := NewHTTPRTMPValidator(server.URL, time.Second)
+	if err := v.Validate(context.Background(), rtmpPublishRequest("live", "cam1")); err != nil {
+		t.Fatalf("allowed publish rejected: %v", err)
+	}
+	if got.App != "live" || got.StreamKey != "cam1" || got.StreamID != "live/cam1" ||
+		got.RemoteAddr != "192.0.2.1:50000" || len(got.Query["token"]) != 1 || got.Query["token"][0] != "xyz" {
+		t.Fatalf("callback body = %+v", got)
+	}
+
+	if err := v.Validate(context.Background(), rtmpPublishRequest("live", "denied")); !errors.Is(err, errRTMPUnauthorized) {
+		t.Fatalf("error = %v, want errRTMPUnauthorized", err)
+	}
+}
+
+func TestHTTPRTMPValidatorUnreachable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	addr := server.URL
+	server.Close()
+
+	// 콜백 서버에 연결할 수 없으면 발행을 막는다.
+	v := NewHTTPRTMPValidator(addr, time.Second)
+	if err := v.Validate(context.Background(), rtmpPublishRequest("live", "cam1")); err == nil {
+		t.Fatal("publish allowed without a callback response")
+	}
+}
+
+func TestNewRTMPPublishValidator(t *testing.T) {
+	if _, ok := NewRTMPPublishValidator(configs.RTMP{}).(allowAllRTMPValidator); !ok {
+		t.Fatal("empty Auth must allow every publish")
+	}
+	if _, ok := NewRTMPPublishValidator(configs.RTMP{Auth: configs.RTMPAuthStatic}).(*StaticRTMPValidator); !ok {
+		t.Fatal("static Auth must use StaticRTMPValidator")
+	}
+	v, ok := NewRTMPPublishValidator(configs.RTMP{Auth: configs.RTMPAuthHTTP, AuthURL: "http://127.0.0.1"}).(*HTTPRTMPValidator)
+	if !ok {
+		t.Fatal("http Auth must use HTTPRTMPValidator")
+	}
+	if v.client.Timeout != defaultRTMPAuthTimeout {
+		t.Fatalf("timeout = %v, want %v", v.client.Timeout, defaultRTMPAuthTimeout)
+	}
+}
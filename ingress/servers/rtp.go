@@ -2,35 +2,92 @@ package servers
 
 import (
 	"context"
+	"errors"
+	"sync"
+
+	"go.uber.org/zap"
+
 	"mediaserver-go/hubs"
 	"mediaserver-go/ingress/sessions"
 	"mediaserver-go/utils/dto"
+	"mediaserver-go/utils/log"
+)
+
+var (
+	errRTPStreamExists    = errors.New("stream already exists")
+	errRTPSessionNotFound = errors.New("rtp session not found")
 )
 
 type RTPServer struct {
-	hub *hubs.Hub
+	mu sync.Mutex
+
+	hub      *hubs.Hub
+	sessions map[string]context.CancelFunc
 }
 
 func NewRTPServer(hub *hubs.Hub) (RTPServer, error) {
 	return RTPServer{
-		hub: hub,
+		hub:      hub,
+		sessions: make(map[string]context.CancelFunc),
 	}, nil
 }
 
 func (f *RTPServer) StartSession(streamID string, req dto.IngressRTPRequest) (dto.IngressRTPResponse, error) {
-	stream := hubs.NewStream()
-	f.hub.AddStream(streamID, stream)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// 같은 streamID 의 스트림을 바꿔치기하면 기존 송출이 끊기므로 받지 않는다.
+	if _, ok := f.sessions[streamID]; ok {
+		return dto.IngressRTPResponse{}, errRTPStreamExists
+	}
+	if _, ok := f.hub.GetStream(streamID); ok {
+		return dto.IngressRTPResponse{}, errRTPStreamExists
+	}
+
+	configs := []sessions.RTPTrackConfig{{
+		MimeType:    req.MimeType,
+		PayloadType: req.PayloadType,
+		Addr:        req.Addr,
+		Port:        req.Port,
+	}}
+	if req.SDP != "" {
+		var err error
+		if configs, err = sessions.RTPTracksFromSDP(req.SDP, req.Addr); err != nil {
+			return dto.IngressRTPResponse{}, err
+		}
+	}
 
-	fileSession, err := sessions.NewRTPSession(req.Addr, req.Port, req.PayloadType, req.MimeType, stream)
+	stream := hubs.NewStream()
+	session, err := sessions.NewRTPSession(configs, stream)
 	if err != nil {
 		return dto.IngressRTPResponse{}, err
 	}
+	f.hub.AddStream(streamID, stream)
 
+	ctx, cancel := context.WithCancel(context.Background())
+	f.sessions[streamID] = cancel
 	go func() {
-		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
-		fileSession.Run(ctx)
+		if err := session.Run(ctx); err != nil {
+			log.Logger.Warn("rtp session stopped", zap.String("streamID", streamID), zap.Error(err))
+		}
+		f.hub.RemoveStream(streamID)
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		delete(f.sessions, streamID)
 	}()
 
 	return dto.IngressRTPResponse{}, nil
 }
+
+func (f *RTPServer) StopSession(streamID string) error {
+	f.mu.Lock()
+	cancel, ok := f.sessions[streamID]
+	f.mu.Unlock()
+	if !ok {
+		return errRTPSessionNotFound
+	}
+	cancel()
+	return nil
+}
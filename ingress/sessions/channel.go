@@ -0,0 +1,434 @@
+package sessions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+
+	"mediaserver-go/codecs"
+	"mediaserver-go/hubs"
+	"mediaserver-go/utils"
+	"mediaserver-go/utils/dto"
+	"mediaserver-go/utils/log"
+	"mediaserver-go/utils/types"
+	"mediaserver-go/utils/units"
+)
+
+const (
+	channelDefaultTimeout = 3 * time.Second
+	channelCheckInterval  = time.Second
+)
+
+var (
+	errChannelInputEnded        = errors.New("channel input ended")
+	errChannelInputStalled      = errors.New("channel input stalled")
+	errChannelInputNotAvailable = errors.New("channel input not available")
+)
+
+type ChannelInput string
+
+const (
+	ChannelInputPrimary ChannelInput = "primary"
+	ChannelInputBackup  ChannelInput = "backup"
+)
+
+func ParseChannelInput(s string) (ChannelInput, error) {
+	switch s {
+	case "primary":
+		return ChannelInputPrimary, nil
+	case "backup":
+		return ChannelInputBackup, nil
+	default:
+		return "", fmt.Errorf("unsupported channel input: %s", s)
+	}
+}
+
+func (i ChannelInput) other() ChannelInput {
+	if i == ChannelInputPrimary {
+		return ChannelInputBackup
+	}
+	return ChannelInputPrimary
+}
+
+// channelOutput 은 채널 스트림의 미디어 타입 하나이다. 입력이 바뀌어도 코덱이 같으면 소스를 그대로 쓴다.
+type channelOutput struct {
+	source *hubs.HubSource
+	codec  codecs.Codec
+
+	// 출력 타임스탬프의 timebase. 처음 들어온 unit 의 것을 계속 쓴다.
+	timeBase int
+	started  bool
+	lastDTS  int64
+	// 마지막 프레임 간격. Duration 이 없는 입력에서 next 를 정할 때 쓴다.
+	lastStep int64
+	// 다음 프레임이 시작될 시각. 새 입력의 첫 unit 은 이보다 앞서지 않는다.
+	next int64
+	// 지금 입력에서 offset 에 더해 미는 값. 입력이 바뀐 뒤 첫 unit 에서 한 번만 정한다.
+	shift   int64
+	rebased bool
+}
+
+// ChannelSession 은 primary, backup 두 입력 스트림 중 하나를 골라 채널 스트림으로 보낸다.
+// 보내던 입력이 끝나거나 Timeout 동안 멈추면 다른 입력으로 바꾸고, 시청자는 채널 스트림을 계속 본다.
+// 타임스탬프는 입력이 바뀌어도 이어지도록 다시 계산한다. 코덱이 달라지면 소스를 바꿔서 egress 에 알린다.
+type ChannelSession struct {
+	mu sync.Mutex
+
+	hub       *hubs.Hub
+	stream    *hubs.Stream
+	inputs    map[ChannelInput]string
+	timeout   time.Duration
+	revertive bool
+
+	// revertive 일 때 돌아갈 입력
+	preferred ChannelInput
+	active    ChannelInput
+	live      bool
+	switchCh  chan struct{}
+
+	outputs map[types.MediaType]*channelOutput
+	// 지금 입력의 타임스탬프에 더할 값. 입력이 바뀌면 첫 unit 에서 다시 정한다.
+	offset    time.Duration
+	offsetSet bool
+}
+
+func NewChannelSession(req dto.ChannelRequest, hub *hubs.Hub, stream *hubs.Stream) *ChannelSession {
+	timeout := time.Duration(req.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = channelDefaultTimeout
+	}
+	return &ChannelSession{
+		hub:    hub,
+		stream: stream,
+		inputs: map[ChannelInput]string{
+			ChannelInputPrimary: req.Primary,
+			ChannelInputBackup:  req.Backup,
+		},
+		timeout:   timeout,
+		revertive: req.Revertive,
+		preferred: ChannelInputPrimary,
+		active:    ChannelInputPrimary,
+		switchCh:  make(chan struct{}, 1),
+		outputs:   make(map[types.MediaType]*channelOutput),
+	}
+}
+
+func (s *ChannelSession) Run(ctx context.Context) error {
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.live = false
+		for _, out := range s.outputs {
+			s.stream.RemoveSource(out.source)
+			out.source.Close()
+		}
+	}()
+
+	ticker := time.NewTicker(channelCheckInterval)
+	defer ticker.Stop()
+	for {
+		input, stream, ok := s.selectInput()
+		if ok {
+			err := s.forward(ctx, input, stream)
+			if ctx.Err() != nil {
+				return nil
+			}
+			if err != nil {
+				log.Logger.Warn("channel input lost", zap.String("input", string(input)), zap.String("streamID", s.inputs[input]), zap.Error(err))
+			}
+			continue
+		}
+
+		s.mu.Lock()
+		s.live = false
+		s.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-s.switchCh:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Switch 는 input 으로 바꾼다. revertive 이면 이후 input 이 우선 입력이 된다.
+func (s *ChannelSession) Switch(input ChannelInput) error {
+	if _, ok := s.alive(input); !ok {
+		return fmt.Errorf("%w: %s", errChannelInputNotAvailable, input)
+	}
+	s.mu.Lock()
+	s.preferred = input
+	s.active = input
+	s.mu.Unlock()
+	utils.SendOrDrop(s.switchCh, struct{}{})
+	return nil
+}
+
+func (s *ChannelSession) Status() (ChannelInput, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.active, s.live
+}
+
+// alive 는 input 이 발행 중이고 Timeout 안에 unit 이 들어왔으면 그 스트림을 반환한다.
+func (s *ChannelSession) alive(input ChannelInput) (*hubs.Stream, bool) {
+	stream, ok := s.hub.GetStream(s.inputs[input])
+	if !ok || stream == s.stream {
+		return nil, false
+	}
+	for _, source := range stream.Sources() {
+		if time.Since(source.LastWrite()) < s.timeout {
+			return stream, true
+		}
+	}
+	return nil, false
+}
+
+// selectInput 은 보낼 입력을 고른다. revertive 이면 우선 입력을, 아니면 지금 입력을 먼저 본다.
+func (s *ChannelSession) selectInput() (ChannelInput, *hubs.Stream, bool) {
+	s.mu.Lock()
+	first := s.active
+	if s.revertive {
+		first = s.preferred
+	}
+	s.mu.Unlock()
+
+	for _, input := range []ChannelInput{first, first.other()} {
+		if stream, ok := s.alive(input); ok {
+			return input, stream, true
+		}
+	}
+	return "", nil, false
+}
+
+// forward 는 입력이 끊기거나, 수동 전환되거나, revertive 로 우선 입력에 돌아갈 때까지 stream 을 보낸다.
+func (s *ChannelSession) forward(ctx context.Context, input ChannelInput, stream *hubs.Stream) error {
+	s.mu.Lock()
+	s.active = input
+	s.live = true
+	s.resetTimeline()
+	s.mu.Unlock()
+	log.Logger.Info("channel input selected", zap.String("input", string(input)), zap.String("streamID", s.inputs[input]))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.forwardStream(ctx, stream)
+	}()
+
+	ticker := time.NewTicker(channelCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-errCh:
+			return err
+		case <-s.switchCh:
+		case <-ticker.C:
+		}
+		if next, _, ok := s.selectInput(); ok && next != input {
+			cancel()
+			<-errCh
+			return nil
+		}
+	}
+}
+
+func (s *ChannelSession) forwardStream(ctx context.Context, stream *hubs.Stream) error {
+	g, ctx := errgroup.WithContext(ctx)
+
+	// 늦게 추가되는 소스도 받는다. simulcast 는 미디어 타입마다 첫 소스만 보낸다.
+	sourceCh := stream.Subscribe()
+	defer stream.Unsubscribe(sourceCh)
+	forwarding := make(map[types.MediaType]bool)
+	for {
+		select {
+		case <-ctx.Done():
+			return g.Wait()
+		case source := <-sourceCh:
+			if forwarding[source.MediaType()] {
+				continue
+			}
+			forwarding[source.MediaType()] = true
+			g.Go(func() error {
+				return s.forwardSource(ctx, source)
+			})
+		}
+	}
+}
+
+func (s *ChannelSession) forwardSource(ctx context.Context, source *hubs.HubSource) error {
+	waitCtx, cancel := context.WithTimeout(ctx, s.timeout)
+	codec, err := source.WaitCodec(waitCtx)
+	cancel()
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return errChannelInputStalled
+	}
+	track := source.GetTrack(codec)
+	if track == nil {
+		return fmt.Errorf("%w: no track for %s", errChannelInputEnded, codec.MimeType())
+	}
+	consumerCh := track.AddConsumer()
+	defer track.RemoveConsumer(consumerCh)
+
+	out := s.output(codec)
+	// 디코더가 끊김 없이 이어가도록 비디오는 키프레임부터 보낸다.
+	waitKeyFrame := codec.MediaType() == types.MediaTypeVideo
+	decoder := codec.Decoder()
+
+	timer := time.NewTimer(s.timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-timer.C:
+			return errChannelInputStalled
+		case unit, ok := <-consumerCh:
+			if !ok {
+				return errChannelInputEnded
+			}
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(s.timeout)
+
+			if waitKeyFrame {
+				if !decoder.KeyFrame(unit.Payload) {
+					continue
+				}
+				waitKeyFrame = false
+			}
+			s.write(out, unit)
+		}
+	}
+}
+
+// output 은 codec 의 출력을 반환한다. 입력이 바뀌어 코덱이 달라졌으면 새 소스로 바꾼다.
+// HLS 는 EXT-X-DISCONTINUITY 로 이어서 쓰고, WHEP 는 같은 transceiver(SSRC)에 트랙을 바꿔 붙인다.
+func (s *ChannelSession) output(codec codecs.Codec) *channelOutput {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out, ok := s.outputs[codec.MediaType()]
+	if ok && out.codec.Equals(codec) {
+		return out
+	}
+
+	source := hubs.NewHubSource(codec, "")
+	source.SetCodec(codec)
+	if !ok {
+		out = &channelOutput{source: source, codec: codec}
+		s.outputs[codec.MediaType()] = out
+		s.stream.AddSource(source)
+		return out
+	}
+
+	log.Logger.Info("channel codec changed", zap.String("from", out.codec.String()), zap.String("to", codec.String()))
+	old := out.source
+	out.source = source
+	out.codec = codec
+	s.stream.ReplaceSource(old, source)
+	return out
+}
+
+// write 는 입력의 타임스탬프를 채널 타임라인으로 바꿔서 보낸다.
+func (s *ChannelSession) write(out *channelOutput, unit units.Unit) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out.source.Write(s.rewrite(out, unit))
+}
+
+// resetTimeline 은 입력이 바뀔 때 호출한다. 새 입력의 첫 unit 에서 offset 과 shift 를 다시 정한다. s.mu 를 잡고 호출해야 한다.
+func (s *ChannelSession) resetTimeline() {
+	s.offsetSet = false
+	for _, out := range s.outputs {
+		out.rebased = false
+	}
+}
+
+// rewrite 는 새 입력의 첫 unit 을 지금까지 보낸 가장 늦은 시각에 이어 붙이고, 이후 unit 은 입력의 간격을 그대로 따른다.
+// 오디오와 비디오가 같은 offset 을 쓰므로 입력의 싱크가 유지된다. 한 프레임의 NAL unit 들은 같은 DTS 를 유지한다.
+// s.mu 를 잡고 호출해야 한다.
+func (s *ChannelSession) rewrite(out *channelOutput, unit units.Unit) units.Unit {
+	if out.timeBase == 0 {
+		out.timeBase = unit.TimeBase
+	}
+	if !s.offsetSet {
+		s.offset = s.end() - unitsToDuration(unit.DTS, unit.TimeBase)
+		s.offsetSet = true
+	}
+
+	offset := durationToTicks(s.offset, uint32(out.timeBase))
+	dts := rescaleTicks(unit.DTS, unit.TimeBase, out.timeBase) + offset
+	pts := rescaleTicks(unit.PTS, unit.TimeBase, out.timeBase) + offset
+	duration := rescaleTicks(unit.Duration, unit.TimeBase, out.timeBase)
+	// 입력의 오디오와 비디오 시작이 조금 달라서 이전 입력보다 앞서면, 이 입력이 끝날 때까지 같은 만큼 뒤로 민다.
+	if !out.rebased {
+		out.shift = 0
+		if out.started && dts < out.next {
+			out.shift = out.next - dts
+		}
+		out.rebased = true
+	}
+	dts += out.shift
+	pts += out.shift
+
+	if out.started && dts > out.lastDTS {
+		out.lastStep = dts - out.lastDTS
+	}
+	step := duration
+	if step <= 0 {
+		step = out.lastStep
+	}
+	if step <= 0 {
+		step = 1
+	}
+	out.started = true
+	out.lastDTS = dts
+	out.next = dts + step
+
+	unit.DTS = dts
+	unit.PTS = pts
+	unit.Duration = duration
+	unit.TimeBase = out.timeBase
+	return unit
+}
+
+// end 는 지금까지 보낸 unit 중 가장 늦게 끝나는 시각이다.
+func (s *ChannelSession) end() time.Duration {
+	var end time.Duration
+	for _, out := range s.outputs {
+		if !out.started {
+			continue
+		}
+		if next := unitsToDuration(out.next, out.timeBase); next > end {
+			end = next
+		}
+	}
+	return end
+}
+
+func unitsToDuration(ticks int64, timeBase int) time.Duration {
+	if timeBase <= 0 {
+		return 0
+	}
+	scale := int64(timeBase)
+	return time.Duration(ticks/scale)*time.Second + time.Duration(ticks%scale)*time.Second/time.Duration(scale)
+}
+
+func rescaleTicks(ticks int64, from, to int) int64 {
+	if from == to || from <= 0 {
+		return ticks
+	}
+	return durationToTicks(unitsToDuration(ticks, from), uint32(to))
+}
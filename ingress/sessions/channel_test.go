@@ -0,0 +1,94 @@
+package sessions
+
+import (
+	"testing"
+
+	"mediaserver-go/utils/types"
+	"mediaserver-go/utils/units"
+)
+
+// channelFrame 은 같은 PTS/DTS 를 가진 NAL unit 들로 이루어진 한 프레임을 만든다. RTMP, RTP ingress 와 같은 모양이다.
+func channelFrame(dts, duration int64, nals int) []units.Unit {
+	frame := make([]units.Unit, 0, nals)
+	for i := 0; i < nals; i++ {
+		frame = append(frame, units.Unit{
+			Payload:  []byte{byte(i)},
+			PTS:      dts,
+			DTS:      dts,
+			Duration: duration,
+			TimeBase: 1000,
+			Marker:   i == nals-1,
+		})
+	}
+	return frame
+}
+
+func TestChannelRewriteMultiNALFrameAcrossSwitch(t *testing.T) {
+	for _, duration := range []int64{33, 0} {
+		s := &ChannelSession{outputs: make(map[types.MediaType]*channelOutput)}
+		video := &channelOutput{}
+		s.outputs[types.MediaTypeVideo] = video
+
+		var got [][]int64
+		feed := func(start int64, frames, nals int) {
+			for i := 0; i < frames; i++ {
+				var dts []int64
+				for _, unit := range channelFrame(start+int64(i)*33, duration, nals) {
+					dts = append(dts, s.rewrite(video, unit).DTS)
+				}
+				got = append(got, dts)
+			}
+		}
+
+		s.resetTimeline()
+		feed(1000, 10, 3)
+		// backup 은 primary 와 상관없는 시각에서 시작한다.
+		s.resetTimeline()
+		feed(90000, 10, 2)
+
+		for i, dts := range got {
+			for _, d := range dts {
+				if d != dts[0] {
+					t.Fatalf("duration %d: frame %d has different DTS in one access unit: %v", duration, i, dts)
+				}
+			}
+			// 입력이 바뀌어도 프레임 간격이 그대로 이어지고 밀리지 않는다.
+			if want := int64(i) * 33; dts[0] != want {
+				t.Fatalf("duration %d: frame %d DTS = %d, want %d", duration, i, dts[0], want)
+			}
+		}
+	}
+}
+
+func TestChannelRewriteKeepsAVSyncAcrossSwitch(t *testing.T) {
+	s := &ChannelSession{outputs: make(map[types.MediaType]*channelOutput)}
+	video := &channelOutput{}
+	audio := &channelOutput{}
+	s.outputs[types.MediaTypeVideo] = video
+	s.outputs[types.MediaTypeAudio] = audio
+
+	s.resetTimeline()
+	for i := int64(0); i < 30; i++ {
+		s.rewrite(video, units.Unit{PTS: i * 3000, DTS: i * 3000, Duration: 3000, TimeBase: 90000})
+	}
+	for i := int64(0); i < 50; i++ {
+		s.rewrite(audio, units.Unit{PTS: i * 960, DTS: i * 960, Duration: 960, TimeBase: 48000})
+	}
+
+	s.resetTimeline()
+	// backup 의 오디오가 비디오보다 100ms 먼저 시작한다.
+	firstAudio := s.rewrite(audio, units.Unit{PTS: 500 * 48, DTS: 500 * 48, Duration: 960, TimeBase: 48000})
+	firstVideo := s.rewrite(video, units.Unit{PTS: 600 * 90, DTS: 600 * 90, Duration: 3000, TimeBase: 90000})
+
+	if firstAudio.DTS < 50*960 {
+		t.Fatalf("audio DTS went backwards: %d", firstAudio.DTS)
+	}
+	if firstVideo.DTS < 30*3000 {
+		t.Fatalf("video DTS went backwards: %d", firstVideo.DTS)
+	}
+	audioTime := unitsToDuration(firstAudio.DTS, firstAudio.TimeBase)
+	videoTime := unitsToDuration(firstVideo.DTS, firstVideo.TimeBase)
+	if diff := videoTime - audioTime; diff.Milliseconds() != 100 {
+		t.Fatalf("video - audio = %v, want 100ms", diff)
+	}
+}
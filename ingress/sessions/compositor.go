@@ -0,0 +1,452 @@
+package sessions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"mediaserver-go/codecs"
+	"mediaserver-go/codecs/h264"
+	"mediaserver-go/hubs"
+	"mediaserver-go/hubs/compositors"
+	"mediaserver-go/hubs/transcoders"
+	"mediaserver-go/thirdparty/ffmpeg/avutil"
+	"mediaserver-go/utils/dto"
+	"mediaserver-go/utils/log"
+	"mediaserver-go/utils/types"
+	"mediaserver-go/utils/units"
+	"slices"
+	"sync"
+	"time"
+)
+
+var (
+	errCreateCompositorSession  = errors.New("failed to create compositor session")
+	errDuplicateCompositorInput = errors.New("duplicate compositor input")
+)
+
+const (
+	compositorDefaultWidth   = 1280
+	compositorDefaultHeight  = 720
+	compositorDefaultFPS     = 30
+	compositorDefaultBitrate = 2_000_000
+
+	compositorRetryInterval = time.Second
+)
+
+// compositorInput 은 합성에 사용되는 하나의 입력 스트림이다. 가장 최근에 디코딩된 프레임만 유지한다.
+type compositorInput struct {
+	mu sync.Mutex
+
+	streamID string
+	cancel   context.CancelFunc
+
+	frame  *avutil.Frame
+	scaler *compositors.Scaler
+}
+
+func (i *compositorInput) setFrame(frame *avutil.Frame) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.frame != nil {
+		i.frame.AvFrameFree()
+	}
+	i.frame = frame
+}
+
+func (i *compositorInput) close() {
+	i.cancel()
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.frame != nil {
+		i.frame.AvFrameFree()
+		i.frame = nil
+	}
+	i.scaler.Close()
+}
+
+// CompositorSession 은 여러 스트림의 비디오를 디코딩하여 하나의 캔버스에 배치한 후 H264 로 인코딩하여 새로운 스트림으로 발행한다.
+type CompositorSession struct {
+	mu sync.Mutex
+
+	ctx    context.Context
+	hub    *hubs.Hub
+	stream *hubs.Stream
+	fps    int
+
+	inputs   []*compositorInput
+	layout   compositors.Layout
+	mainID   string
+	audioID  string
+	canvas   *compositors.Canvas
+	encoder  *transcoders.VideoEncoder
+	videoSrc *hubs.HubSource
+}
+
+func NewCompositorSession(req dto.CompositorRequest, hub *hubs.Hub, stream *hubs.Stream) (*CompositorSession, error) {
+	width, height := req.Width, req.Height
+	if width == 0 || height == 0 {
+		width, height = compositorDefaultWidth, compositorDefaultHeight
+	}
+	fps := req.FPS
+	if fps <= 0 {
+		fps = compositorDefaultFPS
+	}
+	bitrate := req.Bitrate
+	if bitrate <= 0 {
+		bitrate = compositorDefaultBitrate
+	}
+	layoutType, err := compositors.ParseLayoutType(req.Layout)
+	if err != nil {
+		return nil, fmt.Errorf("%v, %w", err, errCreateCompositorSession)
+	}
+	background, err := compositors.ParseColor(req.Background)
+	if err != nil {
+		return nil, fmt.Errorf("%v, %w", err, errCreateCompositorSession)
+	}
+	canvas, err := compositors.NewCanvas(width, height, background)
+	if err != nil {
+		return nil, fmt.Errorf("%v, %w", err, errCreateCompositorSession)
+	}
+
+	videoSrc := hubs.NewHubSource(&h264.Base{}, "")
+	encoder, err := transcoders.NewVideoEncoder(transcoders.VideoEncoderConfig{
+		Width:   width,
+		Height:  height,
+		FPS:     fps,
+		GOPSize: fps * 2,
+		BitRate: bitrate,
+	}, func(codec codecs.Codec) {
+		videoSrc.SetCodec(codec)
+	})
+	if err != nil {
+		canvas.Close()
+		return nil, fmt.Errorf("%v, %w", err, errCreateCompositorSession)
+	}
+	stream.AddSource(videoSrc)
+
+	s := &CompositorSession{
+		hub:      hub,
+		stream:   stream,
+		fps:      fps,
+		layout:   compositors.Layout{Type: layoutType},
+		mainID:   req.Main,
+		audioID:  req.Audio,
+		canvas:   canvas,
+		encoder:  encoder,
+		videoSrc: videoSrc,
+	}
+	if err := s.SetInputs(req.Inputs); err != nil {
+		encoder.Close()
+		canvas.Close()
+		return nil, fmt.Errorf("%v, %w", err, errCreateCompositorSession)
+	}
+	return s, nil
+}
+
+func (s *CompositorSession) Run(ctx context.Context) error {
+	s.mu.Lock()
+	s.ctx = ctx
+	for _, input := range s.inputs {
+		s.startInput(input)
+	}
+	s.mu.Unlock()
+
+	if s.audioID != "" {
+		go s.forwardAudio(ctx, s.audioID)
+	}
+
+	defer func() {
+		s.mu.Lock()
+		for _, input := range s.inputs {
+			input.close()
+		}
+		s.inputs = nil
+		s.mu.Unlock()
+		s.stream.Close()
+		s.encoder.Close()
+		s.canvas.Close()
+	}()
+
+	start := time.Now()
+	ticker := time.NewTicker(time.Second / time.Duration(s.fps))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			pts := now.Sub(start).Microseconds() * transcoders.VideoEncoderTimeBase / 1_000_000
+			for _, u := range s.compose(pts) {
+				s.videoSrc.Write(u)
+			}
+		}
+	}
+}
+
+// ValidateCompositorInputs 는 입력 목록에 같은 스트림이 두 번 들어있는지 확인한다.
+// 같은 입력이 두 번 있으면 compose 가 같은 lock 을 두 번 잡는다.
+func ValidateCompositorInputs(streamIDs []string) error {
+	seen := make(map[string]struct{}, len(streamIDs))
+	for _, streamID := range streamIDs {
+		if _, ok := seen[streamID]; ok {
+			return fmt.Errorf("%w: %s", errDuplicateCompositorInput, streamID)
+		}
+		seen[streamID] = struct{}{}
+	}
+	return nil
+}
+
+// SetInputs 는 합성할 입력 스트림 목록을 변경한다. 기존 입력은 디코더를 유지한다. 같은 스트림이 두 번 있으면 바꾸지 않는다.
+func (s *CompositorSession) SetInputs(streamIDs []string) error {
+	if err := ValidateCompositorInputs(streamIDs); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var inputs []*compositorInput
+	for _, streamID := range streamIDs {
+		index := slices.IndexFunc(s.inputs, func(input *compositorInput) bool {
+			return input.streamID == streamID
+		})
+		if index >= 0 {
+			inputs = append(inputs, s.inputs[index])
+			continue
+		}
+		input := &compositorInput{
+			streamID: streamID,
+			scaler:   compositors.NewScaler(),
+			cancel:   func() {},
+		}
+		if s.ctx != nil {
+			s.startInput(input)
+		}
+		inputs = append(inputs, input)
+	}
+	for _, input := range s.inputs {
+		if !slices.Contains(inputs, input) {
+			input.close()
+		}
+	}
+	s.inputs = inputs
+	return nil
+}
+
+func (s *CompositorSession) SetLayout(req dto.CompositorLayoutRequest) error {
+	var layoutType compositors.LayoutType
+	if req.Layout != "" {
+		t, err := compositors.ParseLayoutType(req.Layout)
+		if err != nil {
+			return err
+		}
+		layoutType = t
+	}
+	var background *compositors.Color
+	if req.Background != "" {
+		c, err := compositors.ParseColor(req.Background)
+		if err != nil {
+			return err
+		}
+		background = &c
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if layoutType != "" {
+		s.layout.Type = layoutType
+	}
+	if background != nil {
+		s.canvas.SetBackground(*background)
+	}
+	if req.Main != "" {
+		s.mainID = req.Main
+	}
+	return nil
+}
+
+func (s *CompositorSession) startInput(input *compositorInput) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	input.cancel = cancel
+	go s.runInput(ctx, input)
+}
+
+// runInput 은 입력 스트림이 생길 때까지 기다렸다가 디코딩한다. 입력 스트림이 종료되면 다시 기다린다.
+func (s *CompositorSession) runInput(ctx context.Context, input *compositorInput) {
+	for {
+		if err := s.decodeInput(ctx, input); err != nil {
+			log.Logger.Debug("compositor input not ready", zap.String("streamID", input.streamID), zap.Error(err))
+		}
+		input.setFrame(nil)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(compositorRetryInterval):
+		}
+	}
+}
+
+func (s *CompositorSession) decodeInput(ctx context.Context, input *compositorInput) error {
+	stream, ok := s.hub.GetStream(input.streamID)
+	if !ok || stream == s.stream {
+		return errors.New("stream not found")
+	}
+	source, ok := stream.SourcesMap()[types.MediaTypeVideo]
+	if !ok {
+		return errors.New("video source not found")
+	}
+	codec, err := source.VideoCodec()
+	if err != nil {
+		return err
+	}
+	decoder, err := transcoders.NewVideoDecoder(codec)
+	if err != nil {
+		return err
+	}
+	defer decoder.Close()
+
+	track := source.GetTrack(codec)
+	if track == nil {
+		return errors.New("track not found")
+	}
+	consumerCh := track.AddConsumer()
+	defer track.RemoveConsumer(consumerCh)
+
+	log.Logger.Info("compositor input started", zap.String("streamID", input.streamID), zap.String("codec", codec.String()))
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case unit, ok := <-consumerCh:
+			if !ok {
+				return errors.New("track closed")
+			}
+			for _, frame := range decoder.Decode(unit) {
+				input.setFrame(frame)
+			}
+		}
+	}
+}
+
+func (s *CompositorSession) compose(pts int64) []units.Unit {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.canvas.Clear(); err != nil {
+		log.Logger.Warn("compositor canvas clear failed", zap.Error(err))
+		return nil
+	}
+
+	var actives []*compositorInput
+	main := 0
+	for _, input := range s.inputs {
+		input.mu.Lock()
+		if input.frame == nil {
+			input.mu.Unlock()
+			continue
+		}
+		if input.streamID == s.mainID {
+			main = len(actives)
+		}
+		actives = append(actives, input)
+	}
+	defer func() {
+		for _, input := range actives {
+			input.mu.Unlock()
+		}
+	}()
+
+	layout := s.layout
+	layout.Main = main
+	rects := layout.Rects(len(actives), s.canvas.Width(), s.canvas.Height())
+	// 메인 화면을 먼저 그려서 pip 의 작은 화면들이 위에 올라오도록 한다.
+	order := make([]int, 0, len(actives))
+	order = append(order, main)
+	for i := range actives {
+		if i != main {
+			order = append(order, i)
+		}
+	}
+	for _, i := range order {
+		if i >= len(actives) {
+			continue
+		}
+		input := actives[i]
+		rect := rects[i].Fit(input.frame.Width(), input.frame.Height())
+		scaled, err := input.scaler.Scale(input.frame, rect.Width, rect.Height)
+		if err != nil {
+			log.Logger.Warn("compositor scale failed", zap.String("streamID", input.streamID), zap.Error(err))
+			continue
+		}
+		s.canvas.Blit(scaled, rect.X, rect.Y)
+	}
+
+	frame := s.canvas.Frame()
+	frame.SetPTS(pts)
+	return s.encoder.Encode(frame)
+}
+
+// forwardAudio 는 streamID 의 오디오를 그대로 합성 스트림으로 전달한다. 타임스탬프는 합성 스트림 기준으로 다시 계산한다.
+func (s *CompositorSession) forwardAudio(ctx context.Context, streamID string) {
+	start := time.Now()
+	for {
+		if err := s.forwardAudioOnce(ctx, streamID, start); err != nil {
+			log.Logger.Debug("compositor audio not ready", zap.String("streamID", streamID), zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(compositorRetryInterval):
+		}
+	}
+}
+
+func (s *CompositorSession) forwardAudioOnce(ctx context.Context, streamID string, start time.Time) error {
+	stream, ok := s.hub.GetStream(streamID)
+	if !ok || stream == s.stream {
+		return errors.New("stream not found")
+	}
+	source, ok := stream.SourcesMap()[types.MediaTypeAudio]
+	if !ok {
+		return errors.New("audio source not found")
+	}
+	codec, err := source.AudioCodec()
+	if err != nil {
+		return err
+	}
+	track := source.GetTrack(codec)
+	if track == nil {
+		return errors.New("track not found")
+	}
+	consumerCh := track.AddConsumer()
+	defer track.RemoveConsumer(consumerCh)
+
+	audioSrc := hubs.NewHubSource(codec, "")
+	s.stream.AddSource(audioSrc)
+	audioSrc.SetCodec(codec)
+	defer func() {
+		s.stream.RemoveSource(audioSrc)
+		audioSrc.Close()
+	}()
+
+	var offset int64
+	set := false
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case unit, ok := <-consumerCh:
+			if !ok {
+				return errors.New("track closed")
+			}
+			if !set {
+				set = true
+				offset = time.Since(start).Microseconds()*int64(unit.TimeBase)/1_000_000 - unit.PTS
+			}
+			unit.PTS += offset
+			unit.DTS += offset
+			audioSrc.Write(unit)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package sessions
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidateCompositorInputs(t *testing.T) {
+	if err := ValidateCompositorInputs([]string{"a", "b", "c"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateCompositorInputs(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateCompositorInputs([]string{"a", "b", "a"}); !errors.Is(err, errDuplicateCompositorInput) {
+		t.Fatalf("error = %v, want errDuplicateCompositorInput", err)
+	}
+}
+
+func TestCompositorSetInputsRejectsDuplicates(t *testing.T) {
+	s := &CompositorSession{}
+	if err := s.SetInputs([]string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+	before := append([]*compositorInput(nil), s.inputs...)
+
+	// 같은 입력이 두 번 들어가면 compose 가 같은 input.mu 를 두 번 잡아서 멈춘다.
+	if err := s.SetInputs([]string{"b", "a", "b"}); !errors.Is(err, errDuplicateCompositorInput) {
+		t.Fatalf("error = %v, want errDuplicateCompositorInput", err)
+	}
+	if len(s.inputs) != len(before) {
+		t.Fatalf("inputs changed on a rejected update: %d, want %d", len(s.inputs), len(before))
+	}
+	for i, input := range s.inputs {
+		if input != before[i] {
+			t.Fatalf("input %d changed on a rejected update", i)
+		}
+	}
+
+	// 순서만 바꾸면 기존 입력을 그대로 쓴다.
+	if err := s.SetInputs([]string{"b", "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if s.inputs[0] != before[1] || s.inputs[1] != before[0] {
+		t.Fatal("reordered inputs were recreated")
+	}
+}
@@ -5,146 +5,330 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"io"
+	"go.uber.org/zap"
+	"math"
 	"mediaserver-go/codecs"
 	"mediaserver-go/codecs/factory"
 	"mediaserver-go/hubs"
 	"mediaserver-go/thirdparty/ffmpeg/avcodec"
 	"mediaserver-go/thirdparty/ffmpeg/avformat"
 	"mediaserver-go/thirdparty/ffmpeg/avutil"
+	"mediaserver-go/utils/log"
 	"mediaserver-go/utils/types"
 	"mediaserver-go/utils/units"
 	"slices"
 	"time"
 )
 
+const (
+	// 남은 시간이 이보다 짧으면 기다리지 않고 보낸다.
+	filePacingThreshold = time.Millisecond
+)
+
 var (
 	errCreateFileSession = errors.New("failed to create file session")
+	errFileNoPath        = errors.New("no file to play")
+	errFileLoopNotLive   = errors.New("loop requires live")
+	errFileInvalidSpeed  = errors.New("invalid playback speed")
+	errFileEmptyPlaylist = errors.New("no packets in playlist")
 )
 
+// FileSessionConfig 는 재생 목록과 재생 방식이다.
+type FileSessionConfig struct {
+	// 순서대로 이어서 하나의 스트림으로 재생한다.
+	Paths      []string
+	MediaTypes []types.MediaType
+	// true 이면 타임스탬프에 맞춰 실시간으로 보낸다. false 이면 기다리지 않고 읽는 대로 보낸다.
+	Live bool
+	// 마지막 파일이 끝나면 처음부터 다시 재생한다. 타임스탬프는 이어진다.
+	Loop bool
+	// 첫 파일의 시작 위치. 그 앞의 키프레임부터 보낸다. 반복할 때는 처음부터 재생한다.
+	Start time.Duration
+	// 재생 속도. 0 이면 1. 타임스탬프는 그대로 두고 보내는 속도만 바꾼다.
+	Speed float64
+}
+
 type trackContext struct {
+	base            codecs.Base
 	hubSource       *hubs.HubSource
 	codec           codecs.Codec
 	bitStreamFilter codecs.BitStreamFilter
+	// 입력 스트림의 time base
+	timeBase avutil.Rational
 }
 
-type FileSession struct {
-	live bool
+// fileInput 은 재생 목록의 파일 하나이다.
+type fileInput struct {
+	formatCtx *avformat.FormatContext
+	// stream index 별 트랙. 미디어 타입마다 첫 스트림만 쓴다.
+	tracks map[int]*trackContext
+}
 
-	trackCtx [2]*trackContext
+func (f *fileInput) close() {
+	f.formatCtx.AvformatCloseInput()
+}
 
-	inputFormatCtx *avformat.FormatContext
+type FileSession struct {
+	config FileSessionConfig
 
-	stream *hubs.Stream
+	stream  *hubs.Stream
+	sources map[types.MediaType]*hubs.HubSource
+	// 미디어 타입별 출력 time base(1/timeBase). 첫 파일의 것을 계속 쓴다.
+	timeBases map[types.MediaType]int
+	// NewFileSession 에서 연 첫 파일
+	first *fileInput
+
+	// 재생 목록 전체에서 이어지는 시각(us). 다음 파일은 여기서 시작한다.
+	offset int64
+	// pacingStart 에 보낸 패킷의 시각(us)
+	pacingBase  int64
+	pacingStart time.Time
 }
 
-func NewFileSession(path string, mediaTypes []types.MediaType, live bool, hubStream *hubs.Stream) (FileSession, error) {
-	var trackCtx [2]*trackContext
+func NewFileSession(config FileSessionConfig, hubStream *hubs.Stream) (FileSession, error) {
+	if len(config.Paths) == 0 {
+		return FileSession{}, errFileNoPath
+	}
+	if config.Speed < 0 {
+		return FileSession{}, fmt.Errorf("%w: %v", errFileInvalidSpeed, config.Speed)
+	}
+	if config.Speed == 0 {
+		config.Speed = 1
+	}
+	// 기다리지 않고 반복하면 CPU 를 다 쓴다.
+	if config.Loop && !config.Live {
+		return FileSession{}, errFileLoopNotLive
+	}
+
+	first, err := openFileInput(config.Paths[0], config.MediaTypes)
+	if err != nil {
+		return FileSession{}, err
+	}
+	if config.Start > 0 {
+		ts := config.Start.Microseconds()
+		if ret := first.formatCtx.AvformatSeekFile(-1, math.MinInt64, ts, ts, 0); ret < 0 {
+			first.close()
+			return FileSession{}, fmt.Errorf("avformat seek file failed: %s, %w", avutil.AvErr2str(ret), errCreateFileSession)
+		}
+	}
+
+	s := FileSession{
+		config:    config,
+		stream:    hubStream,
+		sources:   make(map[types.MediaType]*hubs.HubSource),
+		timeBases: make(map[types.MediaType]int),
+		first:     first,
+	}
+	for _, track := range first.tracks {
+		source := hubs.NewHubSource(track.base, "")
+		hubStream.AddSource(source)
+		source.SetCodec(track.codec)
+		track.hubSource = source
 
+		mediaType := track.base.MediaType()
+		s.sources[mediaType] = source
+		s.timeBases[mediaType] = track.timeBase.Den()
+		if mediaType == types.MediaTypeVideo {
+			source.SetTranscodeCodec(track.codec.(codecs.VideoCodec))
+		}
+	}
+	return s, nil
+}
+
+func openFileInput(path string, mediaTypes []types.MediaType) (*fileInput, error) {
 	inputFormatCtx := avformat.NewAvFormatContextNull()
 	if ret := avformat.AvformatOpenInput(&inputFormatCtx, path, nil, nil); ret < 0 {
-		return FileSession{}, fmt.Errorf("avformat open input failed: %s, %w", avutil.AvErr2str(ret), errCreateFileSession)
+		return nil, fmt.Errorf("avformat open input failed: %s, %w", avutil.AvErr2str(ret), errCreateFileSession)
+	}
+	input := &fileInput{
+		formatCtx: inputFormatCtx,
+		tracks:    make(map[int]*trackContext),
 	}
 	if ret := inputFormatCtx.AvformatFindStreamInfo(nil); ret < 0 {
-		return FileSession{}, fmt.Errorf("avformat find stream info failed: %s, %w", avutil.AvErr2str(ret), errCreateFileSession)
+		input.close()
+		return nil, fmt.Errorf("avformat find stream info failed: %s, %w", avutil.AvErr2str(ret), errCreateFileSession)
 	}
+
+	found := make(map[types.MediaType]bool)
 	for i, stream := range inputFormatCtx.Streams() {
 		codecType := types.CodecTypeFromFFMPEG(stream.CodecParameters().CodecID())
 		mediaType := types.MediaTypeFromFFMPEG(stream.CodecParameters().CodecType())
-		if !slices.Contains(mediaTypes, mediaType) {
+		if !slices.Contains(mediaTypes, mediaType) || found[mediaType] {
 			continue
 		}
 		base, err := factory.NewBase(fmt.Sprintf("%s/%s", mediaType, codecType))
 		if err != nil {
-			return FileSession{}, err
+			input.close()
+			return nil, err
 		}
 		codec, err := base.CodecFromAVCodecParameters(stream.CodecParameters())
 		if err != nil {
-			return FileSession{}, err
+			input.close()
+			return nil, err
 		}
-
-		source := hubs.NewHubSource(base, "")
-
-		hubStream.AddSource(source)
-		source.SetCodec(codec)
-		trackCtx[i] = &trackContext{
-			hubSource:       source,
+		found[mediaType] = true
+		input.tracks[i] = &trackContext{
+			base:            base,
 			codec:           codec,
 			bitStreamFilter: codec.GetBitStreamFilter(false),
-		}
-
-		switch mediaType {
-		case types.MediaTypeAudio:
-		case types.MediaTypeVideo:
-			source.SetTranscodeCodec(codec.(codecs.VideoCodec))
+			timeBase:        stream.TimeBase(),
 		}
 	}
 
-	if trackCtx[0] == nil && trackCtx[1] == nil {
-		return FileSession{}, fmt.Errorf("no audio or video stream found, %w", errCreateFileSession)
+	if len(input.tracks) == 0 {
+		input.close()
+		return nil, fmt.Errorf("no audio or video stream found, %w", errCreateFileSession)
 	}
+	return input, nil
+}
 
-	return FileSession{
-		live:           live,
-		trackCtx:       trackCtx,
-		stream:         hubStream,
-		inputFormatCtx: inputFormatCtx,
-	}, nil
+// openNext 는 재생 목록의 다음 파일을 열고 첫 파일의 소스에 연결한다. 코덱 종류가 다른 트랙은 버린다.
+func (s *FileSession) openNext(path string) (*fileInput, error) {
+	input, err := openFileInput(path, s.config.MediaTypes)
+	if err != nil {
+		return nil, err
+	}
+	for index, track := range input.tracks {
+		source, ok := s.sources[track.base.MediaType()]
+		if !ok || source.CodecType() != track.base.CodecType() {
+			log.Logger.Warn("file track skipped", zap.String("path", path), zap.String("codecType", string(track.base.CodecType())))
+			delete(input.tracks, index)
+			continue
+		}
+		// 해상도나 샘플레이트가 바뀌었을 수 있다.
+		source.SetCodec(track.codec)
+		track.hubSource = source
+	}
+	if len(input.tracks) == 0 {
+		input.close()
+		return nil, fmt.Errorf("no matching track in %s, %w", path, errCreateFileSession)
+	}
+	return input, nil
 }
 
+// Run 은 재생 목록을 끝까지(Loop 이면 ctx 가 끝날 때까지) 재생한다. 열 수 없는 파일은 건너뛴다.
 func (s *FileSession) Run(ctx context.Context) error {
-	defer func() {
-		s.inputFormatCtx.AvformatCloseInput()
-		s.stream.Close()
-	}()
+	defer s.stream.Close()
+
+	input := s.first
+	for {
+		packets := 0
+		for _, path := range s.config.Paths {
+			if input == nil {
+				var err error
+				if input, err = s.openNext(path); err != nil {
+					log.Logger.Warn("file skipped", zap.String("path", path), zap.Error(err))
+					continue
+				}
+			}
+			n, err := s.play(ctx, input)
+			input.close()
+			input = nil
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return err
+			}
+			packets += n
+		}
+		if !s.config.Loop {
+			return nil
+		}
+		if packets == 0 {
+			return errFileEmptyPlaylist
+		}
+	}
+}
 
-	var startTime time.Time
+// play 는 파일 하나를 끝까지 보내고 보낸 패킷 수를 반환한다. 타임스탬프는 앞 파일이 끝난 시각(s.offset)부터 이어진다.
+func (s *FileSession) play(ctx context.Context, input *fileInput) (int, error) {
 	pkt := avcodec.AvPacketAlloc()
+	defer pkt.AvPacketFree()
+
+	var (
+		started bool
+		// 이 파일의 첫 패킷의 DTS(us)
+		inputStart int64
+		end        = s.offset
+		count      int
+	)
 	for {
 		select {
 		case <-ctx.Done():
-			return nil
+			return count, ctx.Err()
 		default:
 		}
 
-		ret := s.inputFormatCtx.AvReadFrame(pkt)
-		if ret < 0 {
-			return io.EOF
+		if ret := input.formatCtx.AvReadFrame(pkt); ret < 0 {
+			s.offset = end
+			return count, nil
 		}
 
-		index := pkt.StreamIndex()
-		trackCtx := s.trackCtx[index]
-		if trackCtx == nil {
+		trackCtx, ok := input.tracks[pkt.StreamIndex()]
+		if !ok {
+			pkt.AvPacketUnref()
 			continue
 		}
 
-		if startTime.IsZero() {
-			startTime = time.Now()
+		pts := avutil.GetTimebaseUSec(trackCtx.timeBase, pkt.PTS())
+		dts := avutil.GetTimebaseUSec(trackCtx.timeBase, pkt.DTS())
+		duration := avutil.GetTimebaseUSec(trackCtx.timeBase, pkt.Duration())
+		if !started {
+			started = true
+			inputStart = dts
 		}
+		pts += s.offset - inputStart
+		dts += s.offset - inputStart
+		end = max(end, pts+duration)
 
-		stream := s.inputFormatCtx.Streams()[pkt.StreamIndex()]
-		itb := stream.TimeBase()
-		ptsTimeSec := avutil.GetTimebaseUSec(itb, pkt.PTS())
-		diffus := time.Now().Sub(startTime).Microseconds()
-		delay := ptsTimeSec - (diffus)
+		if err := s.pace(ctx, dts); err != nil {
+			pkt.AvPacketUnref()
+			return count, err
+		}
 
+		timeBase := s.timeBases[trackCtx.base.MediaType()]
 		payloads := trackCtx.bitStreamFilter.Filter(pkt.Data())
 		for i, au := range payloads {
 			trackCtx.hubSource.Write(units.Unit{
 				Payload:  au,
-				PTS:      pkt.PTS(),
-				DTS:      pkt.DTS(),
-				Duration: pkt.Duration(),
-				TimeBase: stream.TimeBase().Den(),
+				PTS:      usToTimeBase(pts, timeBase),
+				DTS:      usToTimeBase(dts, timeBase),
+				Duration: usToTimeBase(duration, timeBase),
+				TimeBase: timeBase,
 				Marker:   i == len(payloads)-1,
 			})
 		}
 		pkt.AvPacketUnref()
+		count++
+	}
+}
 
-		if types.MediaTypeFromFFMPEG(stream.CodecParameters().CodecType()) == types.MediaTypeVideo {
-			if delay > 0 {
-				time.Sleep(time.Duration(delay) * time.Microsecond)
-			}
-		}
+// pace 는 Live 일 때 ts(us) 가 될 때까지 기다린다. 오디오만 있는 파일도 같은 시계로 보낸다.
+func (s *FileSession) pace(ctx context.Context, ts int64) error {
+	if !s.config.Live {
+		return nil
+	}
+	if s.pacingStart.IsZero() {
+		s.pacingStart = time.Now()
+		s.pacingBase = ts
+		return nil
+	}
+
+	delay := time.Duration(float64(ts-s.pacingBase)/s.config.Speed)*time.Microsecond - time.Since(s.pacingStart)
+	if delay < filePacingThreshold {
+		return nil
 	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func usToTimeBase(us int64, timeBase int) int64 {
+	return avutil.AvRescaleQ(us, avutil.NewRational(1, 1000000), avutil.NewRational(1, timeBase))
 }
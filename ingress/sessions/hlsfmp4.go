@@ -0,0 +1,247 @@
+package sessions
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	commonh264 "github.com/bluenviron/mediacommon/pkg/codecs/h264"
+	"github.com/bluenviron/mediacommon/pkg/formats/fmp4"
+	pion "github.com/pion/webrtc/v3"
+	"go.uber.org/zap"
+
+	"mediaserver-go/codecs"
+	"mediaserver-go/codecs/aac"
+	"mediaserver-go/codecs/av1"
+	"mediaserver-go/codecs/factory"
+	"mediaserver-go/codecs/h264"
+	"mediaserver-go/codecs/opus"
+	"mediaserver-go/codecs/vp9"
+	"mediaserver-go/hubs"
+	"mediaserver-go/thirdparty/ffmpeg/avutil"
+	"mediaserver-go/utils/log"
+	"mediaserver-go/utils/types"
+	"mediaserver-go/utils/units"
+)
+
+var (
+	errFMP4NoTrack = errors.New("no supported track in fmp4 init")
+)
+
+// fmp4Track 은 init segment 의 트랙 하나이다.
+type fmp4Track struct {
+	hubSource *hubs.HubSource
+	codecType types.CodecType
+	timeScale uint32
+	// 키 프레임에 sequence header 가 없으면 앞에 넣는다.
+	av1SequenceHeader []byte
+}
+
+// fmp4Writer 는 fMP4 HLS 의 세그먼트를 hubs.Stream 의 소스로 쓴다.
+// init segment 가 바뀌어도 미디어 타입마다 같은 HubSource 에 이어서 쓴다.
+type fmp4Writer struct {
+	stream *hubs.Stream
+
+	sources map[types.MediaType]*hubs.HubSource
+	// init segment 의 track ID 별 트랙
+	tracks map[int]*fmp4Track
+	// tsWriter 와 같이 첫 샘플의 DTS 를 offset 으로 맞춘다. 트랙마다 timescale 이 다르므로 시간으로 계산한다.
+	start    time.Duration
+	hasStart bool
+	offset   time.Duration
+	end      time.Duration
+}
+
+func newFMP4Writer(stream *hubs.Stream) *fmp4Writer {
+	return &fmp4Writer{
+		stream:  stream,
+		sources: make(map[types.MediaType]*hubs.HubSource),
+		tracks:  make(map[int]*fmp4Track),
+	}
+}
+
+// discontinuity 는 다음 샘플부터의 타임스탬프를 지금까지 쓴 샘플 뒤에 이어 붙인다.
+func (w *fmp4Writer) discontinuity() {
+	w.offset = w.end
+	w.hasStart = false
+}
+
+// setInit 은 init segment 의 트랙들을 소스에 연결한다. 코덱 종류가 바뀐 트랙은 버린다.
+func (w *fmp4Writer) setInit(b []byte) error {
+	var init fmp4.Init
+	if err := init.Unmarshal(bytes.NewReader(b)); err != nil {
+		return err
+	}
+
+	w.tracks = make(map[int]*fmp4Track)
+	for _, initTrack := range init.Tracks {
+		mimeType, codec, err := fmp4Codec(initTrack.Codec)
+		if err != nil {
+			log.Logger.Warn("hls fmp4 track skipped", zap.Int("trackID", initTrack.ID), zap.Error(err))
+			continue
+		}
+		base, err := factory.NewBase(mimeType)
+		if err != nil {
+			continue
+		}
+
+		source, ok := w.sources[base.MediaType()]
+		if !ok {
+			source = hubs.NewHubSource(base, "")
+			w.stream.AddSource(source)
+			w.sources[base.MediaType()] = source
+		} else if source.CodecType() != base.CodecType() {
+			log.Logger.Warn("hls fmp4 codec changed, skipped",
+				zap.Int("trackID", initTrack.ID),
+				zap.String("codec", string(base.CodecType())))
+			continue
+		}
+		source.SetCodec(codec)
+
+		track := &fmp4Track{
+			hubSource: source,
+			codecType: base.CodecType(),
+			timeScale: initTrack.TimeScale,
+		}
+		if c, ok := initTrack.Codec.(*fmp4.CodecAV1); ok {
+			track.av1SequenceHeader = bytes.Clone(c.SequenceHeader)
+		}
+		w.tracks[initTrack.ID] = track
+		log.Logger.Info("hls fmp4 track found", zap.Int("trackID", initTrack.ID), zap.String("codec", string(base.CodecType())))
+	}
+
+	if len(w.tracks) == 0 {
+		return errFMP4NoTrack
+	}
+	return nil
+}
+
+func fmp4Codec(codec fmp4.Codec) (string, codecs.Codec, error) {
+	switch c := codec.(type) {
+	case *fmp4.CodecH264:
+		config := &h264.Config{}
+		if err := config.UnmarshalFromSPSPPS(c.SPS, c.PPS); err != nil {
+			return "", nil, err
+		}
+		return pion.MimeTypeH264, h264.NewH264(config), nil
+	case *fmp4.CodecAV1:
+		config := av1.NewAV1Config()
+		if err := config.UnmarshalSequenceHeader(c.SequenceHeader); err != nil {
+			return "", nil, err
+		}
+		return pion.MimeTypeAV1, av1.NewAV1(config), nil
+	case *fmp4.CodecVP9:
+		return pion.MimeTypeVP9, vp9.NewVP9(&vp9.Config{
+			Width:   c.Width,
+			Height:  c.Height,
+			Profile: int(c.Profile),
+		}), nil
+	case *fmp4.CodecMPEG4Audio:
+		return "audio/aac", aac.NewAAC(aac.NewConfig(aac.Parameters{
+			SampleRate:   c.SampleRate,
+			Channels:     c.ChannelCount,
+			SampleFormat: int(avutil.AV_SAMPLE_FMT_FLTP),
+		})), nil
+	case *fmp4.CodecOpus:
+		return pion.MimeTypeOpus, opus.NewOpus(opus.NewConfig(opus.Parameters{
+			Channels:     c.ChannelCount,
+			SampleRate:   48000,
+			SampleFormat: int(avutil.AV_SAMPLE_FMT_FLT),
+		})), nil
+	default:
+		return "", nil, fmt.Errorf("unsupported fmp4 codec: %T", codec)
+	}
+}
+
+// write 는 media segment(또는 part)의 moof/mdat 들을 쓴다.
+func (w *fmp4Writer) write(b []byte) error {
+	var parts fmp4.Parts
+	if err := parts.Unmarshal(b); err != nil {
+		return err
+	}
+	for _, part := range parts {
+		for _, partTrack := range part.Tracks {
+			track, ok := w.tracks[partTrack.ID]
+			if !ok {
+				continue
+			}
+			dts := partTrack.BaseTime
+			for _, sample := range partTrack.Samples {
+				w.writeSample(track, dts, sample)
+				dts += uint64(sample.Duration)
+			}
+		}
+	}
+	return nil
+}
+
+func (w *fmp4Writer) writeSample(track *fmp4Track, dts uint64, sample *fmp4.PartSample) {
+	ts := ticksToDuration(dts, track.timeScale)
+	if !w.hasStart {
+		w.start = ts
+		w.hasStart = true
+	}
+	ts = ts - w.start + w.offset
+	if ts < w.offset {
+		return
+	}
+	w.end = max(w.end, ts+ticksToDuration(uint64(sample.Duration), track.timeScale))
+
+	flag := 0
+	if !sample.IsNonSyncSample {
+		flag = 1
+	}
+	var payloads [][]byte
+	switch track.codecType {
+	case types.CodecTypeH264:
+		nalus, err := sample.GetH26x()
+		if err != nil {
+			log.Logger.Warn("hls fmp4 h264 avcc unmarshal failed", zap.Error(err))
+			return
+		}
+		for _, nalu := range nalus {
+			if len(nalu) == 0 {
+				continue
+			}
+			// SPS, PPS 는 init segment 의 것을 쓴다.
+			switch commonh264.NALUType(nalu[0] & 0x1f) {
+			case commonh264.NALUTypeSEI, commonh264.NALUTypeAccessUnitDelimiter, commonh264.NALUTypeFillerData,
+				commonh264.NALUTypeSPS, commonh264.NALUTypePPS:
+			default:
+				payloads = append(payloads, nalu)
+			}
+		}
+	case types.CodecTypeAV1:
+		payloads = (&av1.OBUBitStreamFilter{}).Filter(sample.Payload)
+		if flag == 1 && len(track.av1SequenceHeader) > 0 && !hasAV1SequenceHeader(payloads) {
+			payloads = append([][]byte{track.av1SequenceHeader}, payloads...)
+		}
+	default:
+		payloads = [][]byte{sample.Payload}
+	}
+
+	dtsTicks := durationToTicks(ts, track.timeScale)
+	for i, payload := range payloads {
+		track.hubSource.Write(units.Unit{
+			Payload:   payload,
+			PTS:       dtsTicks + int64(sample.PTSOffset),
+			DTS:       dtsTicks,
+			Duration:  int64(sample.Duration),
+			TimeBase:  int(track.timeScale),
+			Marker:    i == len(payloads)-1,
+			FrameInfo: units.FrameInfo{Flag: flag},
+		})
+	}
+}
+
+// ticksToDuration 은 BaseTime 이 커도 넘치지 않게 초와 나머지를 나누어 계산한다.
+func ticksToDuration(ticks uint64, timeScale uint32) time.Duration {
+	scale := uint64(timeScale)
+	return time.Duration(ticks/scale)*time.Second + time.Duration(ticks%scale*uint64(time.Second)/scale)
+}
+
+func durationToTicks(d time.Duration, timeScale uint32) int64 {
+	scale := int64(timeScale)
+	return int64(d/time.Second)*scale + int64(d%time.Second)*scale/int64(time.Second)
+}
@@ -0,0 +1,496 @@
+package sessions
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bluenviron/gohlslib/pkg/playlist"
+	"github.com/bluenviron/gohlslib/pkg/playlist/primitives"
+	"go.uber.org/zap"
+
+	"mediaserver-go/hubs"
+	"mediaserver-go/ingress/sessions/tsdemuxer"
+	"mediaserver-go/utils/log"
+)
+
+const (
+	// 라이브 재생목록은 끝에서 이만큼 앞의 세그먼트부터 받는다.
+	hlsPullLiveStartSegments = 3
+	hlsPullRequestTimeout    = 10 * time.Second
+	// blocking reload 는 서버가 다음 part 를 만들 때까지 응답을 늦추므로 target duration 의 배수만큼 기다린다.
+	hlsPullBlockingTimeoutFactor = 3
+	hlsPullMaxFailures           = 5
+	hlsPullRetryInterval         = time.Second
+	hlsPullMaxResponseSize       = 64 * 1024 * 1024
+)
+
+var (
+	errHLSPullNoURL           = errors.New("no hls url")
+	errHLSPullNoVariant       = errors.New("no hls variant")
+	errHLSPullInvalidPlaylist = errors.New("invalid hls playlist")
+	errHLSPullStatus          = errors.New("unexpected hls response status")
+)
+
+type HLSPullConfig struct {
+	// Multivariant 또는 Media 재생목록의 URL
+	URL string
+	// Multivariant 재생목록에서 고를 variant 의 최대 BANDWIDTH. 0 이면 가장 높은 것을 고른다.
+	MaxBandwidth int
+}
+
+// hlsSegmentInfo 는 gohlslib 이 남기지 않는 세그먼트별 태그이다.
+type hlsSegmentInfo struct {
+	discontinuity bool
+	// 이 세그먼트에 적용되는 #EXT-X-MAP 의 속성
+	mapTag string
+}
+
+// HLSPullSession 은 HLS 재생목록을 주기적으로(LL-HLS 이면 blocking reload 로) 받아서
+// 세그먼트(TS 또는 fMP4)를 hubs.Stream 에 쓴다. 세그먼트와 discontinuity 를 지나도 타임스탬프는 이어진다.
+type HLSPullSession struct {
+	config HLSPullConfig
+	stream *hubs.Stream
+	client *http.Client
+
+	mediaURL *url.URL
+	// CAN-BLOCK-RELOAD 이면 _HLS_msn(_HLS_part) 로 다음 업데이트를 기다린다.
+	blocking bool
+	partial  bool
+	// 마지막 재생목록의 EXT-X-TARGETDURATION
+	targetDuration time.Duration
+
+	started bool
+	// 다음에 받을 세그먼트의 media sequence number 와 그 세그먼트에서 이미 받은 part 수
+	nextMSN  int
+	nextPart int
+	// 놓친 세그먼트가 있으면 다음 세그먼트를 discontinuity 로 처리한다.
+	lost bool
+	// 마지막 재생목록에서 새 세그먼트를 받았는지
+	changed bool
+
+	mapTag  string
+	ts      *tsWriter
+	demuxer *tsdemuxer.Demuxer
+	fmp4    *fmp4Writer
+	// 같은 URI 의 BYTERANGE 에 시작 위치가 없으면 앞 범위의 끝부터이다.
+	rangeURI string
+	rangeEnd uint64
+}
+
+func NewHLSPullSession(config HLSPullConfig, stream *hubs.Stream) (*HLSPullSession, error) {
+	if config.URL == "" {
+		return nil, errHLSPullNoURL
+	}
+	if _, err := url.Parse(config.URL); err != nil {
+		return nil, err
+	}
+	return &HLSPullSession{
+		config: config,
+		stream: stream,
+		client: &http.Client{},
+	}, nil
+}
+
+// Run 은 VOD 이면 끝까지, 라이브이면 ctx 가 끝날 때까지 받는다. 연속해서 실패하면 끝난다.
+func (s *HLSPullSession) Run(ctx context.Context) error {
+	defer s.stream.Close()
+
+	failures := 0
+	for {
+		pl, raw, err := s.loadPlaylist(ctx)
+		if err == nil {
+			err = s.consume(ctx, pl, raw)
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			failures++
+			if failures >= hlsPullMaxFailures {
+				return err
+			}
+			log.Logger.Warn("hls pull failed, retrying", zap.String("url", s.config.URL), zap.Int("failures", failures), zap.Error(err))
+			if !sleepContext(ctx, hlsPullRetryInterval) {
+				return nil
+			}
+			continue
+		}
+		failures = 0
+
+		if pl.Endlist && s.nextMSN >= pl.MediaSequence+len(pl.Segments) {
+			s.flush()
+			return nil
+		}
+		if !s.blocking && !sleepContext(ctx, s.reloadInterval()) {
+			return nil
+		}
+	}
+}
+
+// reloadInterval 은 RFC 8216 6.3.4 를 따른다. 바뀐 것이 없으면 target duration 의 절반 뒤에 다시 받는다.
+func (s *HLSPullSession) reloadInterval() time.Duration {
+	interval := s.targetDuration
+	if !s.changed {
+		interval /= 2
+	}
+	return interval
+}
+
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// loadPlaylist 는 Media 재생목록을 받는다. 처음에는 Multivariant 재생목록이면 variant 를 고른다.
+func (s *HLSPullSession) loadPlaylist(ctx context.Context) (*playlist.Media, []byte, error) {
+	if s.mediaURL == nil {
+		return s.resolvePlaylist(ctx)
+	}
+
+	u := *s.mediaURL
+	timeout := hlsPullRequestTimeout
+	if s.blocking && s.started {
+		timeout += hlsPullBlockingTimeoutFactor * s.targetDuration
+		query := u.Query()
+		query.Set("_HLS_msn", strconv.Itoa(s.nextMSN))
+		if s.partial {
+			query.Set("_HLS_part", strconv.Itoa(s.nextPart))
+		}
+		u.RawQuery = query.Encode()
+	}
+	raw, err := s.get(ctx, u.String(), nil, nil, timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	pl, err := playlist.Unmarshal(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	media, ok := pl.(*playlist.Media)
+	if !ok {
+		return nil, nil, errHLSPullInvalidPlaylist
+	}
+	return media, raw, nil
+}
+
+func (s *HLSPullSession) resolvePlaylist(ctx context.Context) (*playlist.Media, []byte, error) {
+	u, err := url.Parse(s.config.URL)
+	if err != nil {
+		return nil, nil, err
+	}
+	raw, err := s.get(ctx, u.String(), nil, nil, hlsPullRequestTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	pl, err := playlist.Unmarshal(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if multivariant, ok := pl.(*playlist.Multivariant); ok {
+		variant := selectHLSVariant(multivariant.Variants, s.config.MaxBandwidth)
+		if variant == nil {
+			return nil, nil, errHLSPullNoVariant
+		}
+		if u, err = u.Parse(variant.URI); err != nil {
+			return nil, nil, err
+		}
+		log.Logger.Info("hls variant selected", zap.String("uri", u.String()), zap.Int("bandwidth", variant.Bandwidth))
+		if raw, err = s.get(ctx, u.String(), nil, nil, hlsPullRequestTimeout); err != nil {
+			return nil, nil, err
+		}
+		if pl, err = playlist.Unmarshal(raw); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	media, ok := pl.(*playlist.Media)
+	if !ok {
+		return nil, nil, errHLSPullInvalidPlaylist
+	}
+	s.mediaURL = u
+	s.blocking = media.ServerControl != nil && media.ServerControl.CanBlockReload && !media.Endlist
+	s.partial = s.blocking && media.PartInf != nil
+	return media, raw, nil
+}
+
+// selectHLSVariant 는 maxBandwidth 이하에서 BANDWIDTH 가 가장 높은 variant 를 고른다. 모두 넘으면 가장 낮은 것을 고른다.
+func selectHLSVariant(variants []*playlist.MultivariantVariant, maxBandwidth int) *playlist.MultivariantVariant {
+	var best, lowest *playlist.MultivariantVariant
+	for _, variant := range variants {
+		if lowest == nil || variant.Bandwidth < lowest.Bandwidth {
+			lowest = variant
+		}
+		if maxBandwidth > 0 && variant.Bandwidth > maxBandwidth {
+			continue
+		}
+		if best == nil || variant.Bandwidth > best.Bandwidth {
+			best = variant
+		}
+	}
+	if best == nil {
+		return lowest
+	}
+	return best
+}
+
+// consume 은 재생목록에서 아직 받지 않은 세그먼트와 part 를 받는다.
+func (s *HLSPullSession) consume(ctx context.Context, pl *playlist.Media, raw []byte) error {
+	s.targetDuration = time.Duration(pl.TargetDuration) * time.Second
+	infos := scanHLSSegments(raw)
+	first := pl.MediaSequence
+	// 아직 끝나지 않은 세그먼트(pl.Parts)의 media sequence number
+	last := first + len(pl.Segments)
+
+	if !s.started {
+		s.started = true
+		s.nextMSN = hlsStartMSN(pl, s.partial)
+	}
+	if s.nextMSN < first {
+		log.Logger.Warn("hls segments lost", zap.Int("from", s.nextMSN), zap.Int("to", first))
+		s.nextMSN, s.nextPart = first, 0
+		s.lost = true
+	}
+
+	s.changed = false
+	for i, segment := range pl.Segments {
+		if first+i < s.nextMSN {
+			continue
+		}
+		if err := s.consumeSegment(ctx, segment, infos[i]); err != nil {
+			return err
+		}
+		s.changed = true
+	}
+
+	if s.partial && s.nextMSN == last {
+		for s.nextPart < len(pl.Parts) {
+			if s.nextPart == 0 {
+				if err := s.begin(ctx, infos[len(pl.Segments)]); err != nil {
+					return err
+				}
+			}
+			if err := s.consumePart(ctx, pl.Parts[s.nextPart]); err != nil {
+				return err
+			}
+			s.nextPart++
+			s.changed = true
+		}
+	}
+	return nil
+}
+
+// hlsStartMSN 은 VOD 이면 처음부터, LL-HLS 이면 마지막으로 끝난 세그먼트부터, 아니면 끝에서 몇 세그먼트 앞부터 받는다.
+func hlsStartMSN(pl *playlist.Media, partial bool) int {
+	first := pl.MediaSequence
+	last := first + len(pl.Segments)
+	switch {
+	case pl.Endlist:
+		return first
+	case partial:
+		return max(first, last-1)
+	default:
+		return max(first, last-hlsPullLiveStartSegments)
+	}
+}
+
+func (s *HLSPullSession) consumeSegment(ctx context.Context, segment *playlist.MediaSegment, info hlsSegmentInfo) error {
+	if s.nextPart == 0 {
+		if err := s.begin(ctx, info); err != nil {
+			return err
+		}
+		if !segment.Gap {
+			b, err := s.get(ctx, s.resolve(segment.URI), segment.ByteRangeLength, segment.ByteRangeStart, hlsPullRequestTimeout)
+			if err != nil {
+				return err
+			}
+			s.write(b)
+		}
+	} else if len(segment.Parts) > s.nextPart {
+		// 앞의 part 들은 이미 받았다.
+		for _, part := range segment.Parts[s.nextPart:] {
+			if err := s.consumePart(ctx, part); err != nil {
+				return err
+			}
+		}
+	} else if len(segment.Parts) == 0 {
+		log.Logger.Warn("hls segment without parts, remaining parts skipped", zap.String("uri", segment.URI))
+	}
+	s.flush()
+	s.nextMSN++
+	s.nextPart = 0
+	return nil
+}
+
+func (s *HLSPullSession) consumePart(ctx context.Context, part *playlist.MediaPart) error {
+	if part.Gap {
+		return nil
+	}
+	b, err := s.get(ctx, s.resolve(part.URI), part.ByteRangeLength, part.ByteRangeStart, hlsPullRequestTimeout)
+	if err != nil {
+		return err
+	}
+	s.write(b)
+	return nil
+}
+
+// begin 은 새 세그먼트를 받기 전에 discontinuity 와 init segment 를 처리한다.
+func (s *HLSPullSession) begin(ctx context.Context, info hlsSegmentInfo) error {
+	if s.ts == nil && s.fmp4 == nil {
+		if info.mapTag == "" {
+			s.ts = newTSWriter(s.stream)
+			s.demuxer = tsdemuxer.NewDemuxer(s.ts.onStreams, s.ts.onFrame)
+		} else {
+			s.fmp4 = newFMP4Writer(s.stream)
+		}
+	} else if info.discontinuity || s.lost {
+		s.discontinuity()
+	}
+	s.lost = false
+
+	if s.fmp4 != nil && info.mapTag != s.mapTag {
+		if err := s.loadInit(ctx, info.mapTag); err != nil {
+			return err
+		}
+		s.mapTag = info.mapTag
+	}
+	return nil
+}
+
+func (s *HLSPullSession) loadInit(ctx context.Context, mapTag string) error {
+	var m playlist.MediaMap
+	attrs, err := primitives.AttributesUnmarshal(mapTag)
+	if err != nil {
+		return err
+	}
+	for key, val := range attrs {
+		switch key {
+		case "URI":
+			m.URI = val
+		case "BYTERANGE":
+			length, start, err := primitives.ByteRangeUnmarshal(val)
+			if err != nil {
+				return err
+			}
+			m.ByteRangeLength = &length
+			m.ByteRangeStart = start
+		}
+	}
+	if m.URI == "" {
+		return fmt.Errorf("%w: EXT-X-MAP without URI", errHLSPullInvalidPlaylist)
+	}
+
+	b, err := s.get(ctx, s.resolve(m.URI), m.ByteRangeLength, m.ByteRangeStart, hlsPullRequestTimeout)
+	if err != nil {
+		return err
+	}
+	return s.fmp4.setInit(b)
+}
+
+func (s *HLSPullSession) discontinuity() {
+	if s.ts != nil {
+		// 앞 세그먼트의 타임스탬프 기준(wrap-around)을 버린다.
+		s.demuxer.Flush()
+		s.demuxer = tsdemuxer.NewDemuxer(s.ts.onStreams, s.ts.onFrame)
+		s.ts.discontinuity()
+	}
+	if s.fmp4 != nil {
+		s.fmp4.discontinuity()
+	}
+}
+
+// write 는 받은 세그먼트나 part 를 demux 한다. 깨진 데이터는 버리고 계속 받는다.
+func (s *HLSPullSession) write(b []byte) {
+	if s.ts != nil {
+		s.demuxer.Write(b)
+		return
+	}
+	if err := s.fmp4.write(b); err != nil {
+		log.Logger.Warn("hls fmp4 segment unmarshal failed", zap.Error(err))
+	}
+}
+
+// flush 는 세그먼트가 끝나면 TS 의 마지막 PES 를 내보낸다.
+func (s *HLSPullSession) flush() {
+	if s.demuxer != nil {
+		s.demuxer.Flush()
+	}
+}
+
+func (s *HLSPullSession) resolve(uri string) string {
+	u, err := s.mediaURL.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	return u.String()
+}
+
+// get 은 uri 를 받는다. length 가 있으면 Range 요청으로 BYTERANGE 만 받는다.
+func (s *HLSPullSession) get(ctx context.Context, uri string, length, start *uint64, timeout time.Duration) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	if length != nil {
+		begin := s.rangeEnd
+		if start != nil {
+			begin = *start
+		} else if s.rangeURI != uri {
+			begin = 0
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", begin, begin+*length-1))
+		s.rangeURI, s.rangeEnd = uri, begin+*length
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("%w: %s %d", errHLSPullStatus, uri, resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, hlsPullMaxResponseSize))
+}
+
+// scanHLSSegments 는 재생목록의 세그먼트마다 discontinuity 여부와 적용되는 EXT-X-MAP 을 찾는다.
+// 마지막 원소는 아직 끝나지 않은(part 만 있는) 세그먼트의 것이다.
+func scanHLSSegments(raw []byte) []hlsSegmentInfo {
+	var (
+		infos   []hlsSegmentInfo
+		current hlsSegmentInfo
+	)
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "#EXT-X-DISCONTINUITY":
+			current.discontinuity = true
+		case strings.HasPrefix(line, "#EXT-X-MAP:"):
+			current.mapTag = line[len("#EXT-X-MAP:"):]
+		case line != "" && !strings.HasPrefix(line, "#"):
+			infos = append(infos, current)
+			current.discontinuity = false
+		}
+	}
+	return append(infos, current)
+}
@@ -0,0 +1,448 @@
+package sessions
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	commonh264 "github.com/bluenviron/mediacommon/pkg/codecs/h264"
+	"github.com/bluenviron/mediacommon/pkg/codecs/mpeg4audio"
+	commonopus "github.com/bluenviron/mediacommon/pkg/codecs/opus"
+	"github.com/pion/rtp"
+	pion "github.com/pion/webrtc/v3"
+	"go.uber.org/zap"
+
+	"mediaserver-go/codecs/aac"
+	"mediaserver-go/codecs/factory"
+	"mediaserver-go/codecs/h264"
+	"mediaserver-go/codecs/opus"
+	"mediaserver-go/hubs"
+	"mediaserver-go/ingress/sessions/tsdemuxer"
+	"mediaserver-go/thirdparty/ffmpeg/avutil"
+	"mediaserver-go/utils/log"
+	"mediaserver-go/utils/types"
+	"mediaserver-go/utils/units"
+)
+
+const (
+	MPEGTSProtocolUDP = "udp"
+	MPEGTSProtocolTCP = "tcp"
+
+	// 인코더가 보내는 비트레이트가 높으면 커널 버퍼가 넘치므로 크게 잡는다.
+	mpegtsReadBufferSize = 4 * 1024 * 1024
+	mpegtsTimeBase       = 90000
+)
+
+type MPEGTSConfig struct {
+	// udp(기본값) 또는 tcp
+	Protocol string
+	// bind 할 주소. udp 이고 멀티캐스트 주소이면 그룹에 가입한다.
+	Addr string
+	Port int
+	// 멀티캐스트 그룹에 가입할 네트워크 인터페이스 이름. 비어있으면 시스템이 고른다.
+	Interface string
+}
+
+// tsTrack 은 미디어 타입마다 하나이다. 인코더가 재시작하여 PID 가 바뀌어도 같은 HubSource 에 이어서 쓴다.
+type tsTrack struct {
+	hubSource *hubs.HubSource
+	codecType types.CodecType
+	codecSet  bool
+	prevDTS   int64
+
+	// h264
+	sps, pps         []byte
+	spsTemp, ppsTemp []byte
+
+	// aac
+	sampleRate, channels int
+}
+
+// tsWriter 는 tsdemuxer 의 PES 를 hubs.Stream 의 소스로 쓴다. MPEG-TS ingress 와 HLS pull 이 함께 쓴다.
+type tsWriter struct {
+	stream *hubs.Stream
+
+	tracks map[types.MediaType]*tsTrack
+	pids   map[uint16]types.MediaType
+	// 첫 DTS 를 offset 으로 맞춘다. 트랙 사이의 싱크를 위해 모든 트랙이 같은 값을 뺀다.
+	startTS  int64
+	hasStart bool
+	offset   int64
+	// 지금까지 쓴 프레임의 끝(DTS + duration)
+	end int64
+}
+
+func newTSWriter(stream *hubs.Stream) *tsWriter {
+	return &tsWriter{
+		stream: stream,
+		tracks: make(map[types.MediaType]*tsTrack),
+		pids:   make(map[uint16]types.MediaType),
+	}
+}
+
+// discontinuity 는 다음 프레임부터의 타임스탬프를 지금까지 쓴 프레임 뒤에 이어 붙인다.
+func (s *tsWriter) discontinuity() {
+	s.offset = s.end
+	s.hasStart = false
+}
+
+type MPEGTSSession struct {
+	*tsWriter
+
+	config MPEGTSConfig
+
+	udpConn  *net.UDPConn
+	listener net.Listener
+}
+
+func NewMPEGTSSession(config MPEGTSConfig, stream *hubs.Stream) (*MPEGTSSession, error) {
+	s := &MPEGTSSession{
+		tsWriter: newTSWriter(stream),
+		config:   config,
+	}
+
+	switch config.Protocol {
+	case "", MPEGTSProtocolUDP:
+		conn, err := listenUDP(config)
+		if err != nil {
+			return nil, err
+		}
+		if err := conn.SetReadBuffer(mpegtsReadBufferSize); err != nil {
+			log.Logger.Warn("mpegts set read buffer failed", zap.Error(err))
+		}
+		s.udpConn = conn
+	case MPEGTSProtocolTCP:
+		listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", config.Addr, config.Port))
+		if err != nil {
+			return nil, err
+		}
+		s.listener = listener
+	default:
+		return nil, fmt.Errorf("unsupported mpegts protocol: %s", config.Protocol)
+	}
+	return s, nil
+}
+
+func listenUDP(config MPEGTSConfig) (*net.UDPConn, error) {
+	ip := net.ParseIP(config.Addr)
+	if ip == nil || !ip.IsMulticast() {
+		return net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: config.Port})
+	}
+	var ifi *net.Interface
+	if config.Interface != "" {
+		var err error
+		if ifi, err = net.InterfaceByName(config.Interface); err != nil {
+			return nil, err
+		}
+	}
+	return net.ListenMulticastUDP("udp", ifi, &net.UDPAddr{IP: ip, Port: config.Port})
+}
+
+// Run 은 ctx 가 끝날 때까지 TS 를 받는다. tcp 는 인코더의 연결이 끊기면 다음 연결을 기다린다.
+func (s *MPEGTSSession) Run(ctx context.Context) error {
+	defer s.stream.Close()
+
+	go func() {
+		<-ctx.Done()
+		if s.udpConn != nil {
+			s.udpConn.Close()
+		}
+		if s.listener != nil {
+			s.listener.Close()
+		}
+	}()
+
+	if s.udpConn != nil {
+		return s.runUDP(ctx)
+	}
+	return s.runTCP(ctx)
+}
+
+func (s *MPEGTSSession) runUDP(ctx context.Context) error {
+	demuxer := tsdemuxer.NewDemuxer(s.onStreams, s.onFrame)
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := s.udpConn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		demuxer.Write(stripRTPHeader(buf[:n]))
+	}
+}
+
+func (s *MPEGTSSession) runTCP(ctx context.Context) error {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		log.Logger.Info("mpegts tcp connected", zap.String("remote", conn.RemoteAddr().String()))
+
+		stop := context.AfterFunc(ctx, func() {
+			conn.Close()
+		})
+		demuxer := tsdemuxer.NewDemuxer(s.onStreams, s.onFrame)
+		buf := make([]byte, 65536)
+		for {
+			n, err := conn.Read(buf)
+			if n > 0 {
+				demuxer.Write(buf[:n])
+			}
+			if err != nil {
+				if !errors.Is(err, io.EOF) && ctx.Err() == nil {
+					log.Logger.Warn("mpegts tcp read failed", zap.Error(err))
+				}
+				break
+			}
+		}
+		demuxer.Flush()
+		stop()
+		conn.Close()
+		log.Logger.Info("mpegts tcp disconnected")
+	}
+}
+
+// stripRTPHeader 는 RTP(RFC 2250)로 감싼 TS 이면 RTP 헤더를 뗀다.
+func stripRTPHeader(b []byte) []byte {
+	if len(b) == 0 || b[0] == 0x47 || b[0]>>6 != 2 {
+		return b
+	}
+	packet := rtp.Packet{}
+	if err := packet.Unmarshal(b); err != nil {
+		return b
+	}
+	return packet.Payload
+}
+
+func (s *tsWriter) onStreams(streams []tsdemuxer.Stream) {
+	for _, stream := range streams {
+		if stream.CodecType == "" {
+			log.Logger.Warn("mpegts unsupported stream, skipped",
+				zap.Uint16("pid", stream.PID),
+				zap.Uint8("streamType", stream.StreamType))
+			continue
+		}
+
+		var mimeType string
+		var mediaType types.MediaType
+		switch stream.CodecType {
+		case types.CodecTypeH264:
+			mimeType, mediaType = pion.MimeTypeH264, types.MediaTypeVideo
+		case types.CodecTypeAAC:
+			mimeType, mediaType = "audio/aac", types.MediaTypeAudio
+		case types.CodecTypeOpus:
+			mimeType, mediaType = pion.MimeTypeOpus, types.MediaTypeAudio
+		default:
+			continue
+		}
+
+		track, ok := s.tracks[mediaType]
+		if ok {
+			if track.codecType != stream.CodecType {
+				log.Logger.Warn("mpegts codec changed, skipped",
+					zap.Uint16("pid", stream.PID),
+					zap.String("codec", string(stream.CodecType)))
+				continue
+			}
+			s.pids[stream.PID] = mediaType
+			continue
+		}
+
+		base, err := factory.NewBase(mimeType)
+		if err != nil {
+			continue
+		}
+		track = &tsTrack{
+			hubSource: hubs.NewHubSource(base, ""),
+			codecType: stream.CodecType,
+		}
+		if stream.CodecType == types.CodecTypeOpus {
+			track.hubSource.SetCodec(opus.NewOpus(opus.NewConfig(opus.Parameters{
+				Channels:     stream.Channels,
+				SampleRate:   48000,
+				SampleFormat: int(avutil.AV_SAMPLE_FMT_FLT),
+			})))
+			track.codecSet = true
+		}
+		s.stream.AddSource(track.hubSource)
+		s.tracks[mediaType] = track
+		s.pids[stream.PID] = mediaType
+		log.Logger.Info("mpegts stream found", zap.Uint16("pid", stream.PID), zap.String("codec", string(stream.CodecType)))
+	}
+}
+
+func (s *tsWriter) onFrame(stream tsdemuxer.Stream, frame tsdemuxer.Frame) {
+	mediaType, ok := s.pids[stream.PID]
+	if !ok {
+		return
+	}
+	track := s.tracks[mediaType]
+
+	if !s.hasStart {
+		s.startTS = frame.DTS
+		s.hasStart = true
+	}
+	pts, dts := frame.PTS-s.startTS+s.offset, frame.DTS-s.startTS+s.offset
+	if dts < s.offset {
+		return
+	}
+
+	switch track.codecType {
+	case types.CodecTypeH264:
+		s.writeH264(track, frame.Data, pts, dts)
+	case types.CodecTypeAAC:
+		s.writeAAC(track, frame.Data, pts)
+	case types.CodecTypeOpus:
+		s.writeOpus(track, frame.Data, pts)
+	}
+}
+
+func (s *tsWriter) writeH264(track *tsTrack, data []byte, pts, dts int64) {
+	nalus, err := commonh264.AnnexBUnmarshal(data)
+	if err != nil {
+		log.Logger.Warn("mpegts h264 annexb unmarshal failed", zap.Error(err))
+		return
+	}
+
+	flag := 0
+	var payloads [][]byte
+	for _, nalu := range nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+		switch commonh264.NALUType(nalu[0] & 0x1f) {
+		case commonh264.NALUTypeSEI, commonh264.NALUTypeAccessUnitDelimiter, commonh264.NALUTypeFillerData:
+			// drop
+		case commonh264.NALUTypeSPS:
+			track.spsTemp = nalu
+			track.ppsTemp = nil
+		case commonh264.NALUTypePPS:
+			track.ppsTemp = nalu
+		case commonh264.NALUTypeIDR:
+			flag = 1
+			payloads = append(payloads, nalu)
+		default:
+			payloads = append(payloads, nalu)
+		}
+	}
+
+	if len(track.spsTemp) > 0 && len(track.ppsTemp) > 0 &&
+		(!bytes.Equal(track.sps, track.spsTemp) || !bytes.Equal(track.pps, track.ppsTemp)) {
+		config := &h264.Config{}
+		if err := config.UnmarshalFromSPSPPS(track.spsTemp, track.ppsTemp); err != nil {
+			log.Logger.Error("failed to unmarshal sps pps", zap.Error(err))
+		} else {
+			track.sps = bytes.Clone(track.spsTemp)
+			track.pps = bytes.Clone(track.ppsTemp)
+			track.hubSource.SetCodec(h264.NewH264(config))
+			track.codecSet = true
+		}
+	}
+	// SPS, PPS 를 받기 전의 프레임은 디코딩할 수 없다.
+	if !track.codecSet {
+		return
+	}
+
+	duration := dts - track.prevDTS
+	track.prevDTS = dts
+	s.end = max(s.end, dts+duration)
+	for i, payload := range payloads {
+		track.hubSource.Write(units.Unit{
+			Payload:   payload,
+			PTS:       pts,
+			DTS:       dts,
+			Duration:  duration,
+			TimeBase:  mpegtsTimeBase,
+			Marker:    i == len(payloads)-1,
+			FrameInfo: units.FrameInfo{Flag: flag},
+		})
+	}
+}
+
+// writeAAC 는 PES 에 들어있는 ADTS 프레임들을 나누어 쓴다. 프레임마다 1024 샘플이다.
+func (s *tsWriter) writeAAC(track *tsTrack, data []byte, pts int64) {
+	var packets mpeg4audio.ADTSPackets
+	if err := packets.Unmarshal(data); err != nil {
+		log.Logger.Warn("mpegts adts unmarshal failed", zap.Error(err))
+		return
+	}
+	for i, packet := range packets {
+		if packet.SampleRate != track.sampleRate || packet.ChannelCount != track.channels {
+			track.sampleRate, track.channels = packet.SampleRate, packet.ChannelCount
+			track.hubSource.SetCodec(aac.NewAAC(aac.NewConfig(aac.Parameters{
+				SampleRate:   packet.SampleRate,
+				Channels:     packet.ChannelCount,
+				SampleFormat: int(avutil.AV_SAMPLE_FMT_FLTP),
+			})))
+		}
+		duration := int64(mpeg4audio.SamplesPerAccessUnit) * mpegtsTimeBase / int64(packet.SampleRate)
+		ts := pts + int64(i)*duration
+		s.end = max(s.end, ts+duration)
+		track.hubSource.Write(units.Unit{
+			Payload:  packet.AU,
+			PTS:      ts,
+			DTS:      ts,
+			Duration: duration,
+			TimeBase: mpegtsTimeBase,
+			Marker:   true,
+		})
+	}
+}
+
+// writeOpus 는 PES 에 들어있는 Opus 패킷들을 opus_control_header 로 나누어 쓴다.
+func (s *tsWriter) writeOpus(track *tsTrack, data []byte, pts int64) {
+	ts := pts
+	for len(data) >= 2 && data[0] == 0x7f && data[1]&0xe0 == 0xe0 {
+		flags := data[1]
+		i := 2
+		size := 0
+		for i < len(data) {
+			b := int(data[i])
+			i++
+			size += b
+			if b != 0xff {
+				break
+			}
+		}
+		if flags&0x10 != 0 {
+			// start_trim
+			i += 2
+		}
+		if flags&0x08 != 0 {
+			// end_trim
+			i += 2
+		}
+		if flags&0x04 != 0 && i < len(data) {
+			// control_extension
+			i += 1 + int(data[i])
+		}
+		if i+size > len(data) {
+			log.Logger.Warn("mpegts opus packet truncated")
+			return
+		}
+		packet := data[i : i+size]
+		data = data[i+size:]
+
+		duration := int64(commonopus.PacketDuration(packet) * mpegtsTimeBase / time.Second)
+		s.end = max(s.end, ts+duration)
+		track.hubSource.Write(units.Unit{
+			Payload:  packet,
+			PTS:      ts,
+			DTS:      ts,
+			Duration: duration,
+			TimeBase: mpegtsTimeBase,
+			Marker:   true,
+		})
+		ts += duration
+	}
+}
@@ -2,6 +2,7 @@ package sessions
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	pion "github.com/pion/webrtc/v3"
 	flvtag "github.com/yutopp/go-flv/tag"
@@ -9,25 +10,70 @@ import (
 	"github.com/yutopp/go-rtmp/message"
 	"go.uber.org/zap"
 	"io"
+	"mediaserver-go/codecs"
 	"mediaserver-go/codecs/aac"
+	"mediaserver-go/codecs/av1"
 	"mediaserver-go/codecs/factory"
 	"mediaserver-go/codecs/h264"
+	"mediaserver-go/codecs/h265"
+	"mediaserver-go/codecs/opus"
+	"mediaserver-go/codecs/vp9"
 	"mediaserver-go/hubs"
 	"mediaserver-go/parsers/format"
 	"mediaserver-go/thirdparty/ffmpeg/avutil"
 	"mediaserver-go/utils/log"
+	"mediaserver-go/utils/types"
 	"mediaserver-go/utils/units"
-	"sync"
+	"net/url"
+	"strings"
 )
 
+var (
+	errRTMPEmptyStreamKey = errors.New("empty rtmp stream key")
+	errRTMPAlreadyActive  = errors.New("rtmp stream is already publishing or playing")
+)
+
+// RTMPPublishRequest 는 발행 요청이다. StreamID 가 hub 의 스트림 ID 가 된다.
+type RTMPPublishRequest struct {
+	App       string
+	StreamKey string
+	// app/streamKey. app 이 비어있으면 streamKey
+	StreamID string
+	// rtmp://host/app/streamKey?token=abc 의 쿼리
+	Query      url.Values
+	RemoteAddr string
+}
+
+// RTMPSubscriber 는 재생할 스트림의 FLV 바이트 스트림이다.
+type RTMPSubscriber interface {
+	Data() <-chan []byte
+	Close()
+}
+
+// RTMPController 는 RTMPSession 의 발행과 재생을 서버가 허용하고 관리하게 한다.
+type RTMPController interface {
+	// Publish 는 발행을 인증하고 stream 을 hub 에 넣는다. 에러이면 발행을 거부한다.
+	Publish(session *RTMPSession, req RTMPPublishRequest, stream *hubs.Stream) error
+	// Unpublish 는 session 이 아직 streamID 의 발행자일 때만 스트림을 hub 에서 뺀다.
+	Unpublish(session *RTMPSession, streamID string)
+	Subscribe(streamID string) (RTMPSubscriber, error)
+}
+
 type RTMPSession struct {
 	rtmp.DefaultHandler
 
-	once       sync.Once
-	streamKey  string
-	hub        *hubs.Hub
+	controller RTMPController
+	conn       *rtmp.Conn
+	remoteAddr string
+	app        string
+
+	streamID   string
 	stream     *hubs.Stream
+	player     *rtmpPlayer
 	h264Config h264.Config
+	// AV1 키 프레임에 넣을 sequence header OBU
+	av1SequenceHeader []byte
+	vp9Codec          codecs.Codec
 
 	videoSource *hubs.HubSource
 	audioSource *hubs.HubSource
@@ -35,18 +81,50 @@ type RTMPSession struct {
 	prevAudioTS uint32
 }
 
-func NewRTMPSession(hub *hubs.Hub) *RTMPSession {
+func NewRTMPSession(controller RTMPController, remoteAddr string) *RTMPSession {
 	return &RTMPSession{
-		hub: hub,
+		controller: controller,
+		remoteAddr: remoteAddr,
+	}
+}
+
+// Kick 은 연결을 끊는다. 다른 발행자가 스트림을 가져갈 때 호출된다.
+func (h *RTMPSession) Kick() {
+	if h.conn == nil {
+		return
+	}
+	if err := h.conn.Close(); err != nil {
+		log.Logger.Warn("rtmp close failed", zap.String("streamID", h.streamID), zap.Error(err))
+	}
+}
+
+// WrapConn 은 go-rtmp 에 넘길 연결을 감싼다. go-rtmp 는 메시지 처리와 읽기를 한 goroutine 에서 하므로,
+// OnPlay 다음의 Read 는 NetStream.Play.Start 를 보낸 뒤에 불린다.
+func (h *RTMPSession) WrapConn(conn io.ReadWriteCloser) io.ReadWriteCloser {
+	return &rtmpConn{ReadWriteCloser: conn, session: h}
+}
+
+type rtmpConn struct {
+	io.ReadWriteCloser
+	session *RTMPSession
+}
+
+func (c *rtmpConn) Read(b []byte) (int, error) {
+	if c.session.player != nil {
+		c.session.player.start()
 	}
+	return c.ReadWriteCloser.Read(b)
 }
 
 func (h *RTMPSession) OnServe(conn *rtmp.Conn) {
-	fmt.Println("OnServe")
+	h.conn = conn
 }
 
 func (h *RTMPSession) OnConnect(timestamp uint32, cmd *message.NetConnectionConnect) error {
-	fmt.Printf("OnConnect cmd:%+v\n", *cmd)
+	// rtmp://host/live?token=abc 처럼 app 에 쿼리를 붙이는 클라이언트도 있다.
+	app, _, _ := strings.Cut(cmd.Command.App, "?")
+	h.app = strings.Trim(app, "/")
+	log.Logger.Debug("OnConnect", zap.String("app", h.app), zap.String("remoteAddr", h.remoteAddr))
 	return nil
 }
 
@@ -56,12 +134,6 @@ func (h *RTMPSession) OnCreateStream(timestamp uint32, cmd *message.NetConnectio
 }
 
 func (h *RTMPSession) OnReleaseStream(timestamp uint32, cmd *message.NetConnectionReleaseStream) error {
-	h.once.Do(func() {
-		h.streamKey = cmd.StreamName
-		h.stream = hubs.NewStream()
-		h.hub.AddStream(h.streamKey, h.stream)
-	})
-
 	log.Logger.Debug("OnReleaseStream", zap.Any("cmd", cmd))
 	return nil
 }
@@ -71,29 +143,59 @@ func (h *RTMPSession) OnDeleteStream(timestamp uint32, cmd *message.NetStreamDel
 	return nil
 }
 
+// OnPublish 는 인증을 통과한 경우에만 스트림을 만든다. 에러를 반환하면 클라이언트에 NetStream.Publish.BadName 이 간다.
 func (h *RTMPSession) OnPublish(_ *rtmp.StreamContext, timestamp uint32, cmd *message.NetStreamPublish) error {
-	h.once.Do(func() {
-		h.streamKey = cmd.PublishingName
-		h.stream = hubs.NewStream()
-		h.hub.AddStream(h.streamKey, h.stream)
-	})
-
 	log.Logger.Debug("OnPublish", zap.Any("cmd", cmd))
+
+	if h.stream != nil || h.player != nil {
+		return errRTMPAlreadyActive
+	}
+	streamKey, query, err := parseStreamName(cmd.PublishingName)
+	if err != nil {
+		return err
+	}
+	req := RTMPPublishRequest{
+		App:        h.app,
+		StreamKey:  streamKey,
+		StreamID:   RTMPStreamID(h.app, streamKey),
+		Query:      query,
+		RemoteAddr: h.remoteAddr,
+	}
+	stream := hubs.NewStream()
+	if err := h.controller.Publish(h, req, stream); err != nil {
+		log.Logger.Warn("rtmp publish rejected", zap.String("streamID", req.StreamID), zap.String("remoteAddr", h.remoteAddr), zap.Error(err))
+		return err
+	}
+	h.streamID = req.StreamID
+	h.stream = stream
 	return nil
 }
 
-func (h *RTMPSession) OnPlay(_ *rtmp.StreamContext, timestamp uint32, cmd *message.NetStreamPlay) error {
-	fmt.Printf("OnPlay cmd:%+v\n", *cmd)
+// OnPlay 는 hub 의 스트림을 app/streamKey 로 찾고, 없으면 streamKey 로 찾는다.
+func (h *RTMPSession) OnPlay(ctx *rtmp.StreamContext, timestamp uint32, cmd *message.NetStreamPlay) error {
+	log.Logger.Debug("OnPlay", zap.Any("cmd", cmd))
+
+	if h.stream != nil || h.player != nil {
+		return errRTMPAlreadyActive
+	}
+	streamKey, _, err := parseStreamName(cmd.StreamName)
+	if err != nil {
+		return err
+	}
+	subscriber, err := h.controller.Subscribe(RTMPStreamID(h.app, streamKey))
+	if err != nil && h.app != "" {
+		subscriber, err = h.controller.Subscribe(streamKey)
+	}
+	if err != nil {
+		return err
+	}
+	// go-rtmp 는 OnPlay 가 돌아온 뒤에 NetStream.Play.Start 를 보내므로 run 은 다음 Read 까지 기다린다.
+	h.player = newRTMPPlayer(h.conn, ctx.StreamID, subscriber)
+	go h.player.run()
 	return nil
 }
 
 func (h *RTMPSession) OnFCPublish(timestamp uint32, cmd *message.NetStreamFCPublish) error {
-	h.once.Do(func() {
-		h.streamKey = cmd.StreamName
-		h.stream = hubs.NewStream()
-		h.hub.AddStream(h.streamKey, h.stream)
-	})
-
 	log.Logger.Debug("OnFCPublish", zap.Any("cmd", cmd))
 	return nil
 }
@@ -103,6 +205,27 @@ func (h *RTMPSession) OnFCUnpublish(timestamp uint32, cmd *message.NetStreamFCUn
 	return nil
 }
 
+// RTMPStreamID 는 app 과 스트림 키로 hub 의 스트림 ID 를 만든다.
+func RTMPStreamID(app, streamKey string) string {
+	if app == "" {
+		return streamKey
+	}
+	return app + "/" + streamKey
+}
+
+// parseStreamName 은 "streamKey?token=abc" 를 스트림 키와 쿼리로 나눈다.
+func parseStreamName(name string) (string, url.Values, error) {
+	streamKey, rawQuery, _ := strings.Cut(name, "?")
+	if streamKey == "" {
+		return "", nil, errRTMPEmptyStreamKey
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid rtmp stream name query: %w", err)
+	}
+	return streamKey, query, nil
+}
+
 func (h *RTMPSession) OnSetDataFrame(timestamp uint32, data *message.NetStreamSetDataFrame) error {
 	r := bytes.NewReader(data.Payload)
 
@@ -118,29 +241,21 @@ func (h *RTMPSession) OnSetDataFrame(timestamp uint32, data *message.NetStreamSe
 			fmt.Printf("key:%v, value:%v, type:%T\n", key, v, v)
 			switch key {
 			case "videocodecid":
-				fv := v.(float64)
-				value := flvtag.CodecID(fv)
-				if value != flvtag.CodecIDAVC {
-					return fmt.Errorf("unsupported video codec: %v", v)
-				}
-				typ, err := factory.NewBase(pion.MimeTypeH264)
+				mimeType, err := videoMimeType(v)
 				if err != nil {
 					return err
 				}
-				h.videoSource = hubs.NewHubSource(typ, "")
-				h.stream.AddSource(h.videoSource)
-			case "audiocodecid":
-				fv := v.(float64)
-				value := flvtag.SoundFormat(fv)
-				if value != flvtag.SoundFormatAAC {
-					return fmt.Errorf("unsupported audio codec: %v", v)
+				if err := h.setVideoSource(mimeType); err != nil {
+					return err
 				}
-				base, err := factory.NewBase("audio/aac")
+			case "audiocodecid":
+				mimeType, err := audioMimeType(v)
 				if err != nil {
 					return err
 				}
-				h.audioSource = hubs.NewHubSource(base, "")
-				h.stream.AddSource(h.audioSource)
+				if err := h.setAudioSource(mimeType); err != nil {
+					return err
+				}
 			}
 		}
 	}
@@ -150,89 +265,285 @@ func (h *RTMPSession) OnSetDataFrame(timestamp uint32, data *message.NetStreamSe
 	return nil
 }
 
+// setVideoSource 는 mimeType 의 비디오 소스를 만든다. onMetaData 가 없거나 실제 태그의 코덱과 다르면 태그를 받을 때 다시 만든다.
+func (h *RTMPSession) setVideoSource(mimeType string) error {
+	source, err := h.newSource(h.videoSource, mimeType)
+	if err != nil {
+		return err
+	}
+	h.videoSource = source
+	return nil
+}
+
+func (h *RTMPSession) setAudioSource(mimeType string) error {
+	source, err := h.newSource(h.audioSource, mimeType)
+	if err != nil {
+		return err
+	}
+	h.audioSource = source
+	return nil
+}
+
+func (h *RTMPSession) newSource(prev *hubs.HubSource, mimeType string) (*hubs.HubSource, error) {
+	if prev != nil && prev.CodecType() == types.CodecTypeFromMimeType(mimeType) {
+		return prev, nil
+	}
+	base, err := factory.NewBase(mimeType)
+	if err != nil {
+		return nil, err
+	}
+	if prev != nil {
+		h.stream.RemoveSource(prev)
+		prev.Close()
+	}
+	source := hubs.NewHubSource(base, "")
+	h.stream.AddSource(source)
+	return source, nil
+}
+
 func (h *RTMPSession) OnAudio(timestamp uint32, payload io.Reader) error {
+	body, err := io.ReadAll(payload)
+	if err != nil {
+		return err
+	}
+	if isExAudioTag(body) {
+		return h.onExAudio(timestamp, body)
+	}
+
 	var audio flvtag.AudioData
-	if err := flvtag.DecodeAudioData(payload, &audio); err != nil {
+	if err := flvtag.DecodeAudioData(bytes.NewReader(body), &audio); err != nil {
 		return err
 	}
 	data, err := io.ReadAll(audio.Data)
 	if err != nil {
 		return err
 	}
+	if audio.SoundFormat != flvtag.SoundFormatAAC {
+		return fmt.Errorf("unsupported audio codec: %v", audio.SoundFormat)
+	}
+	// 비디오와 같이 onMetaData 가 없으면 태그를 받을 때 소스를 만든다.
+	if err := h.setAudioSource("audio/aac"); err != nil {
+		return err
+	}
 	switch audio.AACPacketType {
 	case flvtag.AACPacketTypeSequenceHeader:
 		fmt.Printf("audio:%+v\n", audio)
 		fmt.Printf("data:%X\n", data)
 
-		if audio.SoundFormat != flvtag.SoundFormatAAC {
-			return fmt.Errorf("unsupported audio codec: %v", audio.SoundFormat)
-		}
+		return h.setAACCodec(data)
+	case flvtag.AACPacketTypeRaw:
+		h.writeAudio(timestamp, data)
+	}
+	return nil
+}
 
-		config := format.AACConfig{}
-		if err := config.ParseAACAudioSpecificConfig(data); err != nil {
-			return err
+func (h *RTMPSession) onExAudio(timestamp uint32, body []byte) error {
+	tag, err := parseExAudioTag(body)
+	if err != nil {
+		return err
+	}
+	mimeType, err := fourCCAudioMimeType(tag.fourCC)
+	if err != nil {
+		return err
+	}
+	if err := h.setAudioSource(mimeType); err != nil {
+		return err
+	}
+
+	switch tag.packetType {
+	case exAudioPacketTypeSequenceStart:
+		if tag.fourCC == fourCCAAC {
+			return h.setAACCodec(tag.data)
 		}
-		codec := aac.NewAAC(aac.NewConfig(aac.Parameters{
-			SampleRate:   config.SamplingRate,
-			Channels:     config.Channel,
-			SampleFormat: int(avutil.AV_SAMPLE_FMT_FLTP),
-		}))
-		h.audioSource.SetCodec(codec)
-	case flvtag.AACPacketTypeRaw:
-		duration := timestamp - h.prevAudioTS
-		h.prevAudioTS = timestamp
-		h.audioSource.Write(units.Unit{
-			Payload:  data,
-			PTS:      int64(timestamp),
-			DTS:      int64(timestamp),
-			Duration: int64(duration),
-			TimeBase: 1000,
-			Marker:   true,
-		})
+		// https://datatracker.ietf.org/doc/html/rfc7845#section-5.1 (OpusHead)
+		channels := 2
+		if len(tag.data) >= 10 && string(tag.data[:8]) == "OpusHead" {
+			channels = int(tag.data[9])
+		}
+		h.audioSource.SetCodec(opus.NewOpus(opus.NewConfig(opus.Parameters{
+			Channels:     channels,
+			SampleRate:   48000,
+			SampleFormat: int(avutil.AV_SAMPLE_FMT_FLT),
+		})))
+	case exAudioPacketTypeCodedFrames:
+		h.writeAudio(timestamp, tag.data)
+	default:
+	}
+	return nil
+}
+
+func (h *RTMPSession) setAACCodec(data []byte) error {
+	config := format.AACConfig{}
+	if err := config.ParseAACAudioSpecificConfig(data); err != nil {
+		return err
 	}
+	codec := aac.NewAAC(aac.NewConfig(aac.Parameters{
+		SampleRate:   config.SamplingRate,
+		Channels:     config.Channel,
+		SampleFormat: int(avutil.AV_SAMPLE_FMT_FLTP),
+	}))
+	h.audioSource.SetCodec(codec)
 	return nil
 }
 
+func (h *RTMPSession) writeAudio(timestamp uint32, data []byte) {
+	duration := timestamp - h.prevAudioTS
+	h.prevAudioTS = timestamp
+	h.audioSource.Write(units.Unit{
+		Payload:  data,
+		PTS:      int64(timestamp),
+		DTS:      int64(timestamp),
+		Duration: int64(duration),
+		TimeBase: 1000,
+		Marker:   true,
+	})
+}
+
 func (h *RTMPSession) OnVideo(timestamp uint32, payload io.Reader) error {
+	body, err := io.ReadAll(payload)
+	if err != nil {
+		return err
+	}
+	if isExVideoTag(body) {
+		return h.onExVideo(timestamp, body)
+	}
+
 	var video flvtag.VideoData
-	if err := flvtag.DecodeVideoData(payload, &video); err != nil {
+	if err := flvtag.DecodeVideoData(bytes.NewReader(body), &video); err != nil {
+		return err
+	}
+	if video.CodecID != flvtag.CodecIDAVC {
+		return fmt.Errorf("unsupported video codec: %v", video.CodecID)
+	}
+	if err := h.setVideoSource(pion.MimeTypeH264); err != nil {
 		return err
 	}
 
-	body, err := io.ReadAll(video.Data)
+	data, err := io.ReadAll(video.Data)
 	if err != nil {
 		return err
 	}
 	switch video.AVCPacketType {
 	case flvtag.AVCPacketTypeSequenceHeader:
-		if video.CodecID != flvtag.CodecIDAVC {
-			return fmt.Errorf("unsupported video codec: %v", video.CodecID)
-		}
-
-		if err := h.h264Config.UnmarshalFromExtraData(body); err != nil {
+		if err := h.h264Config.UnmarshalFromExtraData(data); err != nil {
 			return err
 		}
 		h.videoSource.SetCodec(h264.NewH264(&h.h264Config))
 	case flvtag.AVCPacketTypeNALU:
-		duration := timestamp - h.prevVideoTS
-		h.prevVideoTS = timestamp
-
-		for _, au := range format.GetAUFromAVC(body) {
-			h.videoSource.Write(units.Unit{
-				Payload:  au,
-				PTS:      int64(timestamp),
-				DTS:      int64(timestamp),
-				Duration: int64(duration),
-				TimeBase: 1000,
-				Marker:   true,
-			})
-		}
+		h.writeVideo(timestamp, 0, format.GetAUFromAVC(data), 0)
 	case flvtag.AVCPacketTypeEOS:
 
 	}
 	return nil
 }
 
+func (h *RTMPSession) onExVideo(timestamp uint32, body []byte) error {
+	tag, err := parseExVideoTag(body)
+	if err != nil {
+		return err
+	}
+	mimeType, err := fourCCVideoMimeType(tag.fourCC)
+	if err != nil {
+		return err
+	}
+	if err := h.setVideoSource(mimeType); err != nil {
+		return err
+	}
+
+	switch tag.packetType {
+	case exVideoPacketTypeSequenceStart:
+		return h.setExVideoCodec(tag)
+	case exVideoPacketTypeCodedFrames, exVideoPacketTypeCodedFramesX:
+		flag := 0
+		if tag.frameType == exVideoFrameTypeKey {
+			flag = 1
+		}
+		switch tag.fourCC {
+		case fourCCHEVC:
+			h.writeVideo(timestamp, tag.compositionTime, (&h265.BitStreamHVCC{}).Filter(tag.data), flag)
+		case fourCCAV1:
+			obus := (&av1.OBUBitStreamFilter{}).Filter(tag.data)
+			// 키 프레임에 sequence header 가 없으면 SequenceStart 의 것을 앞에 넣는다. 시청자가 중간에 들어와도 디코딩할 수 있다.
+			if flag == 1 && len(h.av1SequenceHeader) > 0 && !hasAV1SequenceHeader(obus) {
+				obus = append([][]byte{h.av1SequenceHeader}, obus...)
+			}
+			h.writeVideo(timestamp, 0, obus, flag)
+		case fourCCVP9:
+			// vpcC 에는 해상도가 없으므로 키 프레임의 헤더로 코덱을 정한다.
+			if flag == 1 {
+				config := vp9.NewConfig()
+				if err := config.Unmarshal(tag.data); err == nil {
+					codec := vp9.NewVP9(config)
+					if h.vp9Codec == nil || !codec.Equals(h.vp9Codec) {
+						h.vp9Codec = codec
+						h.videoSource.SetCodec(codec)
+					}
+				}
+			}
+			h.writeVideo(timestamp, 0, [][]byte{tag.data}, flag)
+		}
+	default:
+	}
+	return nil
+}
+
+func (h *RTMPSession) setExVideoCodec(tag exVideoTag) error {
+	switch tag.fourCC {
+	case fourCCHEVC:
+		// HEVCDecoderConfigurationRecord
+		config := &h265.Config{}
+		if err := config.UnmarshalFromExtraData(tag.data); err != nil {
+			return err
+		}
+		h.videoSource.SetCodec(h265.NewH265(config))
+	case fourCCAV1:
+		// AV1CodecConfigurationRecord. 4 byte 뒤에 sequence header OBU 가 온다.
+		if len(tag.data) <= 4 {
+			return errRTMPExHeaderShort
+		}
+		seqHeader := av1.ParseExtraData(tag.data)
+		config := av1.NewAV1Config()
+		if err := config.UnmarshalSequenceHeader(seqHeader); err != nil {
+			return err
+		}
+		h.av1SequenceHeader = bytes.Clone(seqHeader)
+		h.videoSource.SetCodec(av1.NewAV1(config))
+	case fourCCVP9:
+		// VPCodecConfigurationRecord 에는 해상도가 없다. 첫 키 프레임에서 코덱을 정한다.
+		h.vp9Codec = nil
+	}
+	return nil
+}
+
+func hasAV1SequenceHeader(obus [][]byte) bool {
+	for _, obu := range obus {
+		if len(obu) > 0 && obu[0]>>3&0x0f == byte(av1.OBUTypeSequenceHeader) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeVideo 는 한 프레임의 NAL unit(또는 OBU)들을 쓴다. compositionTime 은 PTS - DTS(ms) 이다.
+func (h *RTMPSession) writeVideo(timestamp uint32, compositionTime int32, aus [][]byte, flag int) {
+	duration := timestamp - h.prevVideoTS
+	h.prevVideoTS = timestamp
+
+	// H264, H265 는 NAL unit 마다 쓰고, AV1 은 OBU 들을 모아 마지막 OBU 에서 한 프레임이 된다.
+	markEach := h.videoSource.CodecType() != types.CodecTypeAV1
+	for i, au := range aus {
+		h.videoSource.Write(units.Unit{
+			Payload:   au,
+			PTS:       int64(timestamp) + int64(compositionTime),
+			DTS:       int64(timestamp),
+			Duration:  int64(duration),
+			TimeBase:  1000,
+			Marker:    markEach || i == len(aus)-1,
+			FrameInfo: units.FrameInfo{Flag: flag},
+		})
+	}
+}
+
 func (h *RTMPSession) OnUnknownMessage(timestamp uint32, msg message.Message) error {
 	fmt.Println("OnUnknownMessage")
 	return nil
@@ -249,9 +560,12 @@ func (h *RTMPSession) OnUnknownDataMessage(timestamp uint32, data *message.DataM
 }
 
 func (h *RTMPSession) OnClose() {
-	if h.streamKey == "" {
+	if h.player != nil {
+		h.player.close()
+	}
+	if h.stream == nil {
 		return
 	}
 	h.stream.Close()
-	h.hub.RemoveStream(h.streamKey)
+	h.controller.Unpublish(h, h.streamID)
 }
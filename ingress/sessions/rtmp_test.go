@@ -0,0 +1,73 @@
+package sessions
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"mediaserver-go/hubs"
+	"mediaserver-go/utils/types"
+)
+
+func TestRTMPStreamID(t *testing.T) {
+	if got := RTMPStreamID("live", "cam1"); got != "live/cam1" {
+		t.Fatalf(`RTMPStreamID("live", "cam1") = %q`, got)
+	}
+	if got := RTMPStreamID("", "cam1"); got != "cam1" {
+		t.Fatalf(`RTMPStreamID("", "cam1") = %q`, got)
+	}
+}
+
+func TestParseStreamName(t *testing.T) {
+	streamKey, query, err := parseStreamName("cam1?token=abc&user=a&user=b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if streamKey != "cam1" || query.Get("token") != "abc" || len(query["user"]) != 2 {
+		t.Fatalf("parseStreamName = %q, %v", streamKey, query)
+	}
+
+	streamKey, query, err = parseStreamName("cam1")
+	if err != nil || streamKey != "cam1" || len(query) != 0 {
+		t.Fatalf(`parseStreamName("cam1") = %q, %v, %v`, streamKey, query, err)
+	}
+
+	if _, _, err := parseStreamName("?token=abc"); !errors.Is(err, errRTMPEmptyStreamKey) {
+		t.Fatalf("error = %v, want errRTMPEmptyStreamKey", err)
+	}
+	if _, _, err := parseStreamName("cam1?token=%zz"); err == nil {
+		t.Fatal("invalid query accepted")
+	}
+}
+
+// 오래된 인코더는 onMetaData 없이 시퀀스 헤더와 프레임만 보낸다.
+func TestRTMPPublishWithoutMetadata(t *testing.T) {
+	h := &RTMPSession{stream: hubs.NewStream()}
+
+	// AAC LC, 44.1kHz, stereo AudioSpecificConfig
+	if err := h.OnAudio(0, bytes.NewReader([]byte{0xaf, 0x00, 0x12, 0x10})); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.OnAudio(23, bytes.NewReader([]byte{0xaf, 0x01, 0x21, 0x10, 0x04})); err != nil {
+		t.Fatal(err)
+	}
+	// AVC NALU 태그(키프레임, IDR 하나)
+	if err := h.OnVideo(0, bytes.NewReader([]byte{0x17, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0x65, 0x88})); err != nil {
+		t.Fatal(err)
+	}
+
+	sources := h.stream.SourcesMap()
+	audio, ok := sources[types.MediaTypeAudio]
+	if !ok || audio.CodecType() != types.CodecTypeAAC {
+		t.Fatalf("audio source = %v", audio)
+	}
+	if _, err := audio.Codec(); err != nil {
+		t.Fatalf("aac codec not set from the sequence header: %v", err)
+	}
+	if video, ok := sources[types.MediaTypeVideo]; !ok || video.CodecType() != types.CodecTypeH264 {
+		t.Fatalf("video source = %v", video)
+	}
+	if len(h.stream.Sources()) != 2 {
+		t.Fatalf("sources = %d, want 2", len(h.stream.Sources()))
+	}
+}
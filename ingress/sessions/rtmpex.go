@@ -0,0 +1,164 @@
+package sessions
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	pion "github.com/pion/webrtc/v3"
+	flvtag "github.com/yutopp/go-flv/tag"
+)
+
+/*
+Enhanced RTMP (https://github.com/veovera/enhanced-rtmp)
+
+비디오 태그의 첫 바이트의 최상위 비트(IsExHeader)가 켜져 있으면 CodecID 대신 FourCC 를 쓴다.
+
+	1 IsExHeader
+	3 FrameType
+	4 PacketType
+	32 FourCC (av01, vp09, hvc1)
+
+오디오 태그는 SoundFormat 이 9(ExHeader) 이면 SoundRate, SoundSize, SoundType 자리에 PacketType 이 오고 FourCC 가 붙는다.
+*/
+const (
+	exVideoPacketTypeSequenceStart        = 0
+	exVideoPacketTypeCodedFrames          = 1
+	exVideoPacketTypeSequenceEnd          = 2
+	exVideoPacketTypeCodedFramesX         = 3
+	exVideoPacketTypeMetadata             = 4
+	exVideoPacketTypeMPEG2TSSequenceStart = 5
+
+	exAudioPacketTypeSequenceStart = 0
+	exAudioPacketTypeCodedFrames   = 1
+	exAudioPacketTypeSequenceEnd   = 2
+
+	exVideoFrameTypeKey = 1
+
+	soundFormatExHeader = 9
+
+	fourCCAV1  = "av01"
+	fourCCVP9  = "vp09"
+	fourCCHEVC = "hvc1"
+	fourCCOpus = "Opus"
+	fourCCAAC  = "mp4a"
+)
+
+var (
+	errRTMPExHeaderShort = errors.New("enhanced rtmp header too short")
+)
+
+type exVideoTag struct {
+	frameType  int
+	packetType int
+	fourCC     string
+	// hvc1 의 CodedFrames 에만 있다. ms 단위
+	compositionTime int32
+	data            []byte
+}
+
+func isExVideoTag(body []byte) bool {
+	return len(body) > 0 && body[0]&0x80 != 0
+}
+
+func parseExVideoTag(body []byte) (exVideoTag, error) {
+	if len(body) < 5 {
+		return exVideoTag{}, errRTMPExHeaderShort
+	}
+	tag := exVideoTag{
+		frameType:  int(body[0]>>4) & 0x07,
+		packetType: int(body[0] & 0x0f),
+		fourCC:     string(body[1:5]),
+		data:       body[5:],
+	}
+	if tag.fourCC == fourCCHEVC && tag.packetType == exVideoPacketTypeCodedFrames {
+		if len(tag.data) < 3 {
+			return exVideoTag{}, errRTMPExHeaderShort
+		}
+		// SI24
+		tag.compositionTime = int32(uint32(tag.data[0])<<24|uint32(tag.data[1])<<16|uint32(tag.data[2])<<8) >> 8
+		tag.data = tag.data[3:]
+	}
+	return tag, nil
+}
+
+type exAudioTag struct {
+	packetType int
+	fourCC     string
+	data       []byte
+}
+
+func isExAudioTag(body []byte) bool {
+	return len(body) > 0 && body[0]>>4 == soundFormatExHeader
+}
+
+func parseExAudioTag(body []byte) (exAudioTag, error) {
+	if len(body) < 5 {
+		return exAudioTag{}, errRTMPExHeaderShort
+	}
+	return exAudioTag{
+		packetType: int(body[0] & 0x0f),
+		fourCC:     string(body[1:5]),
+		data:       body[5:],
+	}, nil
+}
+
+// videoMimeType 은 onMetaData 의 videocodecid 를 mime type 으로 바꾼다. Enhanced RTMP 는 FourCC 를 숫자 또는 문자열로 보낸다.
+func videoMimeType(v any) (string, error) {
+	switch codecID := v.(type) {
+	case float64:
+		if flvtag.CodecID(codecID) == flvtag.CodecIDAVC {
+			return pion.MimeTypeH264, nil
+		}
+		return fourCCVideoMimeType(fourCCFromNumber(codecID))
+	case string:
+		return fourCCVideoMimeType(codecID)
+	default:
+		return "", fmt.Errorf("unsupported video codec: %v", v)
+	}
+}
+
+func fourCCVideoMimeType(fourCC string) (string, error) {
+	switch fourCC {
+	case fourCCAV1:
+		return pion.MimeTypeAV1, nil
+	case fourCCVP9:
+		return pion.MimeTypeVP9, nil
+	case fourCCHEVC:
+		return pion.MimeTypeH265, nil
+	default:
+		return "", fmt.Errorf("unsupported video codec: %q", fourCC)
+	}
+}
+
+// audioMimeType 은 onMetaData 의 audiocodecid 를 mime type 으로 바꾼다.
+func audioMimeType(v any) (string, error) {
+	switch codecID := v.(type) {
+	case float64:
+		if flvtag.SoundFormat(codecID) == flvtag.SoundFormatAAC {
+			return "audio/aac", nil
+		}
+		return fourCCAudioMimeType(fourCCFromNumber(codecID))
+	case string:
+		return fourCCAudioMimeType(codecID)
+	default:
+		return "", fmt.Errorf("unsupported audio codec: %v", v)
+	}
+}
+
+func fourCCAudioMimeType(fourCC string) (string, error) {
+	switch fourCC {
+	case fourCCOpus:
+		return pion.MimeTypeOpus, nil
+	case fourCCAAC:
+		return "audio/aac", nil
+	default:
+		return "", fmt.Errorf("unsupported audio codec: %q", fourCC)
+	}
+}
+
+func fourCCFromNumber(v float64) string {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(v))
+	return string(b)
+}
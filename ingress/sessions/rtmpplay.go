@@ -0,0 +1,119 @@
+package sessions
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+
+	goflv "github.com/yutopp/go-flv"
+	flvtag "github.com/yutopp/go-flv/tag"
+	"github.com/yutopp/go-rtmp"
+	"github.com/yutopp/go-rtmp/message"
+	"go.uber.org/zap"
+
+	"mediaserver-go/utils/log"
+)
+
+const (
+	flvTagHeaderLength    = 11
+	flvPreviousTagSizeLen = 4
+
+	// go-rtmp 예제와 같은 chunk stream ID 를 쓴다.
+	rtmpAudioChunkStreamID = 5
+	rtmpVideoChunkStreamID = 6
+)
+
+var (
+	errFLVTagShort = errors.New("flv tag too short")
+)
+
+// rtmpPlayer 는 FLV egress 의 구독자가 보내는 FLV 태그를 RTMP 오디오/비디오 메시지로 보낸다.
+// 새 플레이어는 FLV egress 의 GOP 캐시부터 받는다.
+type rtmpPlayer struct {
+	conn       *rtmp.Conn
+	streamID   uint32
+	subscriber RTMPSubscriber
+
+	started   chan struct{}
+	startOnce sync.Once
+}
+
+func newRTMPPlayer(conn *rtmp.Conn, streamID uint32, subscriber RTMPSubscriber) *rtmpPlayer {
+	return &rtmpPlayer{
+		conn:       conn,
+		streamID:   streamID,
+		subscriber: subscriber,
+		started:    make(chan struct{}),
+	}
+}
+
+// start 는 NetStream.Play.Start 가 나간 뒤에 호출되어 run 이 미디어를 보내게 한다.
+func (p *rtmpPlayer) start() {
+	p.startOnce.Do(func() { close(p.started) })
+}
+
+// run 은 스트림이 끝나거나 플레이어가 느려서 구독이 끊기면 연결을 닫는다.
+func (p *rtmpPlayer) run() {
+	defer p.conn.Close()
+
+	<-p.started
+	for b := range p.subscriber.Data() {
+		if err := p.write(b); err != nil {
+			log.Logger.Info("rtmp player write failed", zap.Error(err))
+			return
+		}
+	}
+}
+
+func (p *rtmpPlayer) close() {
+	p.start()
+	p.subscriber.Close()
+}
+
+// write 는 FLV 바이트를 태그 단위로 나눠서 보낸다. 첫 데이터에는 FLV 헤더와 PreviousTagSize0 이 있다.
+func (p *rtmpPlayer) write(b []byte) error {
+	if bytes.HasPrefix(b, []byte("FLV")) {
+		offset := int(goflv.HeaderLength) + flvPreviousTagSizeLen
+		if len(b) < offset {
+			return errFLVTagShort
+		}
+		b = b[offset:]
+	}
+
+	for len(b) > 0 {
+		if len(b) < flvTagHeaderLength {
+			return errFLVTagShort
+		}
+		tagType := flvtag.TagType(b[0])
+		size := int(b[1])<<16 | int(b[2])<<8 | int(b[3])
+		// 하위 24비트 뒤에 상위 8비트(TimestampExtended)가 온다.
+		timestamp := uint32(b[7])<<24 | uint32(b[4])<<16 | uint32(b[5])<<8 | uint32(b[6])
+		end := flvTagHeaderLength + size
+		if len(b) < end+flvPreviousTagSizeLen {
+			return errFLVTagShort
+		}
+		data := b[flvTagHeaderLength:end]
+		b = b[end+flvPreviousTagSizeLen:]
+
+		var (
+			chunkStreamID int
+			msg           message.Message
+		)
+		switch tagType {
+		case flvtag.TagTypeAudio:
+			chunkStreamID, msg = rtmpAudioChunkStreamID, &message.AudioMessage{Payload: bytes.NewReader(data)}
+		case flvtag.TagTypeVideo:
+			chunkStreamID, msg = rtmpVideoChunkStreamID, &message.VideoMessage{Payload: bytes.NewReader(data)}
+		default:
+			continue
+		}
+		if err := p.conn.Write(context.Background(), chunkStreamID, timestamp, &rtmp.ChunkMessage{
+			StreamID: p.streamID,
+			Message:  msg,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -2,79 +2,319 @@ package sessions
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/bluenviron/mediacommon/pkg/codecs/mpeg4audio"
+	"github.com/pion/rtcp"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+
 	"mediaserver-go/codecs"
+	"mediaserver-go/codecs/aac"
 	"mediaserver-go/codecs/factory"
+	"mediaserver-go/codecs/h264"
 	"mediaserver-go/hubs"
 	"mediaserver-go/ingress/sessions/rtpinbounder"
+	"mediaserver-go/thirdparty/ffmpeg/avutil"
+	"mediaserver-go/utils/log"
 	"mediaserver-go/utils/types"
-	"net"
 )
 
-type RTPSession struct {
-	conn      *net.UDPConn
-	stream    *hubs.Stream
-	pt        uint8
+var (
+	errRTPNoTracks       = errors.New("no rtp tracks")
+	errRTPAACNoConfig    = errors.New("aac rtp requires fmtp config")
+	errRTPAllTracksBye   = errors.New("rtcp bye received on all tracks")
+	errRTPInvalidSprop   = errors.New("invalid sprop-parameter-sets")
+	errRTPInvalidAACMode = errors.New("unsupported aac rtp mode")
+)
+
+type RTPTrackConfig struct {
+	MimeType    string
+	PayloadType uint8
+	// 0 이면 코덱의 기본값(비디오 90000, Opus 48000)을 쓴다.
+	ClockRate int
+	Channels  int
+	// SDP a=fmtp 의 파라미터. 키는 소문자이다.
+	Fmtp map[string]string
+
+	// bind 할 주소. 멀티캐스트 주소이면 그룹에 가입한다.
+	Addr string
+	Port int
+	// 0 이면 RTCP 를 받지 않고, PTS 는 첫 패킷을 0 으로 한다.
+	RTCPPort int
+	// RTP 와 같은 포트로 RTCP 를 받는다. (RFC 5761)
+	RTCPMux bool
+}
+
+// rtpTrack 은 SDP 의 m-line 하나이다.
+type rtpTrack struct {
+	config    RTPTrackConfig
 	hubSource *hubs.HubSource
-	timebase  int
+	parser    codecs.RTPParser
+	rtpConn   *net.UDPConn
+	rtcpConn  *net.UDPConn
 
-	codecType codecs.Base
+	stats *rtpinbounder.Stats
+	clock *rtpinbounder.Clock
+	// 트랙마다 한 번만 센다.
+	bye atomic.Bool
 }
 
-func NewRTPSession(ip string, port int, pt uint8, mimeType string, stream *hubs.Stream) (RTPSession, error) {
-	addr := net.UDPAddr{
-		IP:   net.ParseIP(ip),
-		Port: port,
+// RTPSession 은 트랙들을 하나의 hubs.Stream 에 넣는다. RTCP SR 이 있으면 트랙들의 PTS 를 같은 기준 시각으로 맞춘다.
+type RTPSession struct {
+	stream *hubs.Stream
+	tracks []*rtpTrack
+
+	byeCount atomic.Int32
+}
+
+func NewRTPSession(configs []RTPTrackConfig, stream *hubs.Stream) (*RTPSession, error) {
+	if len(configs) == 0 {
+		return nil, errRTPNoTracks
 	}
-	conn, err := net.ListenUDP("udp", &addr)
-	if err != nil {
-		return RTPSession{}, err
+
+	s := &RTPSession{
+		stream: stream,
 	}
+	syncGroup := rtpinbounder.NewSyncGroup()
+	for _, config := range configs {
+		track, err := newRTPTrack(config, syncGroup)
+		if err != nil {
+			s.close()
+			return nil, err
+		}
+		s.tracks = append(s.tracks, track)
+	}
+	for _, track := range s.tracks {
+		stream.AddSource(track.hubSource)
+	}
+	return s, nil
+}
 
-	base, err := factory.NewBase(mimeType)
+func newRTPTrack(config RTPTrackConfig, syncGroup *rtpinbounder.SyncGroup) (*rtpTrack, error) {
+	base, err := factory.NewBase(config.MimeType)
 	if err != nil {
-		return RTPSession{}, err
+		return nil, fmt.Errorf("%w: %s", err, config.MimeType)
+	}
+	if config.ClockRate == 0 {
+		switch types.CodecTypeFromMimeType(config.MimeType) {
+		case types.CodecTypeH264, types.CodecTypeVP8, types.CodecTypeAV1:
+			config.ClockRate = 90000
+		case types.CodecTypeOpus:
+			config.ClockRate = 48000
+		default:
+			return nil, fmt.Errorf("unsupported codec type: %v", config.MimeType)
+		}
 	}
 
 	hubSource := hubs.NewHubSource(base, "")
-	timebase := 0
+	parser, err := base.RTPParser(func(codec codecs.Codec) {
+		hubSource.SetCodec(codec)
+	})
+	if err != nil {
+		return nil, err
+	}
+	track := &rtpTrack{
+		config:    config,
+		hubSource: hubSource,
+		parser:    parser,
+		stats:     rtpinbounder.NewStats(uint32(config.ClockRate), 0),
+	}
+	if err := track.setCodecFromFmtp(); err != nil {
+		return nil, err
+	}
 
-	switch types.CodecTypeFromMimeType(mimeType) {
+	if track.rtpConn, err = listenRTPUDP(config.Addr, config.Port); err != nil {
+		return nil, err
+	}
+	if config.RTCPPort > 0 {
+		track.clock = rtpinbounder.NewClock(syncGroup, config.ClockRate)
+		if !config.RTCPMux {
+			if track.rtcpConn, err = listenRTPUDP(config.Addr, config.RTCPPort); err != nil {
+				track.rtpConn.Close()
+				return nil, err
+			}
+		}
+	}
+	return track, nil
+}
+
+// setCodecFromFmtp 는 첫 키프레임을 기다리지 않도록 SDP 의 fmtp 로 코덱을 먼저 정한다.
+func (t *rtpTrack) setCodecFromFmtp() error {
+	switch types.CodecTypeFromMimeType(t.config.MimeType) {
 	case types.CodecTypeH264:
-		timebase = 90000
-	case types.CodecTypeVP8:
-		timebase = 90000
-	case types.CodecTypeOpus:
-		timebase = 48000
+		sprop, ok := t.config.Fmtp["sprop-parameter-sets"]
+		if !ok {
+			return nil
+		}
+		var sps, pps []byte
+		for _, set := range strings.Split(sprop, ",") {
+			nalu, err := base64.StdEncoding.DecodeString(set)
+			if err != nil || len(nalu) == 0 {
+				return fmt.Errorf("%w: %s", errRTPInvalidSprop, sprop)
+			}
+			switch nalu[0] & 0x1f {
+			case 7:
+				sps = nalu
+			case 8:
+				pps = nalu
+			}
+		}
+		if sps == nil || pps == nil {
+			return fmt.Errorf("%w: %s", errRTPInvalidSprop, sprop)
+		}
+		config := &h264.Config{}
+		if err := config.UnmarshalFromSPSPPS(sps, pps); err != nil {
+			return err
+		}
+		if parser, ok := t.parser.(interface{ SetParameterSets(sps, pps []byte) }); ok {
+			parser.SetParameterSets(sps, pps)
+		}
+		t.hubSource.SetCodec(h264.NewH264(config))
+	case types.CodecTypeAAC:
+		// https://datatracker.ietf.org/doc/html/rfc3640#section-3.3.6 (AAC-hbr)
+		if mode, ok := t.config.Fmtp["mode"]; ok && !strings.EqualFold(mode, "AAC-hbr") {
+			return fmt.Errorf("%w: %s", errRTPInvalidAACMode, mode)
+		}
+		b, err := hex.DecodeString(t.config.Fmtp["config"])
+		if err != nil || len(b) == 0 {
+			return errRTPAACNoConfig
+		}
+		var asc mpeg4audio.Config
+		if err := asc.Unmarshal(b); err != nil {
+			return err
+		}
+		if parser, ok := t.parser.(*aac.RTPParser); ok {
+			parser.SetAUHeaderLengths(
+				fmtpInt(t.config.Fmtp, "sizelength", 13),
+				fmtpInt(t.config.Fmtp, "indexlength", 3),
+				fmtpInt(t.config.Fmtp, "indexdeltalength", 3),
+			)
+		}
+		t.hubSource.SetCodec(aac.NewAAC(aac.NewConfig(aac.Parameters{
+			SampleRate:   asc.SampleRate,
+			Channels:     asc.ChannelCount,
+			SampleFormat: int(avutil.AV_SAMPLE_FMT_FLTP),
+		})))
 	default:
-		return RTPSession{}, fmt.Errorf("unsupported codec type: %v", mimeType)
 	}
+	return nil
+}
 
-	stream.AddSource(hubSource)
+func fmtpInt(fmtp map[string]string, key string, defaultValue int) int {
+	v, err := strconv.Atoi(fmtp[key])
+	if err != nil {
+		return defaultValue
+	}
+	return v
+}
 
-	return RTPSession{
-		pt:        pt,
-		conn:      conn,
-		stream:    stream,
-		hubSource: hubSource,
-		timebase:  timebase,
+func listenRTPUDP(addr string, port int) (*net.UDPConn, error) {
+	ip := net.ParseIP(addr)
+	if ip != nil && ip.IsMulticast() {
+		return net.ListenMulticastUDP("udp", nil, &net.UDPAddr{IP: ip, Port: port})
+	}
+	return net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: port})
+}
 
-		codecType: base,
-	}, nil
+func (r *RTPSession) close() {
+	for _, track := range r.tracks {
+		track.rtpConn.Close()
+		if track.rtcpConn != nil {
+			track.rtcpConn.Close()
+		}
+	}
 }
 
+// Run 은 ctx 가 끝나거나 모든 트랙에서 RTCP BYE 를 받을 때까지 트랙들을 받는다.
 func (r *RTPSession) Run(ctx context.Context) error {
-	parser, err := r.codecType.RTPParser(func(codec codecs.Codec) {
-		r.hubSource.SetCodec(codec)
+	defer r.stream.Close()
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		<-gctx.Done()
+		r.close()
+		return nil
 	})
-	if err != nil {
-		return err
+	for _, track := range r.tracks {
+		g.Go(func() error {
+			return r.readRTP(gctx, track)
+		})
+		if track.rtcpConn != nil {
+			g.Go(func() error {
+				buf := make([]byte, types.ReadBufferSize)
+				for {
+					n, _, err := track.rtcpConn.ReadFromUDP(buf)
+					if err != nil {
+						return err
+					}
+					if err := r.handleRTCP(track, buf[:n]); err != nil {
+						return err
+					}
+				}
+			})
+		}
+	}
+
+	err := g.Wait()
+	if errors.Is(err, errRTPAllTracksBye) || ctx.Err() != nil {
+		return nil
 	}
+	return err
+}
 
-	inbounder := rtpinbounder.NewInbounder(parser, r.timebase, func(bytes []byte) (int, error) {
-		n, _, err := r.conn.ReadFromUDP(bytes)
-		return n, err
+func (r *RTPSession) readRTP(ctx context.Context, track *rtpTrack) error {
+	inbounder := rtpinbounder.NewInbounder(track.parser, track.config.ClockRate, func(buf []byte) (int, error) {
+		for {
+			n, _, err := track.rtpConn.ReadFromUDP(buf)
+			if err != nil {
+				return n, err
+			}
+			// rtcp-mux 이면 두 번째 바이트(RTCP packet type)가 192~223 인 것이 RTCP 이다. (RFC 5761 4)
+			if track.config.RTCPMux && n >= 2 && buf[1] >= 192 && buf[1] <= 223 {
+				if err := r.handleRTCP(track, buf[:n]); err != nil {
+					return 0, err
+				}
+				continue
+			}
+			return n, nil
+		}
 	})
-	stats := rtpinbounder.Stats{}
-	return inbounder.Run(ctx, r.hubSource, &stats)
+	if track.clock != nil {
+		inbounder.SetTimestamper(track.clock)
+	}
+	if track.hubSource.CodecType() == types.CodecTypeAAC {
+		inbounder.SetSamplesPerPayload(mpeg4audio.SamplesPerAccessUnit)
+	}
+	return inbounder.Run(ctx, track.hubSource, track.stats)
+}
+
+func (r *RTPSession) handleRTCP(track *rtpTrack, b []byte) error {
+	packets, err := rtcp.Unmarshal(b)
+	if err != nil {
+		log.Logger.Warn("rtcp failed to unmarshal", zap.Error(err))
+		return nil
+	}
+	for _, packet := range packets {
+		switch p := packet.(type) {
+		case *rtcp.SenderReport:
+			track.stats.UpdateSR(p)
+			if track.clock != nil {
+				track.clock.UpdateSR(p)
+			}
+		case *rtcp.Goodbye:
+			if track.bye.CompareAndSwap(false, true) && int(r.byeCount.Add(1)) == len(r.tracks) {
+				return errRTPAllTracksBye
+			}
+		default:
+		}
+	}
+	return nil
 }
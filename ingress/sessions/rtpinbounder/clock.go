@@ -0,0 +1,106 @@
+package rtpinbounder
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+
+	"mediaserver-go/utils/ntp"
+)
+
+const (
+	// 첫 SR 을 이 시간 동안 기다리고, 오지 않으면 패킷이 도착한 시각을 기준으로 삼는다.
+	srWaitTimeout = time.Second
+	// 트랙마다 기준 시각이 조금씩 다르므로 먼저 잡힌 트랙보다 앞선 트랙도 PTS 가 음수가 되지 않도록 여유를 둔다.
+	syncMargin = 500 * time.Millisecond
+)
+
+// Timestamper 는 RTP timestamp 를 PTS 로 바꾼다. ok 가 false 이면 아직 PTS 를 정할 수 없으므로 버린다.
+type Timestamper interface {
+	Timestamp(rtpTS uint32) (pts int64, ok bool)
+}
+
+// SyncGroup 은 한 세션의 트랙들이 같은 기준 시각(SR 의 NTP)으로 PTS 를 만들게 해서 A/V 싱크를 맞춘다.
+type SyncGroup struct {
+	mu   sync.Mutex
+	base time.Time
+}
+
+func NewSyncGroup() *SyncGroup {
+	return &SyncGroup{}
+}
+
+// offset 은 기준 시각부터 anchor 까지의 시간이다. 처음 호출된 anchor 로 기준 시각을 정한다.
+func (g *SyncGroup) offset(anchor time.Time) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.base.IsZero() {
+		g.base = anchor.Add(-syncMargin)
+	}
+	return anchor.Sub(g.base)
+}
+
+// Clock 은 트랙 하나의 RTP timestamp 를 SyncGroup 기준의 PTS 로 바꾼다. 첫 SR 의 (NTP, RTP) 를 기준점으로 삼는다.
+type Clock struct {
+	mu sync.Mutex
+
+	group     *SyncGroup
+	clockRate int
+
+	anchored  bool
+	anchorPTS int64
+	// 기준점 이후로 wrap-around 를 풀어낸 timestamp
+	lastTS  uint32
+	lastExt int64
+
+	firstArrival time.Time
+	firstTS      uint32
+}
+
+func NewClock(group *SyncGroup, clockRate int) *Clock {
+	return &Clock{
+		group:     group,
+		clockRate: clockRate,
+	}
+}
+
+func (c *Clock) UpdateSR(sr *rtcp.SenderReport) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.anchored {
+		return
+	}
+	c.anchor(ntp.NTPTime(sr.NTPTime).Time(), sr.RTPTime)
+}
+
+func (c *Clock) anchor(t time.Time, rtpTS uint32) {
+	c.anchored = true
+	c.anchorPTS = int64(c.group.offset(t)) * int64(c.clockRate) / int64(time.Second)
+	c.lastTS = rtpTS
+	c.lastExt = 0
+}
+
+func (c *Clock) Timestamp(rtpTS uint32) (int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.anchored {
+		if c.firstArrival.IsZero() {
+			c.firstArrival = time.Now()
+			c.firstTS = rtpTS
+		}
+		if time.Since(c.firstArrival) < srWaitTimeout {
+			return 0, false
+		}
+		c.anchor(c.firstArrival, c.firstTS)
+	}
+
+	c.lastExt += int64(int32(rtpTS - c.lastTS))
+	c.lastTS = rtpTS
+	pts := c.anchorPTS + c.lastExt
+	if pts < 0 {
+		return 0, false
+	}
+	return pts, true
+}
@@ -22,6 +22,10 @@ type Inbounder struct {
 	ReadFunc func([]byte) (int, error)
 	timebase int
 	parser   codecs.RTPParser
+
+	timestamper Timestamper
+	// 패킷 하나에 여러 프레임이 올 때(AAC 등) 프레임마다 더할 샘플 수
+	samplesPerPayload int
 }
 
 func NewInbounder(parser codecs.RTPParser, timebase int, readFunc func([]byte) (int, error)) *Inbounder {
@@ -32,6 +36,16 @@ func NewInbounder(parser codecs.RTPParser, timebase int, readFunc func([]byte) (
 	}
 }
 
+// SetTimestamper 는 PTS 를 첫 패킷 기준이 아닌 timestamper 로 만들게 한다.
+func (i *Inbounder) SetTimestamper(timestamper Timestamper) {
+	i.timestamper = timestamper
+}
+
+// SetSamplesPerPayload 는 패킷의 n 번째 프레임의 PTS 를 pts + n*samples 로 만들게 한다.
+func (i *Inbounder) SetSamplesPerPayload(samples int) {
+	i.samplesPerPayload = samples
+}
+
 func (i *Inbounder) Run(ctx context.Context, hubTrack *hubs.HubSource, stats *Stats) error {
 	startTS := uint32(0)
 	prevTS := uint32(0)
@@ -66,7 +80,11 @@ func (i *Inbounder) Run(ctx context.Context, hubTrack *hubs.HubSource, stats *St
 		if startTS == 0 {
 			startTS = rtpPacket.Timestamp
 		}
-		pts := rtpPacket.Timestamp - startTS
+		pts := int64(rtpPacket.Timestamp - startTS)
+		ok := true
+		if i.timestamper != nil {
+			pts, ok = i.timestamper.Timestamp(rtpPacket.Timestamp)
+		}
 
 		if rtpPacket.Timestamp != prevTS {
 			if prevTS == 0 {
@@ -78,13 +96,24 @@ func (i *Inbounder) Run(ctx context.Context, hubTrack *hubs.HubSource, stats *St
 
 		stats.CalcRTPStats(rtpPacket, n)
 
+		// 파서는 패킷 사이의 상태(SPS, 조각난 프레임 등)를 가지므로 버릴 패킷도 넘긴다.
 		payloads, frameInfo := i.parser.Parse(rtpPacket)
+		if !ok {
+			prevTS = rtpPacket.Timestamp
+			continue
+		}
 		for index, payload := range payloads {
+			payloadPTS := pts
+			payloadDuration := int64(duration)
+			if i.samplesPerPayload > 0 {
+				payloadPTS += int64(index * i.samplesPerPayload)
+				payloadDuration = int64(i.samplesPerPayload)
+			}
 			hubTrack.Write(units.Unit{
 				Payload:   payload,
-				PTS:       int64(pts),
-				DTS:       int64(pts),
-				Duration:  int64(duration),
+				PTS:       payloadPTS,
+				DTS:       payloadPTS,
+				Duration:  payloadDuration,
 				TimeBase:  i.timebase,
 				Marker:    index == len(payloads)-1,
 				FrameInfo: frameInfo,
@@ -0,0 +1,126 @@
+package sessions
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+)
+
+var (
+	errRTPSDPNoMedia      = errors.New("no audio or video media in sdp")
+	errRTPSDPInvalidMedia = errors.New("invalid media in sdp")
+)
+
+// RTPTracksFromSDP 는 ffmpeg -f rtp 등이 만든 SDP 의 m-line 마다 트랙 설정을 만든다. m-line 마다 첫 번째 format 만 사용한다.
+// addr 가 비어있으면 c= 의 주소가 멀티캐스트일 때만 그 주소를 쓰고, 아니면 모든 인터페이스에서 받는다.
+func RTPTracksFromSDP(raw string, addr string) ([]RTPTrackConfig, error) {
+	var sd sdp.SessionDescription
+	if err := sd.UnmarshalString(raw); err != nil {
+		return nil, fmt.Errorf("invalid sdp: %w", err)
+	}
+
+	var configs []RTPTrackConfig
+	for _, md := range sd.MediaDescriptions {
+		if md.MediaName.Media != "video" && md.MediaName.Media != "audio" {
+			continue
+		}
+		// port 가 0 이면 쓰지 않는 m-line 이다.
+		if md.MediaName.Port.Value == 0 || len(md.MediaName.Formats) == 0 {
+			continue
+		}
+		pt, err := strconv.ParseUint(md.MediaName.Formats[0], 10, 7)
+		if err != nil {
+			return nil, fmt.Errorf("%w: payload type %s", errRTPSDPInvalidMedia, md.MediaName.Formats[0])
+		}
+
+		config := RTPTrackConfig{
+			PayloadType: uint8(pt),
+			Addr:        addr,
+			Port:        md.MediaName.Port.Value,
+			Fmtp:        make(map[string]string),
+		}
+		if config.Addr == "" {
+			config.Addr = multicastAddress(&sd, md)
+		}
+
+		rtpmap, ok := formatAttribute(md, "rtpmap", md.MediaName.Formats[0])
+		if !ok {
+			return nil, fmt.Errorf("%w: no rtpmap for payload type %d", errRTPSDPInvalidMedia, pt)
+		}
+		// <encoding name>/<clock rate>[/<channels>]
+		fields := strings.Split(rtpmap, "/")
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%w: rtpmap %s", errRTPSDPInvalidMedia, rtpmap)
+		}
+		if config.ClockRate, err = strconv.Atoi(fields[1]); err != nil || config.ClockRate <= 0 {
+			return nil, fmt.Errorf("%w: rtpmap %s", errRTPSDPInvalidMedia, rtpmap)
+		}
+		if len(fields) > 2 {
+			config.Channels, _ = strconv.Atoi(fields[2])
+		}
+		if strings.EqualFold(fields[0], "MPEG4-GENERIC") {
+			config.MimeType = "audio/aac"
+		} else {
+			config.MimeType = md.MediaName.Media + "/" + fields[0]
+		}
+
+		if fmtp, ok := formatAttribute(md, "fmtp", md.MediaName.Formats[0]); ok {
+			for _, param := range strings.Split(fmtp, ";") {
+				key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if key != "" {
+					config.Fmtp[strings.ToLower(key)] = value
+				}
+			}
+		}
+
+		// https://datatracker.ietf.org/doc/html/rfc3605, https://datatracker.ietf.org/doc/html/rfc5761
+		config.RTCPPort = config.Port + 1
+		if _, ok := md.Attribute("rtcp-mux"); ok {
+			config.RTCPMux = true
+			config.RTCPPort = config.Port
+		} else if rtcpAttr, ok := md.Attribute("rtcp"); ok {
+			port, _, _ := strings.Cut(rtcpAttr, " ")
+			if config.RTCPPort, err = strconv.Atoi(port); err != nil {
+				return nil, fmt.Errorf("%w: rtcp %s", errRTPSDPInvalidMedia, rtcpAttr)
+			}
+		}
+		configs = append(configs, config)
+	}
+	if len(configs) == 0 {
+		return nil, errRTPSDPNoMedia
+	}
+	return configs, nil
+}
+
+// formatAttribute 는 "a=<key>:<format> <value>" 의 value 를 찾는다.
+func formatAttribute(md *sdp.MediaDescription, key, format string) (string, bool) {
+	for _, attr := range md.Attributes {
+		if attr.Key != key {
+			continue
+		}
+		if value, ok := strings.CutPrefix(attr.Value, format+" "); ok {
+			return strings.TrimSpace(value), true
+		}
+	}
+	return "", false
+}
+
+// multicastAddress 는 m-line 또는 세션의 c= 주소가 멀티캐스트이면 그 주소를 돌려준다.
+func multicastAddress(sd *sdp.SessionDescription, md *sdp.MediaDescription) string {
+	connection := md.ConnectionInformation
+	if connection == nil {
+		connection = sd.ConnectionInformation
+	}
+	if connection == nil || connection.Address == nil {
+		return ""
+	}
+	ip := net.ParseIP(connection.Address.Address)
+	if ip == nil || !ip.IsMulticast() {
+		return ""
+	}
+	return ip.String()
+}
@@ -0,0 +1,26 @@
+package tsdemuxer
+
+var crc32Table = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// crc32MPEG2 는 PSI section 의 CRC_32 이다. CRC 까지 포함한 section 을 넣으면 0 이 된다.
+func crc32MPEG2(b []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, v := range b {
+		crc = crc<<8 ^ crc32Table[byte(crc>>24)^v]
+	}
+	return crc
+}
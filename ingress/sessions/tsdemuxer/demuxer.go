@@ -0,0 +1,484 @@
+package tsdemuxer
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"go.uber.org/zap"
+
+	"mediaserver-go/utils/log"
+	"mediaserver-go/utils/types"
+)
+
+const (
+	PacketSize = 188
+	syncByte   = 0x47
+
+	patPID  = 0x0000
+	nullPID = 0x1fff
+
+	tableIDPAT = 0x00
+	tableIDPMT = 0x02
+
+	// PES 하나가 이보다 크면 깨진 것으로 보고 버린다.
+	maxPESSize = 8 * 1024 * 1024
+)
+
+// ISO/IEC 13818-1 Table 2-34 stream_type
+const (
+	StreamTypeAAC         uint8 = 0x0f
+	StreamTypeH264        uint8 = 0x1b
+	StreamTypeH265        uint8 = 0x24
+	StreamTypePrivateData uint8 = 0x06
+)
+
+var (
+	errInvalidSection = errors.New("invalid psi section")
+	errInvalidPES     = errors.New("invalid pes header")
+)
+
+// Stream 은 PMT 에 있는 elementary stream 이다. CodecType 이 비어있으면 지원하지 않는 코덱이다.
+type Stream struct {
+	PID        uint16
+	StreamType uint8
+	CodecType  types.CodecType
+	// Opus 의 채널 수. extension descriptor 의 channel_config_code 이다.
+	Channels int
+}
+
+// Frame 은 PES 하나이다. PTS, DTS 는 33 bit wrap 을 풀어낸 90kHz 값이다.
+type Frame struct {
+	PTS  int64
+	DTS  int64
+	Data []byte
+}
+
+type pesBuffer struct {
+	stream Stream
+	data   []byte
+	// PES_packet_length 로 알 수 있는 전체 크기. 0 이면 다음 PES 가 시작될 때까지 모은다.
+	size   int
+	broken bool
+	cc     int
+}
+
+type sectionBuffer struct {
+	data []byte
+	cc   int
+}
+
+// Demuxer 는 MPEG-TS 를 PAT/PMT 로 elementary stream 을 찾고 PES 를 Frame 으로 모은다.
+// UDP datagram 이나 TCP 에서 읽은 임의 크기의 바이트를 Write 로 넣으면 된다.
+type Demuxer struct {
+	onStreams func(streams []Stream)
+	onFrame   func(stream Stream, frame Frame)
+
+	buf []byte
+
+	pmtPID     int
+	pmtVersion int
+	pcrPID     uint16
+	sections   map[uint16]*sectionBuffer
+	pes        map[uint16]*pesBuffer
+
+	// 33 bit PTS/DTS/PCR 를 풀기 위한 기준값(90kHz). PCR 과 마지막 타임스탬프로 갱신한다.
+	reference    int64
+	hasReference bool
+}
+
+func NewDemuxer(onStreams func(streams []Stream), onFrame func(stream Stream, frame Frame)) *Demuxer {
+	return &Demuxer{
+		onStreams:  onStreams,
+		onFrame:    onFrame,
+		pmtPID:     -1,
+		pmtVersion: -1,
+		sections:   make(map[uint16]*sectionBuffer),
+		pes:        make(map[uint16]*pesBuffer),
+	}
+}
+
+// Write 는 TS 바이트를 넣는다. 188 바이트 경계가 맞지 않으면 sync byte 를 찾아 다시 맞춘다.
+func (d *Demuxer) Write(b []byte) {
+	d.buf = append(d.buf, b...)
+	for len(d.buf) >= PacketSize {
+		if d.buf[0] != syncByte || (len(d.buf) > PacketSize && d.buf[PacketSize] != syncByte) {
+			d.buf = d.buf[1:]
+			continue
+		}
+		d.parsePacket(d.buf[:PacketSize])
+		d.buf = d.buf[PacketSize:]
+	}
+	// 남은 바이트를 앞으로 옮겨서 버퍼가 계속 커지지 않게 한다.
+	d.buf = append(d.buf[:0:0], d.buf...)
+}
+
+// Flush 는 모으고 있던 PES 를 내보낸다. 입력이 끝났을 때 호출한다.
+func (d *Demuxer) Flush() {
+	for _, p := range d.pes {
+		d.flushPES(p)
+	}
+}
+
+func (d *Demuxer) parsePacket(pkt []byte) {
+	if pkt[1]&0x80 != 0 {
+		// transport_error_indicator
+		return
+	}
+	pusi := pkt[1]&0x40 != 0
+	pid := binary.BigEndian.Uint16(pkt[1:3]) & 0x1fff
+	afc := (pkt[3] >> 4) & 0x03
+	cc := int(pkt[3] & 0x0f)
+	if pid == nullPID {
+		return
+	}
+
+	offset := 4
+	discontinuity := false
+	if afc&0x02 != 0 {
+		afl := int(pkt[4])
+		if 5+afl > PacketSize {
+			return
+		}
+		if afl > 0 {
+			flags := pkt[5]
+			discontinuity = flags&0x80 != 0
+			if flags&0x10 != 0 && afl >= 7 && pid == d.pcrPID {
+				d.updateReference(parsePCR(pkt[6:12]))
+			}
+		}
+		offset = 5 + afl
+	}
+	if afc&0x01 == 0 || offset >= PacketSize {
+		return
+	}
+	payload := pkt[offset:]
+
+	if pid == patPID || int(pid) == d.pmtPID {
+		d.parseSectionPacket(pid, payload, pusi, cc)
+		return
+	}
+	p, ok := d.pes[pid]
+	if !ok {
+		return
+	}
+	d.parsePESPacket(p, payload, pusi, cc, discontinuity)
+}
+
+// continuity 는 continuity_counter 를 확인한다. duplicate 는 같은 패킷이 다시 온 것이고, lost 는 사이의 패킷을 잃은 것이다.
+func continuity(last *int, cc int, discontinuity bool) (duplicate bool, lost bool) {
+	defer func() { *last = cc }()
+	if *last < 0 || discontinuity {
+		return false, false
+	}
+	if cc == *last {
+		return true, false
+	}
+	return false, cc != (*last+1)&0x0f
+}
+
+func (d *Demuxer) parseSectionPacket(pid uint16, payload []byte, pusi bool, cc int) {
+	s, ok := d.sections[pid]
+	if !ok {
+		s = &sectionBuffer{cc: -1}
+		d.sections[pid] = s
+	}
+	duplicate, lost := continuity(&s.cc, cc, false)
+	if duplicate {
+		return
+	}
+	if lost {
+		s.data = nil
+	}
+	if pusi {
+		pointer := int(payload[0])
+		if 1+pointer > len(payload) {
+			s.data = nil
+			return
+		}
+		s.data = append([]byte(nil), payload[1+pointer:]...)
+	} else {
+		if s.data == nil {
+			return
+		}
+		s.data = append(s.data, payload...)
+	}
+
+	if len(s.data) < 3 {
+		return
+	}
+	sectionLength := int(binary.BigEndian.Uint16(s.data[1:3]) & 0x0fff)
+	if len(s.data) < 3+sectionLength {
+		return
+	}
+	section := s.data[:3+sectionLength]
+	s.data = nil
+
+	var err error
+	switch {
+	case pid == patPID:
+		err = d.parsePAT(section)
+	case int(pid) == d.pmtPID:
+		err = d.parsePMT(section)
+	}
+	if err != nil {
+		log.Logger.Warn("mpegts section parse failed", zap.Uint16("pid", pid), zap.Error(err))
+	}
+}
+
+// checkSection 은 section 헤더와 CRC 를 확인하고 헤더(8 byte)와 CRC 를 뺀 본문을 돌려준다.
+func checkSection(section []byte, tableID uint8) ([]byte, int, error) {
+	if len(section) < 12 || section[0] != tableID {
+		return nil, 0, errInvalidSection
+	}
+	if crc32MPEG2(section) != 0 {
+		return nil, 0, errInvalidSection
+	}
+	// current_next_indicator 가 0 이면 아직 적용되지 않는 테이블이다.
+	if section[5]&0x01 == 0 {
+		return nil, 0, nil
+	}
+	version := int(section[5]>>1) & 0x1f
+	return section[8 : len(section)-4], version, nil
+}
+
+func (d *Demuxer) parsePAT(section []byte) error {
+	body, _, err := checkSection(section, tableIDPAT)
+	if err != nil || body == nil {
+		return err
+	}
+	for i := 0; i+4 <= len(body); i += 4 {
+		programNumber := binary.BigEndian.Uint16(body[i:])
+		pid := int(binary.BigEndian.Uint16(body[i+2:]) & 0x1fff)
+		if programNumber == 0 {
+			// network PID
+			continue
+		}
+		// 첫 번째 프로그램만 사용한다.
+		if pid != d.pmtPID {
+			d.pmtPID = pid
+			d.pmtVersion = -1
+		}
+		return nil
+	}
+	return nil
+}
+
+func (d *Demuxer) parsePMT(section []byte) error {
+	body, version, err := checkSection(section, tableIDPMT)
+	if err != nil || body == nil {
+		return err
+	}
+	if version == d.pmtVersion {
+		return nil
+	}
+	if len(body) < 4 {
+		return errInvalidSection
+	}
+	d.pcrPID = binary.BigEndian.Uint16(body[0:2]) & 0x1fff
+	programInfoLength := int(binary.BigEndian.Uint16(body[2:4]) & 0x0fff)
+	i := 4 + programInfoLength
+	if i > len(body) {
+		return errInvalidSection
+	}
+
+	var streams []Stream
+	for i+5 <= len(body) {
+		stream := Stream{
+			StreamType: body[i],
+			PID:        binary.BigEndian.Uint16(body[i+1:i+3]) & 0x1fff,
+		}
+		esInfoLength := int(binary.BigEndian.Uint16(body[i+3:i+5]) & 0x0fff)
+		i += 5
+		if i+esInfoLength > len(body) {
+			return errInvalidSection
+		}
+		descriptors := body[i : i+esInfoLength]
+		i += esInfoLength
+
+		switch stream.StreamType {
+		case StreamTypeH264:
+			stream.CodecType = types.CodecTypeH264
+		case StreamTypeAAC:
+			stream.CodecType = types.CodecTypeAAC
+		case StreamTypePrivateData:
+			if channels, ok := parseOpusDescriptors(descriptors); ok {
+				stream.CodecType = types.CodecTypeOpus
+				stream.Channels = channels
+			}
+		}
+		streams = append(streams, stream)
+	}
+
+	// 바뀐 PMT 로 다시 만든다. 이전 PES 는 내보낸다.
+	for pid, p := range d.pes {
+		d.flushPES(p)
+		delete(d.pes, pid)
+	}
+	for _, stream := range streams {
+		if stream.CodecType == "" {
+			continue
+		}
+		d.pes[stream.PID] = &pesBuffer{stream: stream, cc: -1}
+	}
+	d.pmtVersion = version
+	d.onStreams(streams)
+	return nil
+}
+
+// parseOpusDescriptors 는 registration descriptor("Opus")와 extension descriptor(0x80)로 Opus 인지와 채널 수를 찾는다.
+func parseOpusDescriptors(descriptors []byte) (int, bool) {
+	isOpus := false
+	channels := 2
+	for i := 0; i+2 <= len(descriptors); {
+		tag := descriptors[i]
+		length := int(descriptors[i+1])
+		if i+2+length > len(descriptors) {
+			break
+		}
+		data := descriptors[i+2 : i+2+length]
+		switch {
+		case tag == 0x05 && length >= 4 && string(data[:4]) == "Opus":
+			isOpus = true
+		case tag == 0x7f && length >= 2 && data[0] == 0x80:
+			// channel_config_code 0x00~0x08 은 채널 수, 0x80 은 dual mono(2 채널)이다.
+			if code := int(data[1]); code >= 1 && code <= 8 {
+				channels = code
+			}
+		}
+		i += 2 + length
+	}
+	return channels, isOpus
+}
+
+func (d *Demuxer) parsePESPacket(p *pesBuffer, payload []byte, pusi bool, cc int, discontinuity bool) {
+	duplicate, lost := continuity(&p.cc, cc, discontinuity)
+	if duplicate {
+		return
+	}
+	if lost {
+		p.broken = true
+	}
+
+	if pusi {
+		d.flushPES(p)
+		p.data = append(p.data[:0:0], payload...)
+		p.broken = false
+		p.size = 0
+		if len(payload) >= 6 {
+			if length := int(binary.BigEndian.Uint16(payload[4:6])); length > 0 {
+				p.size = 6 + length
+			}
+		}
+	} else {
+		if p.data == nil {
+			return
+		}
+		p.data = append(p.data, payload...)
+	}
+
+	if len(p.data) > maxPESSize {
+		log.Logger.Warn("mpegts pes too large, dropped", zap.Uint16("pid", p.stream.PID))
+		p.data = nil
+		return
+	}
+	if p.size > 0 && len(p.data) >= p.size {
+		d.flushPES(p)
+	}
+}
+
+func (d *Demuxer) flushPES(p *pesBuffer) {
+	data, broken := p.data, p.broken
+	p.data = nil
+	p.broken = false
+	if data == nil {
+		return
+	}
+	if broken {
+		log.Logger.Debug("mpegts pes lost packets, dropped", zap.Uint16("pid", p.stream.PID))
+		return
+	}
+	if p.size > 0 && len(data) > p.size {
+		data = data[:p.size]
+	}
+
+	frame, err := d.parsePES(data)
+	if err != nil {
+		log.Logger.Warn("mpegts pes parse failed", zap.Uint16("pid", p.stream.PID), zap.Error(err))
+		return
+	}
+	d.onFrame(p.stream, frame)
+}
+
+func (d *Demuxer) parsePES(data []byte) (Frame, error) {
+	if len(data) < 9 || data[0] != 0x00 || data[1] != 0x00 || data[2] != 0x01 {
+		return Frame{}, errInvalidPES
+	}
+	ptsDTSFlags := data[7] >> 6
+	headerLength := int(data[8])
+	if 9+headerLength > len(data) {
+		return Frame{}, errInvalidPES
+	}
+
+	var frame Frame
+	switch ptsDTSFlags {
+	case 0x02:
+		if headerLength < 5 {
+			return Frame{}, errInvalidPES
+		}
+		frame.PTS = d.unwrap(parseTimestamp(data[9:14]))
+		frame.DTS = frame.PTS
+	case 0x03:
+		if headerLength < 10 {
+			return Frame{}, errInvalidPES
+		}
+		frame.PTS = d.unwrap(parseTimestamp(data[9:14]))
+		frame.DTS = d.unwrap(parseTimestamp(data[14:19]))
+	default:
+		return Frame{}, errInvalidPES
+	}
+	d.updateReference(frame.DTS)
+	frame.Data = data[9+headerLength:]
+	return frame, nil
+}
+
+func parseTimestamp(b []byte) int64 {
+	return int64(b[0]>>1&0x07)<<30 |
+		int64(b[1])<<22 |
+		int64(b[2]>>1)<<15 |
+		int64(b[3])<<7 |
+		int64(b[4]>>1)
+}
+
+// parsePCR 은 PCR 의 90kHz base 만 읽는다.
+func parsePCR(b []byte) int64 {
+	return int64(b[0])<<25 |
+		int64(b[1])<<17 |
+		int64(b[2])<<9 |
+		int64(b[3])<<1 |
+		int64(b[4]>>7)
+}
+
+const timestampWrap = int64(1) << 33
+
+// unwrap 은 33 bit 타임스탬프를 기준값에 가장 가까운 값으로 푼다. 스트림마다 따로 풀면 한쪽만 wrap 됐을 때 싱크가 어긋나므로 PCR 을 기준으로 한다.
+// 인코더가 재시작하여 타임스탬프가 튀어도 기준값에서 2^32 이내의 값이 되므로 계속 이어진다.
+func (d *Demuxer) unwrap(ts int64) int64 {
+	if !d.hasReference {
+		return ts
+	}
+	x := d.reference - ts + timestampWrap/2
+	n := x / timestampWrap
+	if x < 0 && x%timestampWrap != 0 {
+		n--
+	}
+	return ts + n*timestampWrap
+}
+
+func (d *Demuxer) updateReference(ts int64) {
+	if !d.hasReference {
+		d.reference = ts
+		d.hasReference = true
+		return
+	}
+	d.reference = d.unwrap(ts)
+}
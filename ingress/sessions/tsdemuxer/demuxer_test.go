@@ -0,0 +1,287 @@
+package tsdemuxer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"mediaserver-go/utils/log"
+	"mediaserver-go/utils/types"
+)
+
+const (
+	testPMTPID   = 0x100
+	testVideoPID = 0x101
+	testAudioPID = 0x102
+	testOpusPID  = 0x103
+	testMP3PID   = 0x104
+)
+
+func init() {
+	if log.Logger == nil {
+		log.Logger = zap.NewNop()
+	}
+}
+
+// testSection 은 CRC 를 붙인 PSI section 을 만든다.
+func testSection(tableID uint8, tableIDExtension uint16, version int, body []byte) []byte {
+	length := 5 + len(body) + 4
+	b := []byte{
+		tableID, 0xb0 | byte(length>>8), byte(length),
+		byte(tableIDExtension >> 8), byte(tableIDExtension),
+		0xc1 | byte(version<<1), 0x00, 0x00,
+	}
+	b = append(b, body...)
+	return binary.BigEndian.AppendUint32(b, crc32MPEG2(b))
+}
+
+func testPAT() []byte {
+	return testSection(tableIDPAT, 1, 0, []byte{0x00, 0x01, 0xe0 | testPMTPID>>8, testPMTPID & 0xff})
+}
+
+func testPMT(version int) []byte {
+	es := func(streamType uint8, pid uint16, descriptors []byte) []byte {
+		b := []byte{streamType, 0xe0 | byte(pid>>8), byte(pid), 0xf0 | byte(len(descriptors)>>8), byte(len(descriptors))}
+		return append(b, descriptors...)
+	}
+	body := []byte{0xe0 | testVideoPID>>8, testVideoPID & 0xff, 0xf0, 0x00}
+	body = append(body, es(StreamTypeH264, testVideoPID, nil)...)
+	body = append(body, es(StreamTypeAAC, testAudioPID, nil)...)
+	// registration descriptor "Opus" + extension descriptor(channel_config_code 1)
+	body = append(body, es(StreamTypePrivateData, testOpusPID, []byte{0x05, 0x04, 'O', 'p', 'u', 's', 0x7f, 0x02, 0x80, 0x01})...)
+	body = append(body, es(0x03, testMP3PID, nil)...)
+	return testSection(tableIDPMT, 1, version, body)
+}
+
+// testPackets 는 payload 를 188 바이트 TS 패킷들로 나눈다. 마지막 패킷은 adaptation field 로 채운다.
+func testPackets(pid uint16, cc *int, payload []byte) []byte {
+	var out []byte
+	first := true
+	for len(payload) > 0 {
+		n := min(len(payload), PacketSize-4)
+		header := []byte{syncByte, byte(pid>>8) & 0x1f, byte(pid), 0x10 | byte(*cc&0x0f)}
+		if first {
+			header[1] |= 0x40
+		}
+		if n < PacketSize-4 {
+			// 184-n 바이트의 adaptation field (길이 1 바이트 + flags + stuffing)
+			header[3] |= 0x20
+			afl := PacketSize - 4 - n - 1
+			header = append(header, byte(afl))
+			if afl > 0 {
+				header = append(header, 0x00)
+				header = append(header, bytes.Repeat([]byte{0xff}, afl-1)...)
+			}
+		}
+		out = append(out, header...)
+		out = append(out, payload[:n]...)
+		payload = payload[n:]
+		*cc++
+		first = false
+	}
+	return out
+}
+
+func testSectionPackets(pid uint16, cc *int, section []byte) []byte {
+	payload := append([]byte{0x00}, section...)
+	payload = append(payload, bytes.Repeat([]byte{0xff}, PacketSize-4-len(payload))...)
+	return testPackets(pid, cc, payload)
+}
+
+func testTimestamp(prefix byte, ts int64) []byte {
+	return []byte{
+		prefix<<4 | byte(ts>>29)&0x0e | 0x01,
+		byte(ts >> 22),
+		byte(ts>>14)&0xfe | 0x01,
+		byte(ts >> 7),
+		byte(ts<<1)&0xfe | 0x01,
+	}
+}
+
+// testPES 는 PES 를 만든다. sized 가 false 이면 비디오처럼 PES_packet_length 를 0 으로 둔다.
+func testPES(pts, dts int64, data []byte, sized bool) []byte {
+	header := []byte{0x80, 0x80, 0x05}
+	header = append(header, testTimestamp(0x02, pts)...)
+	if dts != pts {
+		header = []byte{0x80, 0xc0, 0x0a}
+		header = append(header, testTimestamp(0x03, pts)...)
+		header = append(header, testTimestamp(0x01, dts)...)
+	}
+	length := 0
+	if sized {
+		length = len(header) + len(data)
+	}
+	b := []byte{0x00, 0x00, 0x01, 0xe0, byte(length >> 8), byte(length)}
+	b = append(b, header...)
+	return append(b, data...)
+}
+
+type testDemuxer struct {
+	*Demuxer
+	streams [][]Stream
+	frames  map[uint16][]Frame
+	cc      map[uint16]*int
+}
+
+func newTestDemuxer() *testDemuxer {
+	t := &testDemuxer{frames: make(map[uint16][]Frame), cc: make(map[uint16]*int)}
+	t.Demuxer = NewDemuxer(func(streams []Stream) {
+		t.streams = append(t.streams, streams)
+	}, func(stream Stream, frame Frame) {
+		frame.Data = append([]byte(nil), frame.Data...)
+		t.frames[stream.PID] = append(t.frames[stream.PID], frame)
+	})
+	return t
+}
+
+func (t *testDemuxer) counter(pid uint16) *int {
+	if _, ok := t.cc[pid]; !ok {
+		t.cc[pid] = new(int)
+	}
+	return t.cc[pid]
+}
+
+func (t *testDemuxer) tables(pmtVersion int) []byte {
+	b := testSectionPackets(patPID, t.counter(patPID), testPAT())
+	return append(b, testSectionPackets(testPMTPID, t.counter(testPMTPID), testPMT(pmtVersion))...)
+}
+
+func (t *testDemuxer) pes(pid uint16, pts, dts int64, data []byte, sized bool) []byte {
+	return testPackets(pid, t.counter(pid), testPES(pts, dts, data, sized))
+}
+
+func TestDemuxerPATPMT(t *testing.T) {
+	d := newTestDemuxer()
+	d.Write(d.tables(0))
+	// 같은 버전의 PMT 는 다시 알리지 않는다.
+	d.Write(d.tables(0))
+
+	if len(d.streams) != 1 {
+		t.Fatalf("onStreams called %d times, want 1", len(d.streams))
+	}
+	want := []Stream{
+		{PID: testVideoPID, StreamType: StreamTypeH264, CodecType: types.CodecTypeH264},
+		{PID: testAudioPID, StreamType: StreamTypeAAC, CodecType: types.CodecTypeAAC},
+		{PID: testOpusPID, StreamType: StreamTypePrivateData, CodecType: types.CodecTypeOpus, Channels: 1},
+		{PID: testMP3PID, StreamType: 0x03},
+	}
+	got := d.streams[0]
+	if len(got) != len(want) {
+		t.Fatalf("streams = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("stream %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+	if d.pcrPID != testVideoPID {
+		t.Fatalf("pcr pid = %#x, want %#x", d.pcrPID, testVideoPID)
+	}
+
+	// 버전이 바뀌면 다시 알린다.
+	d.Write(d.tables(1))
+	if len(d.streams) != 2 {
+		t.Fatalf("onStreams called %d times after a new PMT version, want 2", len(d.streams))
+	}
+}
+
+func TestDemuxerSectionCRC(t *testing.T) {
+	d := newTestDemuxer()
+	pat := testPAT()
+	pat[len(pat)-1] ^= 0xff
+	d.Write(testSectionPackets(patPID, d.counter(patPID), pat))
+	d.Write(testSectionPackets(testPMTPID, d.counter(testPMTPID), testPMT(0)))
+	if len(d.streams) != 0 || d.pmtPID != -1 {
+		t.Fatalf("PAT with a bad CRC was accepted: pmtPID=%d streams=%v", d.pmtPID, d.streams)
+	}
+}
+
+func TestDemuxerPES(t *testing.T) {
+	d := newTestDemuxer()
+	d.Write(d.tables(0))
+
+	video := bytes.Repeat([]byte{0x00, 0x00, 0x00, 0x01, 0x65, 0xaa}, 100)
+	audio := []byte{0xff, 0xf1, 0x50, 0x80, 0x02, 0x1f, 0xfc, 0x21}
+
+	// PES_packet_length 가 있으면 다 모이자마자 내보낸다.
+	d.Write(d.pes(testAudioPID, 9000, 9000, audio, true))
+	if frames := d.frames[testAudioPID]; len(frames) != 1 || !bytes.Equal(frames[0].Data, audio) || frames[0].PTS != 9000 || frames[0].DTS != 9000 {
+		t.Fatalf("audio frames = %+v", frames)
+	}
+
+	// 길이가 0 인 비디오 PES 는 다음 PES 가 시작되거나 Flush 할 때 내보낸다.
+	d.Write(d.pes(testVideoPID, 12000, 9000, video, false))
+	if len(d.frames[testVideoPID]) != 0 {
+		t.Fatalf("unbounded video PES was emitted before the next one started")
+	}
+	d.Write(d.pes(testVideoPID, 15000, 12000, video[:6], false))
+	d.Flush()
+
+	frames := d.frames[testVideoPID]
+	if len(frames) != 2 {
+		t.Fatalf("video frames = %d, want 2", len(frames))
+	}
+	if frames[0].PTS != 12000 || frames[0].DTS != 9000 || !bytes.Equal(frames[0].Data, video) {
+		t.Fatalf("video frame 0 = PTS %d DTS %d len %d", frames[0].PTS, frames[0].DTS, len(frames[0].Data))
+	}
+	if frames[1].PTS != 15000 || frames[1].DTS != 12000 || !bytes.Equal(frames[1].Data, video[:6]) {
+		t.Fatalf("video frame 1 = PTS %d DTS %d len %d", frames[1].PTS, frames[1].DTS, len(frames[1].Data))
+	}
+}
+
+func TestDemuxerResync(t *testing.T) {
+	d := newTestDemuxer()
+	audio := []byte{0x01, 0x02, 0x03, 0x04}
+	stream := d.tables(0)
+	stream = append(stream, d.pes(testAudioPID, 3000, 3000, audio, true)...)
+
+	// 앞의 쓰레기 바이트를 건너뛰고, datagram 경계가 패킷 경계와 달라도 이어서 읽는다.
+	stream = append([]byte{0x00, 0x47, 0x12}, stream...)
+	for len(stream) > 0 {
+		n := min(len(stream), 100)
+		d.Write(stream[:n])
+		stream = stream[n:]
+	}
+	if len(d.streams) != 1 {
+		t.Fatalf("onStreams called %d times, want 1", len(d.streams))
+	}
+	if frames := d.frames[testAudioPID]; len(frames) != 1 || !bytes.Equal(frames[0].Data, audio) {
+		t.Fatalf("audio frames = %+v", frames)
+	}
+}
+
+func TestDemuxerDropsPESWithLostPacket(t *testing.T) {
+	d := newTestDemuxer()
+	d.Write(d.tables(0))
+
+	video := bytes.Repeat([]byte{0x00, 0x00, 0x01, 0x41}, 200)
+	packets := d.pes(testVideoPID, 3000, 3000, video, true)
+	// 두 번째 패킷을 잃는다.
+	d.Write(packets[:PacketSize])
+	d.Write(packets[2*PacketSize:])
+	d.Write(d.pes(testVideoPID, 6000, 6000, video, true))
+
+	frames := d.frames[testVideoPID]
+	if len(frames) != 1 || frames[0].PTS != 6000 {
+		t.Fatalf("frames = %d, want only the complete PES at 6000", len(frames))
+	}
+}
+
+func TestDemuxerTimestampWrap(t *testing.T) {
+	d := newTestDemuxer()
+	d.Write(d.tables(0))
+
+	audio := []byte{0x01}
+	d.Write(d.pes(testAudioPID, timestampWrap-1800, timestampWrap-1800, audio, true))
+	d.Write(d.pes(testAudioPID, 1200, 1200, audio, true))
+
+	frames := d.frames[testAudioPID]
+	if len(frames) != 2 {
+		t.Fatalf("frames = %d, want 2", len(frames))
+	}
+	if frames[1].PTS != timestampWrap+1200 || frames[1].DTS-frames[0].DTS != 3000 {
+		t.Fatalf("timestamps after wrap = %d, %d", frames[0].PTS, frames[1].PTS)
+	}
+}
@@ -0,0 +1,129 @@
+package sessions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+	pion "github.com/pion/webrtc/v3"
+
+	"mediaserver-go/hubs"
+)
+
+var (
+	errWHEPClientStatus = errors.New("unexpected whep response status")
+)
+
+// NewWHEPClientSession 은 다른 서버의 WHEP endpoint 에 offer 를 보내서 스트림을 받는 세션을 만든다.
+// 받은 트랙은 WHIP ingress 와 같이 처리하므로 Run 은 WHIPSession 의 것을 쓴다.
+func NewWHEPClientSession(ctx context.Context, endpoint, token string, api *pion.API, stream *hubs.Stream) (WHIPSession, error) {
+	onTrack := make(chan OnTrack, 10)
+	onConnectionState := make(chan pion.PeerConnectionState, 10)
+
+	pc, err := api.NewPeerConnection(pion.Configuration{
+		SDPSemantics: pion.SDPSemanticsUnifiedPlan,
+	})
+	if err != nil {
+		return WHIPSession{}, err
+	}
+	for _, kind := range []pion.RTPCodecType{pion.RTPCodecTypeVideo, pion.RTPCodecTypeAudio} {
+		if _, err := pc.AddTransceiverFromKind(kind, pion.RTPTransceiverInit{
+			Direction: pion.RTPTransceiverDirectionRecvonly,
+		}); err != nil {
+			pc.Close()
+			return WHIPSession{}, err
+		}
+	}
+	watchPeerConnection(pc, onTrack, onConnectionState)
+
+	sd, err := pc.CreateOffer(nil)
+	if err != nil {
+		pc.Close()
+		return WHIPSession{}, err
+	}
+	// 서버가 trickle ICE 를 받지 않으므로 후보를 모두 모은 뒤 보낸다.
+	gatherComplete := pion.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(sd); err != nil {
+		pc.Close()
+		return WHIPSession{}, err
+	}
+	select {
+	case <-gatherComplete:
+	case <-ctx.Done():
+		pc.Close()
+		return WHIPSession{}, ctx.Err()
+	}
+
+	answer, err := postWHEPOffer(ctx, endpoint, token, pc.LocalDescription().SDP)
+	if err != nil {
+		pc.Close()
+		return WHIPSession{}, err
+	}
+	if err := pc.SetRemoteDescription(pion.SessionDescription{
+		Type: pion.SDPTypeAnswer,
+		SDP:  answer,
+	}); err != nil {
+		pc.Close()
+		return WHIPSession{}, err
+	}
+
+	return WHIPSession{
+		token:             token,
+		api:               api,
+		pc:                pc,
+		onTrack:           onTrack,
+		onConnectionState: onConnectionState,
+		stream:            stream,
+		expectedTracks:    sendingMediaCount(answer),
+	}, nil
+}
+
+// sendingMediaCount 는 answer 에서 상대가 보내는(sendonly, sendrecv) m-line 의 수를 센다.
+func sendingMediaCount(answer string) int {
+	var desc sdp.SessionDescription
+	if err := desc.Unmarshal([]byte(answer)); err != nil {
+		return 0
+	}
+	count := 0
+	for _, media := range desc.MediaDescriptions {
+		if media.MediaName.Port.Value == 0 {
+			continue
+		}
+		if _, ok := media.Attribute(sdp.AttrKeyRecvOnly); ok {
+			continue
+		}
+		if _, ok := media.Attribute(sdp.AttrKeyInactive); ok {
+			continue
+		}
+		count++
+	}
+	return count
+}
+
+func postWHEPOffer(ctx context.Context, endpoint, token, offer string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(offer))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/sdp")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%w: %s %d", errWHEPClientStatus, endpoint, resp.StatusCode)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
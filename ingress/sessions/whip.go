@@ -29,6 +29,8 @@ type WHIPSession struct {
 	onConnectionState chan pion.PeerConnectionState
 
 	stream *hubs.Stream
+	// WHEP client 에서 answer 로 알게 된, 상대가 보낼 트랙 수. WHIP ingress 에서는 0 이다.
+	expectedTracks int
 }
 
 func NewWHIPSession(offer, token string, api *pion.API, stream *hubs.Stream) (WHIPSession, error) {
@@ -57,15 +59,7 @@ func NewWHIPSession(offer, token string, api *pion.API, stream *hubs.Stream) (WH
 		}
 		candCh <- candidate
 	})
-	pc.OnConnectionStateChange(func(connectionState pion.PeerConnectionState) {
-		utils.SendOrDrop(onConnectionState, connectionState)
-	})
-	pc.OnTrack(func(remote *pion.TrackRemote, receiver *pion.RTPReceiver) {
-		utils.SendOrDrop(onTrack, OnTrack{
-			remote:   remote,
-			receiver: receiver,
-		})
-	})
+	watchPeerConnection(pc, onTrack, onConnectionState)
 
 	sd, err := pc.CreateAnswer(&pion.AnswerOptions{})
 	if err != nil {
@@ -89,6 +83,24 @@ func NewWHIPSession(offer, token string, api *pion.API, stream *hubs.Stream) (WH
 	}, nil
 }
 
+// watchPeerConnection 은 pc 의 트랙과 연결 상태를 Run 이 읽는 채널로 보낸다.
+func watchPeerConnection(pc *pion.PeerConnection, onTrack chan OnTrack, onConnectionState chan pion.PeerConnectionState) {
+	pc.OnConnectionStateChange(func(connectionState pion.PeerConnectionState) {
+		utils.SendOrDrop(onConnectionState, connectionState)
+	})
+	pc.OnTrack(func(remote *pion.TrackRemote, receiver *pion.RTPReceiver) {
+		utils.SendOrDrop(onTrack, OnTrack{
+			remote:   remote,
+			receiver: receiver,
+		})
+	})
+}
+
+// ExpectedTracks 는 상대가 보내겠다고 한 트랙 수이다. 모르면 0 이다.
+func (w *WHIPSession) ExpectedTracks() int {
+	return w.expectedTracks
+}
+
 func (w *WHIPSession) Answer() string {
 	return w.pc.LocalDescription().SDP
 }
@@ -52,6 +52,33 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	ingressMPEGTSServer, err := ingress.NewMPEGTSServer(hub)
+	if err != nil {
+		panic(err)
+	}
+	ingressHLSServer, err := ingress.NewHLSPullServer(hub)
+	if err != nil {
+		panic(err)
+	}
+	relayConfig, err := configs.RelayConfig()
+	if err != nil {
+		panic(err)
+	}
+	relayServer, err := ingress.NewRelayServer(hub, se, relayConfig)
+	if err != nil {
+		panic(err)
+	}
+	if relayServer.Enabled() {
+		hub.SetStreamPuller(&relayServer)
+	}
+	compositorServer, err := ingress.NewCompositorServer(hub)
+	if err != nil {
+		panic(err)
+	}
+	channelServer, err := ingress.NewChannelServer(hub)
+	if err != nil {
+		panic(err)
+	}
 
 	whepServer, err := egress.NewWHEP(hub, se)
 	if err != nil {
@@ -65,7 +92,11 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	hlsServer, err := egress.NewHLSServer(hub)
+	hlsConfig, err := configs.HLSConfig()
+	if err != nil {
+		panic(err)
+	}
+	hlsServer, err := egress.NewHLSServer(hub, hlsConfig)
 	if err != nil {
 		panic(err)
 	}
@@ -73,8 +104,39 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	flvServer, err := egress.NewFLVServer(hub)
+	if err != nil {
+		panic(err)
+	}
+	mseServer, err := egress.NewMSEServer(hub)
+	if err != nil {
+		panic(err)
+	}
+	egressSRTServer, err := egress.NewSRTServer(hub)
+	if err != nil {
+		panic(err)
+	}
+	egressMulticastServer, err := egress.NewMulticastServer(hub)
+	if err != nil {
+		panic(err)
+	}
+	egressWHIPServer, err := egress.NewWHIPClientServer(hub, se)
+	if err != nil {
+		panic(err)
+	}
 
-	e := endpoints.Initialize(&whipServer, &fileServer, &whepServer, &egressFileServer, &ingressRTPServer, &egressRTPServer, &hlsServer, &egressImageServer)
+	recordingRules, err := configs.RecordingRules()
+	if err != nil {
+		panic(err)
+	}
+	autoRecorder, err := egress.NewAutoRecorder(hub, &egressFileServer, recordingRules)
+	if err != nil {
+		panic(err)
+	}
+	hub.AddObserver(autoRecorder)
+	hub.AddObserver(&hlsServer)
+
+	e := endpoints.Initialize(&whipServer, &fileServer, &whepServer, &egressFileServer, &ingressRTPServer, &egressRTPServer, &hlsServer, &egressImageServer, &compositorServer, &flvServer, &mseServer, &egressSRTServer, &egressMulticastServer, &ingressMPEGTSServer, &ingressHLSServer, &egressWHIPServer, &channelServer)
 
 	g, ctx := errgroup.WithContext(ctx)
 	g.Go(func() error {
@@ -85,14 +147,22 @@ func main() {
 		port := viper.GetInt("general.port")
 		return e.Start(fmt.Sprintf("0.0.0.0:%d", port))
 	})
+	rtmpConfig, err := configs.RTMPConfig()
+	if err != nil {
+		panic(err)
+	}
+	rtmpServer, err := ingress.NewRTMPServer(hub, rtmpConfig, &flvServer)
+	if err != nil {
+		panic(err)
+	}
 	g.Go(func() error {
-		rtmpServer, err := ingress.NewRTMPServer(hub)
-		if err != nil {
-			return err
-		}
-		port := viper.GetUint16("rtmp.port")
-		return rtmpServer.Start(fmt.Sprintf("0.0.0.0:%d", port))
+		return rtmpServer.Start(fmt.Sprintf("0.0.0.0:%d", rtmpConfig.Port))
 	})
+	if rtmpConfig.TLSPort > 0 {
+		g.Go(func() error {
+			return rtmpServer.StartTLS(fmt.Sprintf("0.0.0.0:%d", rtmpConfig.TLSPort), rtmpConfig.CertFile, rtmpConfig.KeyFile)
+		})
+	}
 	if err := g.Wait(); err != nil {
 		panic(err)
 	}
@@ -158,7 +158,7 @@ const (
 	AV_CODEC_ID_AV1               = CodecID(C.AV_CODEC_ID_AV1)
 	AV_CODEC_ID_H265              = int(C.AV_CODEC_ID_H265)
 	AV_CODEC_ID_HDMV_PGS_SUBTITLE = int(C.AV_CODEC_ID_HDMV_PGS_SUBTITLE)
-	AV_CODEC_ID_HEVC              = int(C.AV_CODEC_ID_HEVC)
+	AV_CODEC_ID_HEVC              = CodecID(C.AV_CODEC_ID_HEVC)
 	AV_CODEC_ID_HNM4_VIDEO        = int(C.AV_CODEC_ID_HNM4_VIDEO)
 	AV_CODEC_ID_HUFFYUV           = int(C.AV_CODEC_ID_HUFFYUV)
 	AV_CODEC_ID_IAC               = int(C.AV_CODEC_ID_IAC)
@@ -190,7 +190,7 @@ const (
 	AV_CODEC_ID_METASOUND         = int(C.AV_CODEC_ID_METASOUND)
 	AV_CODEC_ID_MICRODVD          = int(C.AV_CODEC_ID_MICRODVD)
 	AV_CODEC_ID_MIMIC             = int(C.AV_CODEC_ID_MIMIC)
-	AV_CODEC_ID_MJPEG             = int(C.AV_CODEC_ID_MJPEG)
+	AV_CODEC_ID_MJPEG             = CodecID(C.AV_CODEC_ID_MJPEG)
 	AV_CODEC_ID_MJPEGB            = int(C.AV_CODEC_ID_MJPEGB)
 	AV_CODEC_ID_MLP               = int(C.AV_CODEC_ID_MLP)
 	AV_CODEC_ID_MMVIDEO           = int(C.AV_CODEC_ID_MMVIDEO)
@@ -269,7 +269,7 @@ const (
 	AV_CODEC_ID_PGMYUV           = int(C.AV_CODEC_ID_PGMYUV)
 	AV_CODEC_ID_PICTOR           = int(C.AV_CODEC_ID_PICTOR)
 	AV_CODEC_ID_PJS              = int(C.AV_CODEC_ID_PJS)
-	AV_CODEC_ID_PNG              = int(C.AV_CODEC_ID_PNG)
+	AV_CODEC_ID_PNG              = CodecID(C.AV_CODEC_ID_PNG)
 	AV_CODEC_ID_PPM              = int(C.AV_CODEC_ID_PPM)
 	AV_CODEC_ID_PROBE            = int(C.AV_CODEC_ID_PROBE)
 	AV_CODEC_ID_PRORES           = int(C.AV_CODEC_ID_PRORES)
@@ -371,10 +371,10 @@ const (
 	AV_CODEC_ID_VP6F          = int(C.AV_CODEC_ID_VP6F)
 	AV_CODEC_ID_VP7           = int(C.AV_CODEC_ID_VP7)
 	AV_CODEC_ID_VP8           = CodecID(C.AV_CODEC_ID_VP8)
-	AV_CODEC_ID_VP9           = int(C.AV_CODEC_ID_VP9)
+	AV_CODEC_ID_VP9           = CodecID(C.AV_CODEC_ID_VP9)
 	AV_CODEC_ID_VPLAYER       = int(C.AV_CODEC_ID_VPLAYER)
 	AV_CODEC_ID_WAVPACK       = int(C.AV_CODEC_ID_WAVPACK)
-	AV_CODEC_ID_WEBP          = int(C.AV_CODEC_ID_WEBP)
+	AV_CODEC_ID_WEBP          = CodecID(C.AV_CODEC_ID_WEBP)
 	AV_CODEC_ID_WEBVTT        = int(C.AV_CODEC_ID_WEBVTT)
 	AV_CODEC_ID_WESTWOOD_SND1 = int(C.AV_CODEC_ID_WESTWOOD_SND1)
 	AV_CODEC_ID_WMALOSSLESS   = int(C.AV_CODEC_ID_WMALOSSLESS)
@@ -181,3 +181,15 @@ func (cc *CodecContext) PrivData() unsafe.Pointer {
 func (cc *CodecContext) SetThreadCount(count int) {
 	cc.thread_count = C.int(count)
 }
+
+const (
+	AV_CODEC_FLAG_GLOBAL_HEADER = int(C.AV_CODEC_FLAG_GLOBAL_HEADER)
+)
+
+func (cc *CodecContext) Flags() int {
+	return int(cc.flags)
+}
+
+func (cc *CodecContext) SetFlags(flags int) {
+	cc.flags = C.int(flags)
+}
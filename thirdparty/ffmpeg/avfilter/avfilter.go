@@ -0,0 +1,98 @@
+// Package avfilter provides the filter graph of the libavfilter library.
+package avfilter
+
+//#cgo pkg-config: libavfilter libavutil
+//#include <stdlib.h>
+//#include <libavfilter/avfilter.h>
+//#include <libavfilter/buffersink.h>
+//#include <libavfilter/buffersrc.h>
+//#include <libavutil/opt.h>
+//
+//// build_graph 는 buffer(in) -> descr -> buffersink(out) 그래프를 구성한다.
+//int build_graph(AVFilterGraph *graph, const char *args, const char *descr, AVFilterContext **src, AVFilterContext **sink) {
+//	const AVFilter *buffersrc = avfilter_get_by_name("buffer");
+//	const AVFilter *buffersink = avfilter_get_by_name("buffersink");
+//	AVFilterInOut *outputs = NULL;
+//	AVFilterInOut *inputs = NULL;
+//	int ret;
+//
+//	ret = avfilter_graph_create_filter(src, buffersrc, "in", args, NULL, graph);
+//	if (ret < 0) {
+//		return ret;
+//	}
+//	ret = avfilter_graph_create_filter(sink, buffersink, "out", NULL, NULL, graph);
+//	if (ret < 0) {
+//		return ret;
+//	}
+//
+//	outputs = avfilter_inout_alloc();
+//	inputs = avfilter_inout_alloc();
+//	if (!outputs || !inputs) {
+//		ret = AVERROR(ENOMEM);
+//		goto end;
+//	}
+//	outputs->name = av_strdup("in");
+//	outputs->filter_ctx = *src;
+//	outputs->pad_idx = 0;
+//	outputs->next = NULL;
+//
+//	inputs->name = av_strdup("out");
+//	inputs->filter_ctx = *sink;
+//	inputs->pad_idx = 0;
+//	inputs->next = NULL;
+//
+//	ret = avfilter_graph_parse_ptr(graph, descr, &inputs, &outputs, NULL);
+//	if (ret < 0) {
+//		goto end;
+//	}
+//	ret = avfilter_graph_config(graph, NULL);
+//end:
+//	avfilter_inout_free(&inputs);
+//	avfilter_inout_free(&outputs);
+//	return ret;
+//}
+import "C"
+import (
+	"mediaserver-go/thirdparty/ffmpeg/avutil"
+	"unsafe"
+)
+
+type (
+	Graph         C.struct_AVFilterGraph
+	FilterContext C.struct_AVFilterContext
+)
+
+func AvfilterGraphAlloc() *Graph {
+	return (*Graph)(C.avfilter_graph_alloc())
+}
+
+func AvfilterGraphFree(g *Graph) {
+	C.avfilter_graph_free((**C.struct_AVFilterGraph)(unsafe.Pointer(&g)))
+}
+
+// BuildGraph 는 args(buffer 필터 옵션)로 입력을 만들고 descr 를 거쳐 buffersink 로 나가는 그래프를 구성한다.
+// descr 에서 입력은 [in], 출력은 [out] 으로 참조한다.
+func (g *Graph) BuildGraph(args, descr string) (src *FilterContext, sink *FilterContext, ret int) {
+	cargs := C.CString(args)
+	defer C.free(unsafe.Pointer(cargs))
+	cdescr := C.CString(descr)
+	defer C.free(unsafe.Pointer(cdescr))
+
+	var csrc, csink *C.struct_AVFilterContext
+	ret = int(C.build_graph((*C.struct_AVFilterGraph)(g), cargs, cdescr, &csrc, &csink))
+	return (*FilterContext)(csrc), (*FilterContext)(csink), ret
+}
+
+// AvBuffersrcAddFrame 는 frame 을 그래프에 넣는다. frame 의 참조는 그래프로 옮겨진다.
+func (fc *FilterContext) AvBuffersrcAddFrame(frame *avutil.Frame) int {
+	return int(C.av_buffersrc_add_frame((*C.struct_AVFilterContext)(fc), (*C.struct_AVFrame)(unsafe.Pointer(frame))))
+}
+
+func (fc *FilterContext) AvBuffersinkGetFrame(frame *avutil.Frame) int {
+	return int(C.av_buffersink_get_frame((*C.struct_AVFilterContext)(fc), (*C.struct_AVFrame)(unsafe.Pointer(frame))))
+}
+
+func (fc *FilterContext) AvBuffersinkGetTimeBase() avutil.Rational {
+	tb := C.av_buffersink_get_time_base((*C.struct_AVFilterContext)(fc))
+	return avutil.NewRational(int(tb.num), int(tb.den))
+}
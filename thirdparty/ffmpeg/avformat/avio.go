@@ -80,6 +80,24 @@ func AVIOCloseDynBuf(avIOCtx *AvIOContext) []byte {
 	return nil
 }
 
+// AvIOWrite 는 b 를 쓰고 flush 한다. 쓰기에 실패하면 AVIOContext 의 error(음수)를 반환한다.
+func AvIOWrite(avIOCtx *AvIOContext, b []byte) int {
+	if len(b) == 0 {
+		return 0
+	}
+	ctx := (*C.struct_AVIOContext)(avIOCtx)
+	C.avio_write(ctx, (*C.uchar)(unsafe.Pointer(&b[0])), C.int(len(b)))
+	C.avio_flush(ctx)
+	return int(ctx.error)
+}
+
+// AvIOFlush 는 버퍼에 남은 데이터를 쓴다. 쓰기에 실패하면 AVIOContext 의 error(음수)를 반환한다.
+func AvIOFlush(avIOCtx *AvIOContext) int {
+	ctx := (*C.struct_AVIOContext)(avIOCtx)
+	C.avio_flush(ctx)
+	return int(ctx.error)
+}
+
 func AVIOCloseP(pb **AvIOContext) int {
 	return int(C.avio_closep((**C.struct_AVIOContext)(unsafe.Pointer(pb))))
 }
@@ -128,11 +128,12 @@ func (f *FormatContext) AvReadFrame(pkt *avcodec.Packet) int {
 //		return int(C.av_seek_frame((*C.struct_AVFormatContext)(s), C.int(st), C.int64_t(t2), AvseekFlagBackward))
 //	}
 //
-// // Seek to timestamp ts.
-//
-//	func (s *Context) AvformatSeekFile(si int, mit, ts, mat int64, f int) int {
-//		return int(C.avformat_seek_file((*C.struct_AVFormatContext)(s), C.int(si), C.int64_t(mit), C.int64_t(ts), C.int64_t(mat), C.int(f)))
-//	}
+// Seek to timestamp ts.
+// si 가 -1 이면 ts 는 AV_TIME_BASE(us) 단위이다.
+func (f *FormatContext) AvformatSeekFile(si int, mit, ts, mat int64, flags int) int {
+	return int(C.avformat_seek_file((*C.struct_AVFormatContext)(unsafe.Pointer(f)), C.int(si), C.int64_t(mit), C.int64_t(ts), C.int64_t(mat), C.int(flags)))
+}
+
 //
 // // Start playing a network-based stream (e.g.
 //
@@ -157,12 +158,12 @@ func (f *FormatContext) AvformatWriteHeader(o **avutil.Dictionary) int {
 	return int(C.avformat_write_header((*C.struct_AVFormatContext)(f), (**C.struct_AVDictionary)(unsafe.Pointer(o))))
 }
 
-// // Write a packet to an output media file.
-//
-//	func (s *Context) AvWriteFrame(pkt *avcodec.Packet) int {
-//		return int(C.av_write_frame((*C.struct_AVFormatContext)(s), toCPacket(pkt)))
-//	}
-//
+// Write a packet to an output media file.
+// pkt 가 nil 이면 muxer 에 버퍼링된 데이터를 flush 한다. (mp4 frag_custom 에서는 현재 fragment 를 쓴다)
+func (f *FormatContext) AvWriteFrame(pkt *avcodec.Packet) int {
+	return int(C.av_write_frame((*C.struct_AVFormatContext)(f), toCPacket(pkt)))
+}
+
 // Write a packet to an output media file ensuring correct interleaving.
 func (f *FormatContext) AvInterleavedWriteFrame(pkt *avcodec.Packet) int {
 	return int(C.av_interleaved_write_frame((*C.struct_AVFormatContext)(f), toCPacket(pkt)))
@@ -82,3 +82,47 @@ func (f *Frame) AvFrameGetBuffer(n int) int {
 func (f *Frame) SetPictType(pict_type AvPictureType) {
 	f.pict_type = C.enum_AVPictureType(pict_type)
 }
+
+func (f *Frame) Width() int {
+	return int(f.width)
+}
+
+func (f *Frame) SetWidth(width int) {
+	f.width = C.int(width)
+}
+
+func (f *Frame) Height() int {
+	return int(f.height)
+}
+
+func (f *Frame) SetHeight(height int) {
+	f.height = C.int(height)
+}
+
+func (f *Frame) Linesize(plane int) int {
+	return int(f.linesize[plane])
+}
+
+// Plane 은 plane 번째 데이터를 rows 줄 만큼 슬라이스로 반환한다. 프레임이 해제되면 사용할 수 없다.
+func (f *Frame) Plane(plane int, rows int) []byte {
+	if f.data[plane] == nil {
+		return nil
+	}
+	return unsafe.Slice((*byte)(unsafe.Pointer(f.data[plane])), int(f.linesize[plane])*rows)
+}
+
+func (f *Frame) KeyFrame() bool {
+	return f.flags&C.AV_FRAME_FLAG_KEY != 0
+}
+
+func (f *Frame) AvFrameMakeWritable() int {
+	return int(C.av_frame_make_writable((*C.struct_AVFrame)(unsafe.Pointer(f))))
+}
+
+func (f *Frame) AvFrameUnref() {
+	C.av_frame_unref((*C.struct_AVFrame)(unsafe.Pointer(f)))
+}
+
+func (f *Frame) AvFrameClone() *Frame {
+	return (*Frame)(C.av_frame_clone((*C.struct_AVFrame)(unsafe.Pointer(f))))
+}
@@ -51,6 +51,7 @@ const (
 	AV_PIX_FMT_YUVA444P16 = C.AV_PIX_FMT_YUVA444P16
 	AV_PIX_FMT_RGB24      = C.AV_PIX_FMT_RGB24
 	AV_PIX_FMT_RGBA       = C.AV_PIX_FMT_RGBA
+	AV_PIX_FMT_YUVJ420P   = C.AV_PIX_FMT_YUVJ420P
 
 	SWS_FAST_BILINEAR        = C.SWS_FAST_BILINEAR
 	SWS_BILINEAR             = C.SWS_BILINEAR
@@ -0,0 +1,50 @@
+package swscale
+
+//#cgo pkg-config: libswscale libavutil
+//#include <libswscale/swscale.h>
+//#include <libavutil/frame.h>
+import "C"
+import (
+	"mediaserver-go/thirdparty/ffmpeg/avutil"
+	"unsafe"
+)
+
+type (
+	SwsContext C.struct_SwsContext
+)
+
+const (
+	SWS_FAST_BILINEAR = C.SWS_FAST_BILINEAR
+	SWS_BILINEAR      = C.SWS_BILINEAR
+	SWS_BICUBIC       = C.SWS_BICUBIC
+	SWS_POINT         = C.SWS_POINT
+	SWS_AREA          = C.SWS_AREA
+	SWS_LANCZOS       = C.SWS_LANCZOS
+)
+
+// SwsGetContext 는 srcW x srcH(srcFormat) 를 dstW x dstH(dstFormat) 로 변환하는 컨텍스트를 생성한다.
+func SwsGetContext(srcW, srcH int, srcFormat avutil.PixelFormat, dstW, dstH int, dstFormat avutil.PixelFormat, flags int) *SwsContext {
+	return (*SwsContext)(C.sws_getContext(
+		C.int(srcW), C.int(srcH), (C.enum_AVPixelFormat)(srcFormat),
+		C.int(dstW), C.int(dstH), (C.enum_AVPixelFormat)(dstFormat),
+		C.int(flags), nil, nil, nil))
+}
+
+// SwsGetCachedContext 는 파라미터가 같으면 기존 컨텍스트를 재사용하고, 다르면 새로 생성한다.
+func SwsGetCachedContext(sc *SwsContext, srcW, srcH int, srcFormat avutil.PixelFormat, dstW, dstH int, dstFormat avutil.PixelFormat, flags int) *SwsContext {
+	return (*SwsContext)(C.sws_getCachedContext((*C.struct_SwsContext)(sc),
+		C.int(srcW), C.int(srcH), (C.enum_AVPixelFormat)(srcFormat),
+		C.int(dstW), C.int(dstH), (C.enum_AVPixelFormat)(dstFormat),
+		C.int(flags), nil, nil, nil))
+}
+
+// SwsScaleFrame 은 src 프레임 전체를 dst 프레임으로 변환한다. dst 는 width, height, format 이 설정되어 있어야 한다.
+func (sc *SwsContext) SwsScaleFrame(dst, src *avutil.Frame) int {
+	return int(C.sws_scale_frame((*C.struct_SwsContext)(sc),
+		(*C.struct_AVFrame)(unsafe.Pointer(dst)),
+		(*C.struct_AVFrame)(unsafe.Pointer(src))))
+}
+
+func SwsFreeContext(sc *SwsContext) {
+	C.sws_freeContext((*C.struct_SwsContext)(sc))
+}
@@ -17,5 +17,172 @@ func Init() error {
 
 	viper.SetDefault("general.port", 8080)
 	viper.SetDefault("log.level", "info")
+	viper.SetDefault("hls.directory", "./hls")
+	viper.SetDefault("rtmp.port", 1935)
 	return nil
 }
+
+// RecordingRule 은 Pattern 에 맞는 스트림이 들어오면 자동으로 녹화를 시작한다.
+// Pattern 은 hub 의 스트림 ID 와 비교한다. RTMP 스트림의 ID 는 app/streamKey 이고 path.Match 의 * 는 / 에 맞지 않으므로
+// rtmp://host/live/rec_1 을 녹화하려면 "live/rec_*" 또는 "*/rec_*" 로 적어야 한다.
+//
+//	[[Recording.Rules]]
+//	Pattern = "live/rec_*"
+//	Format = "mp4"
+//	MediaTypes = ["video", "audio"]
+//	Path = "./records/{stream}/{date}/{stream}_{time}"
+//	SegmentDuration = 60
+type RecordingRule struct {
+	Pattern    string   // path.Match 형식. 스트림 ID 와 비교한다.
+	Format     string   // mp4, webm, mkv. 비어있으면 코덱에 따라 정한다.
+	MediaTypes []string // 비어있으면 video, audio
+	// {stream}, {date}(20060102), {time}(150405) 를 치환한다.
+	Path            string
+	SegmentDuration int   // seconds
+	SegmentSize     int64 // bytes
+}
+
+func RecordingRules() ([]RecordingRule, error) {
+	var rules []RecordingRule
+	if err := viper.UnmarshalKey("recording.rules", &rules); err != nil {
+		return nil, fmt.Errorf("invalid recording rules: %w", err)
+	}
+	return rules, nil
+}
+
+const (
+	// HLSAutoStartPublish 는 스트림이 발행되면 HLS 를 시작한다.
+	HLSAutoStartPublish = "publish"
+	// HLSAutoStartRequest 는 플레이어가 처음 요청할 때 HLS 를 시작한다.
+	HLSAutoStartRequest = "request"
+)
+
+// HLS 는 [Hls] 설정이다. AutoStart 로 시작할 때는 Container 부터의 값을 요청 옵션으로 사용한다.
+//
+//	[Hls]
+//	Directory = "./hls"
+//	AutoStart = "publish"
+//	IdleTimeout = 60
+type HLS struct {
+	Directory string
+	AutoStart string // "", publish, request. 비어있으면 POST /v1/hls 로만 시작한다.
+	// 플레이어의 요청이 없는 채로 IdleTimeout(초)이 지나면 HLS 를 중지한다. 0 이면 중지하지 않는다.
+	IdleTimeout int
+
+	Container       string
+	DVR             bool
+	DVRWindow       int // seconds
+	PartDuration    int // milliseconds
+	SegmentDuration int // seconds
+}
+
+func HLSConfig() (HLS, error) {
+	var config HLS
+	if err := viper.UnmarshalKey("hls", &config); err != nil {
+		return HLS{}, fmt.Errorf("invalid hls config: %w", err)
+	}
+	if config.Directory == "" {
+		config.Directory = viper.GetString("hls.directory")
+	}
+	return config, nil
+}
+
+const (
+	// RTMPAuthStatic 은 StreamKeys 에 있는 키만 발행을 허용한다.
+	RTMPAuthStatic = "static"
+	// RTMPAuthHTTP 는 AuthURL 에 발행 정보를 POST 하고 2xx 응답이면 허용한다.
+	RTMPAuthHTTP = "http"
+
+	// RTMPDuplicateReject 는 이미 발행 중인 스트림 키로 들어온 발행을 거부한다.
+	RTMPDuplicateReject = "reject"
+	// RTMPDuplicateTakeover 는 기존 발행자의 연결을 끊고 새 발행자로 바꾼다.
+	RTMPDuplicateTakeover = "takeover"
+)
+
+// RTMP 는 [Rtmp] 설정이다. 스트림 ID 는 app/streamKey 이다.
+//
+//	[Rtmp]
+//	Port = 1935
+//	TLSPort = 1936
+//	CertFile = "./tls/certificate.crt"
+//	KeyFile = "./tls/private.key"
+//	Auth = "static"
+//	StreamKeys = ["live/secret", "backup"]
+//	DuplicatePublisher = "reject"
+type RTMP struct {
+	Port uint16
+	// 0 이면 RTMPS 를 열지 않는다.
+	TLSPort  uint16
+	CertFile string
+	KeyFile  string
+
+	Auth string // "", static, http. 비어있으면 모든 발행을 허용한다.
+	// "app/streamKey" 는 그 app 에서만, "/" 가 없는 키는 모든 app 에서 허용한다.
+	StreamKeys []string
+	AuthURL    string
+	// 초. 0 이면 5초
+	AuthTimeout int
+
+	DuplicatePublisher string // reject(기본값), takeover
+}
+
+func RTMPConfig() (RTMP, error) {
+	var config RTMP
+	if err := viper.UnmarshalKey("rtmp", &config); err != nil {
+		return RTMP{}, fmt.Errorf("invalid rtmp config: %w", err)
+	}
+	if config.CertFile == "" {
+		config.CertFile = "./tls/certificate.crt"
+	}
+	if config.KeyFile == "" {
+		config.KeyFile = "./tls/private.key"
+	}
+	switch config.Auth {
+	case "", RTMPAuthStatic:
+	case RTMPAuthHTTP:
+		if config.AuthURL == "" {
+			return RTMP{}, fmt.Errorf("invalid rtmp config: AuthURL is required for http auth")
+		}
+	default:
+		return RTMP{}, fmt.Errorf("invalid rtmp config: unknown Auth %q", config.Auth)
+	}
+	switch config.DuplicatePublisher {
+	case "":
+		config.DuplicatePublisher = RTMPDuplicateReject
+	case RTMPDuplicateReject, RTMPDuplicateTakeover:
+	default:
+		return RTMP{}, fmt.Errorf("invalid rtmp config: unknown DuplicatePublisher %q", config.DuplicatePublisher)
+	}
+	return config, nil
+}
+
+// Relay 는 [Relay] 설정이다. hub 에 없는 스트림을 시청자가 요청하면 Origin 서버에서 WHEP 로 가져와 같은 ID 로 발행한다.
+//
+//	[Relay]
+//	Origin = "http://origin:9090"
+//	Streams = ["live/*"]
+//	IdleTimeout = 10
+type Relay struct {
+	// origin 서버의 주소. 비어있으면 relay 를 하지 않는다. WHEP 는 Origin + /v1/whep 로 요청한다.
+	Origin string
+	// path.Match 형식. 비어있으면 모든 스트림을 가져온다.
+	Streams []string
+	// 시청자가 없는 채로 IdleTimeout(초)이 지나면 relay 를 끊는다. 0 이면 10초
+	IdleTimeout int
+	// 초. 0 이면 10초
+	ConnectTimeout int
+}
+
+func RelayConfig() (Relay, error) {
+	var config Relay
+	if err := viper.UnmarshalKey("relay", &config); err != nil {
+		return Relay{}, fmt.Errorf("invalid relay config: %w", err)
+	}
+	if config.IdleTimeout <= 0 {
+		config.IdleTimeout = 10
+	}
+	if config.ConnectTimeout <= 0 {
+		config.ConnectTimeout = 10
+	}
+	return config, nil
+}
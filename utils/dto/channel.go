@@ -0,0 +1,26 @@
+package dto
+
+type ChannelRequest struct {
+	// 주 입력과 예비 입력의 streamID (WHIP token, RTMP app/streamKey 등)
+	Primary string `json:"primary"`
+	Backup  string `json:"backup"`
+	// 입력에서 이 시간(초) 동안 아무것도 오지 않으면 끊긴 것으로 보고 다른 입력으로 바꾼다. 0 이면 3 이다.
+	Timeout int `json:"timeout"`
+	// true 이면 우선 입력(처음에는 primary, 수동 전환 후에는 그 입력)이 돌아왔을 때 다시 그 입력으로 바꾼다.
+	Revertive bool `json:"revertive"`
+}
+
+// ChannelSwitchRequest 는 채널의 입력을 수동으로 바꾼다.
+type ChannelSwitchRequest struct {
+	// primary, backup
+	Input string `json:"input"`
+}
+
+type ChannelResponse struct {
+	Primary string `json:"primary"`
+	Backup  string `json:"backup"`
+	// 지금(또는 마지막으로) 보내고 있는 입력. primary, backup
+	Active string `json:"active"`
+	// 입력을 보내고 있으면 true 이다. 두 입력이 모두 끊겼으면 false 이다.
+	Live bool `json:"live"`
+}
@@ -0,0 +1,24 @@
+package dto
+
+type CompositorRequest struct {
+	Inputs     []string `json:"inputs"`     // 합성할 streamID 목록 (배치 순서)
+	Audio      string   `json:"audio"`      // 오디오를 그대로 전달할 streamID. 비어있으면 오디오 없음
+	Width      int      `json:"width"`      // default 1280
+	Height     int      `json:"height"`     // default 720
+	FPS        int      `json:"fps"`        // default 30
+	Bitrate    int64    `json:"bitrate"`    // bps. default 2,000,000
+	Background string   `json:"background"` // #RRGGBB
+	Layout     string   `json:"layout"`     // grid, speaker, pip
+	Main       string   `json:"main"`       // speaker, pip 레이아웃에서 메인으로 보일 streamID
+}
+
+type CompositorResponse struct {
+}
+
+// CompositorLayoutRequest 는 동작 중인 합성 스트림의 레이아웃을 변경한다. 비어있는 필드는 유지된다.
+type CompositorLayoutRequest struct {
+	Inputs     []string `json:"inputs"`
+	Background string   `json:"background"`
+	Layout     string   `json:"layout"`
+	Main       string   `json:"main"`
+}
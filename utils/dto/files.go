@@ -3,9 +3,18 @@ package dto
 import "mediaserver-go/utils/types"
 
 type IngressFileRequest struct {
-	Path       string            `json:"path"`
+	Path string `json:"path"`
+	// Path 뒤에 이어서 재생할 파일들
+	Paths      []string          `json:"paths"`
 	MediaTypes []types.MediaType `json:"mediaTypes"`
-	Live       bool              `json:"live"`
+	// true 이면 실시간 속도로 보낸다.
+	Live bool `json:"live"`
+	// 재생 목록을 끝없이 반복한다. live 여야 한다.
+	Loop bool `json:"loop"`
+	// 첫 파일의 시작 위치(ms)
+	Start int `json:"start"`
+	// 재생 속도. 0 이면 1
+	Speed float64 `json:"speed"`
 }
 
 type IngressFileResponse struct {
@@ -14,7 +23,15 @@ type IngressFileResponse struct {
 type EgressFileRequest struct {
 	Path       string            `json:"path"`
 	MediaTypes []types.MediaType `json:"mediaTypes"`
-	Interval   int               `json:"interval"`
+	Format     string            `json:"format"` // mp4, webm, mkv. 비어있으면 코덱에 따라 정한다.
+	// Deprecated: Duration 을 사용한다. Duration 이 없을 때만 사용된다.
+	Interval int `json:"interval"`
+	// 녹화 최대 길이(ms). 0 이면 스트림이 끝나거나 중지 요청이 올 때까지 녹화한다.
+	Duration int `json:"duration"`
+	// 세그먼트 길이(초), 크기(bytes). 0 이면 나누지 않는다.
+	SegmentDuration int      `json:"segmentDuration"`
+	SegmentSize     int64    `json:"segmentSize"`
+	Overlay         *Overlay `json:"overlay,omitempty"`
 }
 
 type EgressFileResponse struct {
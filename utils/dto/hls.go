@@ -1,6 +1,28 @@
 package dto
 
 type HLSRequest struct {
+	Overlay *Overlay `json:"overlay,omitempty"`
+	// fmp4(기본값) 또는 ts. ts 는 H264/AAC MPEG-TS 세그먼트와 HLS v3 플레이리스트를 만들고 LL-HLS 는 제공하지 않는다. Opus 는 AAC 로 트랜스코딩된다.
+	Container string `json:"container"`
+	// DVR 이 true 이면 세그먼트를 디스크에 저장하여 되감기할 수 있고, 스트림이 끝나면 /v1/vod 로 제공한다.
+	DVR bool `json:"dvr"`
+	// 라이브 플레이리스트에 유지할 길이(초). 0 이면 모든 세그먼트를 유지한다(EVENT).
+	DVRWindow int `json:"dvrWindow"`
+	// LL-HLS 파트의 목표 길이(ms). 0 이면 500ms 이다.
+	PartDuration int `json:"partDuration"`
+	// 세그먼트의 목표 길이(초). 이 길이를 넘은 후 첫 키프레임에서 세그먼트가 나뉜다. 0 이면 2초이다.
+	SegmentDuration int `json:"segmentDuration"`
+	// true 이면 LL-HLS 파트를 세그먼트의 byte range(EXT-X-BYTERANGE)로 제공하여 CDN 이 세그먼트만 캐시하면 되게 한다.
+	ByteRangeParts bool `json:"byteRangeParts"`
 }
 
 type HLSResponse struct{}
+
+type IngressHLSRequest struct {
+	// 받을 Multivariant 또는 Media 재생목록의 URL
+	URL string `json:"url"`
+	// Multivariant 재생목록에서 고를 variant 의 최대 BANDWIDTH(bps). 0 이면 가장 높은 것을 고른다.
+	MaxBandwidth int `json:"maxBandwidth"`
+}
+
+type IngressHLSResponse struct{}
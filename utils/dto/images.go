@@ -1,7 +1,22 @@
 package dto
 
 type ImagesRequest struct {
-	Encoding string `json:"encoding"` // jpeg, png, etc.
+	Encoding string `json:"encoding"` // jpeg, png, webp
+	Width    int    `json:"width"`    // 0 이면 원본 비율로 맞춘다.
+	Height   int    `json:"height"`
+	Path     string `json:"path"`     // 확장자는 encoding 에 맞게 붙는다.
+	Interval int    `json:"interval"` // 초 단위 저장 주기
 }
 
 type ImagesResponse struct{}
+
+type SnapshotRequest struct {
+	Encoding string
+	Width    int
+	Height   int
+}
+
+type SnapshotResponse struct {
+	ContentType string
+	Payload     []byte
+}
@@ -0,0 +1,14 @@
+package dto
+
+type IngressMPEGTSRequest struct {
+	// udp(기본값) 또는 tcp
+	Protocol string `json:"protocol"`
+	// bind 할 주소. 멀티캐스트 그룹 주소이면 그룹에 가입한다.
+	Addr string `json:"addr"`
+	Port int    `json:"port"`
+	// 멀티캐스트 그룹에 가입할 네트워크 인터페이스 이름
+	Interface string `json:"interface"`
+}
+
+type IngressMPEGTSResponse struct {
+}
@@ -0,0 +1,7 @@
+package dto
+
+// MSEInit 은 WebSocket fMP4 연결의 첫 메시지(텍스트)이다. 플레이어는 MimeType 으로 SourceBuffer 를 만든 후
+// 이어서 오는 바이너리 메시지(init 세그먼트, moof/mdat fragment)를 appendBuffer 한다.
+type MSEInit struct {
+	MimeType string `json:"mimeType"` // 예: video/mp4; codecs="avc1.42E01f,mp4a.40.2"
+}
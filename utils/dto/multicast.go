@@ -0,0 +1,28 @@
+package dto
+
+import "mediaserver-go/utils/types"
+
+type EgressMulticastRequest struct {
+	// 멀티캐스트 그룹(또는 유니캐스트) IPv4 주소
+	Addr       string            `json:"addr"`
+	Port       int               `json:"port"`
+	MediaTypes []types.MediaType `json:"mediaTypes"`
+	// 0 이면 1 이다.
+	TTL int `json:"ttl"`
+	// 보낼 네트워크 인터페이스 이름. 비어있으면 라우팅 테이블을 따른다.
+	Interface string `json:"interface"`
+	// kbps. 0 보다 크면 CBR 로 보낸다.
+	Bitrate int  `json:"bitrate"`
+	RTP     bool `json:"rtp"`
+	// SMPTE 2022-1 FEC. rtp 일 때만 쓸 수 있다.
+	FEC *MulticastFEC `json:"fec,omitempty"`
+}
+
+type MulticastFEC struct {
+	Columns int `json:"columns"`
+	Rows    int `json:"rows"`
+}
+
+type EgressMulticastResponse struct {
+	ID string `json:"id"`
+}
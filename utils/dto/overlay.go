@@ -0,0 +1,28 @@
+package dto
+
+type ImageOverlay struct {
+	Path     string  `json:"path"`
+	Position string  `json:"position"`
+	X        int     `json:"x"`
+	Y        int     `json:"y"`
+	Opacity  float64 `json:"opacity"`
+	Width    int     `json:"width"`
+}
+
+type TextOverlay struct {
+	Text     string  `json:"text"`
+	Clock    bool    `json:"clock"`
+	Position string  `json:"position"`
+	X        int     `json:"x"`
+	Y        int     `json:"y"`
+	FontFile string  `json:"fontFile"`
+	FontSize int     `json:"fontSize"`
+	Color    string  `json:"color"`
+	Opacity  float64 `json:"opacity"`
+	Box      bool    `json:"box"`
+}
+
+type Overlay struct {
+	Images []ImageOverlay `json:"images"`
+	Texts  []TextOverlay  `json:"texts"`
+}
@@ -11,3 +11,14 @@ type RTMPRequest struct {
 
 type RTMPResponse struct {
 }
+
+// RTMPAuthRequest 는 [Rtmp] AuthURL 로 POST 하는 발행 정보이다. 2xx 로 응답하면 발행을 허용한다.
+type RTMPAuthRequest struct {
+	App       string `json:"app"`
+	StreamKey string `json:"streamKey"`
+	// app/streamKey
+	StreamID string `json:"streamId"`
+	// 스트림 키 뒤의 ?a=b 쿼리
+	Query      map[string][]string `json:"query"`
+	RemoteAddr string              `json:"remoteAddr"`
+}
@@ -7,6 +7,9 @@ type IngressRTPRequest struct {
 	Port        int    `json:"port"`
 	PayloadType uint8  `json:"payloadType"`
 	MimeType    string `json:"mimeType"`
+
+	// SDP 가 있으면 port, payloadType, mimeType 대신 SDP 의 m-line 마다 트랙을 연다. addr 는 bind 할 주소로 쓴다.
+	SDP string `json:"sdp"`
 }
 
 type IngressRTPResponse struct {
@@ -16,6 +19,14 @@ type EgressRTPRequest struct {
 	Addr       string            `json:"addr"`
 	Port       int               `json:"port"`
 	MediaTypes []types.MediaType `json:"mediaTypes"`
+
+	VideoPort        int    `json:"videoPort"`
+	AudioPort        int    `json:"audioPort"`
+	RTCPMux          bool   `json:"rtcpMux"`
+	VideoSSRC        uint32 `json:"videoSsrc"`
+	AudioSSRC        uint32 `json:"audioSsrc"`
+	VideoPayloadType uint8  `json:"videoPayloadType"`
+	AudioPayloadType uint8  `json:"audioPayloadType"`
 }
 
 type EgressRTPResponse struct {
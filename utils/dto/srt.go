@@ -0,0 +1,22 @@
+package dto
+
+import "mediaserver-go/utils/types"
+
+type EgressSRTRequest struct {
+	// caller(기본값) 는 원격에 연결하여 보내고, listener 는 Addr:Port 에서 상대의 연결을 기다린다.
+	Mode string `json:"mode"`
+	// caller 는 원격 주소, listener 는 bind 할 주소(비어있으면 0.0.0.0)이다.
+	Addr       string            `json:"addr"`
+	Port       int               `json:"port"`
+	MediaTypes []types.MediaType `json:"mediaTypes"`
+	// SRT 지연(ms). 0 이면 120ms 이다.
+	Latency int `json:"latency"`
+	// 비어있으면 암호화하지 않는다. 10~79 자이다.
+	Passphrase string `json:"passphrase"`
+	// caller 가 원격에 보내는 SRT streamid. listener 에서는 쓸 수 없다.
+	StreamID string `json:"streamId"`
+}
+
+type EgressSRTResponse struct {
+	ID string `json:"id"`
+}
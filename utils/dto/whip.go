@@ -0,0 +1,12 @@
+package dto
+
+type EgressWHIPRequest struct {
+	// 원격 WHIP endpoint URL
+	URL string `json:"url"`
+	// 원격 서버에 보낼 bearer token. 비어있으면 Authorization 헤더를 보내지 않는다.
+	Token string `json:"token"`
+}
+
+type EgressWHIPResponse struct {
+	ID string `json:"id"`
+}
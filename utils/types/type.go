@@ -51,7 +51,9 @@ type CodecType string
 const (
 	CodecTypeUnknown CodecType = "unknown"
 	CodecTypeH264    CodecType = "h264"
+	CodecTypeH265    CodecType = "h265"
 	CodecTypeVP8     CodecType = "vp8"
+	CodecTypeVP9     CodecType = "vp9"
 	CodecTypeAV1     CodecType = "av1"
 	CodecTypeAAC     CodecType = "aac"
 	CodecTypeOpus    CodecType = "opus"
@@ -61,8 +63,12 @@ func CodecTypeFromFFMPEG(codecID avcodec.CodecID) CodecType {
 	switch codecID {
 	case avcodec.AV_CODEC_ID_H264:
 		return CodecTypeH264
+	case avcodec.AV_CODEC_ID_HEVC:
+		return CodecTypeH265
 	case avcodec.AV_CODEC_ID_VP8:
 		return CodecTypeVP8
+	case avcodec.AV_CODEC_ID_VP9:
+		return CodecTypeVP9
 	case avcodec.AV_CODEC_ID_AV1:
 		return CodecTypeAV1
 	case avcodec.AV_CODEC_ID_AAC:
@@ -78,8 +84,12 @@ func CodecTypeFromMimeType(mimeType string) CodecType {
 	switch strings.ToLower(mimeType) {
 	case "video/h264":
 		return CodecTypeH264
+	case "video/h265":
+		return CodecTypeH265
 	case "video/vp8":
 		return CodecTypeVP8
+	case "video/vp9":
+		return CodecTypeVP9
 	case "video/av1":
 		return CodecTypeAV1
 	case "audio/aac":